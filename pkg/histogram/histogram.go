@@ -0,0 +1,213 @@
+// Package histogram records latencies in log-linear buckets, so percentiles
+// can be read without keeping every sample.
+//
+// Values are whole microseconds. Below 128µs every value has its own
+// bucket; above it each power of two is split into 64 buckets, so a bucket
+// is never wider than 1/64 of its lower bound and percentiles are accurate
+// to within 1.6%. Every histogram uses the same buckets, so histograms from
+// several replicas merge exactly by adding their counts.
+package histogram
+
+import (
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
+	"time"
+)
+
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+
+	// MaxValue is the largest value recorded, about 19 hours; larger values
+	// are recorded as MaxValue.
+	MaxValue = 1<<36 - 1
+)
+
+// Bucket is a non-empty bucket of a Histogram. Lower identifies the bucket:
+// it is the smallest value the bucket holds.
+type Bucket struct {
+	Lower uint64
+	Count uint64
+}
+
+// Histogram counts values in buckets. It is not safe for concurrent use.
+type Histogram struct {
+	counts map[int]uint64
+	count  uint64
+	sum    uint64
+	min    uint64
+	max    uint64
+}
+
+// New creates an empty Histogram.
+func New() *Histogram {
+	return &Histogram{counts: make(map[int]uint64)}
+}
+
+// Record adds one value in microseconds.
+func (h *Histogram) Record(us uint64) {
+	h.RecordN(us, 1)
+}
+
+// RecordDuration adds d, truncated to microseconds.
+func (h *Histogram) RecordDuration(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.Record(uint64(d.Microseconds()))
+}
+
+// RecordN adds n occurrences of a value in microseconds.
+func (h *Histogram) RecordN(us, n uint64) {
+	if n == 0 {
+		return
+	}
+	if us > MaxValue {
+		us = MaxValue
+	}
+	h.counts[index(us)] += n
+	if h.count == 0 || us < h.min {
+		h.min = us
+	}
+	if us > h.max {
+		h.max = us
+	}
+	h.count += n
+	h.sum += us * n
+}
+
+// Merge adds the values of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// Count returns the number of values recorded.
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Max returns the largest value recorded, or 0 when empty.
+func (h *Histogram) Max() uint64 {
+	return h.max
+}
+
+// Min returns the smallest value recorded, or 0 when empty.
+func (h *Histogram) Min() uint64 {
+	return h.min
+}
+
+// Sum returns the sum of the values recorded.
+func (h *Histogram) Sum() uint64 {
+	return h.sum
+}
+
+// Mean returns the average value, or 0 when empty.
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return float64(h.sum) / float64(h.count)
+}
+
+// Quantile returns the value below which the fraction q of the values fall,
+// as the upper end of the bucket holding it. It returns 0 when empty.
+func (h *Histogram) Quantile(q float64) uint64 {
+	if h.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.min
+	}
+	if q >= 1 {
+		return h.max
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for _, b := range h.Buckets() {
+		seen += b.Count
+		if seen >= rank {
+			v := upper(index(b.Lower))
+			return max(min(v, h.max), h.min)
+		}
+	}
+	return h.max
+}
+
+// CountAtMost returns the number of values in buckets that end at or below
+// us. Values sharing a bucket with us are counted as above it, so the
+// result errs low by at most that bucket.
+func (h *Histogram) CountAtMost(us uint64) uint64 {
+	var n uint64
+	for i, c := range h.counts {
+		if upper(i) <= us {
+			n += c
+		}
+	}
+	return n
+}
+
+// Buckets returns the non-empty buckets in ascending order.
+func (h *Histogram) Buckets() []Bucket {
+	out := make([]Bucket, 0, len(h.counts))
+	for _, i := range slices.Sorted(maps.Keys(h.counts)) {
+		out = append(out, Bucket{Lower: lower(i), Count: h.counts[i]})
+	}
+	return out
+}
+
+// FromBuckets rebuilds a Histogram from the buckets, min, max and sum of
+// another one, such as one received from a replica.
+func FromBuckets(buckets []Bucket, min, max, sum uint64) *Histogram {
+	h := New()
+	for _, b := range buckets {
+		if b.Count == 0 {
+			continue
+		}
+		h.counts[index(b.Lower)] += b.Count
+		h.count += b.Count
+	}
+	if h.count > 0 {
+		h.min, h.max, h.sum = min, max, sum
+	}
+	return h
+}
+
+// index returns the bucket holding v.
+func index(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits
+	return shift*subBucketHalf + int(v>>shift)
+}
+
+// lower returns the smallest value of bucket i.
+func lower(i int) uint64 {
+	if i < subBucketCount {
+		return uint64(i)
+	}
+	shift := i/subBucketHalf - 1
+	sub := i - shift*subBucketHalf
+	return uint64(sub) << shift
+}
+
+// upper returns the largest value of bucket i.
+func upper(i int) uint64 {
+	return lower(i+1) - 1
+}
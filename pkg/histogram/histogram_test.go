@@ -0,0 +1,88 @@
+package histogram
+
+import (
+	"testing"
+)
+
+func TestBucketsRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, MaxValue} {
+		i := index(v)
+		if lower(i) > v || upper(i) < v {
+			t.Errorf("%d: bucket %d is [%d, %d]", v, i, lower(i), upper(i))
+		}
+		if index(lower(i)) != i || index(upper(i)) != i {
+			t.Errorf("%d: bucket %d bounds map to other buckets", v, i)
+		}
+		if w := upper(i) - lower(i) + 1; v >= subBucketCount && w*subBucketHalf > lower(i) {
+			t.Errorf("%d: bucket %d is %d wide", v, i, w)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := New()
+	for v := uint64(1); v <= 10000; v++ {
+		h.Record(v)
+	}
+	for _, tt := range []struct {
+		q    float64
+		want uint64
+	}{
+		{0.5, 5000},
+		{0.9, 9000},
+		{0.99, 9900},
+		{0.999, 9990},
+	} {
+		got := h.Quantile(tt.q)
+		if got < tt.want || float64(got-tt.want) > float64(tt.want)/64 {
+			t.Errorf("Quantile(%v) = %d, want %d within 1/64", tt.q, got, tt.want)
+		}
+	}
+	if h.Quantile(1) != 10000 || h.Max() != 10000 || h.Count() != 10000 {
+		t.Errorf("max %d, count %d", h.Max(), h.Count())
+	}
+	if got := h.Mean(); got != 5000.5 {
+		t.Errorf("Mean() = %v, want 5000.5", got)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	h := New()
+	if h.Quantile(0.99) != 0 || h.Mean() != 0 || h.Max() != 0 {
+		t.Error("empty histogram reports values")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	all, a, b := New(), New(), New()
+	for v := uint64(0); v < 5000; v += 7 {
+		all.Record(v)
+		if v%2 == 0 {
+			a.Record(v)
+		} else {
+			b.Record(v)
+		}
+	}
+	a.Merge(FromBuckets(b.Buckets(), b.Min(), b.Max(), b.Sum()))
+	if a.Count() != all.Count() || a.Sum() != all.Sum() || a.Min() != all.Min() || a.Max() != all.Max() {
+		t.Fatalf("merged count/sum/min/max differ")
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("Quantile(%v) = %d after merge, want %d", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+}
+
+func TestCountAtMost(t *testing.T) {
+	h := New()
+	for _, us := range []uint64{10, 100, 150_000, 190_000, 250_000} {
+		h.Record(us)
+	}
+	if got := h.CountAtMost(200_000); got != 4 {
+		t.Errorf("at most 200ms: %d", got)
+	}
+	if got := h.CountAtMost(100); got != 2 {
+		t.Errorf("at most 100µs: %d", got)
+	}
+}
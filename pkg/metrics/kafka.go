@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+// WriterStatser is implemented by kafka.Writer and by types wrapping one.
+type WriterStatser interface {
+	Stats() kafka.WriterStats
+}
+
+// ReaderStatser is implemented by kafka.Reader.
+type ReaderStatser interface {
+	Stats() kafka.ReaderStats
+}
+
+var (
+	producerWrites   = prometheus.NewDesc("kafka_producer_writes_total", "Write requests sent to Kafka.", nil, nil)
+	producerMessages = prometheus.NewDesc("kafka_producer_messages_total", "Messages written to Kafka.", nil, nil)
+	producerBytes    = prometheus.NewDesc("kafka_producer_bytes_total", "Bytes of messages written to Kafka.", nil, nil)
+	producerErrors   = prometheus.NewDesc("kafka_producer_errors_total", "Failed writes to Kafka.", nil, nil)
+	producerRetries  = prometheus.NewDesc("kafka_producer_retries_total", "Retried writes to Kafka.", nil, nil)
+
+	consumerLabels     = []string{"topic", "group"}
+	consumerMessages   = prometheus.NewDesc("kafka_consumer_messages_total", "Messages read from Kafka.", consumerLabels, nil)
+	consumerBytes      = prometheus.NewDesc("kafka_consumer_bytes_total", "Bytes of messages read from Kafka.", consumerLabels, nil)
+	consumerErrors     = prometheus.NewDesc("kafka_consumer_errors_total", "Errors reading from Kafka.", consumerLabels, nil)
+	consumerRebalances = prometheus.NewDesc("kafka_consumer_rebalances_total", "Consumer group rebalances.", consumerLabels, nil)
+	consumerOffset     = prometheus.NewDesc("kafka_consumer_offset", "Offset of the last message read.", consumerLabels, nil)
+	consumerLag        = prometheus.NewDesc("kafka_consumer_lag", "Messages behind the end of the partition.", consumerLabels, nil)
+)
+
+// producerCollector accumulates a writer's stats, which kafka-go resets on
+// every read.
+type producerCollector struct {
+	w WriterStatser
+
+	mutex  sync.Mutex
+	totals kafka.WriterStats
+}
+
+func newProducerCollector(w WriterStatser) *producerCollector {
+	return &producerCollector{w: w}
+}
+
+func (c *producerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- producerWrites
+	ch <- producerMessages
+	ch <- producerBytes
+	ch <- producerErrors
+	ch <- producerRetries
+}
+
+func (c *producerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	s := c.w.Stats()
+	c.totals.Writes += s.Writes
+	c.totals.Messages += s.Messages
+	c.totals.Bytes += s.Bytes
+	c.totals.Errors += s.Errors
+	c.totals.Retries += s.Retries
+	t := c.totals
+	c.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(producerWrites, prometheus.CounterValue, float64(t.Writes))
+	ch <- prometheus.MustNewConstMetric(producerMessages, prometheus.CounterValue, float64(t.Messages))
+	ch <- prometheus.MustNewConstMetric(producerBytes, prometheus.CounterValue, float64(t.Bytes))
+	ch <- prometheus.MustNewConstMetric(producerErrors, prometheus.CounterValue, float64(t.Errors))
+	ch <- prometheus.MustNewConstMetric(producerRetries, prometheus.CounterValue, float64(t.Retries))
+}
+
+// ConsumerCollector accumulates a reader's stats, which kafka-go resets on
+// every read.
+type ConsumerCollector struct {
+	rd    ReaderStatser
+	group string
+
+	mutex  sync.Mutex
+	totals kafka.ReaderStats
+}
+
+func newConsumerCollector(rd ReaderStatser, group string) *ConsumerCollector {
+	return &ConsumerCollector{rd: rd, group: group}
+}
+
+// Totals returns the reader's counters since it was created, with its
+// current offset and lag.
+func (c *ConsumerCollector) Totals() kafka.ReaderStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s := c.rd.Stats()
+	c.totals.Messages += s.Messages
+	c.totals.Bytes += s.Bytes
+	c.totals.Errors += s.Errors
+	c.totals.Rebalances += s.Rebalances
+	c.totals.Offset = s.Offset
+	c.totals.Lag = s.Lag
+	c.totals.Topic = s.Topic
+	return c.totals
+}
+
+func (c *ConsumerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- consumerMessages
+	ch <- consumerBytes
+	ch <- consumerErrors
+	ch <- consumerRebalances
+	ch <- consumerOffset
+	ch <- consumerLag
+}
+
+func (c *ConsumerCollector) Collect(ch chan<- prometheus.Metric) {
+	t := c.Totals()
+	labels := []string{t.Topic, c.group}
+	ch <- prometheus.MustNewConstMetric(consumerMessages, prometheus.CounterValue, float64(t.Messages), labels...)
+	ch <- prometheus.MustNewConstMetric(consumerBytes, prometheus.CounterValue, float64(t.Bytes), labels...)
+	ch <- prometheus.MustNewConstMetric(consumerErrors, prometheus.CounterValue, float64(t.Errors), labels...)
+	ch <- prometheus.MustNewConstMetric(consumerRebalances, prometheus.CounterValue, float64(t.Rebalances), labels...)
+	ch <- prometheus.MustNewConstMetric(consumerOffset, prometheus.GaugeValue, float64(t.Offset), labels...)
+	ch <- prometheus.MustNewConstMetric(consumerLag, prometheus.GaugeValue, float64(t.Lag), labels...)
+}
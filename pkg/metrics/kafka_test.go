@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// resettingWriter reports its counts since the last call, like kafka.Writer.
+type resettingWriter struct {
+	pending int64
+}
+
+func (w *resettingWriter) Stats() kafka.WriterStats {
+	s := kafka.WriterStats{Messages: w.pending}
+	w.pending = 0
+	return s
+}
+
+func TestProducerCollectorAccumulatesResettingStats(t *testing.T) {
+	w := &resettingWriter{}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newProducerCollector(w))
+
+	want := func(n string) string {
+		return "# HELP kafka_producer_messages_total Messages written to Kafka.\n" +
+			"# TYPE kafka_producer_messages_total counter\n" +
+			"kafka_producer_messages_total " + n + "\n"
+	}
+	w.pending = 3
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want("3")), "kafka_producer_messages_total"); err != nil {
+		t.Fatal(err)
+	}
+	w.pending = 2
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want("5")), "kafka_producer_messages_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package metrics serves the service's metrics over HTTP in the OpenMetrics
+// format, for Prometheus to scrape.
+//
+// The services share the metric names and labels: grpc_server_* for the
+// gRPC API, go_sql_* for database pools, kafka_producer_* and
+// kafka_consumer_* for Kafka clients, and the standard go_* and process_*
+// runtime metrics.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// latencyBuckets covers 0.5ms to about 16s in powers of two.
+var latencyBuckets = prometheus.ExponentialBuckets(0.0005, 2, 16)
+
+// Registry holds the metrics of one service.
+type Registry struct {
+	reg      *prometheus.Registry
+	handled  *prometheus.CounterVec
+	handling *prometheus.HistogramVec
+}
+
+// New creates a Registry with the gRPC server and runtime metrics.
+func New() *Registry {
+	r := &Registry{
+		reg: prometheus.NewRegistry(),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "RPCs completed on the server, by method and status code.",
+		}, []string{"grpc_service", "grpc_method", "grpc_code"}),
+		handling: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Time taken by the server to complete RPCs, by method and status code.",
+			Buckets: latencyBuckets,
+		}, []string{"grpc_service", "grpc_method", "grpc_code"}),
+	}
+	r.reg.MustRegister(
+		r.handled,
+		r.handling,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// UnaryServerInterceptor records every unary RPC.
+func (r *Registry) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		r.observe(info.FullMethod, err, time.Since(start))
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records every streaming RPC when it ends.
+func (r *Registry) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		r.observe(info.FullMethod, err, time.Since(start))
+		return err
+	}
+}
+
+func (r *Registry) observe(fullMethod string, err error, elapsed time.Duration) {
+	service, method := splitMethod(fullMethod)
+	code := status.Code(err).String()
+	r.handled.WithLabelValues(service, method, code).Inc()
+	r.handling.WithLabelValues(service, method, code).Observe(elapsed.Seconds())
+}
+
+// ServerFault reports whether err is a failure of the server rather than of
+// its caller: a status of Internal, Unavailable, DeadlineExceeded, DataLoss,
+// Unknown or Unimplemented. A context error is taken as its status.
+func ServerFault(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		s = status.FromContextError(err)
+	}
+	switch s.Code() {
+	case codes.Internal, codes.Unavailable, codes.DeadlineExceeded, codes.DataLoss, codes.Unknown, codes.Unimplemented:
+		return true
+	}
+	return false
+}
+
+// splitMethod splits "/package.Service/Method" into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	return service, method
+}
+
+// RegisterDB adds the connection pool stats of db as go_sql_* metrics
+// labelled with name.
+func (r *Registry) RegisterDB(name string, db *sql.DB) {
+	r.reg.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterKafkaWriter adds the stats of a Kafka writer as kafka_producer_*
+// metrics. Its Stats must not be called elsewhere, since each call resets
+// the writer's counters.
+func (r *Registry) RegisterKafkaWriter(w WriterStatser) {
+	r.reg.MustRegister(newProducerCollector(w))
+}
+
+// RegisterKafkaReader adds the stats of a Kafka reader as kafka_consumer_*
+// metrics. Its Stats must not be called elsewhere; the returned collector's
+// Totals reports the same counts.
+func (r *Registry) RegisterKafkaReader(rd ReaderStatser, group string) *ConsumerCollector {
+	c := newConsumerCollector(rd, group)
+	r.reg.MustRegister(c)
+	return c
+}
+
+// MustRegister adds service-specific collectors.
+func (r *Registry) MustRegister(cs ...prometheus.Collector) {
+	r.reg.MustRegister(cs...)
+}
+
+// Handler serves the metrics, in the OpenMetrics format when the scraper
+// accepts it.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// ListenAndServe serves /metrics on addr.
+func (r *Registry) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return srv.ListenAndServe()
+}
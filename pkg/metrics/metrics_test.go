@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerFault(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{status.Error(codes.InvalidArgument, "bad quantity"), false},
+		{status.Error(codes.FailedPrecondition, "user deleted"), false},
+		{status.Error(codes.NotFound, "no user"), false},
+		{context.Canceled, false},
+		{status.Error(codes.Internal, "no database"), true},
+		{status.Error(codes.Unavailable, "no broker"), true},
+		{context.DeadlineExceeded, true},
+		{errors.New("boom"), true},
+	} {
+		if got := ServerFault(tt.err); got != tt.want {
+			t.Errorf("ServerFault(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package monitoringpb is the Go code of service3/proto/monitoring.proto,
+// for the services that report to and register with the monitoring service.
+// It is generated by `make proto` and not checked in.
+package monitoringpb
+
+//go:generate protoc -I ../../service3/proto --go_out=. --go_opt=paths=source_relative --go_opt=Mmonitoring.proto=pkg/monitoringpb;monitoringpb --go-grpc_out=. --go-grpc_opt=paths=source_relative --go-grpc_opt=Mmonitoring.proto=pkg/monitoringpb;monitoringpb monitoring.proto
@@ -0,0 +1,108 @@
+package reporter
+
+import (
+	"context"
+	"os"
+	"runtime/debug"
+	"time"
+
+	pb "pkg/monitoringpb"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Dependency kinds, as the monitoring service's registry knows them.
+const (
+	KindService  = "service"
+	KindPostgres = "postgres"
+	KindKafka    = "kafka"
+)
+
+// Dependency is something the service needs to work.
+type Dependency struct {
+	Kind string
+	Name string
+}
+
+// Announcement describes the instance to the monitoring service's registry.
+type Announcement struct {
+	// Version defaults to SERVICE_VERSION, else the VCS revision the binary
+	// was built from, else "dev".
+	Version      string
+	Endpoints    []string
+	Dependencies []Dependency
+	// TTL is how long the instance stays registered without a heartbeat.
+	// Zero leaves it to the monitoring service.
+	TTL time.Duration
+}
+
+// Announce registers the instance and sends heartbeats until ctx is done.
+// It registers again whenever a heartbeat finds the registration expired,
+// e.g. after the monitoring service restarted.
+func (r *Reporter) Announce(ctx context.Context, a Announcement) {
+	if a.Version == "" {
+		a.Version = version()
+	}
+	req := &pb.RegisterRequest{
+		Service:    r.cfg.Service,
+		InstanceId: r.cfg.Instance,
+		Version:    a.Version,
+		Endpoints:  a.Endpoints,
+		TtlSeconds: int32(a.TTL / time.Second),
+	}
+	for _, d := range a.Dependencies {
+		req.Dependencies = append(req.Dependencies, &pb.Dependency{Kind: d.Kind, Name: d.Name})
+	}
+
+	// Until the first registration succeeds, it is retried every interval.
+	interval := r.cfg.Interval
+	registered := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if registered {
+			_, err := r.client.Heartbeat(ctx, &pb.HeartbeatRequest{Service: r.cfg.Service, InstanceId: r.cfg.Instance})
+			switch {
+			case status.Code(err) == codes.NotFound:
+				logrus.Warn("Registration with the monitoring service expired; registering again")
+				registered = false
+			case err != nil:
+				logrus.Warnf("Failed to send heartbeat: %v", err)
+			}
+		}
+		if !registered {
+			resp, err := r.client.Register(ctx, req)
+			if err != nil {
+				logrus.Warnf("Failed to register with the monitoring service: %v", err)
+				timer.Reset(r.cfg.Interval)
+				continue
+			}
+			registered = true
+			interval = max(time.Duration(resp.HeartbeatIntervalSeconds)*time.Second, time.Second)
+			logrus.Infof("Registered with the monitoring service as %s/%s", r.cfg.Service, r.cfg.Instance)
+		}
+		timer.Reset(interval)
+	}
+}
+
+func version() string {
+	if v := os.Getenv("SERVICE_VERSION"); v != "" {
+		return v
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,253 @@
+// Package reporter records the requests a gRPC server handles and pushes
+// them to the monitoring service, which aggregates them per service and
+// instance.
+//
+// Only errors that are the server's fault count as failures; a caller's
+// invalid argument, a missing resource or a client going away do not.
+// Streaming RPCs are counted but not timed, since a stream such as
+// WatchOrder lasts as long as the client keeps it open.
+//
+// Stats are kept per method and sent as the difference since the previous
+// report over a ReportMetrics stream that stays open. While the monitoring
+// service is unreachable the stats accumulate and are sent once it is back;
+// a report sent just before a stream broke may then be counted twice.
+//
+// Announce registers the instance in the monitoring service's registry and
+// keeps it live with heartbeats.
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"pkg/histogram"
+	"pkg/metrics"
+	pb "pkg/monitoringpb"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Config configures a Reporter.
+type Config struct {
+	// Address of the monitoring service, e.g. "service3:50053".
+	Address string
+	// Service is the name the monitoring service reports the stats under,
+	// e.g. "user" or "order".
+	Service string
+	// Instance identifies this replica. Defaults to the hostname.
+	Instance string
+	// Interval is the time between reports. Defaults to 5s.
+	Interval time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.Instance == "" {
+		c.Instance, _ = os.Hostname()
+	}
+	if c.Interval <= 0 {
+		c.Interval = 5 * time.Second
+	}
+}
+
+type methodStats struct {
+	requests uint64
+	failures uint64
+	latency  *histogram.Histogram
+}
+
+// Reporter records requests with its interceptors and reports them from
+// Run.
+type Reporter struct {
+	cfg    Config
+	conn   *grpc.ClientConn
+	client pb.MonitoringServiceClient
+
+	mutex   sync.Mutex
+	pending map[string]*methodStats
+}
+
+// New creates a Reporter for the monitoring service at cfg.Address. The
+// connection is made when the first report is sent.
+func New(cfg Config, opts ...grpc.DialOption) (*Reporter, error) {
+	cfg.setDefaults()
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	conn, err := grpc.NewClient(cfg.Address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating monitoring service client: %w", err)
+	}
+	return &Reporter{
+		cfg:     cfg,
+		conn:    conn,
+		client:  pb.NewMonitoringServiceClient(conn),
+		pending: make(map[string]*methodStats),
+	}, nil
+}
+
+// Close closes the connection to the monitoring service.
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
+
+// UnaryServerInterceptor records every unary RPC.
+func (r *Reporter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		elapsed := time.Since(start)
+		r.record(info.FullMethod, err, &elapsed)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records every streaming RPC when it ends, without
+// its duration. An error returned after the client went away is taken as
+// the client's doing.
+func (r *Reporter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		recorded := err
+		if ctxErr := ss.Context().Err(); err != nil && ctxErr != nil {
+			recorded = ctxErr
+		}
+		r.record(info.FullMethod, recorded, nil)
+		return err
+	}
+}
+
+// record counts a request to method that returned err, and its latency if
+// elapsed is set.
+func (r *Reporter) record(method string, err error, elapsed *time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	m, ok := r.pending[method]
+	if !ok {
+		m = &methodStats{latency: histogram.New()}
+		r.pending[method] = m
+	}
+	m.requests++
+	if metrics.ServerFault(err) {
+		m.failures++
+	}
+	if elapsed != nil {
+		m.latency.RecordDuration(*elapsed)
+	}
+}
+
+// take returns the stats recorded since the previous call, or nil if there
+// are none.
+func (r *Reporter) take() *pb.MetricsReport {
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*methodStats)
+	r.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	report := &pb.MetricsReport{Service: r.cfg.Service, Instance: r.cfg.Instance}
+	for method, m := range pending {
+		report.Methods = append(report.Methods, &pb.MethodStats{
+			Method:   method,
+			Requests: m.requests,
+			Failures: m.failures,
+			Latency:  histogramToProto(m.latency),
+		})
+	}
+	return report
+}
+
+// putBack returns the stats of a report that could not be sent, to be sent
+// with the next one.
+func (r *Reporter) putBack(report *pb.MetricsReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, sent := range report.Methods {
+		m, ok := r.pending[sent.Method]
+		if !ok {
+			m = &methodStats{latency: histogram.New()}
+			r.pending[sent.Method] = m
+		}
+		m.requests += sent.Requests
+		m.failures += sent.Failures
+		m.latency.Merge(histogramFromProto(sent.Latency))
+	}
+}
+
+// Run sends a report every interval until ctx is done, then sends the last
+// one and closes the stream.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	var stream pb.MonitoringService_ReportMetricsClient
+	var cancel context.CancelFunc
+	defer func() {
+		if cancel != nil {
+			cancel()
+		}
+	}()
+	send := func(report *pb.MetricsReport) {
+		if stream == nil {
+			// The stream outlives ctx so that the last report can be sent
+			// after ctx is done.
+			var streamCtx context.Context
+			streamCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+			var err error
+			if stream, err = r.client.ReportMetrics(streamCtx); err != nil {
+				logrus.Warnf("Failed to open metrics report stream: %v", err)
+				cancel()
+				stream, cancel = nil, nil
+				r.putBack(report)
+				return
+			}
+		}
+		if err := stream.Send(report); err != nil {
+			logrus.Warnf("Failed to send metrics report: %v", err)
+			cancel()
+			stream, cancel = nil, nil
+			r.putBack(report)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if report := r.take(); report != nil {
+				send(report)
+			}
+			if stream != nil {
+				if _, err := stream.CloseAndRecv(); err != nil {
+					logrus.Warnf("Failed to close metrics report stream: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			if report := r.take(); report != nil {
+				send(report)
+			}
+		}
+	}
+}
+
+func histogramToProto(h *histogram.Histogram) *pb.LatencyHistogram {
+	out := &pb.LatencyHistogram{MinUs: h.Min(), MaxUs: h.Max(), SumUs: h.Sum()}
+	for _, b := range h.Buckets() {
+		out.Buckets = append(out.Buckets, &pb.LatencyBucket{LowerUs: b.Lower, Count: b.Count})
+	}
+	return out
+}
+
+func histogramFromProto(h *pb.LatencyHistogram) *histogram.Histogram {
+	buckets := make([]histogram.Bucket, 0, len(h.GetBuckets()))
+	for _, b := range h.GetBuckets() {
+		buckets = append(buckets, histogram.Bucket{Lower: b.LowerUs, Count: b.Count})
+	}
+	return histogram.FromBuckets(buckets, h.GetMinUs(), h.GetMaxUs(), h.GetSumUs())
+}
@@ -0,0 +1,104 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInterceptorAndTake(t *testing.T) {
+	r, err := New(Config{Address: "localhost:0", Service: "order", Instance: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	intercept := r.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/order.OrderService/GetOrder"}
+	ok := func(ctx context.Context, req any) (any, error) { return nil, nil }
+	fail := func(ctx context.Context, req any) (any, error) { return nil, status.Error(codes.Internal, "boom") }
+	// The caller's errors are not failures.
+	notFound := func(ctx context.Context, req any) (any, error) { return nil, status.Error(codes.NotFound, "no order") }
+	for _, h := range []grpc.UnaryHandler{ok, notFound, fail} {
+		intercept(context.Background(), nil, info, h)
+	}
+
+	report := r.take()
+	if report == nil || report.Service != "order" || report.Instance != "a" || len(report.Methods) != 1 {
+		t.Fatalf("report = %v", report)
+	}
+	m := report.Methods[0]
+	if m.Method != info.FullMethod || m.Requests != 3 || m.Failures != 1 || len(m.Latency.Buckets) == 0 {
+		t.Errorf("method stats = %v", m)
+	}
+	if r.take() != nil {
+		t.Error("take did not reset the stats")
+	}
+
+	// A report that failed to send is merged into the next one.
+	intercept(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, errors.New("boom")
+	})
+	r.putBack(report)
+	next := r.take()
+	if got := next.Methods[0]; got.Requests != 4 || got.Failures != 2 {
+		t.Errorf("after putBack: %d requests, %d failures", got.Requests, got.Failures)
+	}
+}
+
+// fakeServerStream is a stream with nothing but a context.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context {
+	return f.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	r, err := New(Config{Address: "localhost:0", Service: "order", Instance: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	intercept := r.StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/order.OrderService/WatchOrder", IsServerStream: true}
+
+	// A client that goes away is not a failure, whatever the handler
+	// returns when its sends start failing.
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, h := range []grpc.StreamHandler{
+		func(srv any, ss grpc.ServerStream) error { return ss.Context().Err() },
+		func(srv any, ss grpc.ServerStream) error {
+			return status.Error(codes.Unavailable, "transport is closing")
+		},
+	} {
+		if err := intercept(nil, &fakeServerStream{ctx: gone}, info, h); err == nil {
+			t.Error("interceptor dropped the handler's error")
+		}
+	}
+	// A stream that fails while the client is still there is.
+	intercept(nil, &fakeServerStream{ctx: context.Background()}, info, func(srv any, ss grpc.ServerStream) error {
+		return status.Error(codes.Internal, "no database")
+	})
+
+	report := r.take()
+	if report == nil || len(report.Methods) != 1 {
+		t.Fatalf("report = %v", report)
+	}
+	m := report.Methods[0]
+	if m.Requests != 3 || m.Failures != 1 {
+		t.Errorf("%d requests, %d failures", m.Requests, m.Failures)
+	}
+	// Streams are not timed.
+	if len(m.Latency.Buckets) != 0 {
+		t.Errorf("stream latency recorded: %v", m.Latency)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"pkg/metrics"
+	"pkg/reporter"
 	pb "service1/service1/proto"
 	"time"
 
@@ -14,7 +17,9 @@ import (
 	"github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
@@ -37,7 +42,9 @@ type server struct {
 // on the broker specified by the environment variables KAFKA_HOST and KAFKA_PORT.
 //
 // Finally, it starts the gRPC server and registers the UserServiceServer with it.
-// It serves on port 50051.
+// It serves on port 50051, and serves metrics over HTTP on METRICS_PORT
+// (9090 by default). When MONITORING_SERVICE_ADDRESS is set, it registers
+// with the monitoring service and reports its request stats there.
 func main() {
 	if err := godotenv.Load(); err != nil {
 		logrus.Warn("No .env file found or error reading it; proceeding with environment variables.")
@@ -64,7 +71,8 @@ func main() {
 			id SERIAL PRIMARY KEY,
 			name TEXT,
 			email TEXT
-		)
+		);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'ACTIVE';
 	`)
 	if err != nil {
 		logrus.Fatalf("Failed to create table: %v", err)
@@ -90,7 +98,55 @@ func main() {
 		kafkaWriter: kafkaWriter,
 	}
 
-	grpcServer := grpc.NewServer()
+	// Serve metrics for Prometheus on METRICS_PORT.
+	reg := metrics.New()
+	reg.RegisterDB("users", db)
+	reg.RegisterKafkaWriter(kafkaWriter)
+	metricsAddr := ":" + os.Getenv("METRICS_PORT")
+	if metricsAddr == ":" {
+		metricsAddr = ":9090"
+	}
+	go func() {
+		logrus.Infof("Metrics served on %s/metrics", metricsAddr)
+		if err := reg.ListenAndServe(metricsAddr); err != nil {
+			logrus.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	unary := []grpc.UnaryServerInterceptor{reg.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{reg.StreamServerInterceptor()}
+
+	// Register with the monitoring service and report request stats to it
+	// when its address is set.
+	if address := os.Getenv("MONITORING_SERVICE_ADDRESS"); address != "" {
+		rep, err := reporter.New(reporter.Config{Address: address, Service: "user"})
+		if err != nil {
+			logrus.Fatalf("Failed to create metrics reporter: %v", err)
+		}
+		defer rep.Close()
+		go rep.Run(context.Background())
+
+		host, _ := os.Hostname()
+		go rep.Announce(context.Background(), reporter.Announcement{
+			Endpoints: []string{
+				fmt.Sprintf("grpc://%s:50051", host),
+				fmt.Sprintf("http://%s%s/metrics", host, metricsAddr),
+			},
+			Dependencies: []reporter.Dependency{
+				{Kind: reporter.KindPostgres, Name: "users"},
+				{Kind: reporter.KindKafka, Name: "user-events"},
+			},
+		})
+		unary = append(unary, rep.UnaryServerInterceptor())
+		stream = append(stream, rep.StreamServerInterceptor())
+	} else {
+		logrus.Warn("MONITORING_SERVICE_ADDRESS is not set; request stats are not reported")
+	}
+
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
 	pb.RegisterUserServiceServer(grpcServer, srv)
 	reflection.Register(grpcServer)
 	logrus.Info("UserService gRPC server listening on :50051")
@@ -156,3 +212,19 @@ func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb
 	logrus.Infof("Successfully created user with ID: %d", id)
 	return &pb.CreateUserResponse{Id: int32(id)}, nil
 }
+
+// GetUser returns a user and the standing of their account.
+func (s *server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	resp := &pb.GetUserResponse{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, COALESCE(name, ''), COALESCE(email, ''), status FROM users WHERE id = $1
+	`, req.Id).Scan(&resp.Id, &resp.Name, &resp.Email, &resp.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user %d not found", req.Id)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to get user %d: %v", req.Id, err)
+		return nil, status.Error(codes.Internal, "failed to get user")
+	}
+	return resp, nil
+}
@@ -0,0 +1,236 @@
+// Package analytics serves order aggregates from rollup tables.
+//
+// The rollups are maintained by a trigger on the orders table in the same
+// transaction as each status change, so they are always consistent with the
+// orders and queries never scan the orders themselves. An order counts
+// while it is CONFIRMED or DELIVERED, in the hour and day it was created.
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Schema creates the rollup tables and the trigger that maintains them. When
+// the trigger is first installed, the counted orders that already exist are
+// rolled up while writes to orders are blocked, so none is missed or counted
+// twice.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS order_stats_hourly (
+		bucket        TIMESTAMPTZ NOT NULL,
+		dimension     TEXT NOT NULL,
+		key           TEXT NOT NULL,
+		orders        BIGINT NOT NULL DEFAULT 0,
+		units         BIGINT NOT NULL DEFAULT 0,
+		revenue_cents BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (dimension, bucket, key)
+	);
+	CREATE TABLE IF NOT EXISTS order_stats_daily (
+		LIKE order_stats_hourly INCLUDING ALL
+	);
+
+	CREATE OR REPLACE FUNCTION order_stats_add(at_time TIMESTAMPTZ, dim TEXT, k TEXT, n BIGINT, u BIGINT, r BIGINT)
+	RETURNS void AS $$
+	BEGIN
+		INSERT INTO order_stats_hourly AS s (bucket, dimension, key, orders, units, revenue_cents)
+		VALUES (date_trunc('hour', at_time, 'UTC'), dim, k, n, u, r)
+		ON CONFLICT (dimension, bucket, key) DO UPDATE SET
+			orders = s.orders + EXCLUDED.orders,
+			units = s.units + EXCLUDED.units,
+			revenue_cents = s.revenue_cents + EXCLUDED.revenue_cents;
+		INSERT INTO order_stats_daily AS s (bucket, dimension, key, orders, units, revenue_cents)
+		VALUES (date_trunc('day', at_time, 'UTC'), dim, k, n, u, r)
+		ON CONFLICT (dimension, bucket, key) DO UPDATE SET
+			orders = s.orders + EXCLUDED.orders,
+			units = s.units + EXCLUDED.units,
+			revenue_cents = s.revenue_cents + EXCLUDED.revenue_cents;
+	END
+	$$ LANGUAGE plpgsql;
+
+	-- Adds (direction = 1) or removes (direction = -1) an order from the rollups. Orders
+	-- placed before line items existed are counted by product and quantity. The amount
+	-- charged is spread over the items in proportion to their price, so a discount lowers
+	-- each product's revenue and the products add up to the same revenue as the user; the
+	-- last item by SKU takes what rounding leaves.
+	CREATE OR REPLACE FUNCTION order_stats_apply(o_id BIGINT, o_user INT, o_product TEXT, o_quantity INT,
+		o_amount BIGINT, o_created TIMESTAMPTZ, direction INT)
+	RETURNS void AS $$
+	DECLARE
+		it RECORD;
+		n_items INT;
+		gross BIGINT;
+		i INT := 0;
+		share BIGINT;
+		left_cents BIGINT := o_amount;
+		units BIGINT := 0;
+	BEGIN
+		SELECT count(*), COALESCE(sum(quantity * unit_price_cents), 0) INTO n_items, gross
+		FROM order_items WHERE order_id = o_id;
+		FOR it IN SELECT sku, quantity, unit_price_cents FROM order_items WHERE order_id = o_id ORDER BY sku LOOP
+			i := i + 1;
+			units := units + it.quantity;
+			IF i = n_items THEN
+				share := left_cents;
+			ELSE
+				share := COALESCE(floor(o_amount::numeric * it.quantity * it.unit_price_cents / NULLIF(gross, 0)), 0);
+			END IF;
+			left_cents := left_cents - share;
+			PERFORM order_stats_add(o_created, 'product', it.sku, direction,
+				direction * it.quantity, direction * share);
+		END LOOP;
+		IF n_items = 0 THEN
+			units := o_quantity;
+			PERFORM order_stats_add(o_created, 'product', COALESCE(o_product, ''), direction,
+				direction * o_quantity, direction * o_amount);
+		END IF;
+		PERFORM order_stats_add(o_created, 'user', COALESCE(o_user::text, ''), direction,
+			direction * units, direction * o_amount);
+	END
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE FUNCTION order_stats_counted(status TEXT) RETURNS boolean AS $$
+		SELECT status IN ('CONFIRMED', 'DELIVERED')
+	$$ LANGUAGE sql IMMUTABLE;
+
+	CREATE OR REPLACE FUNCTION order_stats_on_status() RETURNS trigger AS $$
+	BEGIN
+		IF order_stats_counted(NEW.status) AND NOT order_stats_counted(OLD.status) THEN
+			PERFORM order_stats_apply(NEW.id, NEW.user_id, NEW.product, NEW.quantity,
+				NEW.amount_cents, NEW.created_at, 1);
+		ELSIF order_stats_counted(OLD.status) AND NOT order_stats_counted(NEW.status) THEN
+			PERFORM order_stats_apply(OLD.id, OLD.user_id, OLD.product, OLD.quantity,
+				OLD.amount_cents, OLD.created_at, -1);
+		END IF;
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql;
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'orders_stats_rollup') THEN
+			LOCK TABLE orders IN SHARE ROW EXCLUSIVE MODE;
+			-- Another instance may have installed the trigger while we waited.
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'orders_stats_rollup') THEN
+				PERFORM order_stats_apply(id, user_id, product, quantity, amount_cents, created_at, 1)
+				FROM orders WHERE order_stats_counted(status);
+				CREATE TRIGGER orders_stats_rollup
+					AFTER UPDATE OF status ON orders
+					FOR EACH ROW EXECUTE FUNCTION order_stats_on_status();
+			END IF;
+		END IF;
+	END
+	$$;
+`
+
+// Granularity is the width of a bucket.
+type Granularity string
+
+const (
+	Hour Granularity = "hour"
+	Day  Granularity = "day"
+	Week Granularity = "week"
+)
+
+// maxRange bounds the time range of a query per granularity, which keeps
+// the number of buckets returned manageable.
+var maxRange = map[Granularity]time.Duration{
+	Hour: 31 * 24 * time.Hour,
+	Day:  366 * 24 * time.Hour,
+	Week: 5 * 366 * 24 * time.Hour,
+}
+
+// Dimension is what aggregates are grouped by.
+type Dimension string
+
+const (
+	ByProduct Dimension = "product"
+	ByUser    Dimension = "user"
+)
+
+// ErrInvalidQuery is returned for queries with an unknown granularity or
+// dimension, or an empty or too long time range.
+var ErrInvalidQuery = errors.New("invalid stats query")
+
+// Query selects aggregates. Buckets are in UTC; weeks start on Monday.
+type Query struct {
+	Granularity Granularity
+	GroupBy     Dimension
+	// From is rounded down to the start of its bucket; To is exclusive.
+	From, To time.Time
+	// Keys restricts the result to these SKUs or user IDs when not empty.
+	Keys []string
+}
+
+// Bucket is the aggregate of one product or user over one bucket. An order
+// with several products counts once for each of them. Revenue is the amount
+// charged, after discounts.
+type Bucket struct {
+	Start        time.Time
+	Key          string
+	Orders       int64
+	Units        int64
+	RevenueCents int64
+}
+
+// Stats reads aggregates from the rollup tables.
+type Stats struct {
+	db *sql.DB
+}
+
+// New creates a Stats backed by db.
+func New(db *sql.DB) *Stats {
+	return &Stats{db: db}
+}
+
+// Query returns the non-empty buckets matching q, ordered by start and key.
+func (s *Stats) Query(ctx context.Context, q Query) ([]Bucket, error) {
+	limit, ok := maxRange[q.Granularity]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown granularity %q", ErrInvalidQuery, q.Granularity)
+	}
+	if q.GroupBy != ByProduct && q.GroupBy != ByUser {
+		return nil, fmt.Errorf("%w: unknown dimension %q", ErrInvalidQuery, q.GroupBy)
+	}
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("%w: from must be before to", ErrInvalidQuery)
+	}
+	if q.To.Sub(q.From) > limit {
+		return nil, fmt.Errorf("%w: range exceeds %v for %s buckets", ErrInvalidQuery, limit, q.Granularity)
+	}
+
+	// Hours come from the hourly rollup; days and weeks from the daily one.
+	table := "order_stats_daily"
+	if q.Granularity == Hour {
+		table = "order_stats_hourly"
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT date_trunc($1, bucket, 'UTC') AS start, key,
+		       sum(orders), sum(units), sum(revenue_cents)
+		FROM `+table+`
+		WHERE dimension = $2
+		  AND bucket >= date_trunc($1, $3::timestamptz, 'UTC') AND bucket < $4
+		  AND (COALESCE(cardinality($5::text[]), 0) = 0 OR key = ANY($5))
+		GROUP BY start, key
+		HAVING sum(orders) <> 0
+		ORDER BY start, key
+	`, q.Granularity, q.GroupBy, q.From, q.To, pq.Array(q.Keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Bucket
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Start, &b.Key, &b.Orders, &b.Units, &b.RevenueCents); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
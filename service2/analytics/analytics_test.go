@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/orders"
+)
+
+func TestRollupSpreadsDiscountOverProducts(t *testing.T) {
+	db := testutil.DB(t, orders.Schema, Schema)
+	ctx := context.Background()
+	if err := orders.EnsurePartitions(ctx, db, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("STATS-%d-", time.Now().UnixNano())
+	userID := int32(time.Now().UnixNano() % 1_000_000_000)
+	user := strconv.Itoa(int(userID))
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM orders WHERE id IN (SELECT order_id FROM order_items WHERE sku LIKE $1 || '%')`, prefix)
+		db.Exec(`DELETE FROM order_items WHERE sku LIKE $1 || '%'`, prefix)
+		for _, table := range []string{"order_stats_hourly", "order_stats_daily"} {
+			db.Exec(`DELETE FROM `+table+` WHERE key LIKE $1 || '%' OR key = $2`, prefix, user)
+		}
+	})
+
+	// 600 + 400 less 100 off: 900 charged.
+	store := orders.NewStore(db)
+	o := &orders.Order{
+		UserID: userID,
+		Items: []orders.Item{
+			{SKU: prefix + "A", Quantity: 2, UnitPriceCents: 300},
+			{SKU: prefix + "B", Quantity: 1, UnitPriceCents: 400},
+		},
+		Discounts: []orders.Discount{{Code: "TEST", Kind: "FIXED", AmountCents: 100}},
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(ctx, tx, o); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetStatus(ctx, o.ID, orders.StatusConfirmed, orders.StatusPending); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := New(db)
+	query := func(by Dimension, keys ...string) []Bucket {
+		t.Helper()
+		buckets, err := stats.Query(ctx, Query{
+			Granularity: Day,
+			GroupBy:     by,
+			From:        o.CreatedAt.Add(-time.Hour),
+			To:          o.CreatedAt.Add(time.Hour),
+			Keys:        keys,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buckets
+	}
+
+	products := query(ByProduct, prefix+"A", prefix+"B")
+	if len(products) != 2 {
+		t.Fatalf("product buckets %+v", products)
+	}
+	// The discount is spread 60/40 like the items' prices.
+	a, b := products[0], products[1]
+	if a.Orders != 1 || a.Units != 2 || a.RevenueCents != 540 || b.Orders != 1 || b.Units != 1 || b.RevenueCents != 360 {
+		t.Errorf("product buckets %+v", products)
+	}
+	users := query(ByUser, user)
+	if len(users) != 1 || users[0].Units != 3 || users[0].RevenueCents != a.RevenueCents+b.RevenueCents {
+		t.Errorf("user buckets %+v, products %+v", users, products)
+	}
+
+	// Cancelling removes exactly what was added.
+	if err := store.SetStatus(ctx, o.ID, orders.StatusCancelled, orders.StatusConfirmed); err != nil {
+		t.Fatal(err)
+	}
+	if products, users := query(ByProduct, prefix+"A", prefix+"B"), query(ByUser, user); len(products) != 0 || len(users) != 0 {
+		t.Errorf("after cancelling: products %+v, users %+v", products, users)
+	}
+}
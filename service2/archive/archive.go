@@ -0,0 +1,490 @@
+// Package archive keeps the partitioned orders table bounded. It creates
+// the partitions of coming months and moves months older than the
+// retention period to compressed files on local disk, from which a month
+// can be restored for investigations.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"service2/orders"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the table recording archived months.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS order_archives (
+		month       DATE PRIMARY KEY,
+		status      TEXT NOT NULL,
+		path        TEXT NOT NULL DEFAULT '',
+		orders      BIGINT NOT NULL DEFAULT 0,
+		items       BIGINT NOT NULL DEFAULT 0,
+		archived_at TIMESTAMPTZ,
+		restored_at TIMESTAMPTZ
+	);
+`
+
+// Status is the state of an archived month.
+type Status string
+
+const (
+	// StatusDetached is set while a month is being written to its file. Its
+	// partition is detached from orders but not dropped yet.
+	StatusDetached Status = "DETACHED"
+	// StatusArchived is set once the month is only in its file.
+	StatusArchived Status = "ARCHIVED"
+	// StatusRestored is set while a month is back in the orders table.
+	StatusRestored Status = "RESTORED"
+)
+
+var (
+	// ErrNotFound is returned when a month was never archived.
+	ErrNotFound = errors.New("archive not found")
+	// ErrInProgress is returned when restoring a month that is still being
+	// archived.
+	ErrInProgress = errors.New("archive in progress")
+)
+
+// lockKey is the advisory lock serializing archival across replicas.
+const lockKey = 0x6f72646572617263
+
+// Archive is a row of the order_archives table.
+type Archive struct {
+	Month      time.Time
+	Status     Status
+	Path       string
+	Orders     int64
+	Items      int64
+	ArchivedAt time.Time
+	RestoredAt time.Time
+}
+
+// Archiver manages the partitions of the orders table.
+type Archiver struct {
+	db  *sql.DB
+	dir string
+
+	// Retention is how many months before the current one stay in the
+	// orders table.
+	Retention int
+	// Ahead is how many months after the current one have partitions.
+	Ahead int
+	// RestoreTTL is how long a restored month stays before it is removed
+	// again. Its archive file is kept as it was.
+	RestoreTTL time.Duration
+}
+
+// New creates an Archiver that writes archives to dir.
+func New(db *sql.DB, dir string) *Archiver {
+	return &Archiver{
+		db:         db,
+		dir:        dir,
+		Retention:  12,
+		Ahead:      3,
+		RestoreTTL: 7 * 24 * time.Hour,
+	}
+}
+
+// Maintain creates missing partitions and archives the months past the
+// retention period. Only one replica maintains the table at a time; the
+// others return immediately.
+func (a *Archiver) Maintain(ctx context.Context) error {
+	unlock, ok, err := a.lock(ctx, false)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+
+	var now time.Time
+	if err := a.db.QueryRowContext(ctx, `SELECT now()`).Scan(&now); err != nil {
+		return err
+	}
+	if err := orders.EnsurePartitions(ctx, a.db, now, a.Ahead+1); err != nil {
+		return err
+	}
+
+	// Finish months left detached by a crash.
+	archives, err := a.List(ctx)
+	if err != nil {
+		return err
+	}
+	state := make(map[time.Time]*Archive, len(archives))
+	for _, ar := range archives {
+		state[ar.Month] = ar
+		if ar.Status == StatusDetached {
+			if err := a.export(ctx, ar.Month); err != nil {
+				return fmt.Errorf("archiving %s: %w", monthLabel(ar.Month), err)
+			}
+		}
+	}
+
+	attached, err := orders.AttachedPartitions(ctx, a.db)
+	if err != nil {
+		return err
+	}
+	for _, month := range Expired(attached, now, a.Retention) {
+		if ar, ok := state[month]; ok && ar.Status == StatusRestored {
+			if now.Sub(ar.RestoredAt) >= a.RestoreTTL {
+				if err := a.unrestore(ctx, month); err != nil {
+					return fmt.Errorf("removing restored %s: %w", monthLabel(month), err)
+				}
+			}
+			continue
+		}
+		if err := a.detach(ctx, month); err != nil {
+			return fmt.Errorf("detaching %s: %w", monthLabel(month), err)
+		}
+		if err := a.export(ctx, month); err != nil {
+			return fmt.Errorf("archiving %s: %w", monthLabel(month), err)
+		}
+	}
+	return nil
+}
+
+// MaintainLoop calls Maintain immediately and then on every interval until
+// ctx is cancelled.
+func (a *Archiver) MaintainLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Maintain(ctx); err != nil {
+			logrus.Errorf("Failed to maintain order partitions: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Expired returns the months of partitions older than retention months
+// before the month of now.
+func Expired(months []time.Time, now time.Time, retention int) []time.Time {
+	cutoff := orders.MonthOf(now).AddDate(0, -retention, 0)
+	var out []time.Time
+	for _, m := range months {
+		if m.Before(cutoff) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// detach takes month's partition out of the orders table and records that
+// it is being archived.
+func (a *Archiver) detach(ctx context.Context, month time.Time) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := orders.DetachPartition(ctx, tx, month); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO order_archives (month, status) VALUES ($1, $2)
+			ON CONFLICT (month) DO UPDATE SET status = EXCLUDED.status
+		`, monthDate(month), StatusDetached)
+		return err
+	})
+}
+
+// archiveLine is one line of an archive file: a row of orders or of
+// order_items, as Postgres renders it to JSON.
+type archiveLine struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// export writes the detached partition of month and its items to a file,
+// then drops them from the database.
+func (a *Archiver) export(ctx context.Context, month time.Time) (err error) {
+	partition := orders.PartitionName(month)
+	path := filepath.Join(a.dir, partition+".jsonl.gz")
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+
+	counts := map[string]int64{}
+	for _, q := range []struct{ table, query string }{
+		{"orders", fmt.Sprintf(`SELECT row_to_json(o)::text FROM %s o ORDER BY id`, partition)},
+		{"order_items", fmt.Sprintf(`
+			SELECT row_to_json(i)::text FROM order_items i
+			WHERE i.order_id IN (SELECT id FROM %s) ORDER BY i.order_id, i.sku`, partition)},
+	} {
+		if counts[q.table], err = writeRows(ctx, a.db, enc, q.table, q.query); err != nil {
+			return err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	err = a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := dropPartition(ctx, tx, partition); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE order_archives
+			SET status = $2, path = $3, orders = $4, items = $5, archived_at = now(), restored_at = NULL
+			WHERE month = $1
+		`, monthDate(month), StatusArchived, path, counts["orders"], counts["order_items"])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"month":  monthLabel(month),
+		"orders": counts["orders"],
+		"path":   path,
+	}).Info("Archived orders")
+	return nil
+}
+
+func writeRows(ctx context.Context, db *sql.DB, enc *json.Encoder, table, query string) (int64, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return n, err
+		}
+		if err := enc.Encode(archiveLine{Table: table, Row: json.RawMessage(row)}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// dropPartition deletes a detached partition and the items of its orders.
+func dropPartition(ctx context.Context, tx *sql.Tx, partition string) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`DELETE FROM order_items WHERE order_id IN (SELECT id FROM %s)`, partition)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s`, partition))
+	return err
+}
+
+// unrestore removes a restored month from the database again.
+func (a *Archiver) unrestore(ctx context.Context, month time.Time) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := orders.DetachPartition(ctx, tx, month); err != nil {
+			return err
+		}
+		if err := dropPartition(ctx, tx, orders.PartitionName(month)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE order_archives SET status = $2, restored_at = NULL WHERE month = $1
+		`, monthDate(month), StatusArchived)
+		return err
+	})
+}
+
+// Restore loads an archived month back into the orders table, where it
+// stays for RestoreTTL. Restoring a restored month is a no-op.
+func (a *Archiver) Restore(ctx context.Context, month time.Time) (*Archive, error) {
+	month = orders.MonthOf(month)
+	unlock, _, err := a.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ar, err := a.Get(ctx, month)
+	if err != nil {
+		return nil, err
+	}
+	switch ar.Status {
+	case StatusRestored:
+		return ar, nil
+	case StatusDetached:
+		return nil, fmt.Errorf("%w: %s", ErrInProgress, monthLabel(month))
+	}
+
+	f, err := os.Open(ar.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	partition := orders.PartitionName(month)
+	err = a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := orders.CreateDetachedPartition(ctx, tx, month); err != nil {
+			return err
+		}
+		insert := map[string]string{
+			"orders": fmt.Sprintf(
+				`INSERT INTO %[1]s SELECT * FROM json_populate_record(NULL::%[1]s, $1)`, partition),
+			"order_items": `
+				INSERT INTO order_items SELECT * FROM json_populate_record(NULL::order_items, $1)
+				ON CONFLICT DO NOTHING`,
+		}
+		sc := bufio.NewScanner(zr)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			var line archiveLine
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				return err
+			}
+			query, ok := insert[line.Table]
+			if !ok {
+				return fmt.Errorf("unknown table %q in archive", line.Table)
+			}
+			if _, err := tx.ExecContext(ctx, query, string(line.Row)); err != nil {
+				return err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+		if err := orders.AttachPartition(ctx, tx, month); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE order_archives SET status = $2, restored_at = now() WHERE month = $1
+		`, monthDate(month), StatusRestored)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithField("month", monthLabel(month)).Info("Restored archived orders")
+	return a.Get(ctx, month)
+}
+
+const selectArchive = `
+	SELECT month, status, path, orders, items, archived_at, restored_at FROM order_archives
+`
+
+func scanArchive(row interface{ Scan(...any) error }) (*Archive, error) {
+	var ar Archive
+	var archivedAt, restoredAt sql.NullTime
+	if err := row.Scan(&ar.Month, &ar.Status, &ar.Path, &ar.Orders, &ar.Items, &archivedAt, &restoredAt); err != nil {
+		return nil, err
+	}
+	ar.Month = orders.MonthOf(ar.Month)
+	ar.ArchivedAt = archivedAt.Time
+	ar.RestoredAt = restoredAt.Time
+	return &ar, nil
+}
+
+// Get returns the archive of month.
+func (a *Archiver) Get(ctx context.Context, month time.Time) (*Archive, error) {
+	ar, err := scanArchive(a.db.QueryRowContext(ctx, selectArchive+` WHERE month = $1`, monthDate(month)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, monthLabel(month))
+	}
+	return ar, err
+}
+
+// List returns every archived month, oldest first.
+func (a *Archiver) List(ctx context.Context) ([]*Archive, error) {
+	rows, err := a.db.QueryContext(ctx, selectArchive+` ORDER BY month`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Archive
+	for rows.Next() {
+		ar, err := scanArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ar)
+	}
+	return out, rows.Err()
+}
+
+// lock takes the archival advisory lock on a dedicated connection. Unless
+// wait is set it gives up at once when another replica holds the lock.
+func (a *Archiver) lock(ctx context.Context, wait bool) (unlock func(), ok bool, err error) {
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if wait {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, int64(lockKey))
+		ok = err == nil
+	} else {
+		err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, int64(lockKey)).Scan(&ok)
+	}
+	if err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, int64(lockKey)); err != nil {
+			logrus.Warnf("Failed to release archive lock: %v", err)
+		}
+		conn.Close()
+	}, true, nil
+}
+
+func (a *Archiver) inTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func monthLabel(month time.Time) string {
+	return month.Format("2006-01")
+}
+
+// monthDate formats month for the DATE column, which a timestamp would be
+// converted to in the session's time zone.
+func monthDate(month time.Time) string {
+	return orders.MonthOf(month).Format("2006-01-02")
+}
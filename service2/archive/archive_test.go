@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/orders"
+)
+
+func TestExpiredKeepsRetentionMonths(t *testing.T) {
+	month := func(y int, m time.Month) time.Time { return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC) }
+	attached := []time.Time{month(2023, 12), month(2024, 1), month(2024, 2), month(2024, 3), month(2024, 4)}
+	now := time.Date(2024, 4, 15, 12, 0, 0, 0, time.UTC)
+
+	got := Expired(attached, now, 2)
+	if len(got) != 2 || !got[0].Equal(month(2023, 12)) || !got[1].Equal(month(2024, 1)) {
+		t.Errorf("Expired = %v, want 2023-12 and 2024-01", got)
+	}
+}
+
+func TestArchiveAndRestore(t *testing.T) {
+	db := testutil.IsolatedDB(t, orders.Schema, Schema)
+	ctx := context.Background()
+	store := orders.NewStore(db)
+	now := time.Now()
+	expired := orders.MonthOf(now).AddDate(0, -14, 0)
+	if err := orders.EnsurePartitions(ctx, db, expired, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.EnsurePartitions(ctx, db, now, 1); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(created time.Time) int64 {
+		t.Helper()
+		var id int64
+		if err := db.QueryRowContext(ctx, `
+			INSERT INTO orders (user_id, product, quantity, amount_cents, created_at)
+			VALUES (1, 'SKU', 2, 500, $1) RETURNING id
+		`, created).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO order_items (order_id, sku, quantity, unit_price_cents) VALUES ($1, 'SKU', 2, 250)
+		`, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	oldID := insert(expired.Add(time.Hour))
+	currentID := insert(now)
+
+	a := New(db, t.TempDir())
+	if err := a.Maintain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The expired month is in its file only; the current one is untouched.
+	ar, err := a.Get(ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Status != StatusArchived || ar.Orders != 1 || ar.Items != 1 {
+		t.Errorf("archive %+v", ar)
+	}
+	if _, err := os.Stat(ar.Path); err != nil {
+		t.Errorf("archive file: %v", err)
+	}
+	if _, err := store.Get(ctx, oldID); !errors.Is(err, orders.ErrNotFound) {
+		t.Errorf("archived order: %v", err)
+	}
+	if _, err := store.Get(ctx, currentID); err != nil {
+		t.Errorf("current order: %v", err)
+	}
+	attached, err := orders.AttachedPartitions(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attached) != a.Ahead+1 || !attached[0].Equal(orders.MonthOf(now)) {
+		t.Errorf("partitions after archiving %v", attached)
+	}
+
+	// Restoring brings the orders and their items back, once.
+	for i := 0; i < 2; i++ {
+		if ar, err = a.Restore(ctx, expired); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ar.Status != StatusRestored || ar.RestoredAt.IsZero() {
+		t.Errorf("restored archive %+v", ar)
+	}
+	o, err := store.Get(ctx, oldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.AmountCents != 500 || len(o.Items) != 1 || o.Items[0].UnitPriceCents != 250 {
+		t.Errorf("restored order %+v", o)
+	}
+
+	// Once its time is up the restored month is removed again, and its
+	// file is kept.
+	a.RestoreTTL = 0
+	if err := a.Maintain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ar, err = a.Get(ctx, expired); err != nil || ar.Status != StatusArchived {
+		t.Errorf("archive after the restore expired: %+v, %v", ar, err)
+	}
+	if _, err := store.Get(ctx, oldID); !errors.Is(err, orders.ErrNotFound) {
+		t.Errorf("order after the restore expired: %v", err)
+	}
+	if _, err := os.Stat(ar.Path); err != nil {
+		t.Errorf("archive file after the restore expired: %v", err)
+	}
+
+	if _, err := a.Restore(ctx, expired.AddDate(0, -1, 0)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("restoring a month never archived: %v", err)
+	}
+}
+
+func TestMaintainFinishesDetachedMonth(t *testing.T) {
+	db := testutil.IsolatedDB(t, orders.Schema, Schema)
+	ctx := context.Background()
+	expired := orders.MonthOf(time.Now()).AddDate(0, -14, 0)
+	if err := orders.EnsurePartitions(ctx, db, expired, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO orders (user_id, product, created_at) VALUES (1, 'SKU', $1)`, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after detaching leaves the month detached and unwritten.
+	a := New(db, t.TempDir())
+	if err := a.detach(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Restore(ctx, expired); !errors.Is(err, ErrInProgress) {
+		t.Errorf("restoring a detached month: %v", err)
+	}
+
+	if err := a.Maintain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := a.Get(ctx, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Status != StatusArchived || ar.Orders != 1 {
+		t.Errorf("archive %+v", ar)
+	}
+}
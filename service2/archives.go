@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"service2/archive"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListOrderArchives returns every month moved out of the orders table.
+func (s *server) ListOrderArchives(ctx context.Context, req *pb.ListOrderArchivesRequest) (*pb.ListOrderArchivesResponse, error) {
+	archives, err := s.archiver.List(ctx)
+	if err != nil {
+		return nil, archiveError("list order archives", err)
+	}
+	resp := &pb.ListOrderArchivesResponse{}
+	for _, ar := range archives {
+		resp.Archives = append(resp.Archives, archiveToProto(ar))
+	}
+	return resp, nil
+}
+
+// RestoreOrderArchive loads an archived month back into the orders table.
+func (s *server) RestoreOrderArchive(ctx context.Context, req *pb.RestoreOrderArchiveRequest) (*pb.OrderArchive, error) {
+	logrus.Infof("Received RestoreOrderArchive request: month=%s", req.Month)
+
+	month, err := time.Parse("2006-01", req.Month)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "month must be formatted as YYYY-MM")
+	}
+	ar, err := s.archiver.Restore(ctx, month)
+	if err != nil {
+		return nil, archiveError("restore order archive", err)
+	}
+	return archiveToProto(ar), nil
+}
+
+// archiveError maps archive errors to gRPC status codes.
+func archiveError(op string, err error) error {
+	switch {
+	case errors.Is(err, archive.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, archive.ErrInProgress):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func archiveToProto(ar *archive.Archive) *pb.OrderArchive {
+	return &pb.OrderArchive{
+		Month:      ar.Month.Format("2006-01"),
+		Status:     string(ar.Status),
+		Path:       ar.Path,
+		Orders:     ar.Orders,
+		Items:      ar.Items,
+		ArchivedAt: optionalTimestamp(ar.ArchivedAt),
+		RestoredAt: optionalTimestamp(ar.RestoredAt),
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"service2/cart"
+	"service2/inventory"
+	"service2/orders"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AddItem adds an active product to the user's cart at its current price.
+func (s *server) AddItem(ctx context.Context, req *pb.AddItemRequest) (*pb.Cart, error) {
+	if req.Sku == "" {
+		return nil, status.Error(codes.InvalidArgument, "sku is required")
+	}
+	quantity := req.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	if quantity < 0 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must be positive")
+	}
+	p, err := s.catalog.Get(ctx, req.Sku)
+	if err != nil {
+		return nil, catalogError("add item", err)
+	}
+	if !p.Active {
+		return nil, status.Errorf(codes.FailedPrecondition, "product %s is not active", p.SKU)
+	}
+	c, err := s.carts.AddItem(ctx, req.UserId, p.SKU, quantity, p.PriceCents)
+	if err != nil {
+		return nil, cartError("add item", err)
+	}
+	return cartToProto(c), nil
+}
+
+// RemoveItem takes a SKU out of the user's cart.
+func (s *server) RemoveItem(ctx context.Context, req *pb.RemoveItemRequest) (*pb.Cart, error) {
+	c, err := s.carts.RemoveItem(ctx, req.UserId, req.Sku)
+	if err != nil {
+		return nil, cartError("remove item", err)
+	}
+	return cartToProto(c), nil
+}
+
+// UpdateQuantity sets the quantity of a SKU in the user's cart.
+func (s *server) UpdateQuantity(ctx context.Context, req *pb.UpdateQuantityRequest) (*pb.Cart, error) {
+	if req.Quantity < 0 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must not be negative")
+	}
+	c, err := s.carts.SetQuantity(ctx, req.UserId, req.Sku, req.Quantity)
+	if err != nil {
+		return nil, cartError("update quantity", err)
+	}
+	return cartToProto(c), nil
+}
+
+// GetCart returns the user's cart.
+func (s *server) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	c, err := s.carts.Get(ctx, req.UserId)
+	if err != nil {
+		return nil, cartError("get cart", err)
+	}
+	return cartToProto(c), nil
+}
+
+// Checkout places an order for the items of the user's cart. Prices are
+// checked against the catalog first; if any changed, the cart is repriced
+// and no order is placed unless the caller accepted price changes. If the
+// order fails, for example because payment was declined, the cart is kept.
+func (s *server) Checkout(ctx context.Context, req *pb.CheckoutRequest) (*pb.CheckoutResponse, error) {
+	logrus.Infof("Received Checkout request: user_id=%d", req.UserId)
+
+	if err := s.checkUser(ctx, req.UserId); err != nil {
+		return nil, err
+	}
+	c, err := s.carts.Get(ctx, req.UserId)
+	if err != nil {
+		return nil, cartError("checkout", err)
+	}
+	if len(c.Items) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, cart.ErrEmpty.Error())
+	}
+	items := make([]inventory.Item, 0, len(c.Items))
+	for _, it := range c.Items {
+		items = append(items, inventory.Item{SKU: it.SKU, Quantity: it.Quantity})
+	}
+	prices, err := s.catalog.Quote(ctx, items)
+	if err != nil {
+		return nil, catalogError("quote cart", err)
+	}
+
+	resp := &pb.CheckoutResponse{}
+	changed := c.PriceChanges(prices)
+	for _, it := range c.Items {
+		if price, ok := changed[it.SKU]; ok {
+			resp.PriceChanges = append(resp.PriceChanges, &pb.PriceChange{
+				Sku:           it.SKU,
+				OldPriceCents: it.UnitPriceCents,
+				NewPriceCents: price,
+			})
+		}
+	}
+	if len(changed) > 0 && !req.AcceptPriceChanges {
+		if _, err := s.carts.Reprice(ctx, req.UserId, c.Version, changed); err != nil {
+			return nil, cartError("reprice cart", err)
+		}
+		return resp, nil
+	}
+
+	order, err := s.placeOrder(ctx, req.UserId, items, prices, req.CouponCodes, func(ctx context.Context, tx *sql.Tx, _ int64) error {
+		return s.carts.Consume(ctx, tx, req.UserId, c.Version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Order = order
+	if order.Status == string(orders.StatusFailed) {
+		// The cart was consumed with the order; give it back so the user can
+		// check out again once stock or payment allows.
+		if _, err := s.carts.Restore(context.WithoutCancel(ctx), c); err != nil {
+			logrus.Errorf("Failed to restore the cart of user %d after order %d failed: %v", req.UserId, order.Id, err)
+		}
+		return resp, nil
+	}
+	s.carts.CheckedOut(ctx, c, int64(order.Id))
+	return resp, nil
+}
+
+// cartError maps cart errors to gRPC status codes.
+func cartError(op string, err error) error {
+	switch {
+	case errors.Is(err, cart.ErrItemNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, cart.ErrChanged):
+		return status.Error(codes.Aborted, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func cartToProto(c *cart.Cart) *pb.Cart {
+	out := &pb.Cart{
+		UserId:        c.UserID,
+		SubtotalCents: c.SubtotalCents(),
+		UpdatedAt:     optionalTimestamp(c.UpdatedAt),
+		ExpiresAt:     optionalTimestamp(c.ExpiresAt),
+	}
+	for _, it := range c.Items {
+		out.Items = append(out.Items, &pb.CartItem{
+			Sku:            it.SKU,
+			Quantity:       it.Quantity,
+			UnitPriceCents: it.UnitPriceCents,
+			AddedAt:        timestamppb.New(it.AddedAt),
+		})
+	}
+	return out
+}
@@ -0,0 +1,441 @@
+// Package cart keeps each user's shopping cart until it is checked out or
+// abandoned.
+//
+// Carts are stored server-side, one per user, so they follow the user across
+// devices. A cart expires when it has not been changed for the store's TTL.
+package cart
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"service2/events"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the carts and cart_items tables.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS carts (
+		user_id    INT PRIMARY KEY,
+		version    BIGINT NOT NULL DEFAULT 1,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS carts_expires_at_idx ON carts (expires_at);
+	CREATE TABLE IF NOT EXISTS cart_items (
+		user_id          INT NOT NULL REFERENCES carts (user_id) ON DELETE CASCADE,
+		sku              TEXT NOT NULL,
+		quantity         INT NOT NULL CHECK (quantity > 0),
+		unit_price_cents BIGINT NOT NULL,
+		added_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, sku)
+	);
+`
+
+// Events published to the carts topic for analytics. All of them carry a
+// CartUpdated payload.
+const (
+	EventItemAdded      = "CartItemAdded"
+	EventItemRemoved    = "CartItemRemoved"
+	EventQuantityChange = "CartQuantityChanged"
+	EventCheckedOut     = "CartCheckedOut"
+	EventExpired        = "CartExpired"
+)
+
+var (
+	// ErrItemNotFound is returned when changing a SKU that is not in the
+	// cart.
+	ErrItemNotFound = errors.New("item is not in the cart")
+	// ErrEmpty is returned when checking out a cart without items.
+	ErrEmpty = errors.New("cart is empty")
+	// ErrChanged is returned when the cart changed between being read for
+	// checkout and being checked out.
+	ErrChanged = errors.New("cart changed during checkout")
+)
+
+// Item is a line of a cart. UnitPriceCents is the price when the item was
+// added or last repriced; checkout charges the current price.
+type Item struct {
+	SKU            string
+	Quantity       int32
+	UnitPriceCents int64
+	AddedAt        time.Time
+}
+
+// Cart is a user's cart. A user without a cart has an empty one.
+type Cart struct {
+	UserID int32
+	Items  []Item
+	// Version changes with every change to the cart.
+	Version   int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SubtotalCents is the cart's total at its items' recorded prices.
+func (c *Cart) SubtotalCents() int64 {
+	var total int64
+	for _, it := range c.Items {
+		total += int64(it.Quantity) * it.UnitPriceCents
+	}
+	return total
+}
+
+// PriceChanges returns the current price of every item whose price in
+// prices differs from the one recorded in the cart, by SKU.
+func (c *Cart) PriceChanges(prices map[string]int64) map[string]int64 {
+	changed := make(map[string]int64)
+	for _, it := range c.Items {
+		if price := prices[it.SKU]; price != it.UnitPriceCents {
+			changed[it.SKU] = price
+		}
+	}
+	return changed
+}
+
+// CartUpdated is the payload of the cart events. SKU and Quantity describe
+// the line that changed, if any; OrderID is set on checkout.
+type CartUpdated struct {
+	UserID        int32     `json:"user_id"`
+	SKU           string    `json:"sku,omitempty"`
+	Quantity      int32     `json:"quantity,omitempty"`
+	Items         int       `json:"items"`
+	SubtotalCents int64     `json:"subtotal_cents"`
+	OrderID       int64     `json:"order_id,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// Store reads and writes carts.
+type Store struct {
+	db        *sql.DB
+	publisher events.Publisher
+	ttl       time.Duration
+}
+
+// NewStore creates a Store whose carts expire ttl after their last change.
+// Cart events are announced through publisher, which may be nil.
+func NewStore(db *sql.DB, publisher events.Publisher, ttl time.Duration) *Store {
+	return &Store{db: db, publisher: publisher, ttl: ttl}
+}
+
+// Get returns the user's cart. Expired carts are returned empty.
+func (s *Store) Get(ctx context.Context, userID int32) (*Cart, error) {
+	c := &Cart{UserID: userID}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT version, created_at, updated_at, expires_at FROM carts
+		WHERE user_id = $1 AND expires_at > now()
+	`, userID).Scan(&c.Version, &c.CreatedAt, &c.UpdatedAt, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT sku, quantity, unit_price_cents, added_at FROM cart_items
+		WHERE user_id = $1 ORDER BY added_at, sku
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.SKU, &it.Quantity, &it.UnitPriceCents, &it.AddedAt); err != nil {
+			return nil, err
+		}
+		c.Items = append(c.Items, it)
+	}
+	return c, rows.Err()
+}
+
+// AddItem adds quantity units of sku to the user's cart at unitPriceCents.
+// Adding a SKU that is already in the cart increases its quantity and
+// updates its price.
+func (s *Store) AddItem(ctx context.Context, userID int32, sku string, quantity int32, unitPriceCents int64) (*Cart, error) {
+	c, err := s.update(ctx, userID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO cart_items (user_id, sku, quantity, unit_price_cents) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, sku) DO UPDATE SET
+				quantity = cart_items.quantity + EXCLUDED.quantity,
+				unit_price_cents = EXCLUDED.unit_price_cents
+		`, userID, sku, quantity, unitPriceCents)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publish(ctx, c, EventItemAdded, sku, quantity, 0)
+	return c, nil
+}
+
+// SetQuantity changes the quantity of sku in the user's cart. A quantity of
+// zero removes the item.
+func (s *Store) SetQuantity(ctx context.Context, userID int32, sku string, quantity int32) (*Cart, error) {
+	if quantity == 0 {
+		return s.RemoveItem(ctx, userID, sku)
+	}
+	c, err := s.update(ctx, userID, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE cart_items SET quantity = $3 WHERE user_id = $1 AND sku = $2
+		`, userID, sku, quantity)
+		return itemChanged(res, err, sku)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publish(ctx, c, EventQuantityChange, sku, quantity, 0)
+	return c, nil
+}
+
+// RemoveItem takes sku out of the user's cart.
+func (s *Store) RemoveItem(ctx context.Context, userID int32, sku string) (*Cart, error) {
+	c, err := s.update(ctx, userID, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			DELETE FROM cart_items WHERE user_id = $1 AND sku = $2
+		`, userID, sku)
+		return itemChanged(res, err, sku)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publish(ctx, c, EventItemRemoved, sku, 0, 0)
+	return c, nil
+}
+
+// Reprice records current prices for the SKUs of the user's cart, provided
+// the cart is still at version. It fails with ErrChanged otherwise.
+func (s *Store) Reprice(ctx context.Context, userID int32, version int64, prices map[string]int64) (*Cart, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := current(tx.ExecContext(ctx, `
+		UPDATE carts SET version = version + 1, updated_at = now()
+		WHERE user_id = $1 AND version = $2 AND expires_at > now()
+	`, userID, version)); err != nil {
+		return nil, err
+	}
+	for sku, price := range prices {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE cart_items SET unit_price_cents = $3 WHERE user_id = $1 AND sku = $2
+		`, userID, sku, price); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, userID)
+}
+
+// Consume empties the user's cart inside tx, the transaction that creates
+// the order it is checked out into, provided the cart is still at version.
+// It fails with ErrChanged if the cart changed or expired since it was read,
+// which rolls the order back.
+func (s *Store) Consume(ctx context.Context, tx *sql.Tx, userID int32, version int64) error {
+	return current(tx.ExecContext(ctx, `
+		DELETE FROM carts WHERE user_id = $1 AND version = $2 AND expires_at > now()
+	`, userID, version))
+}
+
+// CheckedOut announces that c was checked out into orderID.
+func (s *Store) CheckedOut(ctx context.Context, c *Cart, orderID int64) {
+	s.publish(ctx, c, EventCheckedOut, "", 0, orderID)
+}
+
+// Restore puts the items of c, a cart consumed by a checkout whose order
+// failed, back into the user's cart. Lines the user added since then are
+// kept as they are.
+func (s *Store) Restore(ctx context.Context, c *Cart) (*Cart, error) {
+	return s.update(ctx, c.UserID, func(tx *sql.Tx) error {
+		for _, it := range c.Items {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO cart_items (user_id, sku, quantity, unit_price_cents, added_at)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (user_id, sku) DO NOTHING
+			`, c.UserID, it.SKU, it.Quantity, it.UnitPriceCents, it.AddedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// update runs change on the user's cart in a transaction, creating the cart
+// if needed and extending its expiry, and returns the changed cart. A cart
+// that expired is emptied first.
+func (s *Store) update(ctx context.Context, userID int32, change func(tx *sql.Tx) error) (c *Cart, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	expired, err := s.deleteExpired(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO carts (user_id, expires_at) VALUES ($1, now() + $2 * interval '1 second')
+		ON CONFLICT (user_id) DO UPDATE SET
+			version = carts.version + 1,
+			updated_at = now(),
+			expires_at = EXCLUDED.expires_at
+	`, userID, s.ttl.Seconds()); err != nil {
+		return nil, err
+	}
+	if err = change(tx); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range expired {
+		s.publish(ctx, e, EventExpired, "", 0, 0)
+	}
+	return s.Get(ctx, userID)
+}
+
+// Expire deletes the carts whose TTL has passed and announces them as
+// abandoned. Each cart is deleted by one statement, so concurrent replicas
+// never announce a cart twice.
+func (s *Store) Expire(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	expired, err := s.deleteExpired(ctx, tx, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, c := range expired {
+		s.publish(ctx, c, EventExpired, "", 0, 0)
+	}
+	return len(expired), nil
+}
+
+// ExpireLoop expires abandoned carts every interval until ctx is done.
+func (s *Store) ExpireLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.Expire(ctx); err != nil {
+			logrus.Errorf("Failed to expire carts: %v", err)
+		} else if n > 0 {
+			logrus.WithField("carts", n).Info("Expired abandoned carts")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteExpired deletes the expired cart of userID, or every expired cart
+// when userID is zero, and returns what they held.
+func (s *Store) deleteExpired(ctx context.Context, tx *sql.Tx, userID int32) ([]*Cart, error) {
+	rows, err := tx.QueryContext(ctx, `
+		WITH expired AS (
+			DELETE FROM carts WHERE expires_at <= now() AND ($1 = 0 OR user_id = $1)
+			RETURNING user_id, version, created_at, updated_at, expires_at
+		)
+		SELECT e.user_id, e.version, e.created_at, e.updated_at, e.expires_at,
+		       COALESCE(i.sku, ''), COALESCE(i.quantity, 0), COALESCE(i.unit_price_cents, 0)
+		FROM expired e LEFT JOIN cart_items i ON i.user_id = e.user_id
+		ORDER BY e.user_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Cart
+	for rows.Next() {
+		var c Cart
+		var it Item
+		if err := rows.Scan(&c.UserID, &c.Version, &c.CreatedAt, &c.UpdatedAt, &c.ExpiresAt,
+			&it.SKU, &it.Quantity, &it.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].UserID != c.UserID {
+			out = append(out, &c)
+		}
+		if it.SKU != "" {
+			last := out[len(out)-1]
+			last.Items = append(last.Items, it)
+		}
+	}
+	return out, rows.Err()
+}
+
+// itemChanged fails with ErrItemNotFound when a statement changing sku's
+// line affected no row.
+func itemChanged(res sql.Result, err error, sku string) error {
+	if n, err := rowsAffected(res, err); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: %s", ErrItemNotFound, sku)
+	}
+	return nil
+}
+
+// current fails with ErrChanged when a statement conditional on the cart's
+// version affected no row.
+func current(res sql.Result, err error) error {
+	if n, err := rowsAffected(res, err); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrChanged
+	}
+	return nil
+}
+
+func rowsAffected(res sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *Store) publish(ctx context.Context, c *Cart, eventType, sku string, quantity int32, orderID int64) {
+	if s.publisher == nil {
+		return
+	}
+	ev := CartUpdated{
+		UserID:        c.UserID,
+		SKU:           sku,
+		Quantity:      quantity,
+		Items:         len(c.Items),
+		SubtotalCents: c.SubtotalCents(),
+		OrderID:       orderID,
+		At:            time.Now(),
+	}
+	key := strconv.FormatInt(int64(c.UserID), 10)
+	if err := s.publisher.Publish(ctx, events.TopicCarts, key, eventType, ev); err != nil {
+		logrus.WithField("user_id", c.UserID).WithError(err).Errorf("Failed to publish %s event", eventType)
+	}
+}
@@ -0,0 +1,223 @@
+package cart
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+)
+
+func TestPriceChanges(t *testing.T) {
+	c := &Cart{Items: []Item{
+		{SKU: "A", Quantity: 2, UnitPriceCents: 500},
+		{SKU: "B", Quantity: 1, UnitPriceCents: 1200},
+	}}
+	if got := c.SubtotalCents(); got != 2200 {
+		t.Fatalf("subtotal %d, want 2200", got)
+	}
+	if changed := c.PriceChanges(map[string]int64{"A": 500, "B": 1200}); len(changed) != 0 {
+		t.Fatalf("changes at the same prices: %v", changed)
+	}
+	changed := c.PriceChanges(map[string]int64{"A": 450, "B": 1200})
+	if len(changed) != 1 || changed["A"] != 450 {
+		t.Fatalf("changes %v, want A at 450", changed)
+	}
+}
+
+// fakePublisher records the events published to it.
+type fakePublisher struct {
+	mutex  sync.Mutex
+	events []published
+}
+
+type published struct {
+	eventType string
+	data      CartUpdated
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic, key, eventType string, data any) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = append(p.events, published{eventType: eventType, data: data.(CartUpdated)})
+	return nil
+}
+
+// find returns the last event of eventType for userID.
+func (p *fakePublisher) find(eventType string, userID int32) (CartUpdated, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := len(p.events) - 1; i >= 0; i-- {
+		if e := p.events[i]; e.eventType == eventType && e.data.UserID == userID {
+			return e.data, true
+		}
+	}
+	return CartUpdated{}, false
+}
+
+// testStore returns a Store on the Postgres database in TEST_DATABASE_URL,
+// and skips the test when it is not set.
+func testStore(t *testing.T) (*Store, *sql.DB, *fakePublisher) {
+	t.Helper()
+	db := testutil.DB(t, Schema)
+	pub := &fakePublisher{}
+	return NewStore(db, pub, time.Hour), db, pub
+}
+
+// testUser returns a user ID no other test run uses.
+func testUser(t *testing.T, db *sql.DB) int32 {
+	t.Helper()
+	userID := int32(time.Now().UnixNano()%1_000_000_000) + 1
+	t.Cleanup(func() { db.Exec(`DELETE FROM carts WHERE user_id = $1`, userID) })
+	return userID
+}
+
+func TestConsumeChecksVersion(t *testing.T) {
+	s, db, _ := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, db)
+
+	read, err := s.AddItem(ctx, userID, "A", 1, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cart changes after it was read for checkout.
+	if _, err := s.AddItem(ctx, userID, "B", 1, 700); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Consume(ctx, tx, userID, read.Version)
+	tx.Rollback()
+	if !errors.Is(err, ErrChanged) {
+		t.Fatalf("Consume of a stale version: %v, want ErrChanged", err)
+	}
+	c, err := s.Get(ctx, userID)
+	if err != nil || len(c.Items) != 2 {
+		t.Fatalf("cart after the failed checkout: %+v, %v", c, err)
+	}
+}
+
+func TestCheckoutConsumesCart(t *testing.T) {
+	s, db, pub := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, db)
+
+	c, err := s.AddItem(ctx, userID, "A", 2, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The order is created in the same transaction that consumes the cart.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Consume(ctx, tx, userID, c.Version); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.CheckedOut(ctx, c, 42)
+
+	after, err := s.Get(ctx, userID)
+	if err != nil || len(after.Items) != 0 || after.Version != 0 {
+		t.Fatalf("cart after checkout: %+v, %v", after, err)
+	}
+	ev, ok := pub.find(EventCheckedOut, userID)
+	if !ok || ev.OrderID != 42 || ev.SubtotalCents != 1000 || ev.Items != 1 {
+		t.Fatalf("checked out event %+v, found %v", ev, ok)
+	}
+
+	// Checking out the same cart again fails.
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := s.Consume(ctx, tx, userID, c.Version); !errors.Is(err, ErrChanged) {
+		t.Fatalf("second Consume: %v, want ErrChanged", err)
+	}
+}
+
+func TestCartExpiry(t *testing.T) {
+	s, db, pub := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, db)
+
+	c, err := s.AddItem(ctx, userID, "A", 1, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.ExpiresAt.After(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("expires at %v, want an hour from now", c.ExpiresAt)
+	}
+	if _, err := db.Exec(`UPDATE carts SET expires_at = now() - interval '1 second' WHERE user_id = $1`, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired cart reads as empty and cannot be checked out.
+	expired, err := s.Get(ctx, userID)
+	if err != nil || len(expired.Items) != 0 {
+		t.Fatalf("expired cart: %+v, %v", expired, err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Consume(ctx, tx, userID, c.Version)
+	tx.Rollback()
+	if !errors.Is(err, ErrChanged) {
+		t.Fatalf("Consume of an expired cart: %v, want ErrChanged", err)
+	}
+
+	// Expire deletes it and announces what it held.
+	if _, err := s.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ev, ok := pub.find(EventExpired, userID)
+	if !ok || ev.Items != 1 || ev.SubtotalCents != 500 {
+		t.Fatalf("expired event %+v, found %v", ev, ok)
+	}
+
+	// Adding to it again starts a new cart.
+	fresh, err := s.AddItem(ctx, userID, "B", 1, 700)
+	if err != nil || len(fresh.Items) != 1 || fresh.Items[0].SKU != "B" || fresh.Version != 1 {
+		t.Fatalf("new cart: %+v, %v", fresh, err)
+	}
+}
+
+func TestRepriceAfterPriceChange(t *testing.T) {
+	s, db, _ := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, db)
+
+	if _, err := s.AddItem(ctx, userID, "A", 2, 500); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.AddItem(ctx, userID, "B", 1, 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog price of A dropped since it was added.
+	changed := c.PriceChanges(map[string]int64{"A": 450, "B": 700})
+	repriced, err := s.Reprice(ctx, userID, c.Version, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repriced.SubtotalCents() != 1600 || repriced.Version != c.Version+1 {
+		t.Fatalf("repriced cart %+v", repriced)
+	}
+	if _, err := s.Reprice(ctx, userID, c.Version, changed); !errors.Is(err, ErrChanged) {
+		t.Fatalf("Reprice of a stale version: %v, want ErrChanged", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/cart"
+	"service2/catalog"
+	"service2/internal/testutil"
+	"service2/orders"
+	"service2/payment"
+	"service2/saga"
+	pb "service2/service2/proto"
+)
+
+func TestCheckoutKeepsCartWhenPaymentDeclined(t *testing.T) {
+	db := testutil.DB(t, orders.Schema, catalog.Schema, payment.Schema, cart.Schema, saga.Schema)
+	ctx := context.Background()
+	if err := orders.EnsurePartitions(ctx, db, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	sku := fmt.Sprintf("CART-%d", time.Now().UnixNano())
+	userID := int32(time.Now().UnixNano()%1_000_000_000) + 1
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM carts WHERE user_id = $1`, userID)
+		db.Exec(`DELETE FROM order_items WHERE sku = $1`, sku)
+		db.Exec(`DELETE FROM orders WHERE user_id = $1`, userID)
+		db.Exec(`DELETE FROM stock_reservations WHERE sku = $1`, sku)
+		db.Exec(`DELETE FROM stock WHERE sku = $1`, sku)
+		db.Exec(`DELETE FROM products WHERE sku = $1`, sku)
+	})
+
+	products := catalog.New(db)
+	if err := products.Create(ctx, &catalog.Product{SKU: sku, Name: "Cart test", PriceCents: 500, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := products.SetStock(ctx, sku, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	fake := payment.NewFake()
+	fake.Script(payment.OpAuthorize, payment.Decline)
+	pub := &recordingPublisher{}
+	store := orders.NewStore(db)
+	s := &server{
+		db:      db,
+		orders:  store,
+		placer:  orders.NewPlacer(db, store, catalog.NewInventory(products, nil), payment.NewService(db, fake), nil, nil),
+		catalog: products,
+		carts:   cart.NewStore(db, pub, time.Hour),
+	}
+
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: userID, Sku: sku, Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Checkout(ctx, &pb.CheckoutRequest{UserId: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Order == nil || resp.Order.Status != string(orders.StatusFailed) {
+		t.Fatalf("order %+v, want FAILED", resp.Order)
+	}
+
+	c, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Items) != 1 || c.Items[0].Sku != sku || c.Items[0].Quantity != 2 {
+		t.Fatalf("cart after the declined checkout: %+v", c.Items)
+	}
+	if pub.has(cart.EventCheckedOut) {
+		t.Fatal("CartCheckedOut published for a failed order")
+	}
+
+	// Once payment goes through, the same cart checks out.
+	resp, err = s.Checkout(ctx, &pb.CheckoutRequest{UserId: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Order == nil || resp.Order.Status != string(orders.StatusConfirmed) {
+		t.Fatalf("second order %+v, want CONFIRMED", resp.Order)
+	}
+	if c, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: userID}); err != nil || len(c.Items) != 0 {
+		t.Fatalf("cart after checking out: %+v, %v", c, err)
+	}
+	if !pub.has(cart.EventCheckedOut) {
+		t.Fatal("CartCheckedOut not published")
+	}
+}
+
+// recordingPublisher records the types of the events published to it.
+type recordingPublisher struct {
+	mutex sync.Mutex
+	types []string
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, topic, key, eventType string, data any) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.types = append(p.types, eventType)
+	return nil
+}
+
+func (p *recordingPublisher) has(eventType string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return slices.Contains(p.types, eventType)
+}
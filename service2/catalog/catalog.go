@@ -0,0 +1,250 @@
+// Package catalog manages products and their stock levels.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"service2/inventory"
+
+	"github.com/lib/pq"
+)
+
+// Schema creates the product, stock and reservation tables and adds the
+// columns introduced after their first version.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS products (
+		sku         TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+		active      BOOLEAN NOT NULL DEFAULT true,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS stock (
+		sku                 TEXT PRIMARY KEY REFERENCES products (sku),
+		quantity            INT NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+		low_stock_threshold INT NOT NULL DEFAULT 10 CHECK (low_stock_threshold >= 0),
+		updated_at          TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS stock_reservations (
+		order_id    BIGINT NOT NULL,
+		sku         TEXT NOT NULL,
+		quantity    INT NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		released_at TIMESTAMPTZ,
+		PRIMARY KEY (order_id, sku)
+	);
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS return_window_days INT NOT NULL DEFAULT 30
+		CHECK (return_window_days >= 0);
+`
+
+var (
+	// ErrNotFound is returned when a SKU is not in the catalog.
+	ErrNotFound = errors.New("product not found")
+	// ErrInactive is returned when a SKU exists but cannot be ordered.
+	ErrInactive = errors.New("product is not active")
+	// ErrAlreadyExists is returned when creating a SKU that exists.
+	ErrAlreadyExists = errors.New("product already exists")
+)
+
+// Product is a catalog entry with its current stock.
+type Product struct {
+	SKU               string
+	Name              string
+	PriceCents        int64
+	Active            bool
+	Stock             int32
+	LowStockThreshold int32
+	// ReturnWindowDays is how long after delivery the product can be
+	// returned; zero means it cannot be.
+	ReturnWindowDays int32
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// ProductUpdate lists the fields to change; nil fields are left as they are.
+type ProductUpdate struct {
+	Name       *string
+	PriceCents *int64
+	Active     *bool
+	// ReturnWindowDays must not be negative.
+	ReturnWindowDays *int32
+}
+
+// Catalog reads and writes products and stock levels.
+type Catalog struct {
+	db *sql.DB
+}
+
+// New creates a Catalog backed by db.
+func New(db *sql.DB) *Catalog {
+	return &Catalog{db: db}
+}
+
+const selectProduct = `
+	SELECT p.sku, p.name, p.price_cents, p.active,
+	       COALESCE(s.quantity, 0), COALESCE(s.low_stock_threshold, 0), p.return_window_days,
+	       p.created_at, p.updated_at
+	FROM products p LEFT JOIN stock s ON s.sku = p.sku
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner) (*Product, error) {
+	var p Product
+	err := row.Scan(&p.SKU, &p.Name, &p.PriceCents, &p.Active, &p.Stock, &p.LowStockThreshold, &p.ReturnWindowDays, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Create adds a product together with its initial stock level.
+func (c *Catalog) Create(ctx context.Context, p *Product) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO products (sku, name, price_cents, active, return_window_days)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at, updated_at
+	`, p.SKU, p.Name, p.PriceCents, p.Active, p.ReturnWindowDays).Scan(&p.CreatedAt, &p.UpdatedAt)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, p.SKU)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO stock (sku, quantity, low_stock_threshold) VALUES ($1, $2, $3)
+	`, p.SKU, p.Stock, p.LowStockThreshold); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get returns the product with the given SKU.
+func (c *Catalog) Get(ctx context.Context, sku string) (*Product, error) {
+	p, err := scanProduct(c.db.QueryRowContext(ctx, selectProduct+` WHERE p.sku = $1`, sku))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, sku)
+	}
+	return p, err
+}
+
+// Update changes the given fields of a product and returns the result.
+func (c *Catalog) Update(ctx context.Context, sku string, u ProductUpdate) (*Product, error) {
+	res, err := c.db.ExecContext(ctx, `
+		UPDATE products SET
+			name               = COALESCE($2, name),
+			price_cents        = COALESCE($3, price_cents),
+			active             = COALESCE($4, active),
+			return_window_days = COALESCE($5, return_window_days),
+			updated_at         = now()
+		WHERE sku = $1
+	`, sku, u.Name, u.PriceCents, u.Active, u.ReturnWindowDays)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, sku)
+	}
+	return c.Get(ctx, sku)
+}
+
+// Delete deactivates a product. Rows are kept because orders and
+// reservations refer to the SKU.
+func (c *Catalog) Delete(ctx context.Context, sku string) error {
+	inactive := false
+	_, err := c.Update(ctx, sku, ProductUpdate{Active: &inactive})
+	return err
+}
+
+// List returns up to limit products ordered by SKU, starting after the
+// given SKU. Inactive products are included only when requested.
+func (c *Catalog) List(ctx context.Context, after string, limit int, includeInactive bool) ([]*Product, error) {
+	rows, err := c.db.QueryContext(ctx, selectProduct+`
+		WHERE p.sku > $1 AND (p.active OR $2)
+		ORDER BY p.sku
+		LIMIT $3
+	`, after, includeInactive, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Lookup returns the given SKUs keyed by SKU. Missing SKUs are absent from
+// the result.
+func (c *Catalog) Lookup(ctx context.Context, skus []string) (map[string]*Product, error) {
+	rows, err := c.db.QueryContext(ctx, selectProduct+` WHERE p.sku = ANY($1)`, pq.Array(skus))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]*Product, len(skus))
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[p.SKU] = p
+	}
+	return out, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// Quote checks that every item refers to an active SKU with enough stock
+// and returns the unit price of each SKU. The stock check is advisory; the
+// reservation made later is what guarantees availability.
+func (c *Catalog) Quote(ctx context.Context, items []inventory.Item) (map[string]int64, error) {
+	skus := make([]string, 0, len(items))
+	for _, it := range items {
+		skus = append(skus, it.SKU)
+	}
+	products, err := c.Lookup(ctx, skus)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[string]int64, len(items))
+	for _, it := range items {
+		p, ok := products[it.SKU]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, it.SKU)
+		case !p.Active:
+			return nil, fmt.Errorf("%w: %s", ErrInactive, it.SKU)
+		case p.Stock < it.Quantity:
+			return nil, fmt.Errorf("%w for %s", inventory.ErrOutOfStock, it.SKU)
+		}
+		prices[it.SKU] = p.PriceCents
+	}
+	return prices, nil
+}
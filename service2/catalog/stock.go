@@ -0,0 +1,233 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"service2/events"
+	"service2/inventory"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventLowStock is published to the inventory topic when a SKU's stock drops
+// to or below its threshold.
+const EventLowStock = "LowStock"
+
+// LowStock is the payload of a LowStock event.
+type LowStock struct {
+	SKU       string `json:"sku"`
+	Quantity  int32  `json:"quantity"`
+	Threshold int32  `json:"threshold"`
+}
+
+// StockLevel is the stock of one SKU.
+type StockLevel struct {
+	SKU               string
+	Quantity          int32
+	LowStockThreshold int32
+}
+
+// SetStock overwrites the stock of sku. A negative threshold leaves the
+// current threshold unchanged.
+func (c *Catalog) SetStock(ctx context.Context, sku string, quantity, threshold int32) (*StockLevel, error) {
+	var lvl StockLevel
+	err := c.db.QueryRowContext(ctx, `
+		UPDATE stock SET
+			quantity = $2,
+			low_stock_threshold = CASE WHEN $3 < 0 THEN low_stock_threshold ELSE $3 END,
+			updated_at = now()
+		WHERE sku = $1
+		RETURNING sku, quantity, low_stock_threshold
+	`, sku, quantity, threshold).Scan(&lvl.SKU, &lvl.Quantity, &lvl.LowStockThreshold)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, sku)
+	}
+	return &lvl, err
+}
+
+// AdjustStock adds delta, which may be negative, to the stock of sku. It
+// fails with inventory.ErrOutOfStock rather than going below zero.
+func (c *Catalog) AdjustStock(ctx context.Context, sku string, delta int32) (*StockLevel, error) {
+	var lvl StockLevel
+	err := c.db.QueryRowContext(ctx, `
+		UPDATE stock SET quantity = quantity + $2, updated_at = now()
+		WHERE sku = $1 AND quantity + $2 >= 0
+		RETURNING sku, quantity, low_stock_threshold
+	`, sku, delta).Scan(&lvl.SKU, &lvl.Quantity, &lvl.LowStockThreshold)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, getErr := c.Get(ctx, sku); getErr != nil {
+			return nil, getErr
+		}
+		return nil, fmt.Errorf("%w for %s", inventory.ErrOutOfStock, sku)
+	}
+	return &lvl, err
+}
+
+// Restock puts returned items back into stock inside tx, so the stock
+// changes commit or roll back with the return that brought them back.
+func (c *Catalog) Restock(ctx context.Context, tx *sql.Tx, items []inventory.Item) error {
+	// Lock rows in a fixed order so concurrent restocks cannot deadlock.
+	sorted := append([]inventory.Item(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SKU < sorted[j].SKU })
+	for _, it := range sorted {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE stock SET quantity = quantity + $2, updated_at = now() WHERE sku = $1
+		`, it.SKU, it.Quantity)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: %s", ErrNotFound, it.SKU)
+		}
+	}
+	return nil
+}
+
+// Inventory is the Postgres-backed inventory.Inventory. Stock is taken with
+// conditional updates, so concurrent reservations can never oversell.
+type Inventory struct {
+	catalog   *Catalog
+	publisher events.Publisher
+}
+
+// NewInventory creates an Inventory over the catalog's stock table that
+// announces low stock through publisher.
+func NewInventory(c *Catalog, publisher events.Publisher) *Inventory {
+	return &Inventory{catalog: c, publisher: publisher}
+}
+
+// Reserve decrements stock for every item and records the reservation. It is
+// all-or-nothing and does nothing if orderID already holds a reservation.
+func (inv *Inventory) Reserve(ctx context.Context, orderID int64, items []inventory.Item) error {
+	// Lock rows in a fixed order so concurrent reservations cannot deadlock.
+	sorted := append([]inventory.Item(nil), items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SKU < sorted[j].SKU })
+
+	tx, err := inv.catalog.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM stock_reservations WHERE order_id = $1)
+	`, orderID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var low []LowStock
+	for _, it := range sorted {
+		var remaining, threshold int32
+		err := tx.QueryRowContext(ctx, `
+			UPDATE stock s SET quantity = s.quantity - $2, updated_at = now()
+			FROM products p
+			WHERE s.sku = $1 AND p.sku = s.sku AND p.active AND s.quantity >= $2
+			RETURNING s.quantity, s.low_stock_threshold
+		`, it.SKU, it.Quantity).Scan(&remaining, &threshold)
+		if errors.Is(err, sql.ErrNoRows) {
+			return inv.reserveError(ctx, it.SKU)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO stock_reservations (order_id, sku, quantity) VALUES ($1, $2, $3)
+		`, orderID, it.SKU, it.Quantity); err != nil {
+			return err
+		}
+		// Announce only the reservation that crosses the threshold.
+		if remaining <= threshold && remaining+it.Quantity > threshold {
+			low = append(low, LowStock{SKU: it.SKU, Quantity: remaining, Threshold: threshold})
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, l := range low {
+		inv.publishLowStock(ctx, l)
+	}
+	return nil
+}
+
+// reserveError explains why the conditional decrement of sku matched no row.
+func (inv *Inventory) reserveError(ctx context.Context, sku string) error {
+	p, err := inv.catalog.Get(ctx, sku)
+	if err != nil {
+		return err
+	}
+	if !p.Active {
+		return fmt.Errorf("%w: %s", ErrInactive, sku)
+	}
+	return fmt.Errorf("%w for %s", inventory.ErrOutOfStock, sku)
+}
+
+// Release returns the stock reserved for orderID. Releasing twice is a
+// no-op.
+func (inv *Inventory) Release(ctx context.Context, orderID int64) error {
+	tx, err := inv.catalog.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE stock_reservations SET released_at = now()
+		WHERE order_id = $1 AND released_at IS NULL
+		RETURNING sku, quantity
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	var released []inventory.Item
+	for rows.Next() {
+		var it inventory.Item
+		if err := rows.Scan(&it.SKU, &it.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		released = append(released, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(released, func(i, j int) bool { return released[i].SKU < released[j].SKU })
+	for _, it := range released {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE stock SET quantity = quantity + $2, updated_at = now() WHERE sku = $1
+		`, it.SKU, it.Quantity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (inv *Inventory) publishLowStock(ctx context.Context, l LowStock) {
+	if inv.publisher == nil {
+		return
+	}
+	if err := inv.publisher.Publish(ctx, events.TopicInventory, l.SKU, EventLowStock, l); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"sku":      l.SKU,
+			"quantity": l.Quantity,
+		}).WithError(err).Error("Failed to publish low stock event")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"sku":       l.SKU,
+		"quantity":  l.Quantity,
+		"threshold": l.Threshold,
+	}).Warn("Stock is low")
+}
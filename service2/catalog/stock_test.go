@@ -0,0 +1,189 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/inventory"
+)
+
+// fakePublisher records the low stock events published to it.
+type fakePublisher struct {
+	mutex sync.Mutex
+	low   []LowStock
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic, key, eventType string, data any) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if eventType == EventLowStock {
+		p.low = append(p.low, data.(LowStock))
+	}
+	return nil
+}
+
+func (p *fakePublisher) events() []LowStock {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]LowStock(nil), p.low...)
+}
+
+// testInventory returns an Inventory on the Postgres database in
+// TEST_DATABASE_URL with a product per stock level, named by SKU suffix,
+// and skips the test when it is not set.
+func testInventory(t *testing.T, stock map[string]int32, threshold int32) (*Inventory, *fakePublisher, func(suffix string) string) {
+	t.Helper()
+	db := testutil.DB(t, Schema)
+	prefix := fmt.Sprintf("STOCK-%d-", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM stock_reservations WHERE sku LIKE $1 || '%'`, prefix)
+		db.Exec(`DELETE FROM stock WHERE sku LIKE $1 || '%'`, prefix)
+		db.Exec(`DELETE FROM products WHERE sku LIKE $1 || '%'`, prefix)
+	})
+
+	c := New(db)
+	for suffix, quantity := range stock {
+		p := &Product{SKU: prefix + suffix, Name: suffix, PriceCents: 100, Active: true, Stock: quantity, LowStockThreshold: threshold}
+		if err := c.Create(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub := &fakePublisher{}
+	return NewInventory(c, pub), pub, func(suffix string) string { return prefix + suffix }
+}
+
+// testOrderID returns an order ID no other test run uses.
+func testOrderID() int64 {
+	return time.Now().UnixNano()
+}
+
+func stockOf(t *testing.T, inv *Inventory, sku string) int32 {
+	t.Helper()
+	p, err := inv.catalog.Get(context.Background(), sku)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Stock
+}
+
+func TestReserveIsAllOrNothing(t *testing.T) {
+	inv, _, sku := testInventory(t, map[string]int32{"A": 5, "B": 1}, 0)
+	ctx := context.Background()
+
+	// B has too little stock, so A is not taken either.
+	err := inv.Reserve(ctx, testOrderID(), []inventory.Item{{SKU: sku("A"), Quantity: 2}, {SKU: sku("B"), Quantity: 2}})
+	if !errors.Is(err, inventory.ErrOutOfStock) {
+		t.Fatalf("Reserve beyond stock: %v, want ErrOutOfStock", err)
+	}
+	err = inv.Reserve(ctx, testOrderID(), []inventory.Item{{SKU: sku("A"), Quantity: 1}, {SKU: sku("missing"), Quantity: 1}})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Reserve of an unknown SKU: %v, want ErrNotFound", err)
+	}
+	if a, b := stockOf(t, inv, sku("A")), stockOf(t, inv, sku("B")); a != 5 || b != 1 {
+		t.Fatalf("stock after failed reservations: A %d, B %d, want 5 and 1", a, b)
+	}
+
+	orderID := testOrderID()
+	items := []inventory.Item{{SKU: sku("A"), Quantity: 2}, {SKU: sku("B"), Quantity: 1}}
+	if err := inv.Reserve(ctx, orderID, items); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := stockOf(t, inv, sku("A")), stockOf(t, inv, sku("B")); a != 3 || b != 0 {
+		t.Fatalf("stock after reserving: A %d, B %d, want 3 and 0", a, b)
+	}
+}
+
+func TestReserveAndReleaseAreIdempotent(t *testing.T) {
+	inv, _, sku := testInventory(t, map[string]int32{"A": 5}, 0)
+	ctx := context.Background()
+
+	orderID := testOrderID()
+	items := []inventory.Item{{SKU: sku("A"), Quantity: 2}}
+	for i := 0; i < 2; i++ {
+		if err := inv.Reserve(ctx, orderID, items); err != nil {
+			t.Fatalf("reserve %d: %v", i, err)
+		}
+	}
+	if got := stockOf(t, inv, sku("A")); got != 3 {
+		t.Fatalf("stock after reserving twice: %d, want 3", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := inv.Release(ctx, orderID); err != nil {
+			t.Fatalf("release %d: %v", i, err)
+		}
+	}
+	if got := stockOf(t, inv, sku("A")); got != 5 {
+		t.Fatalf("stock after releasing twice: %d, want 5", got)
+	}
+
+	// A released reservation is not taken again by a retried Reserve.
+	if err := inv.Reserve(ctx, orderID, items); err != nil {
+		t.Fatal(err)
+	}
+	if got := stockOf(t, inv, sku("A")); got != 5 {
+		t.Fatalf("stock after reserving a released order: %d, want 5", got)
+	}
+}
+
+func TestReserveAnnouncesCrossingLowStock(t *testing.T) {
+	inv, pub, sku := testInventory(t, map[string]int32{"A": 5}, 3)
+	ctx := context.Background()
+
+	reserve := func(quantity int32) {
+		t.Helper()
+		if err := inv.Reserve(ctx, testOrderID(), []inventory.Item{{SKU: sku("A"), Quantity: quantity}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserve(1)
+	if low := pub.events(); len(low) != 0 {
+		t.Fatalf("low stock events above the threshold: %+v", low)
+	}
+	reserve(1)
+	low := pub.events()
+	if len(low) != 1 || low[0].SKU != sku("A") || low[0].Quantity != 3 || low[0].Threshold != 3 {
+		t.Fatalf("low stock events at the threshold: %+v", low)
+	}
+	// Further reservations below the threshold are not announced again.
+	reserve(1)
+	if low := pub.events(); len(low) != 1 {
+		t.Fatalf("low stock events below the threshold: %+v", low)
+	}
+}
+
+func TestInactiveProductsCannotBeOrdered(t *testing.T) {
+	inv, _, sku := testInventory(t, map[string]int32{"A": 5, "B": 5}, 0)
+	ctx := context.Background()
+	c := inv.catalog
+
+	prices, err := c.Quote(ctx, []inventory.Item{{SKU: sku("A"), Quantity: 5}})
+	if err != nil || prices[sku("A")] != 100 {
+		t.Fatalf("Quote: %v, %v", prices, err)
+	}
+	if _, err := c.Quote(ctx, []inventory.Item{{SKU: sku("A"), Quantity: 6}}); !errors.Is(err, inventory.ErrOutOfStock) {
+		t.Fatalf("Quote beyond stock: %v, want ErrOutOfStock", err)
+	}
+	if _, err := c.Quote(ctx, []inventory.Item{{SKU: sku("missing"), Quantity: 1}}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Quote of an unknown SKU: %v, want ErrNotFound", err)
+	}
+
+	if err := c.Delete(ctx, sku("B")); err != nil {
+		t.Fatal(err)
+	}
+	items := []inventory.Item{{SKU: sku("A"), Quantity: 1}, {SKU: sku("B"), Quantity: 1}}
+	if _, err := c.Quote(ctx, items); !errors.Is(err, ErrInactive) {
+		t.Fatalf("Quote of an inactive product: %v, want ErrInactive", err)
+	}
+	if err := inv.Reserve(ctx, testOrderID(), items); !errors.Is(err, ErrInactive) {
+		t.Fatalf("Reserve of an inactive product: %v, want ErrInactive", err)
+	}
+	if got := stockOf(t, inv, sku("A")); got != 5 {
+		t.Fatalf("stock of A after the failed reservation: %d, want 5", got)
+	}
+}
@@ -0,0 +1,200 @@
+// Command export-orders writes an ExportOrders stream of the order service
+// to a file.
+//
+// Progress is recorded next to the output in <out>.progress after every
+// chunk. If the export is interrupted, running the command again with
+// -resume continues where it stopped, with the filter of the first run.
+//
+//	export-orders -out orders.csv -from 2024-01-01 -to 2024-02-01
+//	export-orders -out orders.csv -resume
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// progress is the content of the progress file.
+type progress struct {
+	Format   string    `json:"format"`
+	From     time.Time `json:"from,omitempty"`
+	To       time.Time `json:"to"`
+	UserID   int32     `json:"user_id,omitempty"`
+	Statuses []string  `json:"statuses,omitempty"`
+	// LastOrderID and Offset describe the last chunk written completely.
+	LastOrderID int64 `json:"last_order_id"`
+	Offset      int64 `json:"offset"`
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:50052", "order service address")
+	out := flag.String("out", "", "output file (required)")
+	format := flag.String("format", "csv", "csv or jsonl")
+	from := flag.String("from", "", "export orders created at or after this time (YYYY-MM-DD or RFC 3339)")
+	to := flag.String("to", "", "export orders created before this time; defaults to now")
+	user := flag.Int("user", 0, "export only this user's orders")
+	statuses := flag.String("status", "", "comma-separated order statuses to export")
+	resume := flag.Bool("resume", false, "continue an interrupted export of -out")
+	flag.Parse()
+
+	if *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	progressPath := *out + ".progress"
+
+	var p progress
+	if *resume {
+		raw, err := os.ReadFile(progressPath)
+		if err != nil {
+			logrus.Fatalf("Nothing to resume: %v", err)
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			logrus.Fatalf("Invalid progress file %s: %v", progressPath, err)
+		}
+	} else {
+		if _, err := os.Stat(progressPath); err == nil {
+			logrus.Fatalf("%s exists; use -resume to continue that export or delete it", progressPath)
+		}
+		p = progress{Format: strings.ToUpper(*format), To: time.Now().UTC(), UserID: int32(*user)}
+		var err error
+		if p.From, err = parseTime(*from); err != nil {
+			logrus.Fatalf("Invalid -from: %v", err)
+		}
+		if *to != "" {
+			if p.To, err = parseTime(*to); err != nil {
+				logrus.Fatalf("Invalid -to: %v", err)
+			}
+		}
+		if *statuses != "" {
+			p.Statuses = strings.Split(strings.ToUpper(*statuses), ",")
+		}
+	}
+	formatValue, ok := pb.ExportFormat_value["EXPORT_FORMAT_"+p.Format]
+	if !ok {
+		logrus.Fatalf("Unknown format %q", p.Format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		logrus.Fatalf("Failed to connect to %s: %v", *addr, err)
+	}
+	defer conn.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if *resume {
+		flags = os.O_CREATE | os.O_WRONLY
+	}
+	f, err := os.OpenFile(*out, flags, 0o644)
+	if err != nil {
+		logrus.Fatalf("Failed to open %s: %v", *out, err)
+	}
+	defer f.Close()
+	// Drop whatever was written after the last recorded chunk.
+	if err := f.Truncate(p.Offset); err != nil {
+		logrus.Fatalf("Failed to truncate %s: %v", *out, err)
+	}
+	if _, err := f.Seek(p.Offset, io.SeekStart); err != nil {
+		logrus.Fatalf("Failed to seek %s: %v", *out, err)
+	}
+	if err := saveProgress(progressPath, p); err != nil {
+		logrus.Fatalf("Failed to save progress: %v", err)
+	}
+
+	req := &pb.ExportOrdersRequest{
+		Format:   pb.ExportFormat(formatValue),
+		To:       timestamppb.New(p.To),
+		UserId:   p.UserID,
+		Statuses: p.Statuses,
+		AfterId:  p.LastOrderID,
+	}
+	if !p.From.IsZero() {
+		req.From = timestamppb.New(p.From)
+	}
+	stream, err := pb.NewOrderServiceClient(conn).ExportOrders(ctx, req)
+	if err != nil {
+		logrus.Fatalf("Failed to start export: %v", err)
+	}
+
+	var exported int64
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logrus.Fatalf("Export interrupted after %d orders; run again with -resume: %v", exported, err)
+		}
+		if err := writeChunk(f, chunk.Data); err != nil {
+			logrus.Fatalf("Failed to write %s: %v", *out, err)
+		}
+		p.LastOrderID = chunk.LastOrderId
+		p.Offset += int64(len(chunk.Data))
+		if err := saveProgress(progressPath, p); err != nil {
+			logrus.Fatalf("Failed to save progress: %v", err)
+		}
+		exported += int64(chunk.Orders)
+	}
+
+	if err := f.Close(); err != nil {
+		logrus.Fatalf("Failed to close %s: %v", *out, err)
+	}
+	if err := os.Remove(progressPath); err != nil {
+		logrus.Warnf("Failed to remove %s: %v", progressPath, err)
+	}
+	logrus.Infof("Exported %d orders to %s", exported, *out)
+}
+
+// writeChunk writes data and flushes it to disk, so the progress saved
+// after it never points past what the file holds.
+func writeChunk(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// saveProgress replaces the progress file atomically.
+func saveProgress(path string, p progress) error {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func parseTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither YYYY-MM-DD nor RFC 3339", raw)
+	}
+	return t, nil
+}
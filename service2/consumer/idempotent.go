@@ -0,0 +1,67 @@
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the table used to deduplicate redelivered events.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS processed_events (
+		event_id     TEXT PRIMARY KEY,
+		topic        TEXT NOT NULL,
+		partition    INT NOT NULL,
+		"offset"     BIGINT NOT NULL,
+		processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)
+`
+
+// TxHandler processes a message inside the transaction that records it as
+// processed, so its side effects and the dedup record commit atomically.
+type TxHandler func(ctx context.Context, tx *sql.Tx, msg kafka.Message) error
+
+// Idempotent turns h into a Handler that runs each event at most once. The
+// event ID is inserted into processed_events in the same transaction as the
+// handler's writes; a redelivered event finds its row already present and is
+// reported as ErrAlreadyProcessed without calling h.
+func Idempotent(db *sql.DB, h TxHandler) Handler {
+	return func(ctx context.Context, msg kafka.Message) (err error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+					logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+				}
+			}
+		}()
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO processed_events (event_id, topic, partition, "offset")
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (event_id) DO NOTHING
+		`, EventID(msg), msg.Topic, msg.Partition, msg.Offset)
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			err = ErrAlreadyProcessed
+			return err
+		}
+
+		if err = h(ctx, tx, msg); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+}
@@ -0,0 +1,365 @@
+// Package consumer runs Kafka consumers with at-least-once delivery.
+//
+// Messages are fetched without auto-commit and their offsets are committed
+// only after the handler has processed them successfully, so a crash in the
+// middle of processing causes the message to be redelivered instead of lost.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Reader is the subset of *kafka.Reader used by the Runner.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Handler processes a single message. A nil return marks the message as done
+// and allows its offset to be committed.
+type Handler func(ctx context.Context, msg kafka.Message) error
+
+// ErrAlreadyProcessed is returned by handlers that detect a redelivered
+// message. The Runner treats it as success and counts it as a duplicate.
+var ErrAlreadyProcessed = errors.New("event already processed")
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error that retrying cannot fix, such as a malformed
+// payload. The Runner logs the message, counts it as dropped and commits past
+// it instead of blocking the partition forever.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Config controls concurrency and retry behaviour of the Runner.
+type Config struct {
+	// Workers is the number of goroutines handling messages concurrently.
+	// Messages are routed to workers by partition and key, so messages with
+	// the same key are always handled in order by the same worker.
+	Workers int
+	// QueueSize is the number of messages buffered per worker. When a
+	// worker's queue is full the Runner stops fetching until it drains.
+	QueueSize int
+
+	// RetryBackoff is the delay before the first retry of a failed handler
+	// or commit. It doubles on every attempt up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxCommitAttempts bounds the attempts to commit a batch of offsets.
+	// A batch that still fails is given up: a later commit of the same
+	// partition covers it, or else its messages are redelivered.
+	MaxCommitAttempts int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 64
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxRetryBackoff <= 0 {
+		c.MaxRetryBackoff = 10 * time.Second
+	}
+	if c.MaxCommitAttempts <= 0 {
+		c.MaxCommitAttempts = 10
+	}
+	return c
+}
+
+// Runner fetches messages from a Reader, hands them to a pool of workers and
+// commits their offsets once handled.
+type Runner struct {
+	reader  Reader
+	handler Handler
+	cfg     Config
+	stats   *statsRegistry
+	tracker *offsetTracker
+}
+
+// NewRunner creates a Runner for the given reader and handler.
+func NewRunner(reader Reader, handler Handler, cfg Config) *Runner {
+	return &Runner{
+		reader:  reader,
+		handler: handler,
+		cfg:     cfg.withDefaults(),
+		stats:   newStatsRegistry(),
+		tracker: newOffsetTracker(),
+	}
+}
+
+// Run consumes messages until ctx is cancelled. A failed handler is retried
+// with exponential backoff; no offset at or after it on the same partition is
+// committed until it succeeds. On return, offsets of all messages completed
+// so far have been committed.
+func (r *Runner) Run(ctx context.Context) error {
+	queues := make([]chan kafka.Message, r.cfg.Workers)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, r.cfg.QueueSize)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			r.work(ctx, queue)
+		}(queues[i])
+	}
+
+	commitCtx, stopCommitter := context.WithCancel(context.Background())
+	committerDone := make(chan struct{})
+	go func() {
+		defer close(committerDone)
+		r.commitLoop(commitCtx)
+	}()
+
+	err := r.fetchLoop(ctx, queues)
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	stopCommitter()
+	<-committerDone
+	r.flush()
+	return err
+}
+
+// Stats returns a snapshot of per-partition processing metrics. The metrics
+// of a partition start over when it is tracked again after a rebalance.
+func (r *Runner) Stats() []PartitionStats {
+	stats := r.stats.snapshot()
+	for i := range stats {
+		key := partitionKey{topic: stats[i].Topic, partition: stats[i].Partition}
+		stats[i].InFlight = r.tracker.inFlight(key)
+	}
+	return stats
+}
+
+func (r *Runner) fetchLoop(ctx context.Context, queues []chan kafka.Message) error {
+	for {
+		msg, err := r.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.Errorf("Failed to fetch Kafka message: %v", err)
+			if err := sleep(ctx, r.cfg.RetryBackoff); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !r.tracker.track(msg) {
+			r.stats.refetched(msg)
+			logrus.WithFields(messageFields(msg)).Debug("Skipping Kafka message that is already in flight")
+			continue
+		}
+		r.stats.fetched(msg)
+
+		// Blocks while the worker is saturated, which stops fetching and
+		// keeps the number of buffered messages bounded.
+		select {
+		case queues[r.route(msg)] <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// route picks the worker for a message. Keyed messages are spread by key so
+// that different keys of one partition run in parallel while each key stays
+// ordered; unkeyed messages keep partition order.
+func (r *Runner) route(msg kafka.Message) int {
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic))
+	if len(msg.Key) > 0 {
+		h.Write(msg.Key)
+	} else {
+		h.Write([]byte(strconv.Itoa(msg.Partition)))
+	}
+	return int(h.Sum32() % uint32(r.cfg.Workers))
+}
+
+func (r *Runner) work(ctx context.Context, queue <-chan kafka.Message) {
+	for msg := range queue {
+		if ctx.Err() != nil {
+			// Leave the message uncommitted; it is redelivered on restart.
+			continue
+		}
+		if err := r.process(ctx, msg); err != nil {
+			continue
+		}
+		r.tracker.done(msg)
+	}
+}
+
+// commitLoop commits offsets as the tracker publishes new commit points.
+func (r *Runner) commitLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.tracker.notify:
+		}
+		msgs := r.tracker.takeReady()
+		if len(msgs) == 0 {
+			continue
+		}
+		if err := r.commit(ctx, msgs); err != nil {
+			if ctx.Err() != nil {
+				r.tracker.restore(msgs)
+				return
+			}
+			logrus.WithError(err).Errorf("Giving up committing %d Kafka offsets", len(msgs))
+			if rebalanced(err) {
+				r.forgetIdle()
+			}
+		}
+	}
+}
+
+// rebalanced reports whether a commit failed because the consumer group's
+// generation ended, after which the reader may no longer own the partitions.
+func rebalanced(err error) bool {
+	return errors.Is(err, kafka.RebalanceInProgress) || errors.Is(err, kafka.IllegalGeneration) ||
+		errors.Is(err, kafka.UnknownMemberId)
+}
+
+// forgetIdle drops the offsets and stats of the partitions with nothing in
+// flight, which may have been revoked. The partitions the reader still owns
+// are tracked again from their next message.
+func (r *Runner) forgetIdle() {
+	r.tracker.forgetIdle(r.stats.forget)
+}
+
+// flush commits whatever completed after the commit loop stopped.
+func (r *Runner) flush() {
+	msgs := r.tracker.takeReady()
+	if len(msgs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.commit(ctx, msgs); err != nil {
+		logrus.Errorf("Failed to commit Kafka offsets on shutdown: %v", err)
+	}
+}
+
+// process runs the handler until it succeeds, reports a permanent failure or
+// ctx is cancelled. Only the latter is returned as an error.
+func (r *Runner) process(ctx context.Context, msg kafka.Message) error {
+	backoff := r.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := r.handler(ctx, msg)
+		elapsed := time.Since(start)
+
+		switch {
+		case err == nil:
+			r.stats.processed(msg, elapsed)
+			return nil
+		case errors.Is(err, ErrAlreadyProcessed):
+			r.stats.duplicate(msg)
+			logrus.WithFields(messageFields(msg)).Debug("Skipping already processed Kafka message")
+			return nil
+		case IsPermanent(err):
+			r.stats.dropped(msg)
+			logrus.WithFields(messageFields(msg)).WithError(err).Error("Dropping Kafka message after permanent failure")
+			return nil
+		}
+
+		r.stats.failed(msg)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logrus.WithFields(messageFields(msg)).WithError(err).
+			Warnf("Failed to handle Kafka message (attempt %d), retrying in %v", attempt, backoff)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, r.cfg.MaxRetryBackoff)
+	}
+}
+
+// commit commits msgs, retrying until it succeeds, ctx is cancelled, the
+// group rebalances or MaxCommitAttempts attempts failed.
+func (r *Runner) commit(ctx context.Context, msgs []kafka.Message) error {
+	backoff := r.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := r.reader.CommitMessages(ctx, msgs...)
+		if err == nil {
+			for _, msg := range msgs {
+				r.stats.committed(msg)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if rebalanced(err) || attempt >= r.cfg.MaxCommitAttempts {
+			return err
+		}
+		logrus.WithError(err).Warnf("Failed to commit %d Kafka offsets (attempt %d), retrying", len(msgs), attempt)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, r.cfg.MaxRetryBackoff)
+	}
+}
+
+// EventID returns the idempotency key of a message: the "event_id" header
+// when the producer sets one, otherwise its topic, partition and offset.
+func EventID(msg kafka.Message) string {
+	for _, h := range msg.Headers {
+		if h.Key == "event_id" && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+func messageFields(msg kafka.Message) logrus.Fields {
+	return logrus.Fields{
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+		"key":       string(msg.Key),
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,339 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeReader serves queued messages and records the highest committed offset
+// per partition. Commits fail with commitErr while it is set.
+type fakeReader struct {
+	mutex       sync.Mutex
+	queue       []kafka.Message
+	committed   map[int]int64
+	commitErr   error
+	commitCalls int
+}
+
+func newFakeReader(msgs ...kafka.Message) *fakeReader {
+	return &fakeReader{queue: msgs, committed: make(map[int]int64)}
+}
+
+func (f *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		f.mutex.Lock()
+		if len(f.queue) > 0 {
+			msg := f.queue[0]
+			f.queue = f.queue[1:]
+			f.mutex.Unlock()
+			return msg, nil
+		}
+		f.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (f *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commitCalls++
+	if f.commitErr != nil {
+		return f.commitErr
+	}
+	for _, m := range msgs {
+		if cur, ok := f.committed[m.Partition]; ok && m.Offset < cur {
+			return errors.New("committed offset moved backwards")
+		}
+		f.committed[m.Partition] = m.Offset
+	}
+	return nil
+}
+
+func (f *fakeReader) push(msgs ...kafka.Message) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queue = append(f.queue, msgs...)
+}
+
+func (f *fakeReader) failCommits(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commitErr = err
+}
+
+func (f *fakeReader) commits() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.commitCalls
+}
+
+func (f *fakeReader) committedOffset(partition int) (int64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	off, ok := f.committed[partition]
+	return off, ok
+}
+
+// runUntil runs r until want reports true, then stops it.
+func runUntil(t *testing.T, r *Runner, want func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !want() {
+		if time.Now().After(deadline) {
+			cancel()
+			<-errCh
+			t.Fatal("timed out waiting for the runner")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+}
+
+func committedAt(reader *fakeReader, partition int, offset int64) func() bool {
+	return func() bool {
+		got, ok := reader.committedOffset(partition)
+		return ok && got >= offset
+	}
+}
+
+func TestRunnerCommitsOnlyAfterHandlerSucceeds(t *testing.T) {
+	reader := newFakeReader(
+		kafka.Message{Topic: "user-events", Partition: 0, Offset: 0},
+		kafka.Message{Topic: "user-events", Partition: 0, Offset: 1},
+	)
+
+	var mutex sync.Mutex
+	attempts := map[int64]int{}
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[msg.Offset]++
+		if msg.Offset == 0 && attempts[0] < 3 {
+			if off, ok := reader.committedOffset(0); ok {
+				t.Errorf("offset %d committed before handler succeeded", off)
+			}
+			return errors.New("transient failure")
+		}
+		return nil
+	}
+
+	r := NewRunner(reader, handler, Config{RetryBackoff: time.Millisecond})
+	runUntil(t, r, committedAt(reader, 0, 1))
+
+	if attempts[0] != 3 {
+		t.Errorf("offset 0 handled %d times, want 3", attempts[0])
+	}
+	stats := r.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("got stats for %d partitions, want 1", len(stats))
+	}
+	if stats[0].Processed != 2 || stats[0].Failed != 2 || stats[0].LastCommittedOffset != 1 {
+		t.Errorf("unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestRunnerSkipsDuplicatesAndPermanentFailures(t *testing.T) {
+	reader := newFakeReader(
+		kafka.Message{Topic: "user-events", Partition: 1, Offset: 7},
+		kafka.Message{Topic: "user-events", Partition: 1, Offset: 8},
+		kafka.Message{Topic: "user-events", Partition: 2, Offset: 3},
+	)
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		switch msg.Offset {
+		case 7:
+			return ErrAlreadyProcessed
+		case 8:
+			return Permanent(errors.New("malformed payload"))
+		}
+		return nil
+	}
+
+	r := NewRunner(reader, handler, Config{RetryBackoff: time.Millisecond})
+	runUntil(t, r, func() bool {
+		return committedAt(reader, 1, 8)() && committedAt(reader, 2, 3)()
+	})
+
+	stats := r.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats for %d partitions, want 2", len(stats))
+	}
+	if p1 := stats[0]; p1.Partition != 1 || p1.Duplicates != 1 || p1.Dropped != 1 || p1.Processed != 0 {
+		t.Errorf("unexpected partition 1 stats: %+v", p1)
+	}
+	if p2 := stats[1]; p2.Partition != 2 || p2.Processed != 1 {
+		t.Errorf("unexpected partition 2 stats: %+v", p2)
+	}
+}
+
+func TestRunnerParallelWorkersKeepKeyOrderAndCommitContiguously(t *testing.T) {
+	var msgs []kafka.Message
+	for i := 0; i < 40; i++ {
+		key := []byte{byte('a' + i%4)}
+		msgs = append(msgs, kafka.Message{Topic: "user-events", Partition: 0, Offset: int64(i), Key: key})
+	}
+	reader := newFakeReader(msgs...)
+
+	// Key "a" is slow, so the other keys overtake it on other workers while
+	// the committed offset must not pass the oldest unfinished "a" message.
+	var mutex sync.Mutex
+	seen := map[string][]int64{}
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		if string(msg.Key) == "a" {
+			time.Sleep(2 * time.Millisecond)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[string(msg.Key)] = append(seen[string(msg.Key)], msg.Offset)
+		return nil
+	}
+
+	r := NewRunner(reader, handler, Config{Workers: 4, QueueSize: 2})
+	runUntil(t, r, committedAt(reader, 0, 39))
+
+	for key, offsets := range seen {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("key %s handled out of order: %v", key, offsets)
+				break
+			}
+		}
+	}
+	if len(seen["a"]) != 10 {
+		t.Errorf("key a handled %d times, want 10", len(seen["a"]))
+	}
+}
+
+func TestRunnerSkipsRefetchedInFlightMessages(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	calls := map[int64]int{}
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		mutex.Lock()
+		calls[msg.Offset]++
+		mutex.Unlock()
+		if msg.Offset == 0 {
+			<-release
+		}
+		return nil
+	}
+
+	reader := newFakeReader(
+		kafka.Message{Topic: "user-events", Partition: 0, Offset: 0},
+		kafka.Message{Topic: "user-events", Partition: 0, Offset: 1},
+	)
+	r := NewRunner(reader, handler, Config{Workers: 2})
+
+	// Simulate a rebalance that rewinds the reader to the last committed
+	// offset while offset 0 is still being handled.
+	go func() {
+		for {
+			mutex.Lock()
+			started := calls[0] > 0
+			mutex.Unlock()
+			if started {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		reader.push(
+			kafka.Message{Topic: "user-events", Partition: 0, Offset: 0},
+			kafka.Message{Topic: "user-events", Partition: 0, Offset: 1},
+			kafka.Message{Topic: "user-events", Partition: 0, Offset: 2},
+		)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+
+	runUntil(t, r, committedAt(reader, 0, 2))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for offset, n := range calls {
+		if n != 1 {
+			t.Errorf("offset %d handled %d times, want 1", offset, n)
+		}
+	}
+	if stats := r.Stats(); stats[0].Refetched != 2 {
+		t.Errorf("Refetched = %d, want 2", stats[0].Refetched)
+	}
+}
+
+func TestRunnerGivesUpFailingCommits(t *testing.T) {
+	reader := newFakeReader(kafka.Message{Topic: "user-events", Partition: 0, Offset: 0})
+	reader.failCommits(errors.New("broker unavailable"))
+	handler := func(ctx context.Context, msg kafka.Message) error { return nil }
+	r := NewRunner(reader, handler, Config{RetryBackoff: time.Millisecond, MaxCommitAttempts: 3})
+
+	// After three attempts the commit is given up, and the next one covers
+	// its offset.
+	var recovered bool
+	runUntil(t, r, func() bool {
+		if !recovered && reader.commits() == 3 {
+			recovered = true
+			time.Sleep(20 * time.Millisecond)
+			if n := reader.commits(); n != 3 {
+				t.Errorf("%d commit attempts, want 3", n)
+			}
+			reader.failCommits(nil)
+			reader.push(kafka.Message{Topic: "user-events", Partition: 0, Offset: 1})
+		}
+		return committedAt(reader, 0, 1)()
+	})
+}
+
+func TestRunnerForgetsIdlePartitionsAfterRebalance(t *testing.T) {
+	reader := newFakeReader(
+		kafka.Message{Topic: "user-events", Partition: 0, Offset: 0},
+		kafka.Message{Topic: "user-events", Partition: 1, Offset: 0},
+	)
+	reader.failCommits(kafka.RebalanceInProgress)
+	handler := func(ctx context.Context, msg kafka.Message) error { return nil }
+	r := NewRunner(reader, handler, Config{RetryBackoff: time.Millisecond})
+
+	// A rebalance ends the commit at once and drops the partitions, which
+	// may no longer be ours. A partition that is still ours comes back with
+	// its next message.
+	var rejoined bool
+	runUntil(t, r, func() bool {
+		if !rejoined && reader.commits() > 0 && len(r.Stats()) == 0 {
+			rejoined = true
+			reader.failCommits(nil)
+			reader.push(kafka.Message{Topic: "user-events", Partition: 1, Offset: 1})
+		}
+		return committedAt(reader, 1, 1)()
+	})
+	if n := reader.commits(); n > 3 {
+		t.Errorf("%d commit attempts, want one per rebalanced commit", n)
+	}
+	stats := r.Stats()
+	if len(stats) != 1 || stats[0].Partition != 1 || stats[0].Fetched != 1 {
+		t.Errorf("stats after rebalance: %+v", stats)
+	}
+}
+
+func TestEventID(t *testing.T) {
+	msg := kafka.Message{Topic: "user-events", Partition: 2, Offset: 42}
+	if got := EventID(msg); got != "user-events/2/42" {
+		t.Errorf("EventID without header = %q", got)
+	}
+	msg.Headers = []kafka.Header{{Key: "event_id", Value: []byte("abc")}}
+	if got := EventID(msg); got != "abc" {
+		t.Errorf("EventID with header = %q", got)
+	}
+}
@@ -0,0 +1,143 @@
+package consumer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// PartitionStats holds processing metrics for one topic partition.
+type PartitionStats struct {
+	Topic     string
+	Partition int
+
+	Fetched    uint64
+	Processed  uint64
+	Failed     uint64 // handler attempts that returned a retryable error
+	Duplicates uint64
+	Dropped    uint64
+	Refetched  uint64 // redeliveries of in-flight offsets skipped after a rebalance
+	InFlight   int    // fetched messages whose offsets are not committable yet
+
+	LastFetchedOffset   int64
+	LastCommittedOffset int64
+	Lag                 int64
+
+	TotalProcessingTime time.Duration
+	LastProcessedAt     time.Time
+}
+
+// AverageProcessingTime returns the mean handler duration of successfully
+// processed messages, or zero if nothing was processed yet.
+func (s PartitionStats) AverageProcessingTime() time.Duration {
+	if s.Processed == 0 {
+		return 0
+	}
+	return s.TotalProcessingTime / time.Duration(s.Processed)
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+type statsRegistry struct {
+	mutex      sync.Mutex
+	partitions map[partitionKey]*PartitionStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{partitions: make(map[partitionKey]*PartitionStats)}
+}
+
+func (r *statsRegistry) get(msg kafka.Message) *PartitionStats {
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	s, ok := r.partitions[key]
+	if !ok {
+		s = &PartitionStats{
+			Topic:               msg.Topic,
+			Partition:           msg.Partition,
+			LastFetchedOffset:   -1,
+			LastCommittedOffset: -1,
+		}
+		r.partitions[key] = s
+	}
+	return s
+}
+
+func (r *statsRegistry) fetched(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.get(msg)
+	s.Fetched++
+	s.LastFetchedOffset = msg.Offset
+	if msg.HighWaterMark > 0 {
+		s.Lag = msg.HighWaterMark - msg.Offset - 1
+	}
+}
+
+func (r *statsRegistry) refetched(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(msg).Refetched++
+}
+
+func (r *statsRegistry) processed(msg kafka.Message, elapsed time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.get(msg)
+	s.Processed++
+	s.TotalProcessingTime += elapsed
+	s.LastProcessedAt = time.Now()
+}
+
+func (r *statsRegistry) failed(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(msg).Failed++
+}
+
+func (r *statsRegistry) duplicate(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(msg).Duplicates++
+}
+
+func (r *statsRegistry) dropped(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(msg).Dropped++
+}
+
+func (r *statsRegistry) committed(msg kafka.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.get(msg)
+	if msg.Offset > s.LastCommittedOffset {
+		s.LastCommittedOffset = msg.Offset
+	}
+}
+
+func (r *statsRegistry) forget(key partitionKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.partitions, key)
+}
+
+func (r *statsRegistry) snapshot() []PartitionStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := make([]PartitionStats, 0, len(r.partitions))
+	for _, s := range r.partitions {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Partition < out[j].Partition
+	})
+	return out
+}
@@ -0,0 +1,151 @@
+package consumer
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker decides which offsets are safe to commit when messages of one
+// partition complete out of order on different workers.
+//
+// For every partition it keeps the fetched-but-uncommitted messages in fetch
+// order. A message becomes committable once it and everything fetched before
+// it on the same partition has completed; only the highest such message is
+// handed to the committer, so committed offsets never move backwards.
+type offsetTracker struct {
+	mutex      sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+	ready      map[partitionKey]kafka.Message
+	notify     chan struct{}
+}
+
+type partitionOffsets struct {
+	pending  []trackedOffset
+	next     int64 // one past the highest offset fetched so far
+	hasFetch bool
+}
+
+type trackedOffset struct {
+	msg  kafka.Message
+	done bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[partitionKey]*partitionOffsets),
+		ready:      make(map[partitionKey]kafka.Message),
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+// track registers a fetched message. It returns false when the offset was
+// already fetched, which happens when the reader rewinds to the last committed
+// offset after a rebalance; such a message is either still being processed by
+// a worker or already done and must not be dispatched again.
+func (t *offsetTracker) track(msg kafka.Message) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{}
+		t.partitions[key] = p
+	}
+	if p.hasFetch && msg.Offset < p.next {
+		return false
+	}
+	p.pending = append(p.pending, trackedOffset{msg: msg})
+	p.next = msg.Offset + 1
+	p.hasFetch = true
+	return true
+}
+
+// done marks a message as completed and publishes the new commit point of its
+// partition if it advanced.
+func (t *offsetTracker) done(msg kafka.Message) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		return
+	}
+	for i := range p.pending {
+		if p.pending[i].msg.Offset == msg.Offset {
+			p.pending[i].done = true
+			break
+		}
+	}
+
+	var commit *kafka.Message
+	for len(p.pending) > 0 && p.pending[0].done {
+		m := p.pending[0].msg
+		commit = &m
+		p.pending = p.pending[1:]
+	}
+	if commit == nil {
+		return
+	}
+	t.ready[key] = *commit
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// inFlight returns the number of fetched but uncommittable messages of a
+// partition.
+func (t *offsetTracker) inFlight(key partitionKey) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if p, ok := t.partitions[key]; ok {
+		return len(p.pending)
+	}
+	return 0
+}
+
+// takeReady returns the messages to commit, at most one per partition, and
+// clears them.
+func (t *offsetTracker) takeReady() []kafka.Message {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.ready) == 0 {
+		return nil
+	}
+	out := make([]kafka.Message, 0, len(t.ready))
+	for key, msg := range t.ready {
+		out = append(out, msg)
+		delete(t.ready, key)
+	}
+	return out
+}
+
+// forgetIdle drops the partitions with no pending messages and no commit
+// point waiting, calling forget for each while holding the lock, so a
+// message fetched meanwhile is not forgotten with them.
+func (t *offsetTracker) forgetIdle(forget func(partitionKey)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, p := range t.partitions {
+		if _, ready := t.ready[key]; len(p.pending) == 0 && !ready {
+			delete(t.partitions, key)
+			forget(key)
+		}
+	}
+}
+
+// restore puts messages whose commit failed back, unless a later commit
+// point for the same partition has been published in the meantime.
+func (t *offsetTracker) restore(msgs []kafka.Message) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, msg := range msgs {
+		key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+		if cur, ok := t.ready[key]; !ok || cur.Offset < msg.Offset {
+			t.ready[key] = msg
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"service2/discounts"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var discountKindToProto = map[discounts.Kind]pb.DiscountKind{
+	discounts.Percentage:  pb.DiscountKind_DISCOUNT_KIND_PERCENTAGE,
+	discounts.FixedAmount: pb.DiscountKind_DISCOUNT_KIND_FIXED_AMOUNT,
+	discounts.BuyXGetY:    pb.DiscountKind_DISCOUNT_KIND_BUY_X_GET_Y,
+}
+
+var discountKindFromProto = map[pb.DiscountKind]discounts.Kind{
+	pb.DiscountKind_DISCOUNT_KIND_PERCENTAGE:   discounts.Percentage,
+	pb.DiscountKind_DISCOUNT_KIND_FIXED_AMOUNT: discounts.FixedAmount,
+	pb.DiscountKind_DISCOUNT_KIND_BUY_X_GET_Y:  discounts.BuyXGetY,
+}
+
+// CreateCoupon adds a promotional code.
+func (s *server) CreateCoupon(ctx context.Context, req *pb.CreateCouponRequest) (*pb.Coupon, error) {
+	in := req.GetCoupon()
+	if in == nil {
+		return nil, status.Error(codes.InvalidArgument, "coupon is required")
+	}
+	c := &discounts.Coupon{
+		Code:           in.Code,
+		Kind:           discountKindFromProto[in.Kind],
+		Percent:        in.Percent,
+		AmountCents:    in.AmountCents,
+		SKU:            in.Sku,
+		BuyQuantity:    in.BuyQuantity,
+		GetQuantity:    in.GetQuantity,
+		MinOrderCents:  in.MinOrderCents,
+		MaxRedemptions: in.MaxRedemptions,
+		MaxPerUser:     in.MaxRedemptionsPerUser,
+		Stackable:      in.Stackable,
+		Active:         true,
+	}
+	if in.StartsAt != nil {
+		c.StartsAt = in.StartsAt.AsTime()
+	}
+	if in.EndsAt != nil {
+		c.EndsAt = in.EndsAt.AsTime()
+	}
+	if err := s.discounts.Create(ctx, c); err != nil {
+		return nil, discountError("create coupon", err)
+	}
+	logrus.WithFields(logrus.Fields{"code": c.Code, "kind": c.Kind}).Info("Coupon created")
+	return couponToProto(c), nil
+}
+
+// GetCoupon returns a coupon with its redemption count.
+func (s *server) GetCoupon(ctx context.Context, req *pb.GetCouponRequest) (*pb.Coupon, error) {
+	c, err := s.discounts.Get(ctx, req.Code)
+	if err != nil {
+		return nil, discountError("get coupon", err)
+	}
+	return couponToProto(c), nil
+}
+
+// DeactivateCoupon stops a coupon from being redeemed. Orders that already
+// redeemed it keep their discount.
+func (s *server) DeactivateCoupon(ctx context.Context, req *pb.DeactivateCouponRequest) (*pb.Coupon, error) {
+	c, err := s.discounts.Deactivate(ctx, req.Code)
+	if err != nil {
+		return nil, discountError("deactivate coupon", err)
+	}
+	logrus.WithField("code", c.Code).Info("Coupon deactivated")
+	return couponToProto(c), nil
+}
+
+// discountError maps discount errors to gRPC status codes.
+func discountError(op string, err error) error {
+	switch {
+	case errors.Is(err, discounts.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, discounts.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, discounts.ErrInvalidCoupon):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, discounts.ErrNotApplicable), errors.Is(err, discounts.ErrLimitReached):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func couponToProto(c *discounts.Coupon) *pb.Coupon {
+	out := &pb.Coupon{
+		Code:                  c.Code,
+		Kind:                  discountKindToProto[c.Kind],
+		Percent:               c.Percent,
+		AmountCents:           c.AmountCents,
+		Sku:                   c.SKU,
+		BuyQuantity:           c.BuyQuantity,
+		GetQuantity:           c.GetQuantity,
+		MinOrderCents:         c.MinOrderCents,
+		StartsAt:              timestamppb.New(c.StartsAt),
+		MaxRedemptions:        c.MaxRedemptions,
+		MaxRedemptionsPerUser: c.MaxPerUser,
+		Stackable:             c.Stackable,
+		Active:                c.Active,
+		Redemptions:           c.Redemptions,
+		CreatedAt:             timestamppb.New(c.CreatedAt),
+	}
+	if !c.EndsAt.IsZero() {
+		out.EndsAt = timestamppb.New(c.EndsAt)
+	}
+	return out
+}
@@ -0,0 +1,274 @@
+// Package discounts applies promotional coupons to orders and enforces their
+// redemption limits.
+package discounts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"service2/orders"
+
+	"github.com/lib/pq"
+)
+
+// Schema creates the coupon and redemption tables.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS coupons (
+		code            TEXT PRIMARY KEY,
+		kind            TEXT NOT NULL,
+		percent         INT NOT NULL DEFAULT 0,
+		amount_cents    BIGINT NOT NULL DEFAULT 0,
+		sku             TEXT NOT NULL DEFAULT '',
+		buy_quantity    INT NOT NULL DEFAULT 0,
+		get_quantity    INT NOT NULL DEFAULT 0,
+		min_order_cents BIGINT NOT NULL DEFAULT 0,
+		starts_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+		ends_at         TIMESTAMPTZ,
+		max_redemptions INT NOT NULL DEFAULT 0,
+		max_per_user    INT NOT NULL DEFAULT 0,
+		stackable       BOOLEAN NOT NULL DEFAULT false,
+		active          BOOLEAN NOT NULL DEFAULT true,
+		redemptions     INT NOT NULL DEFAULT 0 CHECK (redemptions >= 0),
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS coupon_redemptions (
+		code           TEXT NOT NULL REFERENCES coupons (code),
+		order_id       BIGINT NOT NULL,
+		user_id        INT NOT NULL,
+		discount_cents BIGINT NOT NULL,
+		redeemed_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (code, order_id)
+	);
+	CREATE INDEX IF NOT EXISTS coupon_redemptions_code_user_idx ON coupon_redemptions (code, user_id);
+	CREATE INDEX IF NOT EXISTS coupon_redemptions_order_idx ON coupon_redemptions (order_id);
+`
+
+var (
+	// ErrNotFound is returned for unknown coupon codes.
+	ErrNotFound = errors.New("coupon not found")
+	// ErrAlreadyExists is returned when creating a code that exists.
+	ErrAlreadyExists = errors.New("coupon already exists")
+	// ErrInvalidCoupon is returned when creating a coupon with a malformed
+	// rule.
+	ErrInvalidCoupon = errors.New("invalid coupon")
+	// ErrNotApplicable is returned when a coupon does not apply to an order:
+	// it is inactive or outside its validity window, the order is too small
+	// or lacks the SKU, or the coupon cannot be stacked.
+	ErrNotApplicable = errors.New("coupon does not apply")
+	// ErrLimitReached is returned when a coupon has been redeemed as often as
+	// allowed overall or by the user.
+	ErrLimitReached = errors.New("coupon redemption limit reached")
+)
+
+// Engine stores coupons and applies them to orders.
+type Engine struct {
+	db *sql.DB
+}
+
+// New creates an Engine backed by db.
+func New(db *sql.DB) *Engine {
+	return &Engine{db: db}
+}
+
+const selectCoupon = `
+	SELECT code, kind, percent, amount_cents, sku, buy_quantity, get_quantity,
+	       min_order_cents, starts_at, ends_at, max_redemptions, max_per_user,
+	       stackable, active, redemptions, created_at
+	FROM coupons
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCoupon(row rowScanner) (*Coupon, error) {
+	var c Coupon
+	var endsAt sql.NullTime
+	err := row.Scan(&c.Code, &c.Kind, &c.Percent, &c.AmountCents, &c.SKU, &c.BuyQuantity, &c.GetQuantity,
+		&c.MinOrderCents, &c.StartsAt, &endsAt, &c.MaxRedemptions, &c.MaxPerUser,
+		&c.Stackable, &c.Active, &c.Redemptions, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.EndsAt = endsAt.Time
+	return &c, nil
+}
+
+// Create adds a coupon. A zero StartsAt makes it valid immediately.
+func (e *Engine) Create(ctx context.Context, c *Coupon) error {
+	if c.StartsAt.IsZero() {
+		c.StartsAt = time.Now()
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	var endsAt sql.NullTime
+	if !c.EndsAt.IsZero() {
+		endsAt = sql.NullTime{Time: c.EndsAt, Valid: true}
+	}
+
+	err := e.db.QueryRowContext(ctx, `
+		INSERT INTO coupons (code, kind, percent, amount_cents, sku, buy_quantity, get_quantity,
+			min_order_cents, starts_at, ends_at, max_redemptions, max_per_user, stackable, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING created_at
+	`, c.Code, c.Kind, c.Percent, c.AmountCents, c.SKU, c.BuyQuantity, c.GetQuantity,
+		c.MinOrderCents, c.StartsAt, endsAt, c.MaxRedemptions, c.MaxPerUser, c.Stackable, c.Active,
+	).Scan(&c.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, c.Code)
+	}
+	return err
+}
+
+// Get returns the coupon with the given code.
+func (e *Engine) Get(ctx context.Context, code string) (*Coupon, error) {
+	c, err := scanCoupon(e.db.QueryRowContext(ctx, selectCoupon+` WHERE code = $1`, code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, code)
+	}
+	return c, err
+}
+
+// Deactivate stops a coupon from being redeemed and returns it.
+func (e *Engine) Deactivate(ctx context.Context, code string) (*Coupon, error) {
+	c, err := scanCoupon(e.db.QueryRowContext(ctx, `
+		UPDATE coupons SET active = false WHERE code = $1
+		RETURNING code, kind, percent, amount_cents, sku, buy_quantity, get_quantity,
+		          min_order_cents, starts_at, ends_at, max_redemptions, max_per_user,
+		          stackable, active, redemptions, created_at
+	`, code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, code)
+	}
+	return c, err
+}
+
+// Apply computes the discounts the given codes take off an order of lines
+// by userID. Limits are checked here to fail early, but only Redeem
+// guarantees them.
+func (e *Engine) Apply(ctx context.Context, userID int32, codes []string, lines []Line) ([]Applied, error) {
+	seen := make(map[string]bool, len(codes))
+	coupons := make([]*Coupon, 0, len(codes))
+	for _, code := range codes {
+		if seen[code] {
+			return nil, fmt.Errorf("%w: %s is given twice", ErrNotApplicable, code)
+		}
+		seen[code] = true
+
+		c, err := e.Get(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.checkLimits(ctx, e.db, c, userID); err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, c)
+	}
+	return compute(coupons, lines, time.Now())
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (e *Engine) checkLimits(ctx context.Context, q querier, c *Coupon, userID int32) error {
+	if c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions {
+		return fmt.Errorf("%w: %s", ErrLimitReached, c.Code)
+	}
+	if c.MaxPerUser == 0 {
+		return nil
+	}
+	var used int32
+	if err := q.QueryRowContext(ctx, `
+		SELECT count(*) FROM coupon_redemptions WHERE code = $1 AND user_id = $2
+	`, c.Code, userID).Scan(&used); err != nil {
+		return err
+	}
+	if used >= c.MaxPerUser {
+		return fmt.Errorf("%w: %s for user %d", ErrLimitReached, c.Code, userID)
+	}
+	return nil
+}
+
+// Redeem records the discounts of o inside tx, the transaction creating the
+// order. Incrementing a coupon's counter locks its row, so concurrent
+// redemptions of one code are serialized and both limits hold.
+func (e *Engine) Redeem(ctx context.Context, tx *sql.Tx, o *orders.Order) error {
+	// Lock coupons in a fixed order so concurrent orders cannot deadlock.
+	discounts := append([]orders.Discount(nil), o.Discounts...)
+	sort.Slice(discounts, func(i, j int) bool { return discounts[i].Code < discounts[j].Code })
+
+	for _, d := range discounts {
+		c, err := scanCoupon(tx.QueryRowContext(ctx, `
+			UPDATE coupons SET redemptions = redemptions + 1
+			WHERE code = $1 AND active AND starts_at <= now() AND (ends_at IS NULL OR ends_at > now())
+			RETURNING code, kind, percent, amount_cents, sku, buy_quantity, get_quantity,
+			          min_order_cents, starts_at, ends_at, max_redemptions, max_per_user,
+			          stackable, active, redemptions, created_at
+		`, d.Code))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s can no longer be redeemed", ErrNotApplicable, d.Code)
+		}
+		if err != nil {
+			return err
+		}
+		// The counter now includes this redemption.
+		c.Redemptions--
+		if err := e.checkLimits(ctx, tx, c, o.UserID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO coupon_redemptions (code, order_id, user_id, discount_cents)
+			VALUES ($1, $2, $3, $4)
+		`, d.Code, o.ID, o.UserID, d.AmountCents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release gives back the redemptions of an order that failed or was
+// cancelled. Releasing twice is a no-op.
+func (e *Engine) Release(ctx context.Context, orderID int64) error {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM coupon_redemptions WHERE order_id = $1 RETURNING code
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Strings(codes)
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE coupons SET redemptions = redemptions - 1 WHERE code = $1
+		`, code); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
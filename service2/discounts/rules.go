@@ -0,0 +1,184 @@
+package discounts
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kind is the type of a discount rule.
+type Kind string
+
+const (
+	// Percentage takes a percentage off the order, or off one SKU's line.
+	Percentage Kind = "PERCENTAGE"
+	// FixedAmount takes a fixed amount off the order.
+	FixedAmount Kind = "FIXED_AMOUNT"
+	// BuyXGetY makes GetQuantity units of a SKU free for every BuyQuantity
+	// units bought.
+	BuyXGetY Kind = "BUY_X_GET_Y"
+)
+
+// applyOrder is the order in which kinds are applied: item-level discounts
+// first, then percentages, then fixed amounts, so a percentage never
+// applies to money already taken off by a fixed amount.
+var applyOrder = []Kind{BuyXGetY, Percentage, FixedAmount}
+
+// Coupon is a promotional code and the rule it applies.
+type Coupon struct {
+	Code string
+	Kind Kind
+	// Percent is 1-100 for Percentage coupons.
+	Percent int32
+	// AmountCents is the amount off for FixedAmount coupons.
+	AmountCents int64
+	// SKU restricts a Percentage coupon to one line and names the product of
+	// a BuyXGetY coupon.
+	SKU         string
+	BuyQuantity int32
+	GetQuantity int32
+	// MinOrderCents is the subtotal an order needs for the coupon to apply.
+	MinOrderCents int64
+	// StartsAt and EndsAt bound when the coupon can be redeemed; a zero
+	// EndsAt means it does not expire.
+	StartsAt time.Time
+	EndsAt   time.Time
+	// MaxRedemptions and MaxPerUser limit redemptions overall and per user;
+	// zero means unlimited.
+	MaxRedemptions int32
+	MaxPerUser     int32
+	// Stackable coupons can be combined with other stackable coupons.
+	Stackable   bool
+	Active      bool
+	Redemptions int32
+	CreatedAt   time.Time
+}
+
+// Validate checks that the rule of c is well-formed.
+func (c *Coupon) Validate() error {
+	if c.Code == "" {
+		return fmt.Errorf("%w: code is required", ErrInvalidCoupon)
+	}
+	switch c.Kind {
+	case Percentage:
+		if c.Percent < 1 || c.Percent > 100 {
+			return fmt.Errorf("%w: percent must be between 1 and 100", ErrInvalidCoupon)
+		}
+	case FixedAmount:
+		if c.AmountCents <= 0 {
+			return fmt.Errorf("%w: amount must be positive", ErrInvalidCoupon)
+		}
+	case BuyXGetY:
+		if c.SKU == "" || c.BuyQuantity <= 0 || c.GetQuantity <= 0 {
+			return fmt.Errorf("%w: buy-x-get-y needs a SKU and positive quantities", ErrInvalidCoupon)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidCoupon, c.Kind)
+	}
+	if c.MinOrderCents < 0 || c.MaxRedemptions < 0 || c.MaxPerUser < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidCoupon)
+	}
+	if !c.EndsAt.IsZero() && !c.EndsAt.After(c.StartsAt) {
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidCoupon)
+	}
+	return nil
+}
+
+// Line is an order line the discounts are computed on.
+type Line struct {
+	SKU            string
+	Quantity       int32
+	UnitPriceCents int64
+}
+
+// Applied is a discount taken off an order.
+type Applied struct {
+	Code        string
+	Kind        Kind
+	AmountCents int64
+}
+
+// compute applies coupons to lines at time now. It checks the validity
+// windows, minimum order values and stacking rules, but not redemption
+// limits, which only hold when checked in the redeeming transaction. The
+// total discount never exceeds the subtotal.
+func compute(coupons []*Coupon, lines []Line, now time.Time) ([]Applied, error) {
+	if len(coupons) > 1 {
+		for _, c := range coupons {
+			if !c.Stackable {
+				return nil, fmt.Errorf("%w: %s cannot be combined with other coupons", ErrNotApplicable, c.Code)
+			}
+		}
+	}
+
+	var subtotal int64
+	for _, l := range lines {
+		subtotal += int64(l.Quantity) * l.UnitPriceCents
+	}
+	for _, c := range coupons {
+		switch {
+		case !c.Active:
+			return nil, fmt.Errorf("%w: %s is not active", ErrNotApplicable, c.Code)
+		case now.Before(c.StartsAt):
+			return nil, fmt.Errorf("%w: %s is not valid yet", ErrNotApplicable, c.Code)
+		case !c.EndsAt.IsZero() && !now.Before(c.EndsAt):
+			return nil, fmt.Errorf("%w: %s has expired", ErrNotApplicable, c.Code)
+		case subtotal < c.MinOrderCents:
+			return nil, fmt.Errorf("%w: %s needs an order of at least %d cents", ErrNotApplicable, c.Code, c.MinOrderCents)
+		}
+	}
+
+	remaining := subtotal
+	var applied []Applied
+	for _, kind := range applyOrder {
+		for _, c := range coupons {
+			if c.Kind != kind {
+				continue
+			}
+			amount, err := discount(c, lines, remaining)
+			if err != nil {
+				return nil, err
+			}
+			amount = min(amount, remaining)
+			remaining -= amount
+			applied = append(applied, Applied{Code: c.Code, Kind: c.Kind, AmountCents: amount})
+		}
+	}
+	return applied, nil
+}
+
+// discount is the amount c takes off an order whose undiscounted remainder
+// is remaining.
+func discount(c *Coupon, lines []Line, remaining int64) (int64, error) {
+	switch c.Kind {
+	case Percentage:
+		base := remaining
+		if c.SKU != "" {
+			l, ok := findLine(lines, c.SKU)
+			if !ok {
+				return 0, fmt.Errorf("%w: %s only applies to %s", ErrNotApplicable, c.Code, c.SKU)
+			}
+			base = min(int64(l.Quantity)*l.UnitPriceCents, remaining)
+		}
+		return base * int64(c.Percent) / 100, nil
+	case FixedAmount:
+		return c.AmountCents, nil
+	case BuyXGetY:
+		l, ok := findLine(lines, c.SKU)
+		group := c.BuyQuantity + c.GetQuantity
+		if !ok || l.Quantity < group {
+			return 0, fmt.Errorf("%w: %s needs %d units of %s", ErrNotApplicable, c.Code, group, c.SKU)
+		}
+		free := l.Quantity / group * c.GetQuantity
+		return int64(free) * l.UnitPriceCents, nil
+	}
+	return 0, fmt.Errorf("%w: unknown kind %q", ErrInvalidCoupon, c.Kind)
+}
+
+func findLine(lines []Line, sku string) (Line, bool) {
+	for _, l := range lines {
+		if l.SKU == sku {
+			return l, true
+		}
+	}
+	return Line{}, false
+}
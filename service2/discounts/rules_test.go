@@ -0,0 +1,103 @@
+package discounts
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCompute(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	lines := []Line{
+		{SKU: "tee", Quantity: 5, UnitPriceCents: 1000},
+		{SKU: "mug", Quantity: 1, UnitPriceCents: 2000},
+	}
+	active := func(c Coupon) *Coupon {
+		c.Active = true
+		c.StartsAt = now.Add(-time.Hour)
+		return &c
+	}
+
+	tests := []struct {
+		name    string
+		coupons []*Coupon
+		want    []int64
+		wantErr error
+	}{
+		{
+			name:    "percentage of order",
+			coupons: []*Coupon{active(Coupon{Code: "P10", Kind: Percentage, Percent: 10})},
+			want:    []int64{700},
+		},
+		{
+			name:    "percentage of one line",
+			coupons: []*Coupon{active(Coupon{Code: "MUG50", Kind: Percentage, Percent: 50, SKU: "mug"})},
+			want:    []int64{1000},
+		},
+		{
+			name:    "buy two get one",
+			coupons: []*Coupon{active(Coupon{Code: "B2G1", Kind: BuyXGetY, SKU: "tee", BuyQuantity: 2, GetQuantity: 1})},
+			want:    []int64{1000},
+		},
+		{
+			name: "stacked in rule order",
+			coupons: []*Coupon{
+				active(Coupon{Code: "F5", Kind: FixedAmount, AmountCents: 500, Stackable: true}),
+				active(Coupon{Code: "P10", Kind: Percentage, Percent: 10, Stackable: true}),
+				active(Coupon{Code: "B2G1", Kind: BuyXGetY, SKU: "tee", BuyQuantity: 2, GetQuantity: 1, Stackable: true}),
+			},
+			// 7000 - 1000 free tee = 6000; 10% = 600; then 500 fixed.
+			want: []int64{1000, 600, 500},
+		},
+		{
+			name:    "capped at subtotal",
+			coupons: []*Coupon{active(Coupon{Code: "BIG", Kind: FixedAmount, AmountCents: 10000})},
+			want:    []int64{7000},
+		},
+		{
+			name: "not stackable",
+			coupons: []*Coupon{
+				active(Coupon{Code: "A", Kind: FixedAmount, AmountCents: 100, Stackable: true}),
+				active(Coupon{Code: "B", Kind: FixedAmount, AmountCents: 100}),
+			},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "expired",
+			coupons: []*Coupon{active(Coupon{Code: "OLD", Kind: FixedAmount, AmountCents: 100, EndsAt: now})},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "below minimum order",
+			coupons: []*Coupon{active(Coupon{Code: "MIN", Kind: FixedAmount, AmountCents: 100, MinOrderCents: 10000})},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "buy-x-get-y without enough units",
+			coupons: []*Coupon{active(Coupon{Code: "B5G1", Kind: BuyXGetY, SKU: "tee", BuyQuantity: 5, GetQuantity: 1})},
+			wantErr: ErrNotApplicable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied, err := compute(tt.coupons, lines, now)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(tt.want) {
+				t.Fatalf("applied %+v, want amounts %v", applied, tt.want)
+			}
+			for i, a := range applied {
+				if a.AmountCents != tt.want[i] {
+					t.Errorf("discount %d (%s) = %d, want %d", i, a.Code, a.AmountCents, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// Package export dumps orders as CSV or JSON Lines.
+//
+// An export reads its orders in one REPEATABLE READ transaction, so it sees
+// a single snapshot however long it runs, and pages through them by ID, so
+// memory use does not grow with the number of orders.
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"service2/orders"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Format is the encoding of an export.
+type Format string
+
+const (
+	// CSV has a header line and one line per order item, repeating the
+	// order's columns.
+	CSV Format = "CSV"
+	// JSONL has one JSON object per order, with its items nested.
+	JSONL Format = "JSONL"
+)
+
+// ErrInvalid is returned for a filter that cannot be exported.
+var ErrInvalid = errors.New("invalid export")
+
+// Filter selects the orders to export. Zero fields match every order.
+type Filter struct {
+	// From and To bound created_at; From is inclusive, To exclusive.
+	From, To time.Time
+	UserID   int32
+	Statuses []orders.Status
+	// AfterID skips the orders up to and including this ID, to resume an
+	// interrupted export. Orders are exported in ID order.
+	AfterID int64
+}
+
+// Exporter reads orders for export.
+type Exporter struct {
+	db *sql.DB
+
+	// BatchSize is how many orders are read per query.
+	BatchSize int
+	// ChunkSize is the size in bytes above which encoded rows are emitted.
+	ChunkSize int
+}
+
+// New creates an Exporter reading from db.
+func New(db *sql.DB) *Exporter {
+	return &Exporter{db: db, BatchSize: 500, ChunkSize: 64 * 1024}
+}
+
+// Chunk is a piece of an export. It always ends at the end of an order, so
+// an export can be resumed after any chunk with AfterID set to LastID.
+type Chunk struct {
+	Data   []byte
+	LastID int64
+	Orders int
+}
+
+// Export encodes the orders matching f and passes them to emit in chunks.
+// The CSV header is written only when f.AfterID is zero. Data is reused
+// after emit returns.
+func (e *Exporter) Export(ctx context.Context, format Format, f Filter, emit func(Chunk) error) (err error) {
+	if format != CSV && format != JSONL {
+		return fmt.Errorf("%w: unknown format %q", ErrInvalid, format)
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalid)
+	}
+
+	tx, err := e.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+		}
+	}()
+
+	var buf bytes.Buffer
+	enc := newEncoder(format, &buf)
+	if f.AfterID == 0 {
+		if err := enc.header(); err != nil {
+			return err
+		}
+	}
+	chunk := Chunk{LastID: f.AfterID}
+	flush := func() error {
+		chunk.Data = buf.Bytes()
+		if err := emit(chunk); err != nil {
+			return err
+		}
+		buf.Reset()
+		chunk.Orders = 0
+		return nil
+	}
+
+	for {
+		batch, err := e.batch(ctx, tx, f, chunk.LastID)
+		if err != nil {
+			return err
+		}
+		for _, o := range batch {
+			if err := enc.order(o); err != nil {
+				return err
+			}
+			chunk.LastID = o.ID
+			chunk.Orders++
+			if buf.Len() >= e.ChunkSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if len(batch) < e.BatchSize {
+			break
+		}
+	}
+	if buf.Len() > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// batch reads the next orders after afterID that match f, with their items.
+func (e *Exporter) batch(ctx context.Context, tx *sql.Tx, f Filter, afterID int64) ([]*orders.Order, error) {
+	var from, to sql.NullTime
+	from.Time, from.Valid = f.From, !f.From.IsZero()
+	to.Time, to.Valid = f.To, !f.To.IsZero()
+	statuses := make([]string, 0, len(f.Statuses))
+	for _, st := range f.Statuses {
+		statuses = append(statuses, string(st))
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, user_id, status, amount_cents, discount_cents, created_at, updated_at
+		FROM orders
+		WHERE id > $1
+		  AND ($2::timestamptz IS NULL OR created_at >= $2)
+		  AND ($3::timestamptz IS NULL OR created_at < $3)
+		  AND ($4 = 0 OR user_id = $4)
+		  AND (cardinality($5::text[]) = 0 OR status = ANY($5))
+		ORDER BY id
+		LIMIT $6
+	`, afterID, from, to, f.UserID, pq.Array(statuses), e.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []*orders.Order
+	byID := make(map[int64]*orders.Order)
+	for rows.Next() {
+		var o orders.Order
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Status, &o.AmountCents, &o.DiscountCents, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		batch = append(batch, &o)
+		byID[o.ID] = &o
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(batch))
+	for _, o := range batch {
+		ids = append(ids, o.ID)
+	}
+	items, err := tx.QueryContext(ctx, `
+		SELECT order_id, sku, quantity, unit_price_cents FROM order_items
+		WHERE order_id = ANY($1) ORDER BY order_id, sku
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+	for items.Next() {
+		var id int64
+		var it orders.Item
+		if err := items.Scan(&id, &it.SKU, &it.Quantity, &it.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		byID[id].Items = append(byID[id].Items, it)
+	}
+	return batch, items.Err()
+}
+
+// encoder writes orders in one format.
+type encoder interface {
+	header() error
+	order(o *orders.Order) error
+}
+
+func newEncoder(format Format, buf *bytes.Buffer) encoder {
+	if format == CSV {
+		return &csvEncoder{w: csv.NewWriter(buf)}
+	}
+	return &jsonlEncoder{enc: json.NewEncoder(buf)}
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{
+	"order_id", "user_id", "status", "amount_cents", "discount_cents", "created_at", "updated_at",
+	"sku", "quantity", "unit_price_cents",
+}
+
+func (c *csvEncoder) header() error {
+	return c.write(csvHeader)
+}
+
+func (c *csvEncoder) order(o *orders.Order) error {
+	head := []string{
+		strconv.FormatInt(o.ID, 10),
+		strconv.FormatInt(int64(o.UserID), 10),
+		string(o.Status),
+		strconv.FormatInt(o.AmountCents, 10),
+		strconv.FormatInt(o.DiscountCents, 10),
+		o.CreatedAt.UTC().Format(time.RFC3339Nano),
+		o.UpdatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if len(o.Items) == 0 {
+		return c.write(append(head, "", "", ""))
+	}
+	for _, it := range o.Items {
+		if err := c.write(append(head[:len(head):len(head)],
+			it.SKU,
+			strconv.FormatInt(int64(it.Quantity), 10),
+			strconv.FormatInt(it.UnitPriceCents, 10),
+		)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvEncoder) write(record []string) error {
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+type jsonItem struct {
+	SKU            string `json:"sku"`
+	Quantity       int32  `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+}
+
+type jsonOrder struct {
+	ID            int64      `json:"order_id"`
+	UserID        int32      `json:"user_id"`
+	Status        string     `json:"status"`
+	AmountCents   int64      `json:"amount_cents"`
+	DiscountCents int64      `json:"discount_cents"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Items         []jsonItem `json:"items"`
+}
+
+func (j *jsonlEncoder) header() error {
+	return nil
+}
+
+func (j *jsonlEncoder) order(o *orders.Order) error {
+	out := jsonOrder{
+		ID:            o.ID,
+		UserID:        o.UserID,
+		Status:        string(o.Status),
+		AmountCents:   o.AmountCents,
+		DiscountCents: o.DiscountCents,
+		CreatedAt:     o.CreatedAt.UTC(),
+		UpdatedAt:     o.UpdatedAt.UTC(),
+		Items:         make([]jsonItem, 0, len(o.Items)),
+	}
+	for _, it := range o.Items {
+		out.Items = append(out.Items, jsonItem{SKU: it.SKU, Quantity: it.Quantity, UnitPriceCents: it.UnitPriceCents})
+	}
+	return j.enc.Encode(out)
+}
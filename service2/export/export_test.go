@@ -0,0 +1,176 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/orders"
+)
+
+func TestEncodersWriteOneOrderPerRowOrItem(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	o := &orders.Order{
+		ID: 7, UserID: 3, Status: orders.StatusConfirmed, AmountCents: 2500,
+		CreatedAt: created, UpdatedAt: created,
+		Items: []orders.Item{
+			{SKU: "MUG", Quantity: 2, UnitPriceCents: 750},
+			{SKU: "TEE, L", Quantity: 1, UnitPriceCents: 1000},
+		},
+	}
+
+	var buf bytes.Buffer
+	enc := newEncoder(CSV, &buf)
+	if err := enc.header(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.order(o); err != nil {
+		t.Fatal(err)
+	}
+	want := "order_id,user_id,status,amount_cents,discount_cents,created_at,updated_at,sku,quantity,unit_price_cents\n" +
+		"7,3,CONFIRMED,2500,0,2024-05-01T08:00:00Z,2024-05-01T08:00:00Z,MUG,2,750\n" +
+		"7,3,CONFIRMED,2500,0,2024-05-01T08:00:00Z,2024-05-01T08:00:00Z,\"TEE, L\",1,1000\n"
+	if got := buf.String(); got != want {
+		t.Errorf("CSV =\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := newEncoder(JSONL, &buf).order(o); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"order_id":7,"user_id":3,"status":"CONFIRMED","amount_cents":2500,"discount_cents":0,` +
+		`"created_at":"2024-05-01T08:00:00Z","updated_at":"2024-05-01T08:00:00Z",` +
+		`"items":[{"sku":"MUG","quantity":2,"unit_price_cents":750},{"sku":"TEE, L","quantity":1,"unit_price_cents":1000}]}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("JSONL =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// createOrders creates n orders of two items each for userID and returns
+// their IDs.
+func createOrders(t *testing.T, db *sql.DB, userID int32, n int) []int64 {
+	t.Helper()
+	ctx := context.Background()
+	store := orders.NewStore(db)
+	var ids []int64
+	for i := 0; i < n; i++ {
+		o := &orders.Order{UserID: userID, Items: []orders.Item{
+			{SKU: "EXPORT-A", Quantity: 1, UnitPriceCents: 100},
+			{SKU: "EXPORT-B", Quantity: 2, UnitPriceCents: 250},
+		}}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Create(ctx, tx, o); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+// exported is what an export emitted: the IDs of its orders in order, and
+// whether it started with the CSV header.
+type exported struct {
+	ids    []int64
+	header bool
+}
+
+// export runs e as CSV and checks that every chunk ends on a whole order.
+func export(t *testing.T, e *Exporter, f Filter, during func(chunk int)) exported {
+	t.Helper()
+	var out exported
+	chunks := 0
+	err := e.Export(context.Background(), CSV, f, func(c Chunk) error {
+		rows, err := csv.NewReader(bytes.NewReader(c.Data)).ReadAll()
+		if err != nil {
+			return err
+		}
+		if chunks == 0 && len(rows) > 0 && slices.Equal(rows[0], csvHeader) {
+			out.header = true
+			rows = rows[1:]
+		}
+		items := make(map[int64]int)
+		var ids []int64
+		for _, row := range rows {
+			id, err := strconv.ParseInt(row[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 || ids[len(ids)-1] != id {
+				ids = append(ids, id)
+			}
+			items[id]++
+		}
+		for id, n := range items {
+			if n != 2 {
+				t.Errorf("chunk %d has %d of the 2 rows of order %d", chunks, n, id)
+			}
+		}
+		if len(ids) != c.Orders || len(ids) == 0 || ids[len(ids)-1] != c.LastID {
+			t.Errorf("chunk %d holds orders %v, reports %d ending at %d", chunks, ids, c.Orders, c.LastID)
+		}
+		out.ids = append(out.ids, ids...)
+		if during != nil {
+			during(chunks)
+		}
+		chunks++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks < 2 {
+		t.Fatalf("export emitted %d chunks, want several", chunks)
+	}
+	return out
+}
+
+func TestExportPagesSnapshotsAndResumes(t *testing.T) {
+	db := testutil.DB(t, orders.Schema)
+	if err := orders.EnsurePartitions(context.Background(), db, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	userID := int32(time.Now().UnixNano()%1_000_000_000) + 1
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM order_items WHERE order_id IN (SELECT id FROM orders WHERE user_id = $1)`, userID)
+		db.Exec(`DELETE FROM orders WHERE user_id = $1`, userID)
+	})
+	ids := createOrders(t, db, userID, 7)
+
+	// Batches of 3 orders, and chunks of about two orders of CSV.
+	e := New(db)
+	e.BatchSize = 3
+	e.ChunkSize = 300
+	f := Filter{UserID: userID}
+
+	// An order placed while the export runs is not part of its snapshot.
+	var added []int64
+	full := export(t, e, f, func(chunk int) {
+		if chunk == 0 {
+			added = createOrders(t, db, userID, 1)
+		}
+	})
+	if !full.header || !slices.Equal(full.ids, ids) {
+		t.Fatalf("export of %v: %+v", ids, full)
+	}
+
+	// Resuming after an order exports the rest, without a header, and now
+	// includes the order added since.
+	f.AfterID = ids[3]
+	resumed := export(t, e, f, nil)
+	if want := append(slices.Clone(ids[4:]), added...); resumed.header || !slices.Equal(resumed.ids, want) {
+		t.Fatalf("export after %d: %+v, want %v without a header", f.AfterID, resumed, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+
+	"service2/export"
+	"service2/orders"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var exportFormats = map[pb.ExportFormat]export.Format{
+	pb.ExportFormat_EXPORT_FORMAT_UNSPECIFIED: export.CSV,
+	pb.ExportFormat_EXPORT_FORMAT_CSV:         export.CSV,
+	pb.ExportFormat_EXPORT_FORMAT_JSONL:       export.JSONL,
+}
+
+var exportStatuses = map[string]orders.Status{
+	string(orders.StatusPending):   orders.StatusPending,
+	string(orders.StatusConfirmed): orders.StatusConfirmed,
+	string(orders.StatusFailed):    orders.StatusFailed,
+	string(orders.StatusCancelled): orders.StatusCancelled,
+	string(orders.StatusDelivered): orders.StatusDelivered,
+}
+
+// ExportOrders streams the orders matching the request in chunks of CSV or
+// JSON Lines.
+func (s *server) ExportOrders(req *pb.ExportOrdersRequest, stream pb.OrderService_ExportOrdersServer) error {
+	logrus.Infof("Received ExportOrders request: format=%s, user_id=%d, statuses=%v, after_id=%d",
+		req.Format, req.UserId, req.Statuses, req.AfterId)
+
+	format, ok := exportFormats[req.Format]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown export format %s", req.Format)
+	}
+	f := export.Filter{UserID: req.UserId, AfterID: req.AfterId}
+	if req.From != nil {
+		f.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		f.To = req.To.AsTime()
+	}
+	for _, raw := range req.Statuses {
+		st, ok := exportStatuses[raw]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown order status %q", raw)
+		}
+		f.Statuses = append(f.Statuses, st)
+	}
+
+	var exported int64
+	err := s.exporter.Export(stream.Context(), format, f, func(c export.Chunk) error {
+		exported += int64(c.Orders)
+		return stream.Send(&pb.ExportChunk{Data: c.Data, LastOrderId: c.LastID, Orders: int32(c.Orders)})
+	})
+	switch {
+	case errors.Is(err, export.ErrInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case err != nil && stream.Context().Err() != nil:
+		return status.FromContextError(stream.Context().Err()).Err()
+	case err != nil:
+		logrus.Errorf("Failed to export orders: %v", err)
+		return status.Error(codes.Internal, "failed to export orders")
+	}
+	logrus.WithField("orders", exported).Info("Exported orders")
+	return nil
+}
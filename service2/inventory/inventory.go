@@ -0,0 +1,85 @@
+// Package inventory reserves stock for orders.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrOutOfStock is returned when a reservation exceeds the available stock.
+var ErrOutOfStock = errors.New("insufficient stock")
+
+// Item is a quantity of one SKU.
+type Item struct {
+	SKU      string
+	Quantity int32
+}
+
+// Inventory reserves and releases stock on behalf of orders. Both operations
+// are keyed by order ID and must be idempotent, because the placement saga
+// repeats a step when it resumes after a crash. Reserve is all-or-nothing
+// across the items.
+type Inventory interface {
+	Reserve(ctx context.Context, orderID int64, items []Item) error
+	Release(ctx context.Context, orderID int64) error
+}
+
+// Local is an in-process Inventory for development and tests. Every SKU
+// starts with the same amount of stock.
+type Local struct {
+	mutex        sync.Mutex
+	initial      int32
+	stock        map[string]int32
+	reservations map[int64][]Item
+}
+
+// NewLocal creates a Local inventory in which every SKU starts with
+// initialStock units.
+func NewLocal(initialStock int32) *Local {
+	return &Local{
+		initial:      initialStock,
+		stock:        make(map[string]int32),
+		reservations: make(map[int64][]Item),
+	}
+}
+
+// Reserve takes the items' quantities for orderID.
+func (l *Local) Reserve(ctx context.Context, orderID int64, items []Item) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.reservations[orderID]; ok {
+		return nil
+	}
+	for _, it := range items {
+		if it.Quantity > l.available(it.SKU) {
+			return fmt.Errorf("%w for %s", ErrOutOfStock, it.SKU)
+		}
+	}
+	for _, it := range items {
+		l.stock[it.SKU] = l.available(it.SKU) - it.Quantity
+	}
+	l.reservations[orderID] = items
+	return nil
+}
+
+// Release returns the stock reserved for orderID.
+func (l *Local) Release(ctx context.Context, orderID int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, it := range l.reservations[orderID] {
+		l.stock[it.SKU] = l.available(it.SKU) + it.Quantity
+	}
+	delete(l.reservations, orderID)
+	return nil
+}
+
+func (l *Local) available(sku string) int32 {
+	if n, ok := l.stock[sku]; ok {
+		return n
+	}
+	return l.initial
+}
@@ -6,8 +6,26 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
+	"pkg/metrics"
+	"pkg/reporter"
+	"service2/analytics"
+	"service2/archive"
+	"service2/cart"
+	"service2/catalog"
+	"service2/consumer"
+	"service2/discounts"
+	"service2/events"
+	"service2/export"
+	"service2/orders"
+	"service2/payment"
+	"service2/returns"
+	"service2/saga"
 	pb "service2/service2/proto" // Import the generated proto package.
+	"service2/subscriptions"
+	"service2/userservice"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -19,8 +37,20 @@ import (
 
 type server struct {
 	pb.UnimplementedOrderServiceServer
-	db          *sql.DB
-	kafkaReader *kafka.Reader
+	db            *sql.DB
+	kafkaReader   *kafka.Reader
+	orders        *orders.Store
+	placer        *orders.Placer
+	catalog       *catalog.Catalog
+	hub           *orders.Hub
+	users         *userservice.Client
+	stats         *analytics.Stats
+	discounts     *discounts.Engine
+	returns       *returns.Service
+	carts         *cart.Store
+	subscriptions *subscriptions.Store
+	archiver      *archive.Archiver
+	exporter      *export.Exporter
 }
 
 func main() {
@@ -45,30 +75,82 @@ func main() {
 		logrus.Fatalf("Failed to connect to Postgres: %v", err)
 	}
 
-	// Ensure the "orders" table exists.
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS orders (
-			id SERIAL PRIMARY KEY,
-			user_id INT,
-			product TEXT
-		)
-	`)
-	if err != nil {
+	// Ensure the "orders" table exists and has the current columns.
+	if _, err := db.Exec(orders.Schema); err != nil {
 		logrus.Fatalf("Failed to create table: %v", err)
 	}
 
+	// Orders tables created before partitioning are converted once, and the
+	// current and coming months need partitions before any order is written.
+	if err := orders.MigrateToPartitions(context.Background(), db); err != nil {
+		logrus.Fatalf("Failed to partition orders table: %v", err)
+	}
+	if err := orders.EnsurePartitions(context.Background(), db, time.Now(), 2); err != nil {
+		logrus.Fatalf("Failed to create orders partitions: %v", err)
+	}
+
+	// Ensure the product catalog and stock tables exist.
+	if _, err := db.Exec(catalog.Schema); err != nil {
+		logrus.Fatalf("Failed to create catalog tables: %v", err)
+	}
+
+	// Ensure the order stats rollups and the trigger maintaining them exist.
+	if _, err := db.Exec(analytics.Schema); err != nil {
+		logrus.Fatalf("Failed to create order stats rollups: %v", err)
+	}
+
+	// Ensure the coupon tables exist.
+	if _, err := db.Exec(discounts.Schema); err != nil {
+		logrus.Fatalf("Failed to create coupon tables: %v", err)
+	}
+
+	// Ensure the tables recording payments and provider calls exist.
+	if _, err := db.Exec(payment.Schema); err != nil {
+		logrus.Fatalf("Failed to create payment tables: %v", err)
+	}
+
+	// Ensure the return tables exist.
+	if _, err := db.Exec(returns.Schema); err != nil {
+		logrus.Fatalf("Failed to create return tables: %v", err)
+	}
+
+	// Ensure the cart tables exist.
+	if _, err := db.Exec(cart.Schema); err != nil {
+		logrus.Fatalf("Failed to create cart tables: %v", err)
+	}
+
+	// Ensure the subscription tables exist.
+	if _, err := db.Exec(subscriptions.Schema); err != nil {
+		logrus.Fatalf("Failed to create subscription tables: %v", err)
+	}
+
+	// Ensure the tables holding placement saga state exist.
+	if _, err := db.Exec(saga.Schema); err != nil {
+		logrus.Fatalf("Failed to create saga tables: %v", err)
+	}
+
+	// Ensure the table recording archived months of orders exists.
+	if _, err := db.Exec(archive.Schema); err != nil {
+		logrus.Fatalf("Failed to create order_archives table: %v", err)
+	}
+
+	// Ensure the table used to deduplicate consumed events exists.
+	if _, err := db.Exec(consumer.Schema); err != nil {
+		logrus.Fatalf("Failed to create processed_events table: %v", err)
+	}
+
 	// Build Kafka address using environment variables.
 	kafkaHost := os.Getenv("KAFKA_HOST")
 	kafkaPort := os.Getenv("KAFKA_PORT")
 	kafkaAddress := fmt.Sprintf("%s:%s", kafkaHost, kafkaPort)
 
 	// Set up Kafka reader to consume messages from the "user-events" topic.
+	// Offsets are committed explicitly once a message has been handled.
 	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers: []string{kafkaAddress},
 		GroupID: "order-service-group",
 		Topic:   "user-events",
 	})
-	go consumeKafkaMessages(kafkaReader)
 
 	// Start the gRPC server.
 	lis, err := net.Listen("tcp", ":50052")
@@ -76,12 +158,164 @@ func main() {
 		logrus.Fatalf("Failed to listen: %v", err)
 	}
 
+	// Domain events such as low stock warnings are published to Kafka.
+	publisher := events.NewKafkaPublisher(kafkaAddress)
+
+	// Stock is reserved from the catalog and payments are made through the
+	// configured provider.
+	provider, err := paymentProvider()
+	if err != nil {
+		logrus.Fatalf("Failed to set up payment provider: %v", err)
+	}
+	productCatalog := catalog.New(db)
+	orderStore := orders.NewStore(db)
+	discountEngine := discounts.New(db)
+	payments := payment.NewService(db, provider)
+	placer := orders.NewPlacer(db, orderStore,
+		catalog.NewInventory(productCatalog, publisher),
+		payments,
+		publisher,
+		discountEngine)
+
+	// Resume placement sagas interrupted by a restart or a failing step.
+	go placer.Sagas().ResumeLoop(context.Background(), 30*time.Second)
+
+	// Carts expire once they have not changed for CART_TTL_HOURS.
+	carts := cart.NewStore(db, publisher, time.Duration(envInt("CART_TTL_HOURS", 7*24))*time.Hour)
+	go carts.ExpireLoop(context.Background(), 5*time.Minute)
+
+	// Months of orders older than ORDER_RETENTION_MONTHS are archived to
+	// ORDER_ARCHIVE_DIR. The directory must be shared when several replicas
+	// run, since any of them may archive or restore a month.
+	archiveDir := os.Getenv("ORDER_ARCHIVE_DIR")
+	if archiveDir == "" {
+		archiveDir = "/var/lib/order-archives"
+	}
+	if err := os.MkdirAll(archiveDir, 0o755); err != nil {
+		logrus.Fatalf("Failed to create archive directory: %v", err)
+	}
+	archiver := archive.New(db, archiveDir)
+	archiver.Retention = envInt("ORDER_RETENTION_MONTHS", archiver.Retention)
+	archiver.RestoreTTL = time.Duration(envInt("ORDER_RESTORE_TTL_HOURS", 7*24)) * time.Hour
+	go archiver.MaintainLoop(context.Background(), time.Hour)
+
+	// Order status changes are announced by Postgres and fanned out to
+	// watchers.
+	hub := orders.NewHub()
+	go func() {
+		if err := hub.Listen(context.Background(), connStr); err != nil {
+			logrus.Errorf("Order status listener stopped: %v", err)
+		}
+	}()
+
+	// Users are verified with the user service when its address is set.
+	var users *userservice.Client
+	if address := os.Getenv("USER_SERVICE_ADDRESS"); address != "" {
+		users, err = userservice.New(userservice.Config{
+			Address: address,
+			Timeout: time.Duration(envInt("USER_SERVICE_TIMEOUT_MS", 500)) * time.Millisecond,
+		})
+		if err != nil {
+			logrus.Fatalf("Failed to create user service client: %v", err)
+		}
+		defer users.Close()
+	} else {
+		logrus.Warn("USER_SERVICE_ADDRESS is not set; orders are placed without verifying users")
+	}
+
 	srv := &server{
-		db:          db,
-		kafkaReader: kafkaReader,
+		db:            db,
+		kafkaReader:   kafkaReader,
+		orders:        orderStore,
+		placer:        placer,
+		catalog:       productCatalog,
+		hub:           hub,
+		users:         users,
+		stats:         analytics.New(db),
+		discounts:     discountEngine,
+		returns:       returns.New(db, orderStore, productCatalog, payments, publisher),
+		carts:         carts,
+		subscriptions: subscriptions.NewStore(db),
+		archiver:      archiver,
+		exporter:      export.New(db),
+	}
+
+	// Subscription orders are placed as their runs fall due. Every replica
+	// runs a scheduler; leases keep them from placing the same run.
+	scheduler := subscriptions.NewScheduler(srv.subscriptions, srv.placeSubscriptionOrder)
+	go scheduler.RunLoop(context.Background(), time.Duration(envInt("SUBSCRIPTION_POLL_SECONDS", 30))*time.Second)
+
+	// Partitions are handled by a pool of workers; messages with the same key
+	// stay on one worker so their relative order is preserved.
+	runner := consumer.NewRunner(kafkaReader, consumer.Idempotent(db, srv.handleUserEvent), consumer.Config{
+		Workers:   envInt("ORDER_CONSUMER_WORKERS", 3),
+		QueueSize: envInt("ORDER_CONSUMER_QUEUE_SIZE", 64),
+	})
+	go func() {
+		if err := runner.Run(context.Background()); err != nil {
+			logrus.Errorf("Kafka consumer stopped: %v", err)
+		}
+	}()
+	go reportConsumerStats(runner)
+
+	// Metrics are served for Prometheus on METRICS_PORT.
+	reg := metrics.New()
+	reg.RegisterDB("orders", db)
+	reg.RegisterKafkaWriter(publisher)
+	reg.RegisterKafkaReader(kafkaReader, "order-service-group")
+	if users != nil {
+		reg.MustRegister(userservice.NewCollector(users))
 	}
+	metricsPort := envInt("METRICS_PORT", 9090)
+	go func() {
+		addr := fmt.Sprintf(":%d", metricsPort)
+		logrus.Infof("Metrics served on %s/metrics", addr)
+		if err := reg.ListenAndServe(addr); err != nil {
+			logrus.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
 
-	grpcServer := grpc.NewServer()
+	unary := []grpc.UnaryServerInterceptor{reg.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{reg.StreamServerInterceptor()}
+
+	// The instance registers with the monitoring service and reports its
+	// request stats there when its address is set.
+	if address := os.Getenv("MONITORING_SERVICE_ADDRESS"); address != "" {
+		rep, err := reporter.New(reporter.Config{Address: address, Service: "order"})
+		if err != nil {
+			logrus.Fatalf("Failed to create metrics reporter: %v", err)
+		}
+		defer rep.Close()
+		go rep.Run(context.Background())
+
+		host, _ := os.Hostname()
+		deps := []reporter.Dependency{
+			{Kind: reporter.KindPostgres, Name: "orders"},
+			{Kind: reporter.KindKafka, Name: "user-events"},
+			{Kind: reporter.KindKafka, Name: events.TopicOrders},
+			{Kind: reporter.KindKafka, Name: events.TopicInventory},
+			{Kind: reporter.KindKafka, Name: events.TopicCarts},
+		}
+		if users != nil {
+			deps = append(deps, reporter.Dependency{Kind: reporter.KindService, Name: "user"})
+		}
+		go rep.Announce(context.Background(), reporter.Announcement{
+			Endpoints: []string{
+				fmt.Sprintf("grpc://%s:50052", host),
+				fmt.Sprintf("http://%s:%d/metrics", host, metricsPort),
+			},
+			Dependencies: deps,
+		})
+		unary = append(unary, rep.UnaryServerInterceptor())
+		stream = append(stream, rep.StreamServerInterceptor())
+	} else {
+		logrus.Warn("MONITORING_SERVICE_ADDRESS is not set; request stats are not reported")
+	}
+
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
 	pb.RegisterOrderServiceServer(grpcServer, srv)
 	reflection.Register(grpcServer)
 	logrus.Info("OrderService gRPC server listening on :50052")
@@ -90,30 +324,57 @@ func main() {
 	}
 }
 
-// CreateOrder writes a new order into Postgres.
-func (s *server) CreateOrder(ctx context.Context, req *pb.CreateOrderRequest) (*pb.CreateOrderResponse, error) {
-	logrus.Infof("Received CreateOrder request: user_id=%d, product=%s", req.UserId, req.Product)
-
-	var id int
-	err := s.db.QueryRowContext(ctx, `
-		INSERT INTO orders (user_id, product)
-		VALUES ($1, $2) RETURNING id
-	`, req.UserId, req.Product).Scan(&id)
-	if err != nil {
-		logrus.Errorf("Failed to insert order: %v", err)
-		return nil, err
+// paymentProvider returns the provider named by PAYMENT_PROVIDER. Only the
+// in-process fake exists so far; PAYMENT_FAKE_SCRIPT scripts its outcomes,
+// e.g. "authorize=DECLINE,SUCCEED;capture=TIMEOUT".
+func paymentProvider() (payment.Provider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "", "fake":
+		fake := payment.NewFake()
+		if err := fake.ParseScript(os.Getenv("PAYMENT_FAKE_SCRIPT")); err != nil {
+			return nil, err
+		}
+		logrus.Warn("Using the fake payment provider")
+		return fake, nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
 	}
-	return &pb.CreateOrderResponse{Id: int32(id)}, nil
 }
 
-// consumeKafkaMessages continuously reads messages from Kafka.
-func consumeKafkaMessages(reader *kafka.Reader) {
-	for {
-		m, err := reader.ReadMessage(context.Background())
-		if err != nil {
-			logrus.Errorf("Failed to read Kafka message: %v", err)
-			continue
+// reportConsumerStats periodically logs per-partition consumer metrics.
+func reportConsumerStats(runner *consumer.Runner) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, stats := range runner.Stats() {
+			logrus.WithFields(logrus.Fields{
+				"topic":                  stats.Topic,
+				"partition":              stats.Partition,
+				"processed":              stats.Processed,
+				"failed":                 stats.Failed,
+				"duplicates":             stats.Duplicates,
+				"dropped":                stats.Dropped,
+				"in_flight":              stats.InFlight,
+				"last_committed_offset":  stats.LastCommittedOffset,
+				"lag":                    stats.Lag,
+				"avg_processing_time_ms": float64(stats.AverageProcessingTime().Microseconds()) / 1000,
+			}).Info("Consumer Metrics")
 		}
-		logrus.Infof("Consumed Kafka message: key=%s, value=%s", string(m.Key), string(m.Value))
 	}
 }
+
+// envInt reads a positive integer from the environment, falling back to def
+// when the variable is unset or invalid.
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v <= 0 {
+		logrus.Warnf("Invalid %s=%q; using default %d", name, raw, def)
+		return def
+	}
+	return v
+}
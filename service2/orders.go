@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"service2/cart"
+	"service2/discounts"
+	"service2/inventory"
+	"service2/orders"
+	"service2/saga"
+	pb "service2/service2/proto"
+	"service2/userservice"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// CreateOrder validates the items against the catalog, writes a new order
+// into Postgres and runs its placement saga. Orders for unknown, inactive or
+// out-of-stock SKUs are rejected without creating an order.
+func (s *server) CreateOrder(ctx context.Context, req *pb.CreateOrderRequest) (*pb.CreateOrderResponse, error) {
+	logrus.Infof("Received CreateOrder request: user_id=%d, product=%s, quantity=%d, items=%d",
+		req.UserId, req.Product, req.Quantity, len(req.Items))
+
+	if err := s.checkUser(ctx, req.UserId); err != nil {
+		return nil, err
+	}
+	items, err := requestedItems(req)
+	if err != nil {
+		return nil, err
+	}
+	prices, err := s.catalog.Quote(ctx, items)
+	if err != nil {
+		return nil, catalogError("quote order", err)
+	}
+	return s.placeOrder(ctx, req.UserId, items, prices, req.CouponCodes, nil)
+}
+
+// placeOrder applies coupons to items at the quoted prices and places the
+// order. within, if set, runs in the transaction that creates the order.
+func (s *server) placeOrder(ctx context.Context, userID int32, items []inventory.Item, prices map[string]int64,
+	couponCodes []string, within func(ctx context.Context, tx *sql.Tx, orderID int64) error) (*pb.CreateOrderResponse, error) {
+	order := &orders.Order{UserID: userID}
+	lines := make([]discounts.Line, 0, len(items))
+	for _, it := range items {
+		order.Items = append(order.Items, orders.Item{
+			SKU:            it.SKU,
+			Quantity:       it.Quantity,
+			UnitPriceCents: prices[it.SKU],
+		})
+		lines = append(lines, discounts.Line{SKU: it.SKU, Quantity: it.Quantity, UnitPriceCents: prices[it.SKU]})
+	}
+	if len(couponCodes) > 0 {
+		applied, err := s.discounts.Apply(ctx, userID, couponCodes, lines)
+		if err != nil {
+			return nil, discountError("apply coupons", err)
+		}
+		for _, a := range applied {
+			order.Discounts = append(order.Discounts, orders.Discount{
+				Code:        a.Code,
+				Kind:        string(a.Kind),
+				AmountCents: a.AmountCents,
+			})
+		}
+	}
+
+	sg, err := s.placer.PlaceWith(ctx, order, within)
+	if errors.Is(err, discounts.ErrLimitReached) || errors.Is(err, discounts.ErrNotApplicable) {
+		return nil, discountError("redeem coupons", err)
+	}
+	if errors.Is(err, cart.ErrChanged) {
+		return nil, cartError("check out cart", err)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to place order: %v", err)
+		return nil, err
+	}
+
+	resp := &pb.CreateOrderResponse{
+		Id:            int32(order.ID),
+		Status:        string(order.Status),
+		SagaId:        sg.ID,
+		Error:         sg.Error,
+		AmountCents:   order.AmountCents,
+		SubtotalCents: order.AmountCents + order.DiscountCents,
+		DiscountCents: order.DiscountCents,
+	}
+	for _, d := range order.Discounts {
+		resp.Discounts = append(resp.Discounts, &pb.AppliedDiscount{
+			Code:        d.Code,
+			Kind:        discountKindToProto[discounts.Kind(d.Kind)],
+			AmountCents: d.AmountCents,
+		})
+	}
+	for _, it := range order.Items {
+		resp.Items = append(resp.Items, &pb.OrderItem{
+			Sku:            it.SKU,
+			Quantity:       it.Quantity,
+			UnitPriceCents: it.UnitPriceCents,
+		})
+	}
+	return resp, nil
+}
+
+// checkUser asks the user service whether the user exists and may place
+// orders. It is skipped when no user service is configured. Orders are
+// refused while the user service cannot answer.
+func (s *server) checkUser(ctx context.Context, userID int32) error {
+	if s.users == nil {
+		return nil
+	}
+	u, err := s.users.GetUser(ctx, userID)
+	switch {
+	case errors.Is(err, userservice.ErrNotFound):
+		return status.Errorf(codes.FailedPrecondition, "user %d does not exist", userID)
+	case errors.Is(err, userservice.ErrUnavailable):
+		logrus.Warnf("Cannot verify user %d: %v", userID, err)
+		return status.Error(codes.Unavailable, "user service is unavailable")
+	case err != nil:
+		logrus.Errorf("Failed to verify user %d: %v", userID, err)
+		return status.Error(codes.Internal, "failed to verify user")
+	case !u.Active():
+		return status.Errorf(codes.FailedPrecondition, "user %d is %s", userID, u.Status)
+	}
+	return nil
+}
+
+// requestedItems returns the order lines of req, merging repeated SKUs.
+// A request without items is a single-item order for req.Product.
+func requestedItems(req *pb.CreateOrderRequest) ([]inventory.Item, error) {
+	lines := req.Items
+	if len(lines) == 0 {
+		lines = []*pb.OrderItem{{Sku: req.Product, Quantity: req.Quantity}}
+		if lines[0].Quantity == 0 {
+			lines[0].Quantity = 1
+		}
+	}
+
+	var items []inventory.Item
+	index := make(map[string]int)
+	for _, line := range lines {
+		if line.Sku == "" {
+			return nil, status.Error(codes.InvalidArgument, "product SKU is required")
+		}
+		if line.Quantity <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "quantity of %s must be positive", line.Sku)
+		}
+		if i, ok := index[line.Sku]; ok {
+			items[i].Quantity += line.Quantity
+			continue
+		}
+		index[line.Sku] = len(items)
+		items = append(items, inventory.Item{SKU: line.Sku, Quantity: line.Quantity})
+	}
+	return items, nil
+}
+
+// GetOrderSaga reports the progress of a placement saga.
+func (s *server) GetOrderSaga(ctx context.Context, req *pb.GetOrderSagaRequest) (*pb.OrderSaga, error) {
+	var (
+		sg  *saga.Saga
+		err error
+	)
+	switch {
+	case req.SagaId != 0:
+		sg, err = s.placer.Sagas().Get(ctx, req.SagaId)
+	case req.OrderId != 0:
+		sg, err = s.placer.Sagas().GetByOrder(ctx, int64(req.OrderId))
+	default:
+		return nil, status.Error(codes.InvalidArgument, "saga_id or order_id is required")
+	}
+	if errors.Is(err, saga.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		logrus.Errorf("Failed to load saga: %v", err)
+		return nil, err
+	}
+	return sagaToProto(sg), nil
+}
+
+// cancelReasons maps the API's reason codes to the ones stored on orders.
+var cancelReasons = map[pb.CancelReason]orders.CancelReason{
+	pb.CancelReason_CANCEL_REASON_CUSTOMER_REQUEST: orders.ReasonCustomerRequest,
+	pb.CancelReason_CANCEL_REASON_FRAUD_SUSPECTED:  orders.ReasonFraudSuspected,
+	pb.CancelReason_CANCEL_REASON_DUPLICATE_ORDER:  orders.ReasonDuplicateOrder,
+	pb.CancelReason_CANCEL_REASON_USER_DELETED:     orders.ReasonUserDeleted,
+	pb.CancelReason_CANCEL_REASON_OTHER:            orders.ReasonOther,
+}
+
+// CancelOrder cancels a pending or confirmed order. Orders that already
+// failed or were cancelled are rejected with FailedPrecondition, and orders
+// whose placement is still finishing with Aborted, to be retried.
+func (s *server) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
+	logrus.Infof("Received CancelOrder request: order_id=%d, reason=%s, actor=%s", req.OrderId, req.Reason, req.Actor)
+
+	reason, ok := cancelReasons[req.Reason]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "a cancellation reason is required")
+	}
+	if req.Actor == "" {
+		return nil, status.Error(codes.InvalidArgument, "actor is required")
+	}
+
+	c, err := s.placer.Cancel(ctx, int64(req.OrderId), reason, req.Actor)
+	switch {
+	case errors.Is(err, orders.ErrNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, orders.ErrStatusConflict):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, saga.ErrNotCompleted):
+		return nil, status.Errorf(codes.Aborted, "order %d is still being placed; retry", req.OrderId)
+	case err != nil:
+		logrus.Errorf("Failed to cancel order %d: %v", req.OrderId, err)
+		return nil, status.Error(codes.Internal, "failed to cancel order")
+	}
+
+	resp := &pb.CancelOrderResponse{
+		OrderId:        int32(c.Order.ID),
+		Status:         string(c.Order.Status),
+		PreviousStatus: string(c.PreviousStatus),
+		Reason:         req.Reason,
+		CancelledBy:    c.Order.CancelledBy,
+		CancelledAt:    timestamppb.New(c.Order.CancelledAt),
+	}
+	if c.Saga != nil {
+		resp.Saga = sagaToProto(c.Saga)
+	}
+	return resp, nil
+}
+
+// MarkOrderDelivered records that a confirmed order was delivered.
+func (s *server) MarkOrderDelivered(ctx context.Context, req *pb.MarkOrderDeliveredRequest) (*pb.MarkOrderDeliveredResponse, error) {
+	o, err := s.orders.MarkDelivered(ctx, int64(req.OrderId))
+	switch {
+	case errors.Is(err, orders.ErrNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, orders.ErrStatusConflict):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		logrus.Errorf("Failed to mark order %d delivered: %v", req.OrderId, err)
+		return nil, status.Error(codes.Internal, "failed to mark order delivered")
+	}
+	logrus.WithField("order_id", o.ID).Info("Order delivered")
+	return &pb.MarkOrderDeliveredResponse{
+		OrderId:     int32(o.ID),
+		Status:      string(o.Status),
+		DeliveredAt: timestamppb.New(o.DeliveredAt),
+	}, nil
+}
+
+func sagaToProto(sg *saga.Saga) *pb.OrderSaga {
+	out := &pb.OrderSaga{
+		Id:        sg.ID,
+		OrderId:   int32(sg.OrderID),
+		Status:    string(sg.Status),
+		Error:     sg.Error,
+		CreatedAt: timestamppb.New(sg.CreatedAt),
+		UpdatedAt: timestamppb.New(sg.UpdatedAt),
+	}
+	for _, st := range sg.Steps {
+		out.Steps = append(out.Steps, &pb.OrderSagaStep{
+			Name:      st.Name,
+			Status:    string(st.Status),
+			Attempts:  int32(st.Attempts),
+			Error:     st.Error,
+			UpdatedAt: timestamppb.New(st.UpdatedAt),
+		})
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"service2/events"
+	"service2/saga"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventOrderCancelled is published to the orders topic when an order is
+// cancelled.
+const EventOrderCancelled = "OrderCancelled"
+
+// OrderCancelled is the payload of an OrderCancelled event.
+type OrderCancelled struct {
+	OrderID        int64        `json:"order_id"`
+	UserID         int32        `json:"user_id"`
+	PreviousStatus Status       `json:"previous_status"`
+	Reason         CancelReason `json:"reason"`
+	Actor          string       `json:"actor"`
+	AmountCents    int64        `json:"amount_cents"`
+	CancelledAt    time.Time    `json:"cancelled_at"`
+}
+
+// Cancellation is the outcome of Cancel.
+type Cancellation struct {
+	Order          *Order
+	PreviousStatus Status
+	// Saga is the placement saga compensating a confirmed order, or nil.
+	Saga *saga.Saga
+}
+
+// ErrCancelled is returned by placement steps once the order was cancelled,
+// which makes the saga compensate what it has done so far.
+var ErrCancelled = errors.New("order was cancelled")
+
+// cancelAttempts bounds how often Cancel retries when the order's status
+// changes under it, e.g. when placement confirms it concurrently, or when
+// a confirmed order's saga has yet to record that it completed.
+const cancelAttempts = 3
+
+// cancelRetryDelay is the wait before retrying a cancellation that found
+// the placement saga still finishing; it grows with each attempt.
+const cancelRetryDelay = 100 * time.Millisecond
+
+// Cancel cancels a pending or confirmed order on behalf of actor.
+//
+// A confirmed order is undone by compensating its completed placement saga:
+// the payment is refunded and the stock released. A pending order is still
+// being placed; its saga notices the cancellation at the next step and
+// compensates itself. Either way the compensation is persisted and resumed
+// after a crash. An order confirmed by a saga that has not yet completed is
+// retried a few times, and then fails with saga.ErrNotCompleted.
+func (p *Placer) Cancel(ctx context.Context, orderID int64, reason CancelReason, actor string) (*Cancellation, error) {
+	var (
+		o    *Order
+		from Status
+		s    *saga.Saga
+		err  error
+	)
+	for attempt := 1; ; attempt++ {
+		if o, err = p.store.Get(ctx, orderID); err != nil {
+			return nil, err
+		}
+		if !o.Status.Open() {
+			return nil, fmt.Errorf("%w: order %d is %s", ErrStatusConflict, orderID, o.Status)
+		}
+		from = o.Status
+		s, err = p.cancel(ctx, o, reason, actor)
+		if attempt == cancelAttempts {
+			break
+		}
+		if errors.Is(err, saga.ErrNotCompleted) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(cancelRetryDelay * time.Duration(attempt)):
+			}
+			continue
+		}
+		if !errors.Is(err, ErrStatusConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"order_id": o.ID,
+		"reason":   reason,
+		"actor":    actor,
+	})
+	log.Info("Order cancelled")
+
+	// The cancellation is committed; undoing the placement must not stop
+	// because the caller went away.
+	runCtx := context.WithoutCancel(ctx)
+	if s != nil {
+		if s, err = p.sagas.Run(runCtx, s.ID); err != nil {
+			log.WithError(err).Error("Compensating cancelled order did not finish; it will be resumed")
+			if s == nil {
+				s, _ = p.sagas.GetByOrder(runCtx, o.ID)
+			}
+		}
+	}
+
+	p.publishCancelled(runCtx, o, from)
+	return &Cancellation{Order: o, PreviousStatus: from, Saga: s}, nil
+}
+
+// cancel records the cancellation and, for a confirmed order, aborts its
+// placement saga in the same transaction.
+func (p *Placer) cancel(ctx context.Context, o *Order, reason CancelReason, actor string) (s *saga.Saga, err error) {
+	from := o.Status
+	if from == StatusConfirmed {
+		if s, err = p.sagas.GetByOrder(ctx, o.ID); err != nil && !errors.Is(err, saga.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	if err = p.store.Cancel(ctx, tx, o, from, reason, actor); err != nil {
+		return nil, err
+	}
+	// Orders confirmed before placement sagas existed have nothing to undo.
+	if s != nil {
+		if err = p.sagas.Abort(ctx, tx, s.ID, "cancelled: "+string(reason)); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *Placer) publishCancelled(ctx context.Context, o *Order, from Status) {
+	if p.publisher == nil {
+		return
+	}
+	ev := OrderCancelled{
+		OrderID:        o.ID,
+		UserID:         o.UserID,
+		PreviousStatus: from,
+		Reason:         o.CancelReason,
+		Actor:          o.CancelledBy,
+		AmountCents:    o.AmountCents,
+		CancelledAt:    o.CancelledAt,
+	}
+	key := strconv.FormatInt(o.ID, 10)
+	if err := p.publisher.Publish(ctx, events.TopicOrders, key, EventOrderCancelled, ev); err != nil {
+		logrus.WithField("order_id", o.ID).WithError(err).Error("Failed to publish order cancelled event")
+	}
+}
@@ -0,0 +1,60 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/inventory"
+	"service2/payment"
+	"service2/saga"
+)
+
+func TestCancelWaitsForPlacementToComplete(t *testing.T) {
+	db := testutil.DB(t, Schema, saga.Schema, payment.Schema)
+	ctx := context.Background()
+	if err := EnsurePartitions(ctx, db, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	userID := int32(time.Now().UnixNano()%1_000_000_000) + 1
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM saga_steps WHERE saga_id IN (SELECT id FROM sagas WHERE order_id IN (SELECT id FROM orders WHERE user_id = $1))`, userID)
+		db.Exec(`DELETE FROM sagas WHERE order_id IN (SELECT id FROM orders WHERE user_id = $1)`, userID)
+		db.Exec(`DELETE FROM order_items WHERE order_id IN (SELECT id FROM orders WHERE user_id = $1)`, userID)
+		db.Exec(`DELETE FROM orders WHERE user_id = $1`, userID)
+	})
+
+	p := NewPlacer(db, NewStore(db), inventory.NewLocal(10), payment.NewService(db, payment.NewFake()), nil, nil)
+	o := &Order{UserID: userID, Items: []Item{{SKU: "CANCEL-A", Quantity: 1, UnitPriceCents: 500}}}
+	s, err := p.Place(ctx, o)
+	if err != nil || o.Status != StatusConfirmed {
+		t.Fatalf("Place: %s, %v", o.Status, err)
+	}
+
+	// The order is confirmed but its saga has not recorded that it
+	// completed, as between the last step and the saga's final write.
+	setSaga := func(status saga.Status) {
+		if _, err := db.Exec(`UPDATE sagas SET status = $2 WHERE id = $1`, s.ID, status); err != nil {
+			t.Error(err)
+		}
+	}
+	setSaga(saga.StatusRunning)
+	if _, err := p.Cancel(ctx, o.ID, ReasonOther, "test"); !errors.Is(err, saga.ErrNotCompleted) {
+		t.Fatalf("Cancel of a saga that never completes: %v, want ErrNotCompleted", err)
+	}
+	if got, err := p.store.Get(ctx, o.ID); err != nil || got.Status != StatusConfirmed {
+		t.Fatalf("order after the failed cancel: %+v, %v", got, err)
+	}
+
+	// Once the saga completes, a retrying Cancel goes through.
+	time.AfterFunc(50*time.Millisecond, func() { setSaga(saga.StatusCompleted) })
+	c, err := p.Cancel(ctx, o.ID, ReasonOther, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Order.Status != StatusCancelled || c.PreviousStatus != StatusConfirmed || c.Saga == nil || c.Saga.Status != saga.StatusCompensated {
+		t.Fatalf("cancellation %+v, saga %+v", c, c.Saga)
+	}
+}
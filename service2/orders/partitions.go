@@ -0,0 +1,217 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The orders table is partitioned by the month of created_at, in UTC. Each
+// month is a table named by PartitionName, so a month can be detached and
+// archived without touching the rest.
+
+const partitionLayout = "orders_2006_01"
+
+// MonthOf returns the start of the UTC month containing t.
+func MonthOf(t time.Time) time.Time {
+	y, m, _ := t.UTC().Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// PartitionName returns the name of the partition holding the orders
+// created in month.
+func PartitionName(month time.Time) string {
+	return MonthOf(month).Format(partitionLayout)
+}
+
+// ParsePartitionName returns the month of a partition named by
+// PartitionName.
+func ParsePartitionName(name string) (time.Time, error) {
+	return time.Parse(partitionLayout, name)
+}
+
+// partitionBounds returns the FOR VALUES clause of month's partition.
+func partitionBounds(month time.Time) string {
+	month = MonthOf(month)
+	return fmt.Sprintf("FROM ('%s') TO ('%s')",
+		month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339))
+}
+
+// EnsurePartitions creates the partitions for the given number of months
+// starting at from that do not exist yet.
+func EnsurePartitions(ctx context.Context, db *sql.DB, from time.Time, months int) error {
+	for i := 0; i < months; i++ {
+		month := MonthOf(from).AddDate(0, i, 0)
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF orders FOR VALUES %s`,
+			PartitionName(month), partitionBounds(month))); err != nil {
+			return fmt.Errorf("creating partition %s: %w", PartitionName(month), err)
+		}
+	}
+	return nil
+}
+
+// AttachedPartitions returns the month of every partition of orders,
+// oldest first.
+func AttachedPartitions(ctx context.Context, db *sql.DB) ([]time.Time, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'orders'::regclass
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var months []time.Time
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		month, err := ParsePartitionName(name)
+		if err != nil {
+			logrus.Warnf("Ignoring orders partition %s: %v", name, err)
+			continue
+		}
+		months = append(months, month)
+	}
+	return months, rows.Err()
+}
+
+// DetachPartition detaches month's partition inside tx. Its orders are no
+// longer visible through the orders table but stay in the partition table.
+func DetachPartition(ctx context.Context, tx *sql.Tx, month time.Time) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE orders DETACH PARTITION %s`, PartitionName(month)))
+	return err
+}
+
+// CreateDetachedPartition creates an empty table shaped like a partition of
+// orders for month, to be filled and then attached with AttachPartition.
+// Rows inserted before it is attached do not fire the triggers of orders.
+func CreateDetachedPartition(ctx context.Context, tx *sql.Tx, month time.Time) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE %s (LIKE orders INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, PartitionName(month)))
+	return err
+}
+
+// AttachPartition attaches month's partition table to orders inside tx.
+func AttachPartition(ctx context.Context, tx *sql.Tx, month time.Time) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE orders ATTACH PARTITION %s FOR VALUES %s`,
+		PartitionName(month), partitionBounds(month)))
+	return err
+}
+
+// MigrateToPartitions converts an orders table created before partitioning
+// into a partitioned one, copying its rows into monthly partitions and
+// moving its triggers. Writes to orders are blocked while it runs. It does
+// nothing once orders is partitioned.
+func MigrateToPartitions(ctx context.Context, db *sql.DB) (err error) {
+	if partitioned, err := isPartitioned(ctx, db); err != nil || partitioned {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, `LOCK TABLE orders IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	// Another instance may have migrated the table while we waited.
+	partitioned, err := isPartitioned(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		return tx.Commit()
+	}
+	logrus.Info("Migrating orders to a partitioned table")
+
+	// The trigger definitions name orders, so once the old table is renamed
+	// and dropped they recreate the triggers on the new one.
+	var triggers []string
+	rows, err := tx.QueryContext(ctx, `
+		SELECT pg_get_triggerdef(oid) FROM pg_trigger WHERE tgrelid = 'orders'::regclass AND NOT tgisinternal
+	`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var def string
+		if err = rows.Scan(&def); err != nil {
+			rows.Close()
+			return err
+		}
+		triggers = append(triggers, def)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		`ALTER TABLE orders RENAME TO orders_unpartitioned`,
+		`ALTER INDEX IF EXISTS orders_user_id_status_idx RENAME TO orders_unpartitioned_user_id_status_idx`,
+		`CREATE TABLE orders (LIKE orders_unpartitioned INCLUDING DEFAULTS INCLUDING CONSTRAINTS)
+			PARTITION BY RANGE (created_at)`,
+		`ALTER TABLE orders ADD PRIMARY KEY (id, created_at)`,
+		`ALTER SEQUENCE orders_id_seq OWNED BY orders.id`,
+		`CREATE INDEX orders_user_id_status_idx ON orders (user_id, status)`,
+	} {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	var first, last time.Time
+	if err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(min(created_at), now()), GREATEST(COALESCE(max(created_at), now()), now())
+		FROM orders_unpartitioned
+	`).Scan(&first, &last); err != nil {
+		return err
+	}
+	for month := MonthOf(first); !month.After(MonthOf(last)); month = month.AddDate(0, 1, 0) {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE %s PARTITION OF orders FOR VALUES %s`,
+			PartitionName(month), partitionBounds(month))); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO orders SELECT * FROM orders_unpartitioned`); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DROP TABLE orders_unpartitioned`); err != nil {
+		return err
+	}
+	// The triggers are recreated after the copy so it does not fire them.
+	for _, def := range triggers {
+		if _, err = tx.ExecContext(ctx, def); err != nil {
+			return fmt.Errorf("moving trigger %q: %w", def, err)
+		}
+	}
+	return tx.Commit()
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func isPartitioned(ctx context.Context, q queryRower) (bool, error) {
+	var partitioned bool
+	err := q.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'orders'::regclass)
+	`).Scan(&partitioned)
+	return partitioned, err
+}
@@ -0,0 +1,94 @@
+package orders
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+)
+
+func TestPartitionsFollowUTCMonths(t *testing.T) {
+	// 2024-03-31 22:00 in New York is already April in UTC.
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	created := time.Date(2024, 3, 31, 22, 0, 0, 0, ny)
+	if got := PartitionName(created); got != "orders_2024_04" {
+		t.Errorf("PartitionName = %s, want orders_2024_04", got)
+	}
+
+	month, err := ParsePartitionName("orders_2024_12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "FROM ('2024-12-01T00:00:00Z') TO ('2025-01-01T00:00:00Z')"
+	if got := partitionBounds(month); got != want {
+		t.Errorf("bounds = %s, want %s", got, want)
+	}
+}
+
+func TestMigrateToPartitions(t *testing.T) {
+	// The orders table as it was created before partitioning, brought up to
+	// date by Schema.
+	db := testutil.IsolatedDB(t, `CREATE TABLE orders (id SERIAL PRIMARY KEY, user_id INT, product TEXT)`, Schema)
+	ctx := context.Background()
+	now := time.Now()
+	old := MonthOf(now).AddDate(0, -2, 0).Add(36 * time.Hour)
+	for _, created := range []time.Time{old, now} {
+		if _, err := db.ExecContext(ctx, `INSERT INTO orders (user_id, product, created_at) VALUES (1, 'SKU', $1)`, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigrateToPartitions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	// Every month from the oldest order's to the current one has a
+	// partition.
+	months, err := AttachedPartitions(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(months) != 3 || !months[0].Equal(MonthOf(old)) || !months[2].Equal(MonthOf(now)) {
+		t.Fatalf("partitions %v", months)
+	}
+	count := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, `SELECT count(*) FROM orders`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(); n != 2 {
+		t.Errorf("%d orders after migrating, want 2", n)
+	}
+
+	// The partitioned table keeps the id sequence and the triggers.
+	var id int64
+	if err := db.QueryRowContext(ctx, `INSERT INTO orders (user_id, product) VALUES (1, 'SKU') RETURNING id`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 {
+		t.Errorf("new order got id %d, want 3", id)
+	}
+	var trigger bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = 'orders'::regclass AND tgname = 'orders_notify_status')
+	`).Scan(&trigger); err != nil {
+		t.Fatal(err)
+	}
+	if !trigger {
+		t.Error("status trigger not moved to the partitioned table")
+	}
+
+	// Once partitioned, migrating again does nothing.
+	if err := MigrateToPartitions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("%d orders after migrating twice, want 3", n)
+	}
+}
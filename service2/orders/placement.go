@@ -0,0 +1,250 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"service2/events"
+	"service2/inventory"
+	"service2/payment"
+	"service2/saga"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PlacementSagaName identifies order placement sagas in the sagas table.
+const PlacementSagaName = "place_order"
+
+// Keys of the saga data shared between placement steps.
+const (
+	dataAuthorizationID = "authorization_id"
+	dataCaptured        = "captured"
+)
+
+// Redeemer records the coupon redemptions of an order. Redeem runs in the
+// transaction that creates the order, so limits are enforced atomically
+// with it; Release gives the redemptions back when placement fails or the
+// order is cancelled, and must be idempotent.
+type Redeemer interface {
+	Redeem(ctx context.Context, tx *sql.Tx, o *Order) error
+	Release(ctx context.Context, orderID int64) error
+}
+
+// Placer creates orders and runs the placement saga for them: the order is
+// created as PENDING, stock is reserved, payment is authorized and finally
+// the payment is captured and the order confirmed.
+type Placer struct {
+	db        *sql.DB
+	store     *Store
+	inventory inventory.Inventory
+	payments  payment.Payments
+	publisher events.Publisher
+	redeemer  Redeemer
+	sagas     *saga.Orchestrator
+}
+
+// NewPlacer wires the placement saga to its collaborators. Order events are
+// announced through publisher and coupons redeemed through redeemer; either
+// may be nil.
+func NewPlacer(db *sql.DB, store *Store, inv inventory.Inventory, pay payment.Payments, publisher events.Publisher, redeemer Redeemer) *Placer {
+	p := &Placer{
+		db:        db,
+		store:     store,
+		inventory: inv,
+		payments:  pay,
+		publisher: publisher,
+		redeemer:  redeemer,
+	}
+	p.sagas = saga.NewOrchestrator(db, saga.Definition{
+		Name: PlacementSagaName,
+		Steps: []saga.Step{
+			{Name: "create_order", Compensate: p.failOrder},
+			{Name: "reserve_inventory", Execute: p.reserveInventory, Compensate: p.releaseInventory},
+			{Name: "authorize_payment", Execute: p.authorizePayment, Compensate: p.voidPayment},
+			{Name: "confirm_order", Execute: p.confirmOrder, Compensate: p.refundPayment},
+		},
+	})
+	return p
+}
+
+// Sagas returns the orchestrator running placement sagas.
+func (p *Placer) Sagas() *saga.Orchestrator {
+	return p.sagas
+}
+
+// Place creates o and runs its placement saga to completion. The order and
+// the saga are recorded in one transaction, so a crash before the saga
+// finishes leaves it to be resumed rather than lost. On return o carries the
+// order's status and the saga its progress.
+func (p *Placer) Place(ctx context.Context, o *Order) (*saga.Saga, error) {
+	return p.PlaceWith(ctx, o, nil)
+}
+
+// PlaceWith is Place, but also runs within in the transaction that creates
+// the order, once the order has its ID. If within fails, no order is
+// created and its error is returned.
+func (p *Placer) PlaceWith(ctx context.Context, o *Order, within func(ctx context.Context, tx *sql.Tx, orderID int64) error) (s *saga.Saga, err error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	if err = p.store.Create(ctx, tx, o); err != nil {
+		return nil, fmt.Errorf("creating order: %w", err)
+	}
+	if len(o.Discounts) > 0 {
+		if p.redeemer == nil {
+			return nil, errors.New("order has discounts but no redeemer is configured")
+		}
+		if err = p.redeemer.Redeem(ctx, tx, o); err != nil {
+			return nil, fmt.Errorf("redeeming coupons: %w", err)
+		}
+	}
+	if within != nil {
+		if err = within(ctx, tx, o.ID); err != nil {
+			return nil, err
+		}
+	}
+	sagaID, err := p.sagas.Start(ctx, tx, o.ID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting placement saga: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The saga must not be abandoned half-way because the client went away.
+	runCtx := context.WithoutCancel(ctx)
+	s, runErr := p.sagas.Run(runCtx, sagaID)
+	if runErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"order_id": o.ID,
+			"saga_id":  sagaID,
+		}).WithError(runErr).Error("Placement saga did not finish; it will be resumed")
+		if s == nil {
+			if s, err = p.sagas.Get(runCtx, sagaID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	o.Status = statusForSaga(s.Status, o.Status)
+	// A cancellation during placement also ends in a compensated saga.
+	if o.Status == StatusFailed {
+		if current, err := p.store.Get(runCtx, o.ID); err == nil {
+			o.Status = current.Status
+		}
+	}
+	return s, nil
+}
+
+func statusForSaga(s saga.Status, current Status) Status {
+	switch s {
+	case saga.StatusCompleted:
+		return StatusConfirmed
+	case saga.StatusCompensated:
+		return StatusFailed
+	}
+	return current
+}
+
+// order loads the saga's order, failing with ErrCancelled once the order
+// was cancelled so that placement stops and compensates.
+func (p *Placer) order(ctx context.Context, s *saga.Saga) (*Order, error) {
+	o, err := p.store.Get(ctx, s.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status == StatusCancelled {
+		return nil, ErrCancelled
+	}
+	return o, nil
+}
+
+// failOrder marks the order FAILED unless it was cancelled, in which case
+// the cancellation is what is being compensated and the status stays.
+// Either way its coupon redemptions are given back.
+func (p *Placer) failOrder(ctx context.Context, s *saga.Saga) error {
+	err := p.store.SetStatus(ctx, s.OrderID, StatusFailed, StatusPending)
+	if errors.Is(err, ErrStatusConflict) {
+		if o, getErr := p.store.Get(ctx, s.OrderID); getErr == nil && o.Status == StatusCancelled {
+			err = nil
+		}
+	}
+	if err != nil || p.redeemer == nil {
+		return err
+	}
+	return p.redeemer.Release(ctx, s.OrderID)
+}
+
+func (p *Placer) reserveInventory(ctx context.Context, s *saga.Saga) error {
+	o, err := p.order(ctx, s)
+	if err != nil {
+		return err
+	}
+	items := make([]inventory.Item, 0, len(o.Items))
+	for _, it := range o.Items {
+		items = append(items, inventory.Item{SKU: it.SKU, Quantity: it.Quantity})
+	}
+	// Orders placed before line items existed have only product/quantity.
+	if len(items) == 0 {
+		items = append(items, inventory.Item{SKU: o.Product, Quantity: o.Quantity})
+	}
+	return p.inventory.Reserve(ctx, o.ID, items)
+}
+
+func (p *Placer) releaseInventory(ctx context.Context, s *saga.Saga) error {
+	return p.inventory.Release(ctx, s.OrderID)
+}
+
+func (p *Placer) authorizePayment(ctx context.Context, s *saga.Saga) error {
+	o, err := p.order(ctx, s)
+	if err != nil {
+		return err
+	}
+	// Keep the ID even on failure: an authorization that timed out may
+	// still have gone through and must then be voided.
+	id, err := p.payments.Authorize(ctx, o.ID, o.UserID, o.AmountCents)
+	if id != "" {
+		s.Data[dataAuthorizationID] = id
+	}
+	return err
+}
+
+func (p *Placer) voidPayment(ctx context.Context, s *saga.Saga) error {
+	id := s.Data[dataAuthorizationID]
+	if id == "" {
+		return nil
+	}
+	return p.payments.Void(ctx, id)
+}
+
+// confirmOrder captures the payment and confirms the order. If the status
+// update fails after the capture succeeded, the step's compensation refunds
+// the capture.
+func (p *Placer) confirmOrder(ctx context.Context, s *saga.Saga) error {
+	if _, err := p.order(ctx, s); err != nil {
+		return err
+	}
+	if err := p.payments.Capture(ctx, s.Data[dataAuthorizationID]); err != nil {
+		return err
+	}
+	s.Data[dataCaptured] = strconv.FormatBool(true)
+	return p.store.SetStatus(ctx, s.OrderID, StatusConfirmed, StatusPending)
+}
+
+func (p *Placer) refundPayment(ctx context.Context, s *saga.Saga) error {
+	if s.Data[dataCaptured] != "true" {
+		return nil
+	}
+	return p.payments.Refund(ctx, s.Data[dataAuthorizationID])
+}
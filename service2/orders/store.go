@@ -0,0 +1,348 @@
+// Package orders stores orders and drives their placement.
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Schema creates the orders table, partitioned by month, and adds the
+// columns introduced after its first version. Tables created before
+// partitioning are converted by MigrateToPartitions.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS orders (
+		id SERIAL,
+		user_id INT,
+		product TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (id, created_at)
+	) PARTITION BY RANGE (created_at);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS quantity INT NOT NULL DEFAULT 1;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS amount_cents BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'CONFIRMED';
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount_cents BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancel_reason TEXT;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancelled_by TEXT;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS orders_user_id_status_idx ON orders (user_id, status);
+	CREATE TABLE IF NOT EXISTS order_items (
+		order_id         BIGINT NOT NULL,
+		sku              TEXT NOT NULL,
+		quantity         INT NOT NULL CHECK (quantity > 0),
+		unit_price_cents BIGINT NOT NULL,
+		PRIMARY KEY (order_id, sku)
+	);
+	CREATE OR REPLACE FUNCTION notify_order_status() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.status IS DISTINCT FROM OLD.status THEN
+			PERFORM pg_notify('` + StatusChannel + `', json_build_object(
+				'order_id', NEW.id,
+				'user_id', NEW.user_id,
+				'status', NEW.status,
+				'previous_status', CASE WHEN TG_OP = 'INSERT' THEN '' ELSE OLD.status END,
+				'updated_at', NEW.updated_at
+			)::text);
+		END IF;
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql;
+	CREATE OR REPLACE TRIGGER orders_notify_status
+		AFTER INSERT OR UPDATE OF status ON orders
+		FOR EACH ROW EXECUTE FUNCTION notify_order_status();
+`
+
+// Status is the lifecycle state of an order.
+type Status string
+
+const (
+	// StatusPending is set when the order is created and placement is in
+	// progress.
+	StatusPending Status = "PENDING"
+	// StatusConfirmed is set once stock is reserved and payment captured.
+	StatusConfirmed Status = "CONFIRMED"
+	// StatusFailed is set when placement failed and was compensated.
+	StatusFailed Status = "FAILED"
+	// StatusCancelled is set when a pending or confirmed order is cancelled.
+	StatusCancelled Status = "CANCELLED"
+	// StatusDelivered is set when a confirmed order reached the customer.
+	// Its items can then be returned, which does not change its status.
+	StatusDelivered Status = "DELIVERED"
+)
+
+// Terminal reports whether an order in this status will not change again.
+func (s Status) Terminal() bool {
+	return s == StatusFailed || s == StatusCancelled || s == StatusDelivered
+}
+
+// Open reports whether an order in this status can still be cancelled.
+func (s Status) Open() bool {
+	return s == StatusPending || s == StatusConfirmed
+}
+
+// CancelReason records why an order was cancelled.
+type CancelReason string
+
+const (
+	ReasonCustomerRequest CancelReason = "CUSTOMER_REQUEST"
+	ReasonFraudSuspected  CancelReason = "FRAUD_SUSPECTED"
+	ReasonDuplicateOrder  CancelReason = "DUPLICATE_ORDER"
+	ReasonUserDeleted     CancelReason = "USER_DELETED"
+	ReasonOther           CancelReason = "OTHER"
+)
+
+// ErrNotFound is returned when an order does not exist.
+var ErrNotFound = errors.New("order not found")
+
+// ErrStatusConflict is returned when an order is not in a state that allows
+// the requested transition.
+var ErrStatusConflict = errors.New("order status does not allow this transition")
+
+// Item is an order line: a quantity of one SKU at the price it was ordered
+// for.
+type Item struct {
+	SKU            string
+	Quantity       int32
+	UnitPriceCents int64
+}
+
+// Discount is an amount taken off an order by a coupon.
+type Discount struct {
+	Code        string
+	Kind        string
+	AmountCents int64
+}
+
+// Order is a row of the orders table with its items. Product and Quantity
+// mirror the first item for clients that predate multi-item orders.
+type Order struct {
+	ID          int64
+	UserID      int32
+	Product     string
+	Quantity    int32
+	AmountCents int64
+	Status      Status
+	Items       []Item
+	// DiscountCents is taken off the items' total to give AmountCents.
+	DiscountCents int64
+	Discounts     []Discount
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+
+	// Set once the order is cancelled.
+	CancelReason CancelReason
+	CancelledBy  string
+	CancelledAt  time.Time
+
+	// Set once the order is delivered.
+	DeliveredAt time.Time
+}
+
+// Store reads and writes orders.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a Store backed by db.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Create inserts o and its items as a PENDING order inside tx and fills in
+// its ID, total and timestamps. The total is the items' total less the
+// discounts.
+func (s *Store) Create(ctx context.Context, tx *sql.Tx, o *Order) error {
+	if len(o.Items) == 0 {
+		return errors.New("order has no items")
+	}
+	o.Status = StatusPending
+	o.Product = o.Items[0].SKU
+	o.Quantity = o.Items[0].Quantity
+	var subtotal int64
+	for _, it := range o.Items {
+		subtotal += int64(it.Quantity) * it.UnitPriceCents
+	}
+	o.DiscountCents = 0
+	for _, d := range o.Discounts {
+		o.DiscountCents += d.AmountCents
+	}
+	if o.DiscountCents > subtotal {
+		return errors.New("discounts exceed the order total")
+	}
+	o.AmountCents = subtotal - o.DiscountCents
+
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO orders (user_id, product, quantity, amount_cents, discount_cents, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at
+	`, o.UserID, o.Product, o.Quantity, o.AmountCents, o.DiscountCents, o.Status).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	for _, it := range o.Items {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO order_items (order_id, sku, quantity, unit_price_cents)
+			VALUES ($1, $2, $3, $4)
+		`, o.ID, it.SKU, it.Quantity, it.UnitPriceCents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const selectOrder = `
+	SELECT id, user_id, product, quantity, amount_cents, discount_cents, status, created_at, updated_at,
+	       COALESCE(cancel_reason, ''), COALESCE(cancelled_by, ''), cancelled_at, delivered_at
+	FROM orders
+`
+
+// Get returns the order with the given ID and its items.
+func (s *Store) Get(ctx context.Context, id int64) (*Order, error) {
+	var o Order
+	var cancelledAt, deliveredAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, selectOrder+` WHERE id = $1`, id).Scan(
+		&o.ID, &o.UserID, &o.Product, &o.Quantity, &o.AmountCents, &o.DiscountCents, &o.Status, &o.CreatedAt, &o.UpdatedAt,
+		&o.CancelReason, &o.CancelledBy, &cancelledAt, &deliveredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.CancelledAt = cancelledAt.Time
+	o.DeliveredAt = deliveredAt.Time
+	if o.Items, err = s.items(ctx, id); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// OpenByUser returns the IDs of the user's pending and confirmed orders.
+func (s *Store) OpenByUser(ctx context.Context, userID int32) ([]int64, error) {
+	open, err := s.OpenStatuses(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(open))
+	for _, c := range open {
+		ids = append(ids, c.OrderID)
+	}
+	return ids, nil
+}
+
+// OpenStatuses returns the current status of each of the user's pending and
+// confirmed orders, oldest first.
+func (s *Store) OpenStatuses(ctx context.Context, userID int32) ([]StatusChange, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, status, updated_at FROM orders
+		WHERE user_id = $1 AND status IN ($2, $3) ORDER BY id
+	`, userID, StatusPending, StatusConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []StatusChange
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.OrderID, &c.UserID, &c.Status, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// Cancel marks the order CANCELLED inside tx, provided it is still in status
+// from, and records who cancelled it and why.
+func (s *Store) Cancel(ctx context.Context, tx *sql.Tx, o *Order, from Status, reason CancelReason, actor string) error {
+	err := tx.QueryRowContext(ctx, `
+		UPDATE orders SET status = $3, cancel_reason = $4, cancelled_by = $5,
+			cancelled_at = now(), updated_at = now()
+		WHERE id = $1 AND status = $2
+		RETURNING cancelled_at, updated_at
+	`, o.ID, from, StatusCancelled, reason, actor).Scan(&o.CancelledAt, &o.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: order %d is no longer %s", ErrStatusConflict, o.ID, from)
+	}
+	if err != nil {
+		return err
+	}
+	o.Status = StatusCancelled
+	o.CancelReason = reason
+	o.CancelledBy = actor
+	return nil
+}
+
+// MarkDelivered moves a confirmed order to DELIVERED and records when.
+// Marking a delivered order again returns it unchanged.
+func (s *Store) MarkDelivered(ctx context.Context, id int64) (*Order, error) {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE orders SET status = $2, delivered_at = now(), updated_at = now()
+		WHERE id = $1 AND status = $3
+	`, id, StatusDelivered, StatusConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	o, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status != StatusDelivered {
+		return nil, fmt.Errorf("%w: order %d is %s", ErrStatusConflict, id, o.Status)
+	}
+	return o, nil
+}
+
+func (s *Store) items(ctx context.Context, orderID int64) ([]Item, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT sku, quantity, unit_price_cents FROM order_items
+		WHERE order_id = $1 ORDER BY sku
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.SKU, &it.Quantity, &it.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// SetStatus moves an order to status to, provided its current status is one
+// of from. Setting the status it already has is a no-op, so retried steps
+// stay idempotent.
+func (s *Store) SetStatus(ctx context.Context, id int64, to Status, from ...Status) error {
+	allowed := make([]string, 0, len(from)+1)
+	allowed = append(allowed, string(to))
+	for _, st := range from {
+		allowed = append(allowed, string(st))
+	}
+
+	var current Status
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE orders SET status = $2, updated_at = now()
+		WHERE id = $1 AND status = ANY($3)
+		RETURNING status
+	`, id, to, pq.Array(allowed)).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, getErr := s.Get(ctx, id); errors.Is(getErr, ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("%w: cannot move order %d to %s", ErrStatusConflict, id, to)
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package orders
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// StatusChannel is the Postgres notification channel on which the orders
+// table announces status changes. The notification is sent on commit, so
+// watchers see changes made by every instance of the service.
+const StatusChannel = "order_status"
+
+// watchBuffer is how many changes a subscriber may fall behind before it is
+// dropped.
+const watchBuffer = 64
+
+var (
+	// ErrWatchLagging ends a subscription that did not keep up with changes.
+	ErrWatchLagging = errors.New("order watcher fell behind")
+	// ErrWatchInterrupted ends subscriptions when changes may have been missed,
+	// e.g. while the notification connection was re-established.
+	ErrWatchInterrupted = errors.New("order watch interrupted")
+)
+
+// StatusChange is a transition of one order's status. PreviousStatus is
+// empty for a newly created order.
+type StatusChange struct {
+	OrderID        int64     `json:"order_id"`
+	UserID         int32     `json:"user_id"`
+	Status         Status    `json:"status"`
+	PreviousStatus Status    `json:"previous_status"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Subscription delivers the status changes of an order or of a user's
+// orders. C is closed when the subscription ends; Err then tells why.
+type Subscription struct {
+	C <-chan StatusChange
+
+	c       chan StatusChange
+	hub     *Hub
+	orderID int64
+	userID  int32
+	err     error
+}
+
+// Err returns why the subscription ended, or nil while it is active or when
+// it was closed by its owner.
+func (s *Subscription) Err() error {
+	s.hub.mutex.RLock()
+	defer s.hub.mutex.RUnlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.remove(s, nil)
+}
+
+// Hub fans order status changes out to subscribers.
+type Hub struct {
+	mutex   sync.RWMutex
+	byOrder map[int64]map[*Subscription]struct{}
+	byUser  map[int32]map[*Subscription]struct{}
+}
+
+// NewHub creates a Hub without subscribers.
+func NewHub() *Hub {
+	return &Hub{
+		byOrder: make(map[int64]map[*Subscription]struct{}),
+		byUser:  make(map[int32]map[*Subscription]struct{}),
+	}
+}
+
+// WatchOrder subscribes to the changes of one order.
+func (h *Hub) WatchOrder(orderID int64) *Subscription {
+	return h.add(&Subscription{orderID: orderID})
+}
+
+// WatchUser subscribes to the changes of all orders of a user.
+func (h *Hub) WatchUser(userID int32) *Subscription {
+	return h.add(&Subscription{userID: userID})
+}
+
+func (h *Hub) add(s *Subscription) *Subscription {
+	s.hub = h
+	s.c = make(chan StatusChange, watchBuffer)
+	s.C = s.c
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if s.orderID != 0 {
+		addTo(h.byOrder, s.orderID, s)
+	} else {
+		addTo(h.byUser, s.userID, s)
+	}
+	return s
+}
+
+func (h *Hub) remove(s *Subscription, reason error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.removeLocked(s, reason)
+}
+
+func (h *Hub) removeLocked(s *Subscription, reason error) {
+	var removed bool
+	if s.orderID != 0 {
+		removed = removeFrom(h.byOrder, s.orderID, s)
+	} else {
+		removed = removeFrom(h.byUser, s.userID, s)
+	}
+	if removed {
+		s.err = reason
+		close(s.c)
+	}
+}
+
+// Publish delivers a change to the subscribers of its order and user.
+// Subscribers whose buffer is full are dropped with ErrWatchLagging rather
+// than holding up everyone else.
+func (h *Hub) Publish(c StatusChange) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var lagging []*Subscription
+	for _, subs := range []map[*Subscription]struct{}{h.byOrder[c.OrderID], h.byUser[c.UserID]} {
+		for s := range subs {
+			select {
+			case s.c <- c:
+			default:
+				lagging = append(lagging, s)
+			}
+		}
+	}
+	for _, s := range lagging {
+		h.removeLocked(s, ErrWatchLagging)
+	}
+}
+
+// interrupt ends every subscription with ErrWatchInterrupted.
+func (h *Hub) interrupt() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, subs := range h.byOrder {
+		for s := range subs {
+			h.removeLocked(s, ErrWatchInterrupted)
+		}
+	}
+	for _, subs := range h.byUser {
+		for s := range subs {
+			h.removeLocked(s, ErrWatchInterrupted)
+		}
+	}
+}
+
+// Listen feeds the hub from Postgres notifications on StatusChannel until
+// ctx is cancelled. When the connection drops, notifications may be lost,
+// so all subscriptions are ended and clients are expected to subscribe again
+// and read the current state. If listening fails, for instance because
+// Postgres is not up yet, it is retried with a backoff of up to a minute.
+func (h *Hub) Listen(ctx context.Context, connStr string) error {
+	backoff := time.Second
+	for {
+		err := h.listen(ctx, connStr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logrus.WithError(err).Warnf("Order status listener failed, retrying in %v", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// listen publishes notifications until ctx is cancelled. Once it listens on
+// StatusChannel, pq reconnects by itself, so it only fails before that.
+func (h *Hub) listen(ctx context.Context, connStr string) error {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logrus.WithError(err).Warn("Order status listener connection event")
+		}
+	})
+	defer listener.Close()
+	// Listen waits for the first connection, which ctx has to be able to
+	// interrupt.
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	if err := listener.Listen(StatusChannel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			// A nil notification signals a reconnect.
+			if n == nil {
+				h.interrupt()
+				continue
+			}
+			var c StatusChange
+			if err := json.Unmarshal([]byte(n.Extra), &c); err != nil {
+				logrus.WithError(err).Warnf("Ignoring malformed order status notification %q", n.Extra)
+				continue
+			}
+			h.Publish(c)
+		case <-time.After(90 * time.Second):
+			// Check the connection now and then; pq reconnects on failure.
+			go listener.Ping()
+		}
+	}
+}
+
+func addTo[K comparable](index map[K]map[*Subscription]struct{}, key K, s *Subscription) {
+	subs, ok := index[key]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		index[key] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+func removeFrom[K comparable](index map[K]map[*Subscription]struct{}, key K, s *Subscription) bool {
+	subs := index[key]
+	if _, ok := subs[s]; !ok {
+		return false
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(index, key)
+	}
+	return true
+}
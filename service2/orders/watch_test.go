@@ -0,0 +1,82 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHubFansOutByOrderAndUser(t *testing.T) {
+	h := NewHub()
+	byOrder := h.WatchOrder(1)
+	byUser := h.WatchUser(7)
+	other := h.WatchOrder(2)
+	defer byOrder.Close()
+	defer byUser.Close()
+	defer other.Close()
+
+	h.Publish(StatusChange{OrderID: 1, UserID: 7, Status: StatusConfirmed})
+
+	for _, sub := range []*Subscription{byOrder, byUser} {
+		select {
+		case c := <-sub.C:
+			if c.OrderID != 1 || c.Status != StatusConfirmed {
+				t.Fatalf("got %+v", c)
+			}
+		default:
+			t.Fatal("subscriber did not receive the change")
+		}
+	}
+	select {
+	case c := <-other.C:
+		t.Fatalf("unrelated subscriber received %+v", c)
+	default:
+	}
+}
+
+func TestHubDropsLaggingSubscriber(t *testing.T) {
+	h := NewHub()
+	sub := h.WatchOrder(1)
+
+	for i := 0; i <= watchBuffer; i++ {
+		h.Publish(StatusChange{OrderID: 1, Status: StatusPending})
+	}
+
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != watchBuffer {
+		t.Fatalf("received %d buffered changes, want %d", n, watchBuffer)
+	}
+	if !errors.Is(sub.Err(), ErrWatchLagging) {
+		t.Fatalf("Err() = %v, want ErrWatchLagging", sub.Err())
+	}
+	// Closing an ended subscription is harmless.
+	sub.Close()
+}
+
+func TestHubListenWaitsForPostgresUntilCancelled(t *testing.T) {
+	// Nothing listens on port 1, so the listener keeps trying to connect.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewHub().Listen(ctx, "host=127.0.0.1 port=1 user=x dbname=x sslmode=disable connect_timeout=1")
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Listen gave up without Postgres: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Listen = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not return once cancelled")
+	}
+}
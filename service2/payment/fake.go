@@ -0,0 +1,222 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Outcome is the scripted result of one Fake call.
+type Outcome string
+
+const (
+	// Succeed performs the operation.
+	Succeed Outcome = "SUCCEED"
+	// Decline refuses the operation. Repeating the idempotency key returns
+	// the decline again.
+	Decline Outcome = "DECLINE"
+	// Timeout fails with ErrTimeout without performing the operation.
+	Timeout Outcome = "TIMEOUT"
+	// TimeoutAfterApply performs the operation but fails with ErrTimeout, as
+	// when the provider's response is lost. Repeating the idempotency key
+	// returns the result.
+	TimeoutAfterApply Outcome = "TIMEOUT_AFTER_APPLY"
+)
+
+// FakeCall is a call received by a Fake.
+type FakeCall struct {
+	Operation      string
+	IdempotencyKey string
+	Ref            string
+	Outcome        Outcome
+	// Replayed is set when the key had been seen and the recorded result was
+	// returned.
+	Replayed bool
+}
+
+type fakeState int
+
+const (
+	fakeAuthorized fakeState = iota
+	fakeCaptured
+	fakeVoided
+	fakeRefunded
+)
+
+// fakePayment is the provider-side state of one authorization.
+type fakePayment struct {
+	state         fakeState
+	capturedCents int64
+	refundedCents int64
+}
+
+type fakeResult struct {
+	ref string
+	err error
+}
+
+// Fake is a deterministic in-process Provider for development and tests.
+// Calls succeed unless outcomes were scripted for their operation, which are
+// then used one per call in order. Results are remembered by idempotency
+// key, like a real provider.
+type Fake struct {
+	mutex   sync.Mutex
+	script  map[string][]Outcome
+	results map[string]fakeResult
+	states  map[string]*fakePayment
+	calls   []FakeCall
+	nextRef int
+}
+
+// NewFake creates a Fake on which every call succeeds.
+func NewFake() *Fake {
+	return &Fake{
+		script:  make(map[string][]Outcome),
+		results: make(map[string]fakeResult),
+		states:  make(map[string]*fakePayment),
+	}
+}
+
+// Name implements Provider.
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Script queues outcomes for the next calls of an operation (OpAuthorize,
+// OpCapture, OpVoid or OpRefund). Replayed idempotency keys do not consume
+// outcomes.
+func (f *Fake) Script(op string, outcomes ...Outcome) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.script[op] = append(f.script[op], outcomes...)
+}
+
+// ParseScript configures a Fake from a string such as
+// "authorize=DECLINE,SUCCEED;capture=TIMEOUT".
+func (f *Fake) ParseScript(script string) error {
+	for _, part := range strings.Split(script, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		op, list, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("invalid fake payment script %q", part)
+		}
+		switch op {
+		case OpAuthorize, OpCapture, OpVoid, OpRefund:
+		default:
+			return fmt.Errorf("unknown payment operation %q", op)
+		}
+		for _, o := range strings.Split(list, ",") {
+			switch outcome := Outcome(strings.ToUpper(strings.TrimSpace(o))); outcome {
+			case Succeed, Decline, Timeout, TimeoutAfterApply:
+				f.Script(op, outcome)
+			default:
+				return fmt.Errorf("unknown payment outcome %q", o)
+			}
+		}
+	}
+	return nil
+}
+
+// Calls returns the calls received so far.
+func (f *Fake) Calls() []FakeCall {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
+
+// Authorize implements Provider.
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	return f.do(OpAuthorize, req.IdempotencyKey, "", func() (string, error) {
+		f.nextRef++
+		ref := fmt.Sprintf("fake-auth-%d", f.nextRef)
+		f.states[ref] = &fakePayment{state: fakeAuthorized}
+		return ref, nil
+	})
+}
+
+// Capture implements Provider.
+func (f *Fake) Capture(ctx context.Context, key, ref string, amountCents int64) error {
+	_, err := f.do(OpCapture, key, ref, f.transition(ref, fakeCaptured, fakeAuthorized, func(p *fakePayment) {
+		p.capturedCents = amountCents
+	}))
+	return err
+}
+
+// Void implements Provider.
+func (f *Fake) Void(ctx context.Context, key, ref string) error {
+	_, err := f.do(OpVoid, key, ref, f.transition(ref, fakeVoided, fakeAuthorized, nil))
+	return err
+}
+
+// Refund implements Provider. A capture can be refunded in several parts
+// until the captured amount is used up.
+func (f *Fake) Refund(ctx context.Context, key, ref string, amountCents int64) error {
+	_, err := f.do(OpRefund, key, ref, func() (string, error) {
+		p, ok := f.states[ref]
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrUnknownAuthorization, ref)
+		}
+		if p.state != fakeCaptured || p.refundedCents+amountCents > p.capturedCents {
+			return "", fmt.Errorf("%w: %s", ErrInvalidState, ref)
+		}
+		p.refundedCents += amountCents
+		if p.refundedCents == p.capturedCents {
+			p.state = fakeRefunded
+		}
+		return ref, nil
+	})
+	return err
+}
+
+func (f *Fake) transition(ref string, to, from fakeState, update func(*fakePayment)) func() (string, error) {
+	return func() (string, error) {
+		p, ok := f.states[ref]
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrUnknownAuthorization, ref)
+		}
+		if p.state != from {
+			return "", fmt.Errorf("%w: %s", ErrInvalidState, ref)
+		}
+		p.state = to
+		if update != nil {
+			update(p)
+		}
+		return ref, nil
+	}
+}
+
+// do runs apply according to the next scripted outcome of op, replaying the
+// recorded result when key was seen before.
+func (f *Fake) do(op, key, ref string, apply func() (string, error)) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r, ok := f.results[key]; ok {
+		f.calls = append(f.calls, FakeCall{Operation: op, IdempotencyKey: key, Ref: r.ref, Replayed: true})
+		return r.ref, r.err
+	}
+
+	outcome := Succeed
+	if queue := f.script[op]; len(queue) > 0 {
+		outcome, f.script[op] = queue[0], queue[1:]
+	}
+	f.calls = append(f.calls, FakeCall{Operation: op, IdempotencyKey: key, Ref: ref, Outcome: outcome})
+
+	switch outcome {
+	case Decline:
+		f.results[key] = fakeResult{err: ErrDeclined}
+		return "", ErrDeclined
+	case Timeout:
+		return "", ErrTimeout
+	}
+	newRef, err := apply()
+	f.results[key] = fakeResult{ref: newRef, err: err}
+	if outcome == TimeoutAfterApply {
+		return "", ErrTimeout
+	}
+	return newRef, err
+}
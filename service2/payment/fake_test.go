@@ -0,0 +1,64 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeScriptAndIdempotency(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake()
+	if err := f.ParseScript("authorize=TIMEOUT_AFTER_APPLY,DECLINE; capture=TIMEOUT"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first authorization takes effect but its response is lost; the
+	// retry with the same key returns the original reference.
+	req := AuthorizeRequest{IdempotencyKey: "order-1-authorize", OrderID: 1, AmountCents: 500}
+	if _, err := f.Authorize(ctx, req); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("first authorize: err = %v, want ErrTimeout", err)
+	}
+	ref, err := f.Authorize(ctx, req)
+	if err != nil || ref != "fake-auth-1" {
+		t.Fatalf("retried authorize = %q, %v", ref, err)
+	}
+
+	// The next scripted outcome applies to a new key and is remembered.
+	declined := AuthorizeRequest{IdempotencyKey: "order-2-authorize", OrderID: 2, AmountCents: 500}
+	for i := 0; i < 2; i++ {
+		if _, err := f.Authorize(ctx, declined); !errors.Is(err, ErrDeclined) {
+			t.Fatalf("authorize %d: err = %v, want ErrDeclined", i, err)
+		}
+	}
+
+	// A plain timeout does not take effect, so the retry captures.
+	if err := f.Capture(ctx, "payment-1-capture", ref, 500); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("first capture: err = %v, want ErrTimeout", err)
+	}
+	if err := f.Capture(ctx, "payment-1-capture", ref, 500); err != nil {
+		t.Fatalf("retried capture: %v", err)
+	}
+	if err := f.Void(ctx, "payment-1-void", ref); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("void after capture: err = %v, want ErrInvalidState", err)
+	}
+	if err := f.Refund(ctx, "return-1-refund", ref, 200); err != nil {
+		t.Fatalf("partial refund: %v", err)
+	}
+	if err := f.Refund(ctx, "return-2-refund", ref, 400); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("refund beyond capture: err = %v, want ErrInvalidState", err)
+	}
+	if err := f.Refund(ctx, "payment-1-refund", ref, 300); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+
+	var replayed int
+	for _, c := range f.Calls() {
+		if c.Replayed {
+			replayed++
+		}
+	}
+	if replayed != 2 {
+		t.Fatalf("replayed %d calls, want 2", replayed)
+	}
+}
@@ -0,0 +1,60 @@
+// Package payment authorizes and settles payments for orders.
+//
+// Order placement talks to Payments, implemented by Service, which records
+// every payment and every call to the payment provider in Postgres. The
+// provider itself sits behind the Provider interface.
+package payment
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrDeclined is returned when the payment provider refuses an
+	// authorization.
+	ErrDeclined = errors.New("payment declined")
+	// ErrUnknownAuthorization is returned for operations on an authorization
+	// that does not exist.
+	ErrUnknownAuthorization = errors.New("unknown payment authorization")
+	// ErrTimeout is returned when the provider did not answer in time. The
+	// operation may or may not have taken effect.
+	ErrTimeout = errors.New("payment provider timed out")
+	// ErrInvalidState is returned for operations the payment's state does
+	// not allow, such as voiding a captured payment.
+	ErrInvalidState = errors.New("payment state does not allow this operation")
+)
+
+// Payments is the payment API used by order placement. Authorize is keyed by
+// order ID and returns the same authorization when repeated; the other
+// operations are no-ops when the authorization is already in the requested
+// state. Authorize returns the authorization ID even when it fails, if one
+// was assigned, so that an authorization whose outcome is unknown can still
+// be voided.
+type Payments interface {
+	Authorize(ctx context.Context, orderID int64, userID int32, amountCents int64) (authorizationID string, err error)
+	Capture(ctx context.Context, authorizationID string) error
+	Void(ctx context.Context, authorizationID string) error
+	Refund(ctx context.Context, authorizationID string) error
+}
+
+// AuthorizeRequest asks a provider to reserve an amount.
+type AuthorizeRequest struct {
+	IdempotencyKey string
+	OrderID        int64
+	UserID         int32
+	AmountCents    int64
+}
+
+// Provider is a payment gateway. Every call carries an idempotency key, and
+// a provider must return the original result without acting again when a
+// key is reused. That makes it safe to retry calls that timed out.
+type Provider interface {
+	// Name identifies the provider in the payments table.
+	Name() string
+	// Authorize reserves an amount and returns the provider's reference.
+	Authorize(ctx context.Context, req AuthorizeRequest) (ref string, err error)
+	Capture(ctx context.Context, idempotencyKey, ref string, amountCents int64) error
+	Void(ctx context.Context, idempotencyKey, ref string) error
+	Refund(ctx context.Context, idempotencyKey, ref string, amountCents int64) error
+}
@@ -0,0 +1,466 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the payments table, holding one payment per order, the
+// payment_attempts table, holding every call made to the provider, and the
+// payment_refunds table, holding the partial refunds of each payment.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS payments (
+		id           BIGSERIAL PRIMARY KEY,
+		order_id     BIGINT NOT NULL UNIQUE,
+		user_id      INT NOT NULL,
+		amount_cents BIGINT NOT NULL,
+		provider     TEXT NOT NULL,
+		provider_ref TEXT NOT NULL DEFAULT '',
+		status       TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS payment_attempts (
+		id              BIGSERIAL PRIMARY KEY,
+		payment_id      BIGINT NOT NULL REFERENCES payments (id),
+		operation       TEXT NOT NULL,
+		idempotency_key TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		provider_ref    TEXT NOT NULL DEFAULT '',
+		error           TEXT NOT NULL DEFAULT '',
+		started_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		finished_at     TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS payment_attempts_payment_id_idx ON payment_attempts (payment_id);
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS refunded_cents BIGINT NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS payment_refunds (
+		payment_id      BIGINT NOT NULL REFERENCES payments (id),
+		idempotency_key TEXT NOT NULL,
+		amount_cents    BIGINT NOT NULL CHECK (amount_cents > 0),
+		status          TEXT NOT NULL,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		refunded_at     TIMESTAMPTZ,
+		PRIMARY KEY (payment_id, idempotency_key)
+	);
+`
+
+// Status is the state of a payment.
+type Status string
+
+const (
+	// StatusPending is set until the authorization's outcome is known.
+	StatusPending    Status = "PENDING"
+	StatusAuthorized Status = "AUTHORIZED"
+	StatusDeclined   Status = "DECLINED"
+	// StatusCaptured stays set while the payment is partially refunded.
+	StatusCaptured Status = "CAPTURED"
+	StatusVoided   Status = "VOIDED"
+	// StatusRefunded is set once the captured amount is refunded in full.
+	StatusRefunded Status = "REFUNDED"
+)
+
+// Attempt statuses.
+const (
+	attemptPending   = "PENDING"
+	attemptSucceeded = "SUCCEEDED"
+	attemptDeclined  = "DECLINED"
+	attemptFailed    = "FAILED"
+)
+
+// Provider operations, as recorded in payment_attempts.
+const (
+	OpAuthorize = "authorize"
+	OpCapture   = "capture"
+	OpVoid      = "void"
+	OpRefund    = "refund"
+)
+
+// Service implements Payments on top of a Provider. Authorization IDs are
+// payment IDs.
+type Service struct {
+	db       *sql.DB
+	provider Provider
+
+	// Timeout bounds each provider call.
+	Timeout time.Duration
+	// Attempts is how often a call that timed out is tried with the same
+	// idempotency key before giving up.
+	Attempts int
+}
+
+// NewService creates a Service that records payments in db and makes them
+// with provider.
+func NewService(db *sql.DB, provider Provider) *Service {
+	return &Service{
+		db:       db,
+		provider: provider,
+		Timeout:  5 * time.Second,
+		Attempts: 3,
+	}
+}
+
+type payment struct {
+	id            int64
+	orderID       int64
+	userID        int32
+	amountCents   int64
+	refundedCents int64
+	providerRef   string
+	status        Status
+}
+
+// Authorize reserves amountCents for orderID. Repeating it returns the
+// existing authorization.
+func (s *Service) Authorize(ctx context.Context, orderID int64, userID int32, amountCents int64) (string, error) {
+	var p payment
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO payments (order_id, user_id, amount_cents, provider, status)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (order_id) DO UPDATE SET updated_at = now()
+		RETURNING id, order_id, user_id, amount_cents, refunded_cents, provider_ref, status
+	`, orderID, userID, amountCents, s.provider.Name(), StatusPending).Scan(
+		&p.id, &p.orderID, &p.userID, &p.amountCents, &p.refundedCents, &p.providerRef, &p.status)
+	if err != nil {
+		return "", err
+	}
+	id := strconv.FormatInt(p.id, 10)
+
+	switch p.status {
+	case StatusPending:
+		return id, s.authorize(ctx, &p)
+	case StatusAuthorized, StatusCaptured:
+		return id, nil
+	case StatusDeclined:
+		return id, ErrDeclined
+	}
+	return id, fmt.Errorf("%w: payment %d is %s", ErrInvalidState, p.id, p.status)
+}
+
+// authorize asks the provider to authorize a pending payment. It is also
+// used to learn the outcome of an earlier attempt that timed out: the same
+// idempotency key returns the original result.
+func (s *Service) authorize(ctx context.Context, p *payment) error {
+	req := AuthorizeRequest{
+		IdempotencyKey: fmt.Sprintf("order-%d-authorize", p.orderID),
+		OrderID:        p.orderID,
+		UserID:         p.userID,
+		AmountCents:    p.amountCents,
+	}
+	var ref string
+	err := s.call(ctx, p, OpAuthorize, req.IdempotencyKey, func(ctx context.Context) (string, error) {
+		var err error
+		ref, err = s.provider.Authorize(ctx, req)
+		return ref, err
+	})
+	switch {
+	case err == nil:
+		return s.transition(ctx, p, StatusAuthorized, ref, StatusPending)
+	case errors.Is(err, ErrDeclined):
+		if tErr := s.transition(ctx, p, StatusDeclined, "", StatusPending); tErr != nil {
+			return tErr
+		}
+	}
+	return err
+}
+
+// Capture settles an authorization.
+func (s *Service) Capture(ctx context.Context, authorizationID string) error {
+	p, err := s.get(ctx, authorizationID)
+	if err != nil {
+		return err
+	}
+	if p.status == StatusCaptured {
+		return nil
+	}
+	if p.status != StatusAuthorized {
+		return fmt.Errorf("%w: cannot capture payment %d in status %s", ErrInvalidState, p.id, p.status)
+	}
+	key := fmt.Sprintf("payment-%d-capture", p.id)
+	if err := s.call(ctx, p, OpCapture, key, func(ctx context.Context) (string, error) {
+		return p.providerRef, s.provider.Capture(ctx, key, p.providerRef, p.amountCents)
+	}); err != nil {
+		return err
+	}
+	return s.transition(ctx, p, StatusCaptured, "", StatusAuthorized)
+}
+
+// Void releases an authorization that has not been captured. Voiding a
+// payment that was declined, voided or refunded is a no-op. A payment whose
+// authorization outcome is unknown is resolved first.
+func (s *Service) Void(ctx context.Context, authorizationID string) error {
+	p, err := s.get(ctx, authorizationID)
+	if err != nil {
+		return err
+	}
+	if p.status == StatusPending {
+		err := s.authorize(ctx, p)
+		if errors.Is(err, ErrDeclined) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch p.status {
+	case StatusDeclined, StatusVoided, StatusRefunded:
+		return nil
+	case StatusCaptured:
+		return fmt.Errorf("%w: cannot void captured payment %d", ErrInvalidState, p.id)
+	}
+	key := fmt.Sprintf("payment-%d-void", p.id)
+	if err := s.call(ctx, p, OpVoid, key, func(ctx context.Context) (string, error) {
+		return p.providerRef, s.provider.Void(ctx, key, p.providerRef)
+	}); err != nil {
+		return err
+	}
+	return s.transition(ctx, p, StatusVoided, "", StatusAuthorized)
+}
+
+// Refund returns what is left of a captured payment after any partial
+// refunds.
+func (s *Service) Refund(ctx context.Context, authorizationID string) error {
+	p, err := s.get(ctx, authorizationID)
+	if err != nil {
+		return err
+	}
+	if p.status == StatusRefunded {
+		return nil
+	}
+	if p.status != StatusCaptured {
+		return fmt.Errorf("%w: cannot refund payment %d in status %s", ErrInvalidState, p.id, p.status)
+	}
+	key := fmt.Sprintf("payment-%d-refund", p.id)
+	remaining := p.amountCents - p.refundedCents
+	if err := s.call(ctx, p, OpRefund, key, func(ctx context.Context) (string, error) {
+		return p.providerRef, s.provider.Refund(ctx, key, p.providerRef, remaining)
+	}); err != nil {
+		return err
+	}
+	return s.transition(ctx, p, StatusRefunded, "", StatusCaptured)
+}
+
+// RefundPartial refunds amountCents of the captured payment of orderID.
+// Refunds are identified by idempotencyKey: repeating one returns without
+// refunding again, and one that was interrupted is completed with the same
+// key at the provider. The payment becomes REFUNDED once nothing is left.
+func (s *Service) RefundPartial(ctx context.Context, orderID int64, idempotencyKey string, amountCents int64) error {
+	if amountCents <= 0 {
+		return fmt.Errorf("refund amount must be positive, got %d", amountCents)
+	}
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM payments WHERE order_id = $1`, orderID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no payment for order %d", ErrUnknownAuthorization, orderID)
+	}
+	if err != nil {
+		return err
+	}
+	p, err := s.get(ctx, strconv.FormatInt(id, 10))
+	if err != nil {
+		return err
+	}
+
+	status, recorded, err := s.startRefund(ctx, p, idempotencyKey, amountCents)
+	switch {
+	case err != nil:
+		return err
+	case status == attemptSucceeded:
+		return nil
+	case recorded != amountCents:
+		return fmt.Errorf("%w: refund %q was started for %d, not %d", ErrInvalidState, idempotencyKey, recorded, amountCents)
+	}
+
+	if err := s.call(ctx, p, OpRefund, idempotencyKey, func(ctx context.Context) (string, error) {
+		return p.providerRef, s.provider.Refund(ctx, idempotencyKey, p.providerRef, amountCents)
+	}); err != nil {
+		return err
+	}
+	return s.completeRefund(ctx, p, idempotencyKey, amountCents)
+}
+
+// startRefund returns the status and amount of the refund with key, first
+// recording it as pending if it is new. The payment row is locked while a
+// new refund is checked, and refunds still pending count against what is
+// left, so concurrent refunds cannot together exceed the captured amount.
+func (s *Service) startRefund(ctx context.Context, p *payment, key string, amountCents int64) (string, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `
+		SELECT amount_cents, refunded_cents, status FROM payments WHERE id = $1 FOR UPDATE
+	`, p.id).Scan(&p.amountCents, &p.refundedCents, &p.status); err != nil {
+		return "", 0, err
+	}
+	var status string
+	var recorded int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, amount_cents FROM payment_refunds WHERE payment_id = $1 AND idempotency_key = $2
+	`, p.id, key).Scan(&status, &recorded)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return status, recorded, err
+	}
+
+	if p.status != StatusCaptured {
+		return "", 0, fmt.Errorf("%w: cannot refund payment %d in status %s", ErrInvalidState, p.id, p.status)
+	}
+	var pending int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount_cents), 0) FROM payment_refunds WHERE payment_id = $1 AND status = $2
+	`, p.id, attemptPending).Scan(&pending); err != nil {
+		return "", 0, err
+	}
+	if left := p.amountCents - p.refundedCents - pending; amountCents > left {
+		return "", 0, fmt.Errorf("%w: refunding %d would exceed the %d left of payment %d",
+			ErrInvalidState, amountCents, left, p.id)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_refunds (payment_id, idempotency_key, amount_cents, status)
+		VALUES ($1, $2, $3, $4)
+	`, p.id, key, amountCents, attemptPending); err != nil {
+		return "", 0, err
+	}
+	return attemptPending, amountCents, tx.Commit()
+}
+
+// completeRefund marks a partial refund as done and adds it to the payment
+// in one transaction, so a refund is counted exactly once.
+func (s *Service) completeRefund(ctx context.Context, p *payment, key string, amountCents int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE payment_refunds SET status = $3, refunded_at = now()
+		WHERE payment_id = $1 AND idempotency_key = $2 AND status = $4
+	`, p.id, key, attemptSucceeded, attemptPending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		// Completed concurrently by a retry of the same refund.
+		return nil
+	}
+	// The payment may have been refunded in full meanwhile; the refund is
+	// then left pending rather than counted beyond the captured amount.
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payments SET
+			refunded_cents = refunded_cents + $2,
+			status = CASE WHEN refunded_cents + $2 >= amount_cents THEN $3 ELSE status END,
+			updated_at = now()
+		WHERE id = $1 AND refunded_cents + $2 <= amount_cents
+		RETURNING refunded_cents, status
+	`, p.id, amountCents, StatusRefunded).Scan(&p.refundedCents, &p.status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: refunding %d would exceed the amount of payment %d", ErrInvalidState, amountCents, p.id)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Service) get(ctx context.Context, authorizationID string) (*payment, error) {
+	id, err := strconv.ParseInt(authorizationID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAuthorization, authorizationID)
+	}
+	var p payment
+	err = s.db.QueryRowContext(ctx, `
+		SELECT id, order_id, user_id, amount_cents, refunded_cents, provider_ref, status FROM payments WHERE id = $1
+	`, id).Scan(&p.id, &p.orderID, &p.userID, &p.amountCents, &p.refundedCents, &p.providerRef, &p.status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownAuthorization, id)
+	}
+	return &p, err
+}
+
+// transition moves p to status to if it is still in status from, storing
+// the provider reference when one is given.
+func (s *Service) transition(ctx context.Context, p *payment, to Status, ref string, from Status) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE payments SET status = $2, provider_ref = COALESCE(NULLIF($3, ''), provider_ref),
+			refunded_cents = CASE WHEN $2 = $5 THEN amount_cents ELSE refunded_cents END,
+			updated_at = now()
+		WHERE id = $1 AND status = $4
+	`, p.id, to, ref, from, StatusRefunded)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: payment %d is no longer %s", ErrInvalidState, p.id, from)
+	}
+	p.status = to
+	if ref != "" {
+		p.providerRef = ref
+	}
+	return nil
+}
+
+// call makes one provider operation, retrying it with the same idempotency
+// key while it times out, and records every attempt.
+func (s *Service) call(ctx context.Context, p *payment, op, key string, fn func(ctx context.Context) (string, error)) error {
+	var err error
+	for attempt := 1; attempt <= s.Attempts; attempt++ {
+		var attemptID int64
+		if err := s.db.QueryRowContext(ctx, `
+			INSERT INTO payment_attempts (payment_id, operation, idempotency_key, status)
+			VALUES ($1, $2, $3, $4) RETURNING id
+		`, p.id, op, key, attemptPending).Scan(&attemptID); err != nil {
+			return err
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, s.Timeout)
+		var ref string
+		ref, err = fn(callCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = ErrTimeout
+		}
+
+		status := attemptSucceeded
+		switch {
+		case errors.Is(err, ErrDeclined):
+			status = attemptDeclined
+		case err != nil:
+			status = attemptFailed
+		}
+		if _, dbErr := s.db.ExecContext(ctx, `
+			UPDATE payment_attempts SET status = $2, provider_ref = $3, error = $4, finished_at = now()
+			WHERE id = $1
+		`, attemptID, status, ref, errorText(err)); dbErr != nil {
+			logrus.WithField("attempt_id", attemptID).WithError(dbErr).Error("Failed to record payment attempt")
+		}
+
+		if !errors.Is(err, ErrTimeout) {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"payment_id": p.id,
+			"operation":  op,
+			"attempt":    attempt,
+		}).Warn("Payment provider timed out; retrying with the same idempotency key")
+	}
+	return err
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+)
+
+func TestConcurrentPartialRefundsDoNotExceedCapture(t *testing.T) {
+	db := testutil.DB(t, Schema)
+	ctx := context.Background()
+	fake := NewFake()
+	s := NewService(db, fake)
+
+	orderID := time.Now().UnixNano()
+	id, err := s.Authorize(ctx, orderID, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Capture(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two refunds of 60 of a 100 payment: only one may go through.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.RefundPartial(ctx, orderID, fmt.Sprintf("return-%d-refund", i), 60)
+		}()
+	}
+	wg.Wait()
+
+	var succeeded int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrInvalidState):
+			t.Fatalf("refund: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d refunds succeeded, want 1 (errors %v)", succeeded, errs)
+	}
+
+	var refunded int64
+	if err := db.QueryRow(`SELECT refunded_cents FROM payments WHERE order_id = $1`, orderID).Scan(&refunded); err != nil {
+		t.Fatal(err)
+	}
+	if refunded != 60 {
+		t.Fatalf("refunded_cents = %d, want 60", refunded)
+	}
+	var calls int
+	for _, c := range fake.Calls() {
+		if c.Operation == OpRefund {
+			calls++
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("provider got %d refunds, want 1", calls)
+	}
+}
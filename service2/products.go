@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"service2/catalog"
+	"service2/inventory"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultProductPageSize = 50
+	maxProductPageSize     = 500
+	defaultLowStockLevel   = 10
+	defaultReturnWindow    = 30
+)
+
+// CreateProduct adds a product to the catalog with its initial stock.
+func (s *server) CreateProduct(ctx context.Context, req *pb.CreateProductRequest) (*pb.Product, error) {
+	if req.Sku == "" || req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "sku and name are required")
+	}
+	if req.PriceCents < 0 || req.InitialStock < 0 || req.GetLowStockThreshold() < 0 || req.GetReturnWindowDays() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "price, stock, threshold and return window must not be negative")
+	}
+	threshold := int32(defaultLowStockLevel)
+	if req.LowStockThreshold != nil {
+		threshold = req.GetLowStockThreshold()
+	}
+	returnWindow := int32(defaultReturnWindow)
+	if req.ReturnWindowDays != nil {
+		returnWindow = req.GetReturnWindowDays()
+	}
+
+	p := &catalog.Product{
+		SKU:               req.Sku,
+		Name:              req.Name,
+		PriceCents:        req.PriceCents,
+		Active:            !req.Inactive,
+		Stock:             req.InitialStock,
+		LowStockThreshold: threshold,
+		ReturnWindowDays:  returnWindow,
+	}
+	if err := s.catalog.Create(ctx, p); err != nil {
+		return nil, catalogError("create product", err)
+	}
+	logrus.WithField("sku", p.SKU).Info("Product created")
+	return productToProto(p), nil
+}
+
+// GetProduct returns a product with its stock.
+func (s *server) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	p, err := s.catalog.Get(ctx, req.Sku)
+	if err != nil {
+		return nil, catalogError("get product", err)
+	}
+	return productToProto(p), nil
+}
+
+// UpdateProduct changes the fields set in the request.
+func (s *server) UpdateProduct(ctx context.Context, req *pb.UpdateProductRequest) (*pb.Product, error) {
+	if req.PriceCents != nil && req.GetPriceCents() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "price must not be negative")
+	}
+	if req.Name != nil && req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name must not be empty")
+	}
+	if req.ReturnWindowDays != nil && req.GetReturnWindowDays() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "return window must not be negative")
+	}
+	p, err := s.catalog.Update(ctx, req.Sku, catalog.ProductUpdate{
+		Name:             req.Name,
+		PriceCents:       req.PriceCents,
+		Active:           req.Active,
+		ReturnWindowDays: req.ReturnWindowDays,
+	})
+	if err != nil {
+		return nil, catalogError("update product", err)
+	}
+	return productToProto(p), nil
+}
+
+// DeleteProduct deactivates a product so it can no longer be ordered.
+func (s *server) DeleteProduct(ctx context.Context, req *pb.DeleteProductRequest) (*pb.DeleteProductResponse, error) {
+	if err := s.catalog.Delete(ctx, req.Sku); err != nil {
+		return nil, catalogError("delete product", err)
+	}
+	logrus.WithField("sku", req.Sku).Info("Product deactivated")
+	return &pb.DeleteProductResponse{}, nil
+}
+
+// ListProducts pages through the catalog in SKU order. The page token is
+// the last SKU of the previous page.
+func (s *server) ListProducts(ctx context.Context, req *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	size := int(req.PageSize)
+	if size <= 0 {
+		size = defaultProductPageSize
+	}
+	size = min(size, maxProductPageSize)
+
+	products, err := s.catalog.List(ctx, req.PageToken, size, req.IncludeInactive)
+	if err != nil {
+		return nil, catalogError("list products", err)
+	}
+	resp := &pb.ListProductsResponse{}
+	for _, p := range products {
+		resp.Products = append(resp.Products, productToProto(p))
+	}
+	if len(products) == size {
+		resp.NextPageToken = products[len(products)-1].SKU
+	}
+	return resp, nil
+}
+
+// SetStock overwrites the stock level of a SKU.
+func (s *server) SetStock(ctx context.Context, req *pb.SetStockRequest) (*pb.StockLevel, error) {
+	if req.Quantity < 0 {
+		return nil, status.Error(codes.InvalidArgument, "quantity must not be negative")
+	}
+	threshold := int32(-1)
+	if req.LowStockThreshold != nil {
+		if req.GetLowStockThreshold() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "threshold must not be negative")
+		}
+		threshold = req.GetLowStockThreshold()
+	}
+	lvl, err := s.catalog.SetStock(ctx, req.Sku, req.Quantity, threshold)
+	if err != nil {
+		return nil, catalogError("set stock", err)
+	}
+	return stockToProto(lvl), nil
+}
+
+// AdjustStock adds or removes units of a SKU.
+func (s *server) AdjustStock(ctx context.Context, req *pb.AdjustStockRequest) (*pb.StockLevel, error) {
+	lvl, err := s.catalog.AdjustStock(ctx, req.Sku, req.Delta)
+	if err != nil {
+		return nil, catalogError("adjust stock", err)
+	}
+	return stockToProto(lvl), nil
+}
+
+// catalogError maps catalog and inventory errors to gRPC status codes.
+func catalogError(op string, err error) error {
+	switch {
+	case errors.Is(err, catalog.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, catalog.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, catalog.ErrInactive), errors.Is(err, inventory.ErrOutOfStock):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func productToProto(p *catalog.Product) *pb.Product {
+	return &pb.Product{
+		Sku:               p.SKU,
+		Name:              p.Name,
+		PriceCents:        p.PriceCents,
+		Active:            p.Active,
+		Stock:             p.Stock,
+		LowStockThreshold: p.LowStockThreshold,
+		ReturnWindowDays:  p.ReturnWindowDays,
+		CreatedAt:         timestamppb.New(p.CreatedAt),
+		UpdatedAt:         timestamppb.New(p.UpdatedAt),
+	}
+}
+
+func stockToProto(lvl *catalog.StockLevel) *pb.StockLevel {
+	return &pb.StockLevel{
+		Sku:               lvl.SKU,
+		Quantity:          lvl.Quantity,
+		LowStockThreshold: lvl.LowStockThreshold,
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"service2/catalog"
+	"service2/inventory"
+	"service2/orders"
+	"service2/returns"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RequestReturn opens a return of items of a delivered order.
+func (s *server) RequestReturn(ctx context.Context, req *pb.RequestReturnRequest) (*pb.Return, error) {
+	logrus.Infof("Received RequestReturn request: order_id=%d, items=%d, actor=%s", req.OrderId, len(req.Items), req.Actor)
+
+	if req.Actor == "" {
+		return nil, status.Error(codes.InvalidArgument, "actor is required")
+	}
+	if len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one item is required")
+	}
+	r, err := s.returns.Request(ctx, int64(req.OrderId), returnItems(req.Items), req.Reason, req.Actor)
+	if err != nil {
+		return nil, returnError("request return", err)
+	}
+	return returnToProto(r), nil
+}
+
+// ApproveReturn accepts a requested return.
+func (s *server) ApproveReturn(ctx context.Context, req *pb.ApproveReturnRequest) (*pb.Return, error) {
+	if req.Actor == "" {
+		return nil, status.Error(codes.InvalidArgument, "actor is required")
+	}
+	r, err := s.returns.Approve(ctx, req.ReturnId, req.Actor)
+	if err != nil {
+		return nil, returnError("approve return", err)
+	}
+	return returnToProto(r), nil
+}
+
+// ReceiveReturn restocks the items of an approved return and refunds them.
+func (s *server) ReceiveReturn(ctx context.Context, req *pb.ReceiveReturnRequest) (*pb.Return, error) {
+	r, err := s.returns.Receive(ctx, req.ReturnId, returnItems(req.Items))
+	if err != nil {
+		return nil, returnError("receive return", err)
+	}
+	return returnToProto(r), nil
+}
+
+func returnItems(lines []*pb.OrderItem) []inventory.Item {
+	items := make([]inventory.Item, 0, len(lines))
+	for _, line := range lines {
+		items = append(items, inventory.Item{SKU: line.Sku, Quantity: line.Quantity})
+	}
+	return items
+}
+
+// returnError maps return errors to gRPC status codes.
+func returnError(op string, err error) error {
+	switch {
+	case errors.Is(err, returns.ErrNotFound), errors.Is(err, orders.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, returns.ErrInvalidReturn), errors.Is(err, returns.ErrQuantityExceeded):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, returns.ErrNotReturnable), errors.Is(err, returns.ErrStatusConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, returns.ErrRefundFailed):
+		logrus.Errorf("Failed to %s: %v", op, err)
+		return status.Error(codes.Unavailable, "the items were received but the refund failed; retry to refund them")
+	case errors.Is(err, catalog.ErrNotFound):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func returnToProto(r *returns.Return) *pb.Return {
+	out := &pb.Return{
+		Id:          r.ID,
+		OrderId:     int32(r.OrderID),
+		UserId:      r.UserID,
+		Status:      string(r.Status),
+		Reason:      r.Reason,
+		RequestedBy: r.RequestedBy,
+		ApprovedBy:  r.ApprovedBy,
+		RefundCents: r.RefundCents,
+		CreatedAt:   timestamppb.New(r.CreatedAt),
+		ApprovedAt:  optionalTimestamp(r.ApprovedAt),
+		ReceivedAt:  optionalTimestamp(r.ReceivedAt),
+		RefundedAt:  optionalTimestamp(r.RefundedAt),
+	}
+	for _, it := range r.Items {
+		out.Items = append(out.Items, &pb.ReturnItem{
+			Sku:              it.SKU,
+			Quantity:         it.Quantity,
+			ReceivedQuantity: it.ReceivedQuantity,
+			UnitPriceCents:   it.UnitPriceCents,
+		})
+	}
+	return out
+}
+
+// optionalTimestamp leaves times that are not set yet out of responses.
+func optionalTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
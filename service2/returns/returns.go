@@ -0,0 +1,600 @@
+// Package returns runs the returns (RMA) workflow for delivered orders.
+//
+// A customer requests to return some quantity of any of an order's lines
+// while their products' return windows are open. Once the return is
+// approved and the items arrive, they are put back into stock and the share
+// of the order's payment they account for is refunded.
+package returns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"service2/catalog"
+	"service2/events"
+	"service2/inventory"
+	"service2/orders"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the returns and return_items tables.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS returns (
+		id           BIGSERIAL PRIMARY KEY,
+		order_id     BIGINT NOT NULL,
+		user_id      INT NOT NULL,
+		status       TEXT NOT NULL,
+		reason       TEXT NOT NULL DEFAULT '',
+		requested_by TEXT NOT NULL,
+		approved_by  TEXT,
+		refund_cents BIGINT NOT NULL DEFAULT 0,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		approved_at  TIMESTAMPTZ,
+		received_at  TIMESTAMPTZ,
+		refunded_at  TIMESTAMPTZ,
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS returns_order_id_idx ON returns (order_id);
+	CREATE TABLE IF NOT EXISTS return_items (
+		return_id         BIGINT NOT NULL REFERENCES returns (id),
+		sku               TEXT NOT NULL,
+		quantity          INT NOT NULL CHECK (quantity > 0),
+		received_quantity INT CHECK (received_quantity >= 0 AND received_quantity <= quantity),
+		unit_price_cents  BIGINT NOT NULL,
+		PRIMARY KEY (return_id, sku)
+	);
+`
+
+// Status is the state of a return.
+type Status string
+
+const (
+	// StatusRequested is set when the customer asks to return items.
+	StatusRequested Status = "REQUESTED"
+	// StatusApproved is set once the return is accepted and the items can
+	// be sent back.
+	StatusApproved Status = "APPROVED"
+	// StatusReceived is set when the items arrived and were restocked; the
+	// refund is still to be made.
+	StatusReceived Status = "RECEIVED"
+	// StatusRefunded is set once the refund was made.
+	StatusRefunded Status = "REFUNDED"
+)
+
+// Events published to the orders topic as a return progresses. All of them
+// carry a ReturnUpdated payload.
+const (
+	EventReturnRequested = "ReturnRequested"
+	EventReturnApproved  = "ReturnApproved"
+	EventReturnReceived  = "ReturnReceived"
+	EventReturnRefunded  = "ReturnRefunded"
+)
+
+var (
+	// ErrNotFound is returned when a return does not exist.
+	ErrNotFound = errors.New("return not found")
+	// ErrNotReturnable is returned when the order is not delivered or the
+	// return window of one of the items has closed.
+	ErrNotReturnable = errors.New("items cannot be returned")
+	// ErrInvalidReturn is returned for items that are malformed or not part
+	// of the order or return.
+	ErrInvalidReturn = errors.New("invalid return")
+	// ErrQuantityExceeded is returned when more units of a line would be
+	// returned than were ordered.
+	ErrQuantityExceeded = errors.New("return quantity exceeds the quantity ordered")
+	// ErrStatusConflict is returned when a return is not in a state that
+	// allows the requested transition.
+	ErrStatusConflict = errors.New("return status does not allow this transition")
+	// ErrRefundFailed is returned when a received return could not be
+	// refunded. Receiving it again retries the refund.
+	ErrRefundFailed = errors.New("refund failed")
+)
+
+// Item is a returned quantity of one order line.
+type Item struct {
+	SKU      string
+	Quantity int32
+	// ReceivedQuantity is how many units arrived; set once the return is
+	// received.
+	ReceivedQuantity int32
+	UnitPriceCents   int64
+}
+
+// Return is a row of the returns table with its items.
+type Return struct {
+	ID          int64
+	OrderID     int64
+	UserID      int32
+	Status      Status
+	Reason      string
+	RequestedBy string
+	ApprovedBy  string
+	// RefundCents is set when the return is received.
+	RefundCents int64
+	Items       []Item
+	CreatedAt   time.Time
+	ApprovedAt  time.Time
+	ReceivedAt  time.Time
+	RefundedAt  time.Time
+}
+
+// ReturnUpdated is the payload of the return events.
+type ReturnUpdated struct {
+	ReturnID    int64       `json:"return_id"`
+	OrderID     int64       `json:"order_id"`
+	UserID      int32       `json:"user_id"`
+	Status      Status      `json:"status"`
+	Items       []EventItem `json:"items"`
+	RefundCents int64       `json:"refund_cents"`
+	Actor       string      `json:"actor,omitempty"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// EventItem is a line of a ReturnUpdated event.
+type EventItem struct {
+	SKU              string `json:"sku"`
+	Quantity         int32  `json:"quantity"`
+	ReceivedQuantity int32  `json:"received_quantity"`
+}
+
+// Refunder refunds part of an order's payment. Refunds are identified by an
+// idempotency key, and repeating one must not refund twice.
+type Refunder interface {
+	RefundPartial(ctx context.Context, orderID int64, idempotencyKey string, amountCents int64) error
+}
+
+// Service stores returns and moves them through their workflow.
+type Service struct {
+	db        *sql.DB
+	orders    *orders.Store
+	catalog   *catalog.Catalog
+	refunder  Refunder
+	publisher events.Publisher
+}
+
+// New creates a Service that restocks returned items into the catalog and
+// refunds them through refunder. Return events are announced through
+// publisher, which may be nil.
+func New(db *sql.DB, store *orders.Store, c *catalog.Catalog, refunder Refunder, publisher events.Publisher) *Service {
+	return &Service{
+		db:        db,
+		orders:    store,
+		catalog:   c,
+		refunder:  refunder,
+		publisher: publisher,
+	}
+}
+
+// Request opens a return of items of a delivered order on behalf of actor.
+// Every item must be within its product's return window, and no line may be
+// returned beyond the quantity ordered across all of the order's returns.
+func (s *Service) Request(ctx context.Context, orderID int64, items []inventory.Item, reason, actor string) (r *Return, err error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no items", ErrInvalidReturn)
+	}
+	o, err := s.orders.Get(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status != orders.StatusDelivered {
+		return nil, fmt.Errorf("%w: order %d is %s, not %s", ErrNotReturnable, orderID, o.Status, orders.StatusDelivered)
+	}
+	lines := orderLines(o)
+	ordered := make(map[string]int32, len(lines))
+	prices := make(map[string]int64, len(lines))
+	for _, it := range lines {
+		ordered[it.SKU] = it.Quantity
+		prices[it.SKU] = it.UnitPriceCents
+	}
+	if err := checkQuantities(ordered, nil, items); err != nil {
+		return nil, err
+	}
+	if err := s.checkWindows(ctx, o, items); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	// Returns of one order are serialized on the order's row, so two of them
+	// cannot both take the last units of a line.
+	if err = lockOrder(ctx, tx, orderID); err != nil {
+		return nil, err
+	}
+	returned, err := returnedQuantities(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkQuantities(ordered, returned, items); err != nil {
+		return nil, err
+	}
+
+	r = &Return{
+		OrderID:     orderID,
+		UserID:      o.UserID,
+		Status:      StatusRequested,
+		Reason:      reason,
+		RequestedBy: actor,
+	}
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO returns (order_id, user_id, status, reason, requested_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, r.OrderID, r.UserID, r.Status, r.Reason, r.RequestedBy).Scan(&r.ID, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		item := Item{SKU: it.SKU, Quantity: it.Quantity, UnitPriceCents: prices[it.SKU]}
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO return_items (return_id, sku, quantity, unit_price_cents)
+			VALUES ($1, $2, $3, $4)
+		`, r.ID, item.SKU, item.Quantity, item.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		r.Items = append(r.Items, item)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.logger(r).WithField("actor", actor).Info("Return requested")
+	s.publish(ctx, r, EventReturnRequested, actor, r.CreatedAt)
+	return r, nil
+}
+
+// checkWindows fails with ErrNotReturnable if the return window of any of
+// the items has closed.
+func (s *Service) checkWindows(ctx context.Context, o *orders.Order, items []inventory.Item) error {
+	skus := make([]string, 0, len(items))
+	for _, it := range items {
+		skus = append(skus, it.SKU)
+	}
+	products, err := s.catalog.Lookup(ctx, skus)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, it := range items {
+		p, ok := products[it.SKU]
+		if !ok {
+			return fmt.Errorf("%w: %s is not in the catalog", ErrNotReturnable, it.SKU)
+		}
+		if end := deadline(o.DeliveredAt, p.ReturnWindowDays); !now.Before(end) {
+			return fmt.Errorf("%w: the return window of %s closed at %s", ErrNotReturnable, it.SKU, end.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Approve accepts a requested return on behalf of actor. Approving an
+// approved return returns it unchanged.
+func (s *Service) Approve(ctx context.Context, id int64, actor string) (*Return, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE returns SET status = $2, approved_by = $3, approved_at = now(), updated_at = now()
+		WHERE id = $1 AND status = $4
+	`, id, StatusApproved, actor, StatusRequested)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if r.Status == StatusApproved {
+			return r, nil
+		}
+		return nil, fmt.Errorf("%w: return %d is %s", ErrStatusConflict, id, r.Status)
+	}
+
+	s.logger(r).WithField("actor", actor).Info("Return approved")
+	s.publish(ctx, r, EventReturnApproved, actor, r.ApprovedAt)
+	return r, nil
+}
+
+// Receive records the arrival of an approved return, puts the items back
+// into stock and refunds them. received lists the units that arrived per
+// SKU; when it is empty, every requested unit is taken to have arrived.
+//
+// The receipt and the restocking commit together, before the refund is
+// made. If the refund fails the return stays RECEIVED, and calling Receive
+// again retries the refund without receiving the items twice.
+func (s *Service) Receive(ctx context.Context, id int64, received []inventory.Item) (*Return, error) {
+	r, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Status {
+	case StatusRequested:
+		return nil, fmt.Errorf("%w: return %d has not been approved", ErrStatusConflict, id)
+	case StatusApproved:
+		if r, err = s.receive(ctx, r, received); err != nil {
+			return nil, err
+		}
+	}
+	if r.Status == StatusReceived {
+		return s.refund(ctx, r)
+	}
+	return r, nil
+}
+
+func (s *Service) receive(ctx context.Context, r *Return, received []inventory.Item) (_ *Return, err error) {
+	arrived, err := receivedQuantities(r, received)
+	if err != nil {
+		return nil, err
+	}
+	o, err := s.orders.Get(ctx, r.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	// Lock the order first, like Request, then the return. Holding the
+	// order's lock also keeps the refunds of its returns in sequence.
+	if err = lockOrder(ctx, tx, r.OrderID); err != nil {
+		return nil, err
+	}
+	var current Status
+	if err = tx.QueryRowContext(ctx, `
+		SELECT status FROM returns WHERE id = $1 FOR UPDATE
+	`, r.ID).Scan(&current); err != nil {
+		return nil, err
+	}
+	if current != StatusApproved {
+		// Received concurrently; continue from its current state.
+		if err = tx.Rollback(); err != nil {
+			return nil, err
+		}
+		return s.Get(ctx, r.ID)
+	}
+
+	var restock []inventory.Item
+	var valueCents int64
+	for i := range r.Items {
+		it := &r.Items[i]
+		it.ReceivedQuantity = arrived[it.SKU]
+		if _, err = tx.ExecContext(ctx, `
+			UPDATE return_items SET received_quantity = $3 WHERE return_id = $1 AND sku = $2
+		`, r.ID, it.SKU, it.ReceivedQuantity); err != nil {
+			return nil, err
+		}
+		if it.ReceivedQuantity > 0 {
+			restock = append(restock, inventory.Item{SKU: it.SKU, Quantity: it.ReceivedQuantity})
+			valueCents += int64(it.ReceivedQuantity) * it.UnitPriceCents
+		}
+	}
+	if len(restock) > 0 {
+		if err = s.catalog.Restock(ctx, tx, restock); err != nil {
+			return nil, err
+		}
+	}
+
+	var previousCents int64
+	if err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(ri.received_quantity * ri.unit_price_cents), 0)
+		FROM return_items ri JOIN returns r ON r.id = ri.return_id
+		WHERE r.order_id = $1 AND r.id <> $2 AND r.status IN ($3, $4)
+	`, r.OrderID, r.ID, StatusReceived, StatusRefunded).Scan(&previousCents); err != nil {
+		return nil, err
+	}
+	var subtotalCents int64
+	for _, it := range orderLines(o) {
+		subtotalCents += int64(it.Quantity) * it.UnitPriceCents
+	}
+	r.RefundCents = refundCents(o.AmountCents, subtotalCents, previousCents, valueCents)
+
+	if err = tx.QueryRowContext(ctx, `
+		UPDATE returns SET status = $2, refund_cents = $3, received_at = now(), updated_at = now()
+		WHERE id = $1
+		RETURNING received_at
+	`, r.ID, StatusReceived, r.RefundCents).Scan(&r.ReceivedAt); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Status = StatusReceived
+
+	s.logger(r).WithField("refund_cents", r.RefundCents).Info("Return received and restocked")
+	s.publish(ctx, r, EventReturnReceived, "", r.ReceivedAt)
+	return r, nil
+}
+
+// receivedQuantities maps each SKU of r to the units that arrived.
+func receivedQuantities(r *Return, received []inventory.Item) (map[string]int32, error) {
+	requested := make(map[string]int32, len(r.Items))
+	for _, it := range r.Items {
+		requested[it.SKU] = it.Quantity
+	}
+	if len(received) == 0 {
+		return requested, nil
+	}
+	arrived := make(map[string]int32, len(received))
+	for _, it := range received {
+		if _, ok := requested[it.SKU]; !ok {
+			return nil, fmt.Errorf("%w: %s is not part of return %d", ErrInvalidReturn, it.SKU, r.ID)
+		}
+		if _, dup := arrived[it.SKU]; dup {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidReturn, it.SKU)
+		}
+		if it.Quantity < 0 || it.Quantity > requested[it.SKU] {
+			return nil, fmt.Errorf("%w: %d of %s received, %d were returned", ErrQuantityExceeded, it.Quantity, it.SKU, requested[it.SKU])
+		}
+		arrived[it.SKU] = it.Quantity
+	}
+	return arrived, nil
+}
+
+// refund pays back a received return and marks it REFUNDED.
+func (s *Service) refund(ctx context.Context, r *Return) (*Return, error) {
+	if r.RefundCents > 0 {
+		key := fmt.Sprintf("return-%d-refund", r.ID)
+		if err := s.refunder.RefundPartial(ctx, r.OrderID, key, r.RefundCents); err != nil {
+			s.logger(r).WithError(err).Error("Failed to refund return; receiving it again retries the refund")
+			return nil, fmt.Errorf("%w for return %d: %w", ErrRefundFailed, r.ID, err)
+		}
+	}
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE returns SET status = $2, refunded_at = now(), updated_at = now()
+		WHERE id = $1 AND status = $3
+		RETURNING refunded_at
+	`, r.ID, StatusRefunded, StatusReceived).Scan(&r.RefundedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Refunded concurrently.
+		return s.Get(ctx, r.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Status = StatusRefunded
+
+	s.logger(r).WithField("refund_cents", r.RefundCents).Info("Return refunded")
+	s.publish(ctx, r, EventReturnRefunded, "", r.RefundedAt)
+	return r, nil
+}
+
+// Get returns the return with the given ID and its items.
+func (s *Service) Get(ctx context.Context, id int64) (*Return, error) {
+	var r Return
+	var approvedAt, receivedAt, refundedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, order_id, user_id, status, reason, requested_by, COALESCE(approved_by, ''),
+		       refund_cents, created_at, approved_at, received_at, refunded_at
+		FROM returns WHERE id = $1
+	`, id).Scan(&r.ID, &r.OrderID, &r.UserID, &r.Status, &r.Reason, &r.RequestedBy, &r.ApprovedBy,
+		&r.RefundCents, &r.CreatedAt, &approvedAt, &receivedAt, &refundedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.ApprovedAt = approvedAt.Time
+	r.ReceivedAt = receivedAt.Time
+	r.RefundedAt = refundedAt.Time
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT sku, quantity, COALESCE(received_quantity, 0), unit_price_cents
+		FROM return_items WHERE return_id = $1 ORDER BY sku
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.SKU, &it.Quantity, &it.ReceivedQuantity, &it.UnitPriceCents); err != nil {
+			return nil, err
+		}
+		r.Items = append(r.Items, it)
+	}
+	return &r, rows.Err()
+}
+
+// orderLines returns the lines of o. Orders placed before line items existed
+// have a single line priced from their total.
+func orderLines(o *orders.Order) []orders.Item {
+	if len(o.Items) > 0 || o.Quantity <= 0 {
+		return o.Items
+	}
+	return []orders.Item{{
+		SKU:            o.Product,
+		Quantity:       o.Quantity,
+		UnitPriceCents: o.AmountCents / int64(o.Quantity),
+	}}
+}
+
+func lockOrder(ctx context.Context, tx *sql.Tx, orderID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return orders.ErrNotFound
+	}
+	return err
+}
+
+// returnedQuantities sums the units of each SKU taken by the order's
+// returns: the units received once a return arrived, the units requested
+// before.
+func returnedQuantities(ctx context.Context, tx *sql.Tx, orderID int64) (map[string]int32, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT ri.sku, SUM(COALESCE(ri.received_quantity, ri.quantity))
+		FROM return_items ri JOIN returns r ON r.id = ri.return_id
+		WHERE r.order_id = $1
+		GROUP BY ri.sku
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]int32)
+	for rows.Next() {
+		var sku string
+		var n int32
+		if err := rows.Scan(&sku, &n); err != nil {
+			return nil, err
+		}
+		out[sku] = n
+	}
+	return out, rows.Err()
+}
+
+func (s *Service) logger(r *Return) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"return_id": r.ID,
+		"order_id":  r.OrderID,
+	})
+}
+
+func (s *Service) publish(ctx context.Context, r *Return, eventType, actor string, at time.Time) {
+	if s.publisher == nil {
+		return
+	}
+	ev := ReturnUpdated{
+		ReturnID:    r.ID,
+		OrderID:     r.OrderID,
+		UserID:      r.UserID,
+		Status:      r.Status,
+		RefundCents: r.RefundCents,
+		Actor:       actor,
+		UpdatedAt:   at,
+	}
+	for _, it := range r.Items {
+		ev.Items = append(ev.Items, EventItem{SKU: it.SKU, Quantity: it.Quantity, ReceivedQuantity: it.ReceivedQuantity})
+	}
+	// Keyed by order, so a return's events stay in order with the order's.
+	key := strconv.FormatInt(r.OrderID, 10)
+	if err := s.publisher.Publish(ctx, events.TopicOrders, key, eventType, ev); err != nil {
+		s.logger(r).WithError(err).Errorf("Failed to publish %s event", eventType)
+	}
+}
@@ -0,0 +1,273 @@
+package returns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/catalog"
+	"service2/internal/testutil"
+	"service2/inventory"
+	"service2/orders"
+)
+
+// fakeRefunder records refunds by idempotency key, and fails while err is
+// set.
+type fakeRefunder struct {
+	mutex   sync.Mutex
+	err     error
+	calls   int
+	refunds map[string]int64
+}
+
+func (f *fakeRefunder) RefundPartial(ctx context.Context, orderID int64, key string, amountCents int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	if f.refunds == nil {
+		f.refunds = make(map[string]int64)
+	}
+	f.refunds[key] = amountCents
+	return nil
+}
+
+func (f *fakeRefunder) total() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var total int64
+	for _, cents := range f.refunds {
+		total += cents
+	}
+	return total
+}
+
+type fixture struct {
+	db       *sql.DB
+	svc      *Service
+	orders   *orders.Store
+	catalog  *catalog.Catalog
+	refunder *fakeRefunder
+	prefix   string
+}
+
+// newFixture returns a Service on the Postgres database in
+// TEST_DATABASE_URL, and skips the test when it is not set.
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	db := testutil.DB(t, orders.Schema, catalog.Schema, Schema)
+	if err := orders.EnsurePartitions(context.Background(), db, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	}
+	f := &fixture{
+		db:       db,
+		orders:   orders.NewStore(db),
+		catalog:  catalog.New(db),
+		refunder: &fakeRefunder{},
+		prefix:   fmt.Sprintf("RET-%d-", time.Now().UnixNano()),
+	}
+	f.svc = New(db, f.orders, f.catalog, f.refunder, nil)
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM return_items WHERE sku LIKE $1 || '%'`, f.prefix)
+		db.Exec(`DELETE FROM returns WHERE order_id IN (SELECT order_id FROM order_items WHERE sku LIKE $1 || '%')`, f.prefix)
+		db.Exec(`DELETE FROM orders WHERE id IN (SELECT order_id FROM order_items WHERE sku LIKE $1 || '%')`, f.prefix)
+		db.Exec(`DELETE FROM order_items WHERE sku LIKE $1 || '%'`, f.prefix)
+		db.Exec(`DELETE FROM stock WHERE sku LIKE $1 || '%'`, f.prefix)
+		db.Exec(`DELETE FROM products WHERE sku LIKE $1 || '%'`, f.prefix)
+	})
+	return f
+}
+
+// product adds a product with no stock and returns its SKU.
+func (f *fixture) product(t *testing.T, name string, windowDays int32) string {
+	t.Helper()
+	p := &catalog.Product{SKU: f.prefix + name, Name: name, PriceCents: 100, Active: true, ReturnWindowDays: windowDays}
+	if err := f.catalog.Create(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	return p.SKU
+}
+
+// delivered creates an order of items less discountCents and delivers it.
+func (f *fixture) delivered(t *testing.T, discountCents int64, items ...orders.Item) *orders.Order {
+	t.Helper()
+	ctx := context.Background()
+	o := &orders.Order{UserID: 1, Items: items}
+	if discountCents > 0 {
+		o.Discounts = []orders.Discount{{Code: "TEST", Kind: "FIXED", AmountCents: discountCents}}
+	}
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.orders.Create(ctx, tx, o); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.orders.SetStatus(ctx, o.ID, orders.StatusConfirmed, orders.StatusPending); err != nil {
+		t.Fatal(err)
+	}
+	delivered, err := f.orders.MarkDelivered(ctx, o.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivered
+}
+
+// approved requests and approves a return of items.
+func (f *fixture) approved(t *testing.T, orderID int64, items ...inventory.Item) *Return {
+	t.Helper()
+	r, err := f.svc.Request(context.Background(), orderID, items, "damaged", "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = f.svc.Approve(context.Background(), r.ID, "agent"); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (f *fixture) stock(t *testing.T, sku string) int32 {
+	t.Helper()
+	p, err := f.catalog.Get(context.Background(), sku)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Stock
+}
+
+func TestRequestCapsQuantityAcrossReturns(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	a, b := f.product(t, "A", 30), f.product(t, "B", 30)
+	o := f.delivered(t, 0, orders.Item{SKU: a, Quantity: 3, UnitPriceCents: 100}, orders.Item{SKU: b, Quantity: 1, UnitPriceCents: 100})
+
+	first := f.approved(t, o.ID, inventory.Item{SKU: a, Quantity: 2})
+	if _, err := f.svc.Request(ctx, o.ID, []inventory.Item{{SKU: a, Quantity: 2}}, "", "customer"); !errors.Is(err, ErrQuantityExceeded) {
+		t.Fatalf("returning 4 of 3 units: %v", err)
+	}
+	if _, err := f.svc.Request(ctx, o.ID, []inventory.Item{{SKU: a, Quantity: 1}, {SKU: b, Quantity: 1}}, "", "customer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.svc.Request(ctx, o.ID, []inventory.Item{{SKU: a, Quantity: 1}}, "", "customer"); !errors.Is(err, ErrQuantityExceeded) {
+		t.Fatalf("returning a unit already returned: %v", err)
+	}
+
+	// Only one unit of the first return arrived, so the other can be
+	// returned again.
+	if _, err := f.svc.Receive(ctx, first.ID, []inventory.Item{{SKU: a, Quantity: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.svc.Request(ctx, o.ID, []inventory.Item{{SKU: a, Quantity: 1}}, "", "customer"); err != nil {
+		t.Fatalf("returning the unit that did not arrive: %v", err)
+	}
+}
+
+func TestRequestNeedsOpenWindow(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	sku := f.product(t, "A", 1)
+	o := f.delivered(t, 0, orders.Item{SKU: sku, Quantity: 1, UnitPriceCents: 100})
+
+	// Delivered two days ago, past the one-day window.
+	if _, err := f.db.Exec(`UPDATE orders SET delivered_at = now() - interval '2 days' WHERE id = $1`, o.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.svc.Request(ctx, o.ID, []inventory.Item{{SKU: sku, Quantity: 1}}, "", "customer"); !errors.Is(err, ErrNotReturnable) {
+		t.Fatalf("return after the window closed: %v", err)
+	}
+
+	// Orders that were not delivered cannot be returned at all.
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &orders.Order{UserID: 1, Items: []orders.Item{{SKU: sku, Quantity: 1, UnitPriceCents: 100}}}
+	if err := f.orders.Create(ctx, tx, pending); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.svc.Request(ctx, pending.ID, []inventory.Item{{SKU: sku, Quantity: 1}}, "", "customer"); !errors.Is(err, ErrNotReturnable) {
+		t.Fatalf("return of a pending order: %v", err)
+	}
+}
+
+func TestReceiveRefundsProratedShare(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	sku := f.product(t, "A", 30)
+	// Three units at 333 with 100 off: 899 charged.
+	o := f.delivered(t, 100, orders.Item{SKU: sku, Quantity: 3, UnitPriceCents: 333})
+
+	var refunds []int64
+	for i := 0; i < 3; i++ {
+		r := f.approved(t, o.ID, inventory.Item{SKU: sku, Quantity: 1})
+		r, err := f.svc.Receive(ctx, r.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Status != StatusRefunded {
+			t.Fatalf("return %d is %s", r.ID, r.Status)
+		}
+		refunds = append(refunds, r.RefundCents)
+	}
+	if refunds[0] != 299 || refunds[1] != 300 || refunds[2] != 300 {
+		t.Errorf("refunds %v, want [299 300 300]", refunds)
+	}
+	if total := f.refunder.total(); total != o.AmountCents {
+		t.Errorf("refunded %d of %d", total, o.AmountCents)
+	}
+	if got := f.stock(t, sku); got != 3 {
+		t.Errorf("stock %d after restocking, want 3", got)
+	}
+}
+
+func TestReceiveRetriesFailedRefund(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	sku := f.product(t, "A", 30)
+	o := f.delivered(t, 0, orders.Item{SKU: sku, Quantity: 2, UnitPriceCents: 500})
+	r := f.approved(t, o.ID, inventory.Item{SKU: sku, Quantity: 2})
+
+	f.refunder.err = errors.New("provider unavailable")
+	if _, err := f.svc.Receive(ctx, r.ID, nil); !errors.Is(err, ErrRefundFailed) {
+		t.Fatalf("Receive with a failing refund: %v", err)
+	}
+	got, err := f.svc.Get(ctx, r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusReceived || got.RefundCents != 1000 || f.stock(t, sku) != 2 {
+		t.Fatalf("after the failed refund: %+v, stock %d", got, f.stock(t, sku))
+	}
+
+	// Receiving it again retries the refund without restocking twice.
+	f.refunder.err = nil
+	got, err = f.svc.Receive(ctx, r.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusRefunded || f.refunder.total() != 1000 || f.refunder.calls != 2 {
+		t.Errorf("after the retry: %+v, %d refunded in %d calls", got, f.refunder.total(), f.refunder.calls)
+	}
+	if stock := f.stock(t, sku); stock != 2 {
+		t.Errorf("stock %d after the retry, want 2", stock)
+	}
+
+	// A refunded return is left as it is.
+	if again, err := f.svc.Receive(ctx, r.ID, nil); err != nil || again.Status != StatusRefunded || f.refunder.calls != 2 {
+		t.Errorf("receiving a refunded return: %+v, %v", again, err)
+	}
+}
@@ -0,0 +1,54 @@
+package returns
+
+import (
+	"fmt"
+	"time"
+
+	"service2/inventory"
+)
+
+// checkQuantities verifies that requested neither names a SKU the order does
+// not contain nor takes a line past the quantity ordered, counting what
+// earlier returns of the order already took.
+func checkQuantities(ordered, returned map[string]int32, requested []inventory.Item) error {
+	seen := make(map[string]bool, len(requested))
+	for _, it := range requested {
+		if it.SKU == "" || it.Quantity <= 0 {
+			return fmt.Errorf("%w: every item needs a SKU and a positive quantity", ErrInvalidReturn)
+		}
+		if seen[it.SKU] {
+			return fmt.Errorf("%w: %s is listed twice", ErrInvalidReturn, it.SKU)
+		}
+		seen[it.SKU] = true
+		n, ok := ordered[it.SKU]
+		if !ok {
+			return fmt.Errorf("%w: %s is not part of the order", ErrInvalidReturn, it.SKU)
+		}
+		if left := n - returned[it.SKU]; it.Quantity > left {
+			return fmt.Errorf("%w: %d of %s requested, %d left to return", ErrQuantityExceeded, it.Quantity, it.SKU, left)
+		}
+	}
+	return nil
+}
+
+// deadline is the end of the return window of a product delivered at
+// deliveredAt. A window of zero days means the product cannot be returned.
+func deadline(deliveredAt time.Time, windowDays int32) time.Time {
+	return deliveredAt.AddDate(0, 0, int(windowDays))
+}
+
+// refundCents returns the share of amountCents, what was charged for an
+// order whose items are worth subtotalCents, that is refunded for items worth
+// valueCents once items worth previousCents were refunded. Order discounts
+// are spread over the items in proportion to their value. Shares are taken
+// of running totals, so rounding never refunds more than was charged and
+// returning every item refunds exactly the amount.
+func refundCents(amountCents, subtotalCents, previousCents, valueCents int64) int64 {
+	if subtotalCents <= 0 {
+		return 0
+	}
+	share := func(v int64) int64 {
+		return v * amountCents / subtotalCents
+	}
+	return share(previousCents+valueCents) - share(previousCents)
+}
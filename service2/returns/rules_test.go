@@ -0,0 +1,59 @@
+package returns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"service2/inventory"
+)
+
+func TestCheckQuantities(t *testing.T) {
+	ordered := map[string]int32{"A": 3, "B": 1}
+	returned := map[string]int32{"A": 2}
+
+	tests := []struct {
+		name      string
+		requested []inventory.Item
+		want      error
+	}{
+		{"within what is left", []inventory.Item{{SKU: "A", Quantity: 1}, {SKU: "B", Quantity: 1}}, nil},
+		{"beyond what is left", []inventory.Item{{SKU: "A", Quantity: 2}}, ErrQuantityExceeded},
+		{"not ordered", []inventory.Item{{SKU: "C", Quantity: 1}}, ErrInvalidReturn},
+		{"listed twice", []inventory.Item{{SKU: "B", Quantity: 1}, {SKU: "B", Quantity: 1}}, ErrInvalidReturn},
+		{"zero quantity", []inventory.Item{{SKU: "B", Quantity: 0}}, ErrInvalidReturn},
+	}
+	for _, tt := range tests {
+		if err := checkQuantities(ordered, returned, tt.requested); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	delivered := time.Date(2024, 1, 30, 12, 0, 0, 0, time.UTC)
+	if got, want := deadline(delivered, 30), time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("deadline = %v, want %v", got, want)
+	}
+	if got := deadline(delivered, 0); !got.Equal(delivered) {
+		t.Errorf("zero-day window ends at %v, want the delivery time", got)
+	}
+}
+
+func TestRefundCents(t *testing.T) {
+	// Three units at 333 with 100 off: 899 charged for 999 worth of items.
+	const amount, subtotal = 899, 999
+
+	first := refundCents(amount, subtotal, 0, 333)
+	second := refundCents(amount, subtotal, 333, 333)
+	third := refundCents(amount, subtotal, 666, 333)
+	if first != 299 || second != 300 {
+		t.Errorf("refunds = %d, %d, want 299, 300", first, second)
+	}
+	if total := first + second + third; total != amount {
+		t.Errorf("returning every unit refunds %d, want %d", total, amount)
+	}
+	if got := refundCents(0, 0, 0, 100); got != 0 {
+		t.Errorf("refund of a free order = %d, want 0", got)
+	}
+}
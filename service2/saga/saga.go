@@ -0,0 +1,439 @@
+// Package saga runs orchestrated sagas whose progress is persisted in
+// Postgres, so a saga interrupted by a restart resumes where it stopped.
+//
+// A saga is a fixed sequence of steps. Steps run in order; when one fails,
+// the failed step and every step before it are compensated in reverse order.
+// Steps may run more than once after a crash, so both actions must be
+// idempotent.
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the tables holding saga state.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS sagas (
+		id           BIGSERIAL PRIMARY KEY,
+		name         TEXT NOT NULL,
+		order_id     BIGINT NOT NULL,
+		status       TEXT NOT NULL,
+		data         JSONB NOT NULL DEFAULT '{}',
+		error        TEXT NOT NULL DEFAULT '',
+		lease_owner  TEXT,
+		lease_until  TIMESTAMPTZ,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS sagas_order_id_idx ON sagas (order_id);
+	CREATE INDEX IF NOT EXISTS sagas_status_idx ON sagas (status);
+	CREATE TABLE IF NOT EXISTS saga_steps (
+		saga_id    BIGINT NOT NULL,
+		position   INT NOT NULL,
+		name       TEXT NOT NULL,
+		status     TEXT NOT NULL,
+		attempts   INT NOT NULL DEFAULT 0,
+		error      TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (saga_id, position)
+	);
+`
+
+// Status is the state of a saga as a whole.
+type Status string
+
+const (
+	StatusRunning      Status = "RUNNING"
+	StatusCompensating Status = "COMPENSATING"
+	StatusCompleted    Status = "COMPLETED"
+	StatusCompensated  Status = "COMPENSATED"
+)
+
+// StepStatus is the state of a single step.
+type StepStatus string
+
+const (
+	StepPending      StepStatus = "PENDING"
+	StepRunning      StepStatus = "RUNNING"
+	StepCompleted    StepStatus = "COMPLETED"
+	StepFailed       StepStatus = "FAILED"
+	StepCompensating StepStatus = "COMPENSATING"
+	StepCompensated  StepStatus = "COMPENSATED"
+)
+
+// ErrNotFound is returned when a saga does not exist.
+var ErrNotFound = errors.New("saga not found")
+
+// ErrNotCompleted is returned when aborting a saga that has not completed.
+var ErrNotCompleted = errors.New("saga is not completed")
+
+// ErrLeased is returned when another process is currently running the saga.
+var ErrLeased = errors.New("saga is being run by another process")
+
+// Step is one action of a saga and the action that undoes it. Either may be
+// nil. Steps share state through Saga.Data, which is persisted after each
+// step.
+type Step struct {
+	Name       string
+	Execute    func(ctx context.Context, s *Saga) error
+	Compensate func(ctx context.Context, s *Saga) error
+}
+
+// Definition names a saga type and lists its steps.
+type Definition struct {
+	Name  string
+	Steps []Step
+}
+
+// StepState is the persisted progress of one step.
+type StepState struct {
+	Name      string
+	Status    StepStatus
+	Attempts  int
+	Error     string
+	UpdatedAt time.Time
+}
+
+// Saga is a persisted saga instance.
+type Saga struct {
+	ID        int64
+	Name      string
+	OrderID   int64
+	Status    Status
+	Data      map[string]string
+	Error     string
+	Steps     []StepState
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Orchestrator starts, runs and resumes sagas of one Definition.
+type Orchestrator struct {
+	store store
+	def   Definition
+	owner string
+
+	// LeaseDuration bounds how long a crashed process blocks others from
+	// resuming its sagas. The lease is renewed every third of it while a
+	// saga runs, so steps may take longer.
+	LeaseDuration time.Duration
+	// CompensationAttempts is how many times a failing compensation is tried
+	// within one run before the saga is left for the resume loop.
+	CompensationAttempts int
+	// RetryBackoff is the delay between compensation attempts.
+	RetryBackoff time.Duration
+}
+
+// NewOrchestrator creates an Orchestrator for def.
+func NewOrchestrator(db *sql.DB, def Definition) *Orchestrator {
+	return newOrchestrator(&pgStore{db: db}, def)
+}
+
+func newOrchestrator(store store, def Definition) *Orchestrator {
+	host, _ := os.Hostname()
+	return &Orchestrator{
+		store:                store,
+		def:                  def,
+		owner:                fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		LeaseDuration:        time.Minute,
+		CompensationAttempts: 3,
+		RetryBackoff:         200 * time.Millisecond,
+	}
+}
+
+// Start records a new saga for orderID inside tx, so it commits atomically
+// with whatever the caller writes. Call Run after tx commits.
+func (o *Orchestrator) Start(ctx context.Context, tx *sql.Tx, orderID int64, data map[string]string) (int64, error) {
+	if data == nil {
+		data = map[string]string{}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO sagas (name, order_id, status, data)
+		VALUES ($1, $2, $3, $4) RETURNING id
+	`, o.def.Name, orderID, StatusRunning, raw).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for i, step := range o.def.Steps {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO saga_steps (saga_id, position, name, status)
+			VALUES ($1, $2, $3, $4)
+		`, id, i, step.Name, StepPending); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// Abort marks a completed saga as COMPENSATING inside tx, so that the next
+// Run undoes all of its steps. Like Start it commits atomically with the
+// caller's writes; a crash before Run leaves the saga to Resume. Sagas that
+// are not COMPLETED are left alone and ErrNotCompleted is returned.
+func (o *Orchestrator) Abort(ctx context.Context, tx *sql.Tx, id int64, reason string) error {
+	res, err := tx.ExecContext(ctx, `
+		UPDATE sagas SET status = $3, error = $4, updated_at = now()
+		WHERE id = $1 AND status = $2
+	`, id, StatusCompleted, StatusCompensating, reason)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: saga %d", ErrNotCompleted, id)
+	}
+	return nil
+}
+
+// Run drives the saga forward until it completes or is fully compensated.
+// It returns the saga's final state. An error means the saga could not make
+// progress (for example a compensation keeps failing); it stays unfinished
+// and is picked up again by Resume. If another process takes the lease
+// over, Run stops at its next write with ErrLeased and leaves the saga to
+// it.
+func (o *Orchestrator) Run(ctx context.Context, id int64) (*Saga, error) {
+	if err := o.store.acquire(ctx, id, o.owner, o.LeaseDuration); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		o.renewLease(ctx, cancel, id)
+	}()
+	defer func() {
+		cancel()
+		<-renewed
+		o.release(id)
+	}()
+
+	s, err := o.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Steps) != len(o.def.Steps) {
+		return s, fmt.Errorf("saga %d has %d steps, definition %q has %d", id, len(s.Steps), o.def.Name, len(o.def.Steps))
+	}
+
+	if s.Status == StatusRunning {
+		if err := o.forward(ctx, s); err != nil {
+			return s, err
+		}
+	}
+	if s.Status == StatusCompensating {
+		if err := o.backward(ctx, s); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (o *Orchestrator) forward(ctx context.Context, s *Saga) error {
+	for i, step := range o.def.Steps {
+		if s.Steps[i].Status == StepCompleted {
+			continue
+		}
+		if err := o.setStep(ctx, s, i, StepRunning, ""); err != nil {
+			return err
+		}
+
+		var stepErr error
+		if step.Execute != nil {
+			stepErr = step.Execute(ctx, s)
+		}
+		if stepErr != nil && ctx.Err() != nil {
+			// Interrupted rather than failed: the step stays RUNNING and
+			// runs again when the saga is resumed.
+			return ctx.Err()
+		}
+		if stepErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"saga_id":  s.ID,
+				"order_id": s.OrderID,
+				"step":     step.Name,
+			}).WithError(stepErr).Warn("Saga step failed, compensating")
+			if err := o.setStep(ctx, s, i, StepFailed, stepErr.Error()); err != nil {
+				return err
+			}
+			return o.setStatus(ctx, s, StatusCompensating, fmt.Sprintf("%s: %v", step.Name, stepErr))
+		}
+		if err := o.setStep(ctx, s, i, StepCompleted, ""); err != nil {
+			return err
+		}
+	}
+	return o.setStatus(ctx, s, StatusCompleted, "")
+}
+
+func (o *Orchestrator) backward(ctx context.Context, s *Saga) error {
+	for i := len(o.def.Steps) - 1; i >= 0; i-- {
+		switch s.Steps[i].Status {
+		case StepPending, StepCompensated:
+			continue
+		}
+		step := o.def.Steps[i]
+		if err := o.setStep(ctx, s, i, StepCompensating, s.Steps[i].Error); err != nil {
+			return err
+		}
+		if step.Compensate != nil {
+			if err := o.compensate(ctx, s, step); err != nil {
+				return err
+			}
+		}
+		if err := o.setStep(ctx, s, i, StepCompensated, s.Steps[i].Error); err != nil {
+			return err
+		}
+	}
+	return o.setStatus(ctx, s, StatusCompensated, s.Error)
+}
+
+func (o *Orchestrator) compensate(ctx context.Context, s *Saga, step Step) error {
+	var err error
+	for attempt := 1; attempt <= o.CompensationAttempts; attempt++ {
+		if err = step.Compensate(ctx, s); err == nil {
+			return nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"saga_id": s.ID,
+			"step":    step.Name,
+			"attempt": attempt,
+		}).WithError(err).Warn("Saga compensation failed")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(o.RetryBackoff * time.Duration(attempt)):
+		}
+	}
+	return fmt.Errorf("compensating %s: %w", step.Name, err)
+}
+
+// Resume runs every unfinished saga whose lease has expired, such as those
+// interrupted by a restart.
+func (o *Orchestrator) Resume(ctx context.Context) error {
+	ids, err := o.store.unfinished(ctx, o.def.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		s, err := o.Run(ctx, id)
+		if errors.Is(err, ErrLeased) {
+			continue
+		}
+		if err != nil {
+			logrus.WithField("saga_id", id).WithError(err).Error("Failed to resume saga")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"saga_id": id,
+			"status":  s.Status,
+		}).Info("Resumed saga")
+	}
+	return nil
+}
+
+// ResumeLoop calls Resume immediately and then on every interval until ctx
+// is cancelled.
+func (o *Orchestrator) ResumeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := o.Resume(ctx); err != nil {
+			logrus.Errorf("Failed to resume sagas: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get loads a saga and its steps.
+func (o *Orchestrator) Get(ctx context.Context, id int64) (*Saga, error) {
+	return o.store.get(ctx, id)
+}
+
+// GetByOrder loads the most recent saga of this definition for orderID.
+func (o *Orchestrator) GetByOrder(ctx context.Context, orderID int64) (*Saga, error) {
+	id, err := o.store.latest(ctx, o.def.Name, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return o.Get(ctx, id)
+}
+
+// renewLease extends the lease on saga id every third of LeaseDuration
+// until ctx is done, so a long step does not let another process take the
+// saga over. If the lease is lost anyway, it cancels the run.
+func (o *Orchestrator) renewLease(ctx context.Context, cancel context.CancelFunc, id int64) {
+	ticker := time.NewTicker(o.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := o.store.extend(ctx, id, o.owner, o.LeaseDuration)
+			switch {
+			case errors.Is(err, ErrLeased):
+				logrus.WithField("saga_id", id).Error("Lost saga lease, stopping the run")
+				cancel()
+				return
+			case err != nil && ctx.Err() == nil:
+				logrus.WithField("saga_id", id).WithError(err).Warn("Failed to renew saga lease")
+			}
+		}
+	}
+}
+
+func (o *Orchestrator) release(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.store.release(ctx, id, o.owner); err != nil {
+		logrus.WithField("saga_id", id).WithError(err).Warn("Failed to release saga lease")
+	}
+}
+
+// setStep persists a step transition together with the saga's current data,
+// so values produced by a step are durable before the next one starts.
+func (o *Orchestrator) setStep(ctx context.Context, s *Saga, i int, status StepStatus, errMsg string) error {
+	attempts := 0
+	if status == StepRunning {
+		attempts = 1
+	}
+	if err := o.store.setStep(ctx, s, i, status, errMsg, attempts, o.owner, o.LeaseDuration); err != nil {
+		return err
+	}
+
+	s.Steps[i].Status = status
+	s.Steps[i].Error = errMsg
+	s.Steps[i].Attempts += attempts
+	s.Steps[i].UpdatedAt = time.Now()
+	return nil
+}
+
+func (o *Orchestrator) setStatus(ctx context.Context, s *Saga, status Status, errMsg string) error {
+	if err := o.store.setStatus(ctx, s.ID, o.owner, status, errMsg); err != nil {
+		return err
+	}
+	s.Status = status
+	s.Error = errMsg
+	s.UpdatedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,439 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore keeps sagas in memory. Leases expire by the wall clock.
+type fakeStore struct {
+	mutex  sync.Mutex
+	sagas  map[int64]*Saga
+	leases map[int64]lease
+	lastID int64
+}
+
+type lease struct {
+	owner string
+	until time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{sagas: make(map[int64]*Saga), leases: make(map[int64]lease)}
+}
+
+// add stores a saga of def with every step in status, and returns its ID.
+func (f *fakeStore) add(def Definition, status Status, data map[string]string, steps ...StepStatus) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lastID++
+	s := &Saga{ID: f.lastID, Name: def.Name, OrderID: 100 + f.lastID, Status: status, Data: data}
+	if s.Data == nil {
+		s.Data = map[string]string{}
+	}
+	for i, step := range def.Steps {
+		st := StepState{Name: step.Name, Status: StepPending}
+		if i < len(steps) {
+			st.Status = steps[i]
+		}
+		s.Steps = append(s.Steps, st)
+	}
+	f.sagas[s.ID] = s
+	return s.ID
+}
+
+func (f *fakeStore) lease(id int64, owner string, until time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.leases[id] = lease{owner: owner, until: until}
+}
+
+func (f *fakeStore) get(ctx context.Context, id int64) (*Saga, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.sagas[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *s
+	c.Data = maps.Clone(s.Data)
+	c.Steps = slices.Clone(s.Steps)
+	return &c, nil
+}
+
+func (f *fakeStore) latest(ctx context.Context, name string, orderID int64) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var latest int64
+	for id, s := range f.sagas {
+		if s.Name == name && s.OrderID == orderID && id > latest {
+			latest = id
+		}
+	}
+	if latest == 0 {
+		return 0, ErrNotFound
+	}
+	return latest, nil
+}
+
+func (f *fakeStore) unfinished(ctx context.Context, name string) ([]int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var ids []int64
+	for id, s := range f.sagas {
+		if s.Name == name && (s.Status == StatusRunning || s.Status == StatusCompensating) && !f.leases[id].until.After(time.Now()) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (f *fakeStore) acquire(ctx context.Context, id int64, owner string, d time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.sagas[id]; !ok {
+		return ErrNotFound
+	}
+	if l := f.leases[id]; l.owner != owner && l.until.After(time.Now()) {
+		return ErrLeased
+	}
+	f.leases[id] = lease{owner: owner, until: time.Now().Add(d)}
+	return nil
+}
+
+func (f *fakeStore) extend(ctx context.Context, id int64, owner string, d time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.leases[id].owner != owner {
+		return ErrLeased
+	}
+	f.leases[id] = lease{owner: owner, until: time.Now().Add(d)}
+	return nil
+}
+
+func (f *fakeStore) release(ctx context.Context, id int64, owner string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.leases[id].owner == owner {
+		delete(f.leases, id)
+	}
+	return nil
+}
+
+func (f *fakeStore) setStep(ctx context.Context, s *Saga, i int, status StepStatus, errMsg string, attempts int, owner string, d time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.leases[s.ID].owner != owner {
+		return ErrLeased
+	}
+	stored := f.sagas[s.ID]
+	stored.Data = maps.Clone(s.Data)
+	stored.Steps[i].Status = status
+	stored.Steps[i].Error = errMsg
+	stored.Steps[i].Attempts += attempts
+	f.leases[s.ID] = lease{owner: owner, until: time.Now().Add(d)}
+	return nil
+}
+
+func (f *fakeStore) setStatus(ctx context.Context, id int64, owner string, status Status, errMsg string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.leases[id].owner != owner {
+		return ErrLeased
+	}
+	f.sagas[id].Status = status
+	f.sagas[id].Error = errMsg
+	return nil
+}
+
+// recorder builds steps that log their actions and fail when told to.
+type recorder struct {
+	mutex sync.Mutex
+	calls []string
+	fail  map[string]error
+}
+
+func (r *recorder) record(call string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, call)
+	return r.fail[call]
+}
+
+func (r *recorder) step(name string) Step {
+	return Step{
+		Name: name,
+		Execute: func(ctx context.Context, s *Saga) error {
+			s.Data[name] = "done"
+			return r.record("execute " + name)
+		},
+		Compensate: func(ctx context.Context, s *Saga) error {
+			return r.record("compensate " + name)
+		},
+	}
+}
+
+func (r *recorder) definition() Definition {
+	return Definition{Name: "test", Steps: []Step{r.step("reserve"), r.step("authorize"), r.step("confirm")}}
+}
+
+func (r *recorder) called() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.calls, ", ")
+}
+
+func TestRunCompletesSteps(t *testing.T) {
+	r := &recorder{}
+	def := r.definition()
+	st := newFakeStore()
+	id := st.add(def, StatusRunning, nil)
+
+	s, err := newOrchestrator(st, def).Run(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.called(); got != "execute reserve, execute authorize, execute confirm" {
+		t.Fatalf("calls: %s", got)
+	}
+	stored, _ := st.get(context.Background(), id)
+	if s.Status != StatusCompleted || stored.Status != StatusCompleted {
+		t.Fatalf("status %s, stored %s", s.Status, stored.Status)
+	}
+	for _, step := range stored.Steps {
+		if step.Status != StepCompleted || step.Attempts != 1 || stored.Data[step.Name] != "done" {
+			t.Fatalf("step %+v, data %v", step, stored.Data)
+		}
+	}
+	if _, leased := st.leases[id]; leased {
+		t.Fatal("lease not released")
+	}
+}
+
+func TestRunCompensatesAfterFailedStep(t *testing.T) {
+	r := &recorder{fail: map[string]error{"execute confirm": errors.New("declined")}}
+	def := r.definition()
+	st := newFakeStore()
+	id := st.add(def, StatusRunning, nil)
+
+	s, err := newOrchestrator(st, def).Run(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "execute reserve, execute authorize, execute confirm, compensate confirm, compensate authorize, compensate reserve"
+	if got := r.called(); got != want {
+		t.Fatalf("calls: %s", got)
+	}
+	if s.Status != StatusCompensated || s.Error != "confirm: declined" {
+		t.Fatalf("status %s, error %q", s.Status, s.Error)
+	}
+	stored, _ := st.get(context.Background(), id)
+	for _, step := range stored.Steps {
+		if step.Status != StepCompensated {
+			t.Fatalf("step %+v", step)
+		}
+	}
+	if stored.Steps[2].Error != "declined" {
+		t.Fatalf("failed step error %q", stored.Steps[2].Error)
+	}
+}
+
+func TestRunLeavesSagaWhenCompensationKeepsFailing(t *testing.T) {
+	r := &recorder{fail: map[string]error{
+		"execute authorize":  errors.New("declined"),
+		"compensate reserve": errors.New("inventory down"),
+	}}
+	def := r.definition()
+	st := newFakeStore()
+	id := st.add(def, StatusRunning, nil)
+	o := newOrchestrator(st, def)
+	o.RetryBackoff = time.Millisecond
+
+	if _, err := o.Run(context.Background(), id); err == nil {
+		t.Fatal("Run succeeded with a failing compensation")
+	}
+	if n := strings.Count(r.called(), "compensate reserve"); n != o.CompensationAttempts {
+		t.Fatalf("compensated reserve %d times, want %d", n, o.CompensationAttempts)
+	}
+	stored, _ := st.get(context.Background(), id)
+	if stored.Status != StatusCompensating || stored.Steps[0].Status != StepCompensating {
+		t.Fatalf("saga %s, reserve %s", stored.Status, stored.Steps[0].Status)
+	}
+
+	// Once the compensation works, the next run finishes it.
+	r.fail = nil
+	if s, err := o.Run(context.Background(), id); err != nil || s.Status != StatusCompensated {
+		t.Fatalf("rerun: %v, %v", s, err)
+	}
+}
+
+func TestResumeContinuesFromPersistedStep(t *testing.T) {
+	r := &recorder{}
+	def := r.definition()
+	st := newFakeStore()
+	// The process crashed while authorizing, after reserving.
+	id := st.add(def, StatusRunning, map[string]string{"reserve": "done"}, StepCompleted, StepRunning)
+	st.lease(id, "crashed", time.Now().Add(-time.Second))
+	done := st.add(def, StatusCompleted, nil, StepCompleted, StepCompleted, StepCompleted)
+
+	if err := newOrchestrator(st, def).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.called(); got != "execute authorize, execute confirm" {
+		t.Fatalf("calls: %s", got)
+	}
+	stored, _ := st.get(context.Background(), id)
+	if stored.Status != StatusCompleted || stored.Steps[1].Attempts != 1 || stored.Data["reserve"] != "done" {
+		t.Fatalf("saga %+v", stored)
+	}
+	if s, _ := st.get(context.Background(), done); s.Status != StatusCompleted {
+		t.Fatalf("completed saga became %s", s.Status)
+	}
+}
+
+func TestResumeFinishesCompensation(t *testing.T) {
+	r := &recorder{}
+	def := r.definition()
+	st := newFakeStore()
+	// Stopped after compensating the failed step; the completed first step
+	// is still to be undone and the pending last one is left alone.
+	id := st.add(def, StatusCompensating, nil, StepCompleted, StepCompensated, StepPending)
+
+	if err := newOrchestrator(st, def).Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.called(); got != "compensate reserve" {
+		t.Fatalf("calls: %s", got)
+	}
+	if s, _ := st.get(context.Background(), id); s.Status != StatusCompensated {
+		t.Fatalf("status %s", s.Status)
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	r := &recorder{}
+	def := r.definition()
+	st := newFakeStore()
+	held := st.add(def, StatusRunning, nil)
+	st.lease(held, "other", time.Now().Add(time.Minute))
+	expired := st.add(def, StatusRunning, nil)
+	st.lease(expired, "other", time.Now().Add(-time.Second))
+	o := newOrchestrator(st, def)
+
+	if _, err := o.Run(context.Background(), held); !errors.Is(err, ErrLeased) {
+		t.Fatalf("Run of a leased saga: %v", err)
+	}
+	if _, err := o.Run(context.Background(), 99); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Run of a missing saga: %v", err)
+	}
+	if err := o.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := st.get(context.Background(), held); s.Status != StatusRunning || s.Steps[0].Status != StepPending {
+		t.Fatalf("leased saga was run: %+v", s)
+	}
+	if s, _ := st.get(context.Background(), expired); s.Status != StatusCompleted {
+		t.Fatalf("expired saga not taken over: %s", s.Status)
+	}
+}
+
+func TestLeaseRenewedDuringLongStep(t *testing.T) {
+	st := newFakeStore()
+	var other *Orchestrator
+	var takeover error
+	def := Definition{Name: "test", Steps: []Step{{
+		Name: "slow",
+		Execute: func(ctx context.Context, s *Saga) error {
+			// Outlive the lease several times, then check that another
+			// process still cannot take the saga.
+			time.Sleep(100 * time.Millisecond)
+			_, takeover = other.Run(ctx, s.ID)
+			return nil
+		},
+	}}}
+	id := st.add(def, StatusRunning, nil)
+	o := newOrchestrator(st, def)
+	o.LeaseDuration = 30 * time.Millisecond
+	other = newOrchestrator(st, def)
+	other.LeaseDuration = o.LeaseDuration
+
+	s, err := o.Run(context.Background(), id)
+	if err != nil || s.Status != StatusCompleted {
+		t.Fatalf("Run: %v, %v", s, err)
+	}
+	if !errors.Is(takeover, ErrLeased) {
+		t.Fatalf("takeover during the step: %v", takeover)
+	}
+}
+
+func TestLostLeaseStopsRun(t *testing.T) {
+	st := newFakeStore()
+	def := Definition{Name: "test", Steps: []Step{{
+		Name: "slow",
+		Execute: func(ctx context.Context, s *Saga) error {
+			st.lease(s.ID, "other", time.Now().Add(time.Minute))
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}}}
+	id := st.add(def, StatusRunning, nil)
+	o := newOrchestrator(st, def)
+	o.LeaseDuration = 30 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := o.Run(context.Background(), id)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Run succeeded after losing its lease")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after losing its lease")
+	}
+	if l := st.leases[id]; l.owner != "other" {
+		t.Fatalf("lease of the new owner was released: %+v", l)
+	}
+	// The interrupted step is left for the new owner, not compensated.
+	if s, _ := st.get(context.Background(), id); s.Status != StatusRunning || s.Steps[0].Status != StepRunning {
+		t.Fatalf("saga %s, step %s", s.Status, s.Steps[0].Status)
+	}
+}
+
+func TestTakenOverRunWritesNothing(t *testing.T) {
+	for _, stepErr := range []error{nil, errors.New("declined")} {
+		st := newFakeStore()
+		taken := time.Now().Add(time.Minute)
+		def := Definition{Name: "test", Steps: []Step{{
+			Name: "slow",
+			Execute: func(ctx context.Context, s *Saga) error {
+				// The lease expired during the step and another process
+				// took the saga over; the step ends without noticing.
+				st.lease(s.ID, "other", taken)
+				s.Data["slow"] = "stale"
+				return stepErr
+			},
+		}}}
+		id := st.add(def, StatusRunning, nil)
+
+		if _, err := newOrchestrator(st, def).Run(context.Background(), id); !errors.Is(err, ErrLeased) {
+			t.Fatalf("step error %v: Run returned %v, want ErrLeased", stepErr, err)
+		}
+		s, _ := st.get(context.Background(), id)
+		if s.Status != StatusRunning || s.Steps[0].Status != StepRunning || s.Data["slow"] != "" {
+			t.Fatalf("step error %v: stale owner wrote saga %+v", stepErr, s)
+		}
+		if l := st.leases[id]; l.owner != "other" || !l.until.Equal(taken) {
+			t.Fatalf("step error %v: new owner's lease changed: %+v", stepErr, l)
+		}
+	}
+}
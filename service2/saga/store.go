@@ -0,0 +1,207 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// store persists sagas for an Orchestrator. Leases are held by an owner
+// until they expire or are released.
+type store interface {
+	// get loads a saga and its steps.
+	get(ctx context.Context, id int64) (*Saga, error)
+	// latest returns the ID of the most recent saga of name for orderID.
+	latest(ctx context.Context, name string, orderID int64) (int64, error)
+	// unfinished returns the IDs of the running or compensating sagas of
+	// name whose lease has expired.
+	unfinished(ctx context.Context, name string) ([]int64, error)
+	// acquire leases a saga to owner for d, unless another owner holds it.
+	acquire(ctx context.Context, id int64, owner string, d time.Duration) error
+	// extend renews owner's lease for d, and fails with ErrLeased if owner
+	// no longer holds it.
+	extend(ctx context.Context, id int64, owner string, d time.Duration) error
+	release(ctx context.Context, id int64, owner string) error
+	// setStep records a step transition and the saga's data, and renews
+	// owner's lease for d. Like setStatus, it writes nothing and fails with
+	// ErrLeased if owner no longer holds the lease.
+	setStep(ctx context.Context, s *Saga, i int, status StepStatus, errMsg string, attempts int, owner string, d time.Duration) error
+	setStatus(ctx context.Context, id int64, owner string, status Status, errMsg string) error
+}
+
+// pgStore keeps sagas in the tables of Schema.
+type pgStore struct {
+	db *sql.DB
+}
+
+func (p *pgStore) get(ctx context.Context, id int64) (*Saga, error) {
+	var s Saga
+	var raw []byte
+	err := p.db.QueryRowContext(ctx, `
+		SELECT id, name, order_id, status, data, error, created_at, updated_at
+		FROM sagas WHERE id = $1
+	`, id).Scan(&s.ID, &s.Name, &s.OrderID, &s.Status, &raw, &s.Error, &s.CreatedAt, &s.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.Data); err != nil {
+		return nil, fmt.Errorf("decoding saga %d data: %w", id, err)
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT name, status, attempts, error, updated_at
+		FROM saga_steps WHERE saga_id = $1 ORDER BY position
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var st StepState
+		if err := rows.Scan(&st.Name, &st.Status, &st.Attempts, &st.Error, &st.UpdatedAt); err != nil {
+			return nil, err
+		}
+		s.Steps = append(s.Steps, st)
+	}
+	return &s, rows.Err()
+}
+
+func (p *pgStore) latest(ctx context.Context, name string, orderID int64) (int64, error) {
+	var id int64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT id FROM sagas WHERE order_id = $1 AND name = $2 ORDER BY id DESC LIMIT 1
+	`, orderID, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (p *pgStore) unfinished(ctx context.Context, name string) ([]int64, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id FROM sagas
+		WHERE name = $1 AND status IN ($2, $3)
+		  AND (lease_until IS NULL OR lease_until < now())
+		ORDER BY id
+	`, name, StatusRunning, StatusCompensating)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (p *pgStore) acquire(ctx context.Context, id int64, owner string, d time.Duration) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE sagas SET lease_owner = $2, lease_until = now() + $3 * interval '1 millisecond'
+		WHERE id = $1 AND (lease_until IS NULL OR lease_until < now() OR lease_owner = $2)
+	`, id, owner, d.Milliseconds())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var exists bool
+		if err := p.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sagas WHERE id = $1)`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return ErrLeased
+	}
+	return nil
+}
+
+func (p *pgStore) extend(ctx context.Context, id int64, owner string, d time.Duration) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE sagas SET lease_until = now() + $3 * interval '1 millisecond'
+		WHERE id = $1 AND lease_owner = $2
+	`, id, owner, d.Milliseconds())
+	if err != nil {
+		return err
+	}
+	return leaseHeld(res)
+}
+
+func (p *pgStore) release(ctx context.Context, id int64, owner string) error {
+	_, err := p.db.ExecContext(ctx, `
+		UPDATE sagas SET lease_owner = NULL, lease_until = NULL
+		WHERE id = $1 AND lease_owner = $2
+	`, id, owner)
+	return err
+}
+
+func (p *pgStore) setStep(ctx context.Context, s *Saga, i int, status StepStatus, errMsg string, attempts int, owner string, d time.Duration) error {
+	raw, err := json.Marshal(s.Data)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The saga row is updated first: it locks the row, so the lease cannot
+	// change hands before the step is written.
+	res, err := tx.ExecContext(ctx, `
+		UPDATE sagas SET data = $2, updated_at = now(),
+			lease_until = now() + $3 * interval '1 millisecond'
+		WHERE id = $1 AND lease_owner = $4
+	`, s.ID, raw, d.Milliseconds(), owner)
+	if err != nil {
+		return err
+	}
+	if err := leaseHeld(res); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE saga_steps SET status = $3, error = $4, attempts = attempts + $5, updated_at = now()
+		WHERE saga_id = $1 AND position = $2
+	`, s.ID, i, status, errMsg, attempts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *pgStore) setStatus(ctx context.Context, id int64, owner string, status Status, errMsg string) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE sagas SET status = $3, error = $4, updated_at = now()
+		WHERE id = $1 AND lease_owner = $2
+	`, id, owner, status, errMsg)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(res)
+}
+
+// leaseHeld returns ErrLeased if an update conditioned on the lease owner
+// changed no row.
+func leaseHeld(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeased
+	}
+	return nil
+}
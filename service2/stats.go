@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"service2/analytics"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var statsGranularities = map[pb.StatsGranularity]analytics.Granularity{
+	pb.StatsGranularity_STATS_GRANULARITY_UNSPECIFIED: analytics.Day,
+	pb.StatsGranularity_STATS_GRANULARITY_HOUR:        analytics.Hour,
+	pb.StatsGranularity_STATS_GRANULARITY_DAY:         analytics.Day,
+	pb.StatsGranularity_STATS_GRANULARITY_WEEK:        analytics.Week,
+}
+
+var statsDimensions = map[pb.StatsGroupBy]analytics.Dimension{
+	pb.StatsGroupBy_STATS_GROUP_BY_UNSPECIFIED: analytics.ByProduct,
+	pb.StatsGroupBy_STATS_GROUP_BY_PRODUCT:     analytics.ByProduct,
+	pb.StatsGroupBy_STATS_GROUP_BY_USER:        analytics.ByUser,
+}
+
+// GetOrderStats returns time-bucketed order aggregates from the rollups.
+func (s *server) GetOrderStats(ctx context.Context, req *pb.GetOrderStatsRequest) (*pb.GetOrderStatsResponse, error) {
+	q := analytics.Query{
+		Granularity: statsGranularities[req.Granularity],
+		GroupBy:     statsDimensions[req.GroupBy],
+		To:          time.Now(),
+		Keys:        req.Keys,
+	}
+	if req.To != nil {
+		q.To = req.To.AsTime()
+	}
+	q.From = q.To.Add(-7 * 24 * time.Hour)
+	if req.From != nil {
+		q.From = req.From.AsTime()
+	}
+
+	buckets, err := s.stats.Query(ctx, q)
+	if errors.Is(err, analytics.ErrInvalidQuery) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		logrus.Errorf("Failed to query order stats: %v", err)
+		return nil, status.Error(codes.Internal, "failed to query order stats")
+	}
+
+	resp := &pb.GetOrderStatsResponse{}
+	for _, b := range buckets {
+		resp.Buckets = append(resp.Buckets, &pb.OrderStatsBucket{
+			Start:        timestamppb.New(b.Start),
+			Key:          b.Key,
+			Orders:       b.Orders,
+			Units:        b.Units,
+			RevenueCents: b.RevenueCents,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"service2/catalog"
+	"service2/inventory"
+	pb "service2/service2/proto"
+	"service2/subscriptions"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var cadenceFromProto = map[pb.Cadence]subscriptions.Cadence{
+	pb.Cadence_CADENCE_DAILY:    subscriptions.Daily,
+	pb.Cadence_CADENCE_WEEKLY:   subscriptions.Weekly,
+	pb.Cadence_CADENCE_BIWEEKLY: subscriptions.Biweekly,
+	pb.Cadence_CADENCE_MONTHLY:  subscriptions.Monthly,
+}
+
+var cadenceToProto = map[subscriptions.Cadence]pb.Cadence{
+	subscriptions.Daily:    pb.Cadence_CADENCE_DAILY,
+	subscriptions.Weekly:   pb.Cadence_CADENCE_WEEKLY,
+	subscriptions.Biweekly: pb.Cadence_CADENCE_BIWEEKLY,
+	subscriptions.Monthly:  pb.Cadence_CADENCE_MONTHLY,
+}
+
+// CreateSubscription sets up a recurring order of active products.
+func (s *server) CreateSubscription(ctx context.Context, req *pb.CreateSubscriptionRequest) (*pb.Subscription, error) {
+	logrus.Infof("Received CreateSubscription request: user_id=%d, cadence=%s, items=%d",
+		req.UserId, req.Cadence, len(req.Items))
+
+	cadence, ok := cadenceFromProto[req.Cadence]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "a cadence is required")
+	}
+	if len(req.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one item is required")
+	}
+	items, err := requestedItems(&pb.CreateOrderRequest{Items: req.Items})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkUser(ctx, req.UserId); err != nil {
+		return nil, err
+	}
+	skus := make([]string, 0, len(items))
+	for _, it := range items {
+		skus = append(skus, it.SKU)
+	}
+	products, err := s.catalog.Lookup(ctx, skus)
+	if err != nil {
+		return nil, catalogError("look up products", err)
+	}
+	for _, sku := range skus {
+		p, ok := products[sku]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "%v: %s", catalog.ErrNotFound, sku)
+		}
+		if !p.Active {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v: %s", catalog.ErrInactive, sku)
+		}
+	}
+
+	sub := &subscriptions.Subscription{
+		UserID:   req.UserId,
+		Items:    items,
+		Cadence:  cadence,
+		AnchorAt: time.Now(),
+	}
+	if req.FirstRunAt != nil {
+		sub.AnchorAt = req.FirstRunAt.AsTime()
+	}
+	if err := s.subscriptions.Create(ctx, sub); err != nil {
+		return nil, subscriptionError("create subscription", err)
+	}
+	logrus.WithField("subscription_id", sub.ID).Info("Subscription created")
+	return subscriptionToProto(sub), nil
+}
+
+// GetSubscription returns a subscription.
+func (s *server) GetSubscription(ctx context.Context, req *pb.GetSubscriptionRequest) (*pb.Subscription, error) {
+	sub, err := s.subscriptions.Get(ctx, req.SubscriptionId)
+	if err != nil {
+		return nil, subscriptionError("get subscription", err)
+	}
+	return subscriptionToProto(sub), nil
+}
+
+// ListSubscriptions returns the user's active and paused subscriptions.
+func (s *server) ListSubscriptions(ctx context.Context, req *pb.ListSubscriptionsRequest) (*pb.ListSubscriptionsResponse, error) {
+	subs, err := s.subscriptions.ListByUser(ctx, req.UserId)
+	if err != nil {
+		return nil, subscriptionError("list subscriptions", err)
+	}
+	resp := &pb.ListSubscriptionsResponse{}
+	for _, sub := range subs {
+		resp.Subscriptions = append(resp.Subscriptions, subscriptionToProto(sub))
+	}
+	return resp, nil
+}
+
+// PauseSubscription stops a subscription from placing orders until resumed.
+func (s *server) PauseSubscription(ctx context.Context, req *pb.PauseSubscriptionRequest) (*pb.Subscription, error) {
+	sub, err := s.subscriptions.Pause(ctx, req.SubscriptionId)
+	if err != nil {
+		return nil, subscriptionError("pause subscription", err)
+	}
+	return subscriptionToProto(sub), nil
+}
+
+// ResumeSubscription reactivates a paused subscription from its next
+// scheduled run.
+func (s *server) ResumeSubscription(ctx context.Context, req *pb.ResumeSubscriptionRequest) (*pb.Subscription, error) {
+	sub, err := s.subscriptions.Resume(ctx, req.SubscriptionId)
+	if err != nil {
+		return nil, subscriptionError("resume subscription", err)
+	}
+	return subscriptionToProto(sub), nil
+}
+
+// SkipNextRun skips the next run of a subscription.
+func (s *server) SkipNextRun(ctx context.Context, req *pb.SkipNextRunRequest) (*pb.Subscription, error) {
+	sub, err := s.subscriptions.SkipNext(ctx, req.SubscriptionId)
+	if err != nil {
+		return nil, subscriptionError("skip subscription run", err)
+	}
+	return subscriptionToProto(sub), nil
+}
+
+// CancelSubscription ends a subscription.
+func (s *server) CancelSubscription(ctx context.Context, req *pb.CancelSubscriptionRequest) (*pb.Subscription, error) {
+	sub, err := s.subscriptions.Cancel(ctx, req.SubscriptionId)
+	if err != nil {
+		return nil, subscriptionError("cancel subscription", err)
+	}
+	return subscriptionToProto(sub), nil
+}
+
+// placeSubscriptionOrder places a subscription's order the way CreateOrder
+// does, at current catalog prices. It is the scheduler's PlaceFunc, so gRPC
+// statuses are turned back into plain errors for the subscription's
+// last_error.
+func (s *server) placeSubscriptionOrder(ctx context.Context, userID int32, items []inventory.Item,
+	within func(ctx context.Context, tx *sql.Tx, orderID int64) error) (int64, error) {
+	if err := s.checkUser(ctx, userID); err != nil {
+		return 0, errors.New(status.Convert(err).Message())
+	}
+	prices, err := s.catalog.Quote(ctx, items)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.placeOrder(ctx, userID, items, prices, nil, within)
+	if _, ok := status.FromError(err); ok && err != nil {
+		return 0, errors.New(status.Convert(err).Message())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.Id), nil
+}
+
+// subscriptionError maps subscription errors to gRPC status codes.
+func subscriptionError(op string, err error) error {
+	switch {
+	case errors.Is(err, subscriptions.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, subscriptions.ErrInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, subscriptions.ErrStatusConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logrus.Errorf("Failed to %s: %v", op, err)
+	return status.Errorf(codes.Internal, "failed to %s", op)
+}
+
+func subscriptionToProto(sub *subscriptions.Subscription) *pb.Subscription {
+	out := &pb.Subscription{
+		Id:          sub.ID,
+		UserId:      sub.UserID,
+		Cadence:     cadenceToProto[sub.Cadence],
+		Status:      string(sub.Status),
+		FirstRunAt:  timestamppb.New(sub.AnchorAt),
+		NextRunAt:   timestamppb.New(sub.NextRunAt),
+		LastOrderId: int32(sub.LastOrderID),
+		LastRunAt:   optionalTimestamp(sub.LastRunAt),
+		LastError:   sub.LastError,
+		CreatedAt:   timestamppb.New(sub.CreatedAt),
+	}
+	for _, it := range sub.Items {
+		out.Items = append(out.Items, &pb.OrderItem{Sku: it.SKU, Quantity: it.Quantity})
+	}
+	return out
+}
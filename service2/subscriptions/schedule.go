@@ -0,0 +1,60 @@
+package subscriptions
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cadence is how often a subscription places an order.
+type Cadence string
+
+const (
+	Daily    Cadence = "DAILY"
+	Weekly   Cadence = "WEEKLY"
+	Biweekly Cadence = "BIWEEKLY"
+	// Monthly runs on the anchor's day of the month, or on the last day of
+	// shorter months.
+	Monthly Cadence = "MONTHLY"
+)
+
+// Valid reports whether c is a known cadence.
+func (c Cadence) Valid() bool {
+	switch c {
+	case Daily, Weekly, Biweekly, Monthly:
+		return true
+	}
+	return false
+}
+
+// occurrence returns the time of the nth run of a schedule whose first run
+// is at anchor. Runs are always computed from the anchor, so monthly runs
+// do not drift after a short month.
+func occurrence(anchor time.Time, c Cadence, n int) time.Time {
+	switch c {
+	case Daily:
+		return anchor.AddDate(0, 0, n)
+	case Weekly:
+		return anchor.AddDate(0, 0, 7*n)
+	case Biweekly:
+		return anchor.AddDate(0, 0, 14*n)
+	case Monthly:
+		y, m, d := anchor.Date()
+		first := time.Date(y, m+time.Month(n), 1, anchor.Hour(), anchor.Minute(), anchor.Second(), anchor.Nanosecond(), anchor.Location())
+		if last := first.AddDate(0, 1, -1).Day(); d > last {
+			d = last
+		}
+		return first.AddDate(0, 0, d-1)
+	}
+	panic(fmt.Sprintf("unknown cadence %q", c))
+}
+
+// nextAfter returns the first run after run n that falls after t. Runs
+// missed while the scheduler was down or the subscription paused are
+// skipped rather than placed late.
+func nextAfter(anchor time.Time, c Cadence, n int, t time.Time) int {
+	next := n + 1
+	for !occurrence(anchor, c, next).After(t) {
+		next++
+	}
+	return next
+}
@@ -0,0 +1,42 @@
+package subscriptions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccurrenceMonthlyClampsWithoutDrifting(t *testing.T) {
+	anchor := time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)
+	want := []time.Time{
+		anchor,
+		time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 31, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 30, 9, 0, 0, 0, time.UTC),
+	}
+	for n, w := range want {
+		if got := occurrence(anchor, Monthly, n); !got.Equal(w) {
+			t.Errorf("run %d = %v, want %v", n, got, w)
+		}
+	}
+	if got, w := occurrence(anchor, Monthly, 13), time.Date(2025, 2, 28, 9, 0, 0, 0, time.UTC); !got.Equal(w) {
+		t.Errorf("run 13 = %v, want %v", got, w)
+	}
+}
+
+func TestNextAfterSkipsMissedRuns(t *testing.T) {
+	anchor := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+
+	// Run 0 is placed on time; the next is a week later.
+	if got := nextAfter(anchor, Weekly, 0, anchor); got != 1 {
+		t.Errorf("next after an on-time run = %d, want 1", got)
+	}
+	// Three weeks of downtime: runs 1 and 2 are skipped.
+	late := anchor.Add(20 * 24 * time.Hour)
+	if got := nextAfter(anchor, Weekly, 0, late); got != 3 {
+		t.Errorf("next after downtime = %d, want 3", got)
+	}
+	// A run exactly at t is not after it.
+	if got := nextAfter(anchor, Daily, 0, occurrence(anchor, Daily, 2)); got != 3 {
+		t.Errorf("next after a run boundary = %d, want 3", got)
+	}
+}
@@ -0,0 +1,227 @@
+package subscriptions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"service2/inventory"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrAlreadyRun is returned when another process already placed the
+	// order for a run.
+	ErrAlreadyRun = errors.New("subscription run already placed")
+	// ErrChanged is returned when a subscription was paused, skipped or
+	// cancelled while its order was being placed.
+	ErrChanged = errors.New("subscription changed during run")
+)
+
+// PlaceFunc places an order for items on behalf of userID and returns its
+// ID. It must call within in the transaction that creates the order.
+type PlaceFunc func(ctx context.Context, userID int32, items []inventory.Item,
+	within func(ctx context.Context, tx *sql.Tx, orderID int64) error) (int64, error)
+
+// Scheduler places the orders of due subscriptions. Replicas may run
+// schedulers side by side: each claims due subscriptions with a lease, and
+// a run's order commits together with its subscription_runs row, so a run
+// is never placed twice.
+type Scheduler struct {
+	store *Store
+	place PlaceFunc
+	owner string
+
+	// LeaseDuration bounds how long a crashed process blocks others from
+	// placing its claimed runs.
+	LeaseDuration time.Duration
+	// RetryDelay is the wait before a failed run is tried again.
+	RetryDelay time.Duration
+	// MaxAttempts is how many times a run is tried before it is skipped.
+	MaxAttempts int
+	// BatchSize is the most subscriptions claimed at once.
+	BatchSize int
+}
+
+// NewScheduler creates a Scheduler that places orders with place.
+func NewScheduler(store *Store, place PlaceFunc) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		store:         store,
+		place:         place,
+		owner:         fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		LeaseDuration: time.Minute,
+		RetryDelay:    time.Minute,
+		MaxAttempts:   3,
+		BatchSize:     20,
+	}
+}
+
+// RunDue places the orders of every due subscription it can claim and
+// returns how many were placed.
+func (s *Scheduler) RunDue(ctx context.Context) (int, error) {
+	placed := 0
+	for {
+		ids, err := s.claim(ctx)
+		if err != nil {
+			return placed, err
+		}
+		for _, id := range ids {
+			if s.run(ctx, id) {
+				placed++
+			}
+		}
+		if len(ids) < s.BatchSize || ctx.Err() != nil {
+			return placed, ctx.Err()
+		}
+	}
+}
+
+// RunLoop calls RunDue immediately and then on every interval until ctx is
+// cancelled.
+func (s *Scheduler) RunLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.RunDue(ctx); err != nil && ctx.Err() == nil {
+			logrus.Errorf("Failed to run subscriptions: %v", err)
+		} else if n > 0 {
+			logrus.WithField("orders", n).Info("Placed subscription orders")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim leases a batch of due subscriptions that no other process holds.
+func (s *Scheduler) claim(ctx context.Context) ([]int64, error) {
+	rows, err := s.store.db.QueryContext(ctx, `
+		UPDATE subscriptions SET lease_owner = $1, lease_until = now() + $2 * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM subscriptions
+			WHERE status = $3 AND next_run_at <= now()
+			  AND (lease_until IS NULL OR lease_until < now())
+			ORDER BY next_run_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id
+	`, s.owner, s.LeaseDuration.Milliseconds(), StatusActive, s.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// run places the order for the claimed subscription's current run and
+// reports whether it was placed.
+func (s *Scheduler) run(ctx context.Context, id int64) bool {
+	log := logrus.WithField("subscription_id", id)
+	sub, err := s.store.Get(ctx, id)
+	if err != nil {
+		log.WithError(err).Error("Failed to load subscription")
+		return false
+	}
+	if sub.Status != StatusActive {
+		s.release(ctx, sub)
+		return false
+	}
+	log = log.WithField("sequence", sub.Sequence)
+
+	orderID, err := s.place(ctx, sub.UserID, sub.Items, func(ctx context.Context, tx *sql.Tx, orderID int64) error {
+		return s.complete(ctx, tx, sub, orderID)
+	})
+	switch {
+	case errors.Is(err, ErrAlreadyRun), errors.Is(err, ErrChanged):
+		log.WithError(err).Info("Subscription run abandoned")
+		s.release(ctx, sub)
+		return false
+	case err != nil:
+		s.fail(ctx, sub, err)
+		return false
+	}
+	log.WithField("order_id", orderID).Info("Subscription order placed")
+	return true
+}
+
+// complete records the run and advances the subscription to its next run,
+// inside the transaction that creates the order.
+func (s *Scheduler) complete(ctx context.Context, tx *sql.Tx, sub *Subscription, orderID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO subscription_runs (subscription_id, sequence, scheduled_for, order_id)
+		VALUES ($1, $2, $3, $4)
+	`, sub.ID, sub.Sequence, sub.NextRunAt, orderID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%w: subscription %d run %d", ErrAlreadyRun, sub.ID, sub.Sequence)
+	}
+	if err != nil {
+		return err
+	}
+
+	next := nextAfter(sub.AnchorAt, sub.Cadence, sub.Sequence, time.Now())
+	res, err := tx.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET sequence = $4, next_run_at = $5, attempts = 0, last_order_id = $6, last_run_at = now(),
+		    last_error = '', lease_owner = NULL, lease_until = NULL, updated_at = now()
+		WHERE id = $1 AND sequence = $2 AND status = 'ACTIVE' AND lease_owner = $3
+	`, sub.ID, sub.Sequence, s.owner, next, occurrence(sub.AnchorAt, sub.Cadence, next), orderID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: subscription %d run %d", ErrChanged, sub.ID, sub.Sequence)
+	}
+	return nil
+}
+
+// fail records a failed attempt. The run is retried after RetryDelay, and
+// skipped once it has failed MaxAttempts times.
+func (s *Scheduler) fail(ctx context.Context, sub *Subscription, cause error) {
+	log := logrus.WithFields(logrus.Fields{"subscription_id": sub.ID, "sequence": sub.Sequence}).WithError(cause)
+	attempts, sequence := sub.Attempts+1, sub.Sequence
+	if attempts >= s.MaxAttempts {
+		log.Warn("Skipping subscription run after repeated failures")
+		attempts, sequence = 0, nextAfter(sub.AnchorAt, sub.Cadence, sub.Sequence, time.Now())
+	} else {
+		log.Warn("Subscription run failed; will retry")
+	}
+	if _, err := s.store.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET attempts = $4, sequence = $5, next_run_at = $6, last_error = $7,
+		    lease_until = now() + $8 * interval '1 millisecond', updated_at = now()
+		WHERE id = $1 AND sequence = $2 AND lease_owner = $3
+	`, sub.ID, sub.Sequence, s.owner, attempts, sequence, occurrence(sub.AnchorAt, sub.Cadence, sequence),
+		cause.Error(), s.RetryDelay.Milliseconds()); err != nil {
+		log.WithError(err).Error("Failed to record subscription failure")
+	}
+}
+
+func (s *Scheduler) release(ctx context.Context, sub *Subscription) {
+	if _, err := s.store.db.ExecContext(ctx, `
+		UPDATE subscriptions SET lease_owner = NULL, lease_until = NULL
+		WHERE id = $1 AND lease_owner = $2
+	`, sub.ID, s.owner); err != nil {
+		logrus.WithField("subscription_id", sub.ID).WithError(err).Warn("Failed to release subscription lease")
+	}
+}
@@ -0,0 +1,362 @@
+// Package subscriptions stores recurring orders and places them when they
+// are due.
+//
+// A subscription orders the same items on a fixed cadence. Its runs are
+// numbered from its first run, the anchor, and the next run is tracked by
+// number, so pausing, skipping or downtime never shifts the schedule.
+package subscriptions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"service2/inventory"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Schema creates the subscription tables. subscription_runs records the
+// order placed for each run, and its key keeps a run from being placed
+// twice.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		id            BIGSERIAL PRIMARY KEY,
+		user_id       INT NOT NULL,
+		cadence       TEXT NOT NULL,
+		status        TEXT NOT NULL,
+		anchor_at     TIMESTAMPTZ NOT NULL,
+		sequence      INT NOT NULL DEFAULT 0,
+		next_run_at   TIMESTAMPTZ NOT NULL,
+		attempts      INT NOT NULL DEFAULT 0,
+		last_order_id BIGINT,
+		last_run_at   TIMESTAMPTZ,
+		last_error    TEXT NOT NULL DEFAULT '',
+		lease_owner   TEXT,
+		lease_until   TIMESTAMPTZ,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS subscriptions_user_id_idx ON subscriptions (user_id);
+	CREATE INDEX IF NOT EXISTS subscriptions_due_idx ON subscriptions (next_run_at) WHERE status = 'ACTIVE';
+	CREATE TABLE IF NOT EXISTS subscription_items (
+		subscription_id BIGINT NOT NULL REFERENCES subscriptions (id),
+		sku             TEXT NOT NULL,
+		quantity        INT NOT NULL CHECK (quantity > 0),
+		PRIMARY KEY (subscription_id, sku)
+	);
+	CREATE TABLE IF NOT EXISTS subscription_runs (
+		subscription_id BIGINT NOT NULL REFERENCES subscriptions (id),
+		sequence        INT NOT NULL,
+		scheduled_for   TIMESTAMPTZ NOT NULL,
+		order_id        BIGINT NOT NULL,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (subscription_id, sequence)
+	);
+`
+
+// Status is the state of a subscription.
+type Status string
+
+const (
+	StatusActive    Status = "ACTIVE"
+	StatusPaused    Status = "PAUSED"
+	StatusCancelled Status = "CANCELLED"
+)
+
+var (
+	// ErrNotFound is returned when a subscription does not exist.
+	ErrNotFound = errors.New("subscription not found")
+	// ErrInvalid is returned when creating a subscription without items or
+	// with an unknown cadence.
+	ErrInvalid = errors.New("invalid subscription")
+	// ErrStatusConflict is returned when a subscription is not in a state
+	// that allows the requested change.
+	ErrStatusConflict = errors.New("subscription status does not allow this change")
+)
+
+// Subscription is a row of the subscriptions table with its items.
+type Subscription struct {
+	ID      int64
+	UserID  int32
+	Items   []inventory.Item
+	Cadence Cadence
+	Status  Status
+	// AnchorAt is the time of the first run; run n is the nth occurrence of
+	// the cadence after it.
+	AnchorAt  time.Time
+	Sequence  int
+	NextRunAt time.Time
+	// Attempts counts the failed attempts at the current run.
+	Attempts    int
+	LastOrderID int64
+	LastRunAt   time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Store reads and writes subscriptions.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a Store backed by db.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Create adds an active subscription whose first run is at sub.AnchorAt and
+// fills in its ID and timestamps.
+func (s *Store) Create(ctx context.Context, sub *Subscription) (err error) {
+	if len(sub.Items) == 0 {
+		return fmt.Errorf("%w: no items", ErrInvalid)
+	}
+	if !sub.Cadence.Valid() {
+		return fmt.Errorf("%w: unknown cadence %q", ErrInvalid, sub.Cadence)
+	}
+	sub.Status = StatusActive
+	sub.Sequence = 0
+	sub.NextRunAt = sub.AnchorAt
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	if err = tx.QueryRowContext(ctx, `
+		INSERT INTO subscriptions (user_id, cadence, status, anchor_at, next_run_at)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING id, created_at, updated_at
+	`, sub.UserID, sub.Cadence, sub.Status, sub.AnchorAt).Scan(&sub.ID, &sub.CreatedAt, &sub.UpdatedAt); err != nil {
+		return err
+	}
+	for _, it := range sub.Items {
+		if _, err = tx.ExecContext(ctx, `
+			INSERT INTO subscription_items (subscription_id, sku, quantity) VALUES ($1, $2, $3)
+		`, sub.ID, it.SKU, it.Quantity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const selectSubscription = `
+	SELECT id, user_id, cadence, status, anchor_at, sequence, next_run_at, attempts,
+	       COALESCE(last_order_id, 0), last_run_at, last_error, created_at, updated_at
+	FROM subscriptions
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSubscription(row rowScanner) (*Subscription, error) {
+	var sub Subscription
+	var lastRunAt sql.NullTime
+	if err := row.Scan(&sub.ID, &sub.UserID, &sub.Cadence, &sub.Status, &sub.AnchorAt, &sub.Sequence,
+		&sub.NextRunAt, &sub.Attempts, &sub.LastOrderID, &lastRunAt, &sub.LastError,
+		&sub.CreatedAt, &sub.UpdatedAt); err != nil {
+		return nil, err
+	}
+	sub.LastRunAt = lastRunAt.Time
+	return &sub, nil
+}
+
+// Get returns the subscription with the given ID and its items.
+func (s *Store) Get(ctx context.Context, id int64) (*Subscription, error) {
+	sub, err := scanSubscription(s.db.QueryRowContext(ctx, selectSubscription+` WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadItems(ctx, []*Subscription{sub}); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// ListByUser returns the user's subscriptions that are not cancelled,
+// oldest first.
+func (s *Store) ListByUser(ctx context.Context, userID int32) ([]*Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, selectSubscription+`
+		WHERE user_id = $1 AND status <> $2 ORDER BY id
+	`, userID, StatusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, s.loadItems(ctx, out)
+}
+
+func (s *Store) loadItems(ctx context.Context, subs []*Subscription) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Subscription, len(subs))
+	ids := make([]int64, 0, len(subs))
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+		ids = append(ids, sub.ID)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT subscription_id, sku, quantity FROM subscription_items
+		WHERE subscription_id = ANY($1) ORDER BY subscription_id, sku
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var it inventory.Item
+		if err := rows.Scan(&id, &it.SKU, &it.Quantity); err != nil {
+			return err
+		}
+		byID[id].Items = append(byID[id].Items, it)
+	}
+	return rows.Err()
+}
+
+// Pause stops an active subscription from placing orders. Pausing a paused
+// subscription is a no-op.
+func (s *Store) Pause(ctx context.Context, id int64) (*Subscription, error) {
+	return s.modify(ctx, id, func(sub *Subscription, now time.Time) error {
+		switch sub.Status {
+		case StatusPaused:
+			return nil
+		case StatusActive:
+			sub.Status = StatusPaused
+			return nil
+		}
+		return fmt.Errorf("%w: subscription %d is %s", ErrStatusConflict, id, sub.Status)
+	})
+}
+
+// Resume reactivates a paused subscription. Runs that fell due while it was
+// paused are skipped. Resuming an active subscription is a no-op.
+func (s *Store) Resume(ctx context.Context, id int64) (*Subscription, error) {
+	return s.modify(ctx, id, func(sub *Subscription, now time.Time) error {
+		switch sub.Status {
+		case StatusActive:
+			return nil
+		case StatusPaused:
+			sub.Status = StatusActive
+			if !sub.NextRunAt.After(now) {
+				sub.Sequence = nextAfter(sub.AnchorAt, sub.Cadence, sub.Sequence, now)
+			}
+			return nil
+		}
+		return fmt.Errorf("%w: subscription %d is %s", ErrStatusConflict, id, sub.Status)
+	})
+}
+
+// SkipNext skips the next run, or the run that is due if it has not been
+// placed yet.
+func (s *Store) SkipNext(ctx context.Context, id int64) (*Subscription, error) {
+	return s.modify(ctx, id, func(sub *Subscription, now time.Time) error {
+		if sub.Status == StatusCancelled {
+			return fmt.Errorf("%w: subscription %d is %s", ErrStatusConflict, id, sub.Status)
+		}
+		after := sub.NextRunAt
+		if now.After(after) {
+			after = now
+		}
+		sub.Sequence = nextAfter(sub.AnchorAt, sub.Cadence, sub.Sequence, after)
+		return nil
+	})
+}
+
+// Cancel ends a subscription for good. Cancelling it again is a no-op.
+func (s *Store) Cancel(ctx context.Context, id int64) (*Subscription, error) {
+	return s.modify(ctx, id, func(sub *Subscription, now time.Time) error {
+		sub.Status = StatusCancelled
+		return nil
+	})
+}
+
+// CancelByUser cancels every subscription of userID, as when the user is
+// deleted, and returns how many it cancelled. Cancelling them again is a
+// no-op, and a run in progress is discarded like for Cancel.
+func (s *Store) CancelByUser(ctx context.Context, userID int32) (int, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE subscriptions SET status = $2, updated_at = now()
+		WHERE user_id = $1 AND status <> $2
+	`, userID, StatusCancelled)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// modify applies change to the subscription under a row lock and stores
+// its status and schedule. Changing the run number resets the attempts at
+// the current run. The scheduler's updates are conditional on the status
+// and run number, so a run in progress is discarded when they change.
+func (s *Store) modify(ctx context.Context, id int64, change func(sub *Subscription, now time.Time) error) (_ *Subscription, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				logrus.Errorf("Failed to rollback transaction: %v", rbErr)
+			}
+		}
+	}()
+
+	var now time.Time
+	if err = tx.QueryRowContext(ctx, `SELECT now()`).Scan(&now); err != nil {
+		return nil, err
+	}
+	sub, err := scanSubscription(tx.QueryRowContext(ctx, selectSubscription+` WHERE id = $1 FOR UPDATE`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sequence := sub.Sequence
+	if err = change(sub, now); err != nil {
+		return nil, err
+	}
+	if sub.Sequence != sequence {
+		sub.Attempts = 0
+	}
+	if _, err = tx.ExecContext(ctx, `
+		UPDATE subscriptions SET status = $2, sequence = $3, next_run_at = $4, attempts = $5, updated_at = now()
+		WHERE id = $1
+	`, id, sub.Status, sub.Sequence, occurrence(sub.AnchorAt, sub.Cadence, sub.Sequence), sub.Attempts); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
@@ -0,0 +1,285 @@
+package subscriptions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"service2/internal/testutil"
+	"service2/inventory"
+)
+
+// testStore returns a Store on the Postgres database in TEST_DATABASE_URL,
+// and skips the test when it is not set.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	return NewStore(testutil.DB(t, Schema))
+}
+
+// testUser returns a user ID no other test run uses, and deletes its
+// subscriptions when the test ends.
+func testUser(t *testing.T, s *Store) int32 {
+	t.Helper()
+	userID := int32(time.Now().UnixNano()%1_000_000_000) + 1
+	t.Cleanup(func() {
+		for _, table := range []string{"subscription_runs", "subscription_items"} {
+			s.db.Exec(`DELETE FROM `+table+` WHERE subscription_id IN (SELECT id FROM subscriptions WHERE user_id = $1)`, userID)
+		}
+		s.db.Exec(`DELETE FROM subscriptions WHERE user_id = $1`, userID)
+	})
+	return userID
+}
+
+// testPlacer places orders by committing the subscription run alone, and
+// counts them by user.
+type testPlacer struct {
+	db     *sql.DB
+	mutex  sync.Mutex
+	placed map[int32]int
+	// before, if set, runs before each order is placed; an error fails the
+	// order.
+	before func(userID int32) error
+}
+
+func newTestPlacer(s *Store) *testPlacer {
+	return &testPlacer{db: s.db, placed: make(map[int32]int)}
+}
+
+func (p *testPlacer) place(ctx context.Context, userID int32, items []inventory.Item,
+	within func(ctx context.Context, tx *sql.Tx, orderID int64) error) (int64, error) {
+	if p.before != nil {
+		if err := p.before(userID); err != nil {
+			return 0, err
+		}
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := within(ctx, tx, 1); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.placed[userID]++
+	return 1, nil
+}
+
+func (p *testPlacer) count(userID int32) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.placed[userID]
+}
+
+// createDue creates a weekly subscription for userID whose first run fell
+// due an hour ago.
+func createDue(t *testing.T, s *Store, userID int32) *Subscription {
+	t.Helper()
+	sub := &Subscription{UserID: userID, Cadence: Weekly, AnchorAt: time.Now().Add(-time.Hour), Items: []inventory.Item{{SKU: "A", Quantity: 1}}}
+	if err := s.Create(context.Background(), sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestCancelByUserStopsRuns(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	deleted, other := testUser(t, s), testUser(t, s)
+
+	// The deleted user has a due and a paused subscription, the other user
+	// a due one.
+	var subs []*Subscription
+	for _, userID := range []int32{deleted, deleted, other} {
+		subs = append(subs, createDue(t, s, userID))
+	}
+	if _, err := s.Pause(ctx, subs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.CancelByUser(ctx, deleted)
+	if err != nil || n != 2 {
+		t.Fatalf("CancelByUser = %d, %v, want 2", n, err)
+	}
+	if n, err := s.CancelByUser(ctx, deleted); err != nil || n != 0 {
+		t.Fatalf("repeated CancelByUser = %d, %v, want 0", n, err)
+	}
+	if left, err := s.ListByUser(ctx, deleted); err != nil || len(left) != 0 {
+		t.Fatalf("subscriptions left: %v, %v", left, err)
+	}
+
+	// The scheduler no longer places orders for the deleted user.
+	p := newTestPlacer(s)
+	if _, err := NewScheduler(s, p.place).RunDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p.count(deleted) != 0 || p.count(other) != 1 {
+		t.Fatalf("placed %v, want only one order for user %d", p.placed, other)
+	}
+}
+
+func TestSchedulersPlaceARunOnce(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, s)
+	sub := createDue(t, s, userID)
+
+	// Replica a claims the run and stalls past its lease before placing it;
+	// replica b takes the run over meanwhile.
+	started, resume := make(chan struct{}), make(chan struct{})
+	pa, pb := newTestPlacer(s), newTestPlacer(s)
+	pa.before = func(id int32) error {
+		if id == userID {
+			close(started)
+			<-resume
+		}
+		return nil
+	}
+	a, b := NewScheduler(s, pa.place), NewScheduler(s, pb.place)
+	a.owner, b.owner = "replica-a", "replica-b"
+	a.LeaseDuration = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := a.RunDue(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	_, err := b.RunDue(ctx)
+	close(resume)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pa.count(userID) != 0 || pb.count(userID) != 1 {
+		t.Fatalf("placed by a %d, by b %d, want only b's", pa.count(userID), pb.count(userID))
+	}
+	var runs int
+	if err := s.db.QueryRow(`SELECT count(*) FROM subscription_runs WHERE subscription_id = $1`, sub.ID).Scan(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("%d runs recorded, want 1", runs)
+	}
+	got, err := s.Get(ctx, sub.ID)
+	if err != nil || got.Sequence != 1 {
+		t.Fatalf("subscription after the run: %+v, %v", got, err)
+	}
+}
+
+func TestFailedRunIsRetriedThenSkipped(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, s)
+	sub := createDue(t, s, userID)
+
+	p := newTestPlacer(s)
+	p.before = func(id int32) error {
+		if id == userID {
+			return errors.New("payment declined")
+		}
+		return nil
+	}
+	scheduler := NewScheduler(s, p.place)
+	scheduler.RetryDelay = 0
+
+	for attempt := 1; attempt < scheduler.MaxAttempts; attempt++ {
+		if _, err := scheduler.RunDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, sub.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Attempts != attempt || got.Sequence != 0 || got.LastError != "payment declined" ||
+			!got.NextRunAt.Equal(occurrence(got.AnchorAt, Weekly, 0)) {
+			t.Fatalf("after attempt %d: %+v", attempt, got)
+		}
+	}
+
+	// The last attempt gives up on the run and moves to the next one.
+	if _, err := scheduler.RunDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Attempts != 0 || got.Sequence != 1 || !got.NextRunAt.Equal(occurrence(got.AnchorAt, Weekly, 1)) {
+		t.Fatalf("after the last attempt: %+v", got)
+	}
+	if n, err := scheduler.RunDue(ctx); err != nil || p.count(userID) != 0 {
+		t.Fatalf("RunDue before the next run = %d, %v; placed %d", n, err, p.count(userID))
+	}
+}
+
+func TestPauseResumeAndSkipMoveTheSchedule(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	userID := testUser(t, s)
+	sub := createDue(t, s, userID)
+	if _, err := s.db.Exec(`UPDATE subscriptions SET attempts = 2 WHERE id = $1`, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string, got *Subscription, err error, status Status, sequence int) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if got.Status != status || got.Sequence != sequence || got.Attempts != 0 ||
+			!got.NextRunAt.Equal(occurrence(got.AnchorAt, Weekly, sequence)) {
+			t.Fatalf("%s: %+v, want %s at run %d", step, got, status, sequence)
+		}
+	}
+
+	// Skipping the due run moves to next week's, and skipping again to the
+	// week after.
+	got, err := s.SkipNext(ctx, sub.ID)
+	check("skip the due run", got, err, StatusActive, 1)
+	got, err = s.SkipNext(ctx, sub.ID)
+	check("skip the next run", got, err, StatusActive, 2)
+
+	got, err = s.Pause(ctx, sub.ID)
+	check("pause", got, err, StatusPaused, 2)
+	got, err = s.Pause(ctx, sub.ID)
+	check("pause again", got, err, StatusPaused, 2)
+
+	// A month passes while paused: resuming skips the runs that fell due.
+	if _, err := s.db.Exec(`
+		UPDATE subscriptions SET anchor_at = anchor_at - interval '30 days', next_run_at = next_run_at - interval '30 days'
+		WHERE id = $1
+	`, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Resume(ctx, sub.ID)
+	check("resume", got, err, StatusActive, 5)
+	if !got.NextRunAt.After(time.Now()) {
+		t.Fatalf("resumed with a past run at %v", got.NextRunAt)
+	}
+	got, err = s.Resume(ctx, sub.ID)
+	check("resume again", got, err, StatusActive, 5)
+
+	if _, err := s.Cancel(ctx, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(context.Context, int64) (*Subscription, error){
+		"pause": s.Pause, "resume": s.Resume, "skip": s.SkipNext,
+	} {
+		if _, err := change(ctx, sub.ID); !errors.Is(err, ErrStatusConflict) {
+			t.Errorf("%s after cancelling: %v, want ErrStatusConflict", name, err)
+		}
+	}
+}
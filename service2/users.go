@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"service2/events"
+	"service2/orders"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// eventUserDeleted is consumed from the user-events topic when a user is
+// removed.
+const eventUserDeleted = "UserDeleted"
+
+// userDeleted is the payload of a UserDeleted event.
+type userDeleted struct {
+	UserID int32 `json:"user_id"`
+}
+
+// userEventsActor is recorded as the actor of cancellations triggered by
+// user events.
+const userEventsActor = "system:user-events"
+
+// handleUserEvent processes a message from the "user-events" topic. It runs
+// inside the transaction that marks the event as processed; cancellations of
+// subscriptions and orders commit on their own, so they must be safe to
+// repeat if that transaction fails. Messages that are not event envelopes,
+// such as the plain-text user creation notices, are only logged.
+func (s *server) handleUserEvent(ctx context.Context, tx *sql.Tx, m kafka.Message) error {
+	ev, err := events.Decode(m.Value)
+	if err != nil || ev.Type == "" {
+		logrus.Infof("Consumed Kafka message: key=%s, value=%s", string(m.Key), string(m.Value))
+		return nil
+	}
+
+	switch ev.Type {
+	case eventUserDeleted:
+		var data userDeleted
+		if err := json.Unmarshal(ev.Data, &data); err != nil || data.UserID == 0 {
+			logrus.WithField("event_id", ev.ID).Warn("Ignoring malformed UserDeleted event")
+			return nil
+		}
+		if err := s.cancelUserSubscriptions(ctx, data.UserID); err != nil {
+			return err
+		}
+		return s.cancelUserOrders(ctx, data.UserID)
+	default:
+		logrus.WithFields(logrus.Fields{
+			"event_id": ev.ID,
+			"type":     ev.Type,
+		}).Debug("Ignoring user event")
+		return nil
+	}
+}
+
+// cancelUserSubscriptions cancels the subscriptions of a deleted user, so
+// the scheduler stops placing orders the user check would reject. It runs
+// before the orders are cancelled, so no new order is placed meanwhile.
+func (s *server) cancelUserSubscriptions(ctx context.Context, userID int32) error {
+	n, err := s.subscriptions.CancelByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":       userID,
+		"subscriptions": n,
+	}).Info("Cancelled subscriptions of deleted user")
+	return nil
+}
+
+// cancelUserOrders cancels every open order of a deleted user. It is safe to
+// repeat: orders cancelled by an earlier attempt are no longer open, and an
+// order that failed in the meantime is skipped.
+func (s *server) cancelUserOrders(ctx context.Context, userID int32) error {
+	ids, err := s.orders.OpenByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err := s.placer.Cancel(ctx, id, orders.ReasonUserDeleted, userEventsActor)
+		if errors.Is(err, orders.ErrStatusConflict) || errors.Is(err, orders.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id": userID,
+		"orders":  len(ids),
+	}).Info("Cancelled open orders of deleted user")
+	return nil
+}
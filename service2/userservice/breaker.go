@@ -0,0 +1,116 @@
+package userservice
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = "CLOSED"
+	// BreakerOpen rejects calls until the cooldown has passed.
+	BreakerOpen BreakerState = "OPEN"
+	// BreakerHalfOpen lets a single probe call through to test recovery.
+	BreakerHalfOpen BreakerState = "HALF_OPEN"
+)
+
+// breaker opens after a number of consecutive failures and fails calls fast
+// while open. After the cooldown one probe is let through; its outcome
+// closes the breaker or opens it again.
+type breaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	opens    int64
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     BreakerClosed,
+	}
+}
+
+// allow reports whether a call may proceed. A call that is allowed must be
+// followed by exactly one call to done.
+func (b *breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// done records the outcome of an allowed call. Calls whose outcome says
+// nothing about the service, such as those cancelled by the caller, are
+// released with ignore instead.
+func (b *breaker) done(failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerClosed && b.failures >= b.threshold {
+		b.open()
+	}
+}
+
+// ignore releases an allowed call without counting its outcome.
+func (b *breaker) ignore() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	b.failures = 0
+	b.opens++
+}
+
+func (b *breaker) snapshot() (BreakerState, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state, b.opens
+}
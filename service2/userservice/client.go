@@ -0,0 +1,198 @@
+// Package userservice is the order service's client for the user service.
+//
+// Every call carries a deadline, idempotent calls are retried on UNAVAILABLE
+// through the gRPC service config, and a circuit breaker fails calls fast
+// while the user service keeps failing.
+package userservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "service2/service2/proto/user"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrNotFound is returned when the user does not exist.
+	ErrNotFound = errors.New("user not found")
+	// ErrUnavailable is returned when the user service cannot give an answer:
+	// it is down, too slow, or the circuit breaker is open.
+	ErrUnavailable = errors.New("user service unavailable")
+)
+
+// Status is the standing of a user's account.
+type Status string
+
+const (
+	StatusActive    Status = "ACTIVE"
+	StatusSuspended Status = "SUSPENDED"
+)
+
+// User is a user as reported by the user service.
+type User struct {
+	ID     int32
+	Name   string
+	Email  string
+	Status Status
+}
+
+// Active reports whether the user's account is in good standing.
+func (u *User) Active() bool {
+	return u.Status == StatusActive
+}
+
+// Config configures a Client. Zero values select the defaults.
+type Config struct {
+	// Address of the user service, e.g. "service1:50051".
+	Address string
+	// Timeout is the deadline of a call including its retries. Defaults to
+	// 500ms.
+	Timeout time.Duration
+	// MaxAttempts is how often an idempotent call is tried. Defaults to 3.
+	MaxAttempts int
+	// BreakerFailures is the number of consecutive failures that opens the
+	// circuit breaker. Defaults to 5.
+	BreakerFailures int
+	// BreakerCooldown is how long the breaker stays open before a probe call
+	// is let through. Defaults to 10s.
+	BreakerCooldown time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.Timeout <= 0 {
+		c.Timeout = 500 * time.Millisecond
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 3
+	}
+	if c.BreakerFailures <= 0 {
+		c.BreakerFailures = 5
+	}
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = 10 * time.Second
+	}
+}
+
+// serviceConfig retries GetUser, which is safe to repeat. CreateUser is not
+// retried because it is not idempotent.
+const serviceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "user.UserService", "method": "GetUser"}],
+		"retryPolicy": {
+			"maxAttempts": %d,
+			"initialBackoff": "0.05s",
+			"maxBackoff": "0.5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// Client calls the user service.
+type Client struct {
+	cfg     Config
+	conn    *grpc.ClientConn
+	users   pb.UserServiceClient
+	breaker *breaker
+
+	mutex sync.Mutex
+	stats Stats
+}
+
+// New creates a Client for cfg.Address. The connection is established
+// lazily, so New succeeds while the user service is down. Extra options are
+// appended to the defaults, e.g. to dial an in-memory listener in tests.
+func New(cfg Config, opts ...grpc.DialOption) (*Client, error) {
+	cfg.setDefaults()
+	c := &Client{
+		cfg:     cfg,
+		breaker: newBreaker(cfg.BreakerFailures, cfg.BreakerCooldown),
+		stats:   Stats{Codes: make(map[codes.Code]int64)},
+	}
+
+	maxAttempts := min(cfg.MaxAttempts, 5) // gRPC caps retry attempts at 5.
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(serviceConfig, max(maxAttempts, 2))),
+		grpc.WithChainUnaryInterceptor(c.intercept),
+	}, opts...)
+	conn, err := grpc.NewClient(cfg.Address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.users = pb.NewUserServiceClient(conn)
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// GetUser returns the user with the given ID. It fails with ErrNotFound for
+// unknown users and with ErrUnavailable when no answer could be obtained.
+func (c *Client) GetUser(ctx context.Context, id int32) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	resp, err := c.users.GetUser(ctx, &pb.GetUserRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		ID:     resp.Id,
+		Name:   resp.Name,
+		Email:  resp.Email,
+		Status: Status(resp.Status),
+	}, nil
+}
+
+// intercept applies the circuit breaker, records metrics and translates
+// errors for every call.
+func (c *Client) intercept(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !c.breaker.allow() {
+		c.record(codes.Unavailable, 0, true)
+		return fmt.Errorf("%w: circuit breaker is open", ErrUnavailable)
+	}
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	code := status.Code(err)
+	c.record(code, time.Since(start), false)
+
+	if code == codes.Canceled {
+		c.breaker.ignore()
+	} else {
+		c.breaker.done(isFailure(code))
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case code == codes.NotFound:
+		return fmt.Errorf("%w: %s", ErrNotFound, status.Convert(err).Message())
+	case isFailure(code):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// isFailure reports whether a status code means the user service is
+// unhealthy, as opposed to an answer such as NOT_FOUND.
+func isFailure(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "service2/service2/proto/user"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeUsers is a UserService whose GetUser answers are scripted: each call
+// takes the next error from errs, and succeeds once errs is exhausted.
+type fakeUsers struct {
+	pb.UnimplementedUserServiceServer
+
+	mutex sync.Mutex
+	errs  []error
+	delay time.Duration
+	calls int
+}
+
+func (f *fakeUsers) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	f.mutex.Lock()
+	f.calls++
+	var err error
+	if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	}
+	delay := f.delay
+	f.mutex.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetUserResponse{Id: req.Id, Name: "Ada", Email: "ada@example.com", Status: "ACTIVE"}, nil
+}
+
+func (f *fakeUsers) script(delay time.Duration, errs ...error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.errs = errs
+	f.delay = delay
+	f.calls = 0
+}
+
+func (f *fakeUsers) callCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls
+}
+
+func newTestClient(t *testing.T, cfg Config) (*Client, *fakeUsers) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	fake := &fakeUsers{}
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cfg.Address = "passthrough:///bufnet"
+	c, err := New(cfg, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, fake
+}
+
+func TestGetUser(t *testing.T) {
+	c, fake := newTestClient(t, Config{})
+
+	u, err := c.GetUser(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 7 || !u.Active() {
+		t.Fatalf("got %+v", u)
+	}
+
+	fake.script(0, status.Error(codes.NotFound, "user 8 not found"))
+	if _, err := c.GetUser(context.Background(), 8); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+	if st := c.Stats(); st.Calls != 2 || st.Failures != 0 || st.Codes[codes.NotFound] != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestGetUserRetriesUnavailable(t *testing.T) {
+	c, fake := newTestClient(t, Config{MaxAttempts: 3})
+	unavailable := status.Error(codes.Unavailable, "restarting")
+
+	fake.script(0, unavailable, unavailable)
+	if _, err := c.GetUser(context.Background(), 1); err != nil {
+		t.Fatalf("GetUser after two transient failures: %v", err)
+	}
+	if n := fake.callCount(); n != 3 {
+		t.Fatalf("server saw %d attempts, want 3", n)
+	}
+
+	fake.script(0, unavailable, unavailable, unavailable)
+	if _, err := c.GetUser(context.Background(), 1); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestGetUserDeadline(t *testing.T) {
+	c, fake := newTestClient(t, Config{Timeout: 50 * time.Millisecond})
+
+	fake.script(time.Second)
+	start := time.Now()
+	_, err := c.GetUser(context.Background(), 1)
+	if !errors.Is(err, ErrUnavailable) || status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("call took %v despite a 50ms deadline", elapsed)
+	}
+}
+
+func TestCircuitBreakerFailsFastAndRecovers(t *testing.T) {
+	c, fake := newTestClient(t, Config{
+		MaxAttempts:     1,
+		BreakerFailures: 3,
+		BreakerCooldown: 100 * time.Millisecond,
+	})
+	internal := status.Error(codes.Internal, "database down")
+
+	fake.script(0, internal, internal, internal)
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetUser(context.Background(), 1); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("call %d: err = %v, want ErrUnavailable", i, err)
+		}
+	}
+	if st := c.Stats(); st.Breaker != BreakerOpen || st.BreakerOpens != 1 {
+		t.Fatalf("stats = %+v, want open breaker", st)
+	}
+
+	// While open, calls fail without reaching the service.
+	before := fake.callCount()
+	if _, err := c.GetUser(context.Background(), 1); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	if fake.callCount() != before {
+		t.Fatal("call reached the service while the breaker was open")
+	}
+	if st := c.Stats(); st.Rejected != 1 {
+		t.Fatalf("rejected = %d, want 1", st.Rejected)
+	}
+
+	// After the cooldown a successful probe closes the breaker.
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.GetUser(context.Background(), 1); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if st := c.Stats(); st.Breaker != BreakerClosed {
+		t.Fatalf("breaker = %s, want CLOSED", st.Breaker)
+	}
+}
+
+func TestCollectorExportsStats(t *testing.T) {
+	c, fake := newTestClient(t, Config{MaxAttempts: 1, BreakerFailures: 1, BreakerCooldown: time.Hour})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(c))
+
+	// One call succeeds, the next fails and opens the breaker, and the last
+	// is rejected.
+	if _, err := c.GetUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	fake.script(0, status.Error(codes.Internal, "database down"))
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetUser(context.Background(), 1); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("call %d: err = %v, want ErrUnavailable", i, err)
+		}
+	}
+
+	want := `
+# HELP user_service_client_breaker_state 1 for the circuit breaker's current state, 0 for the others.
+# TYPE user_service_client_breaker_state gauge
+user_service_client_breaker_state{state="CLOSED"} 0
+user_service_client_breaker_state{state="HALF_OPEN"} 0
+user_service_client_breaker_state{state="OPEN"} 1
+# HELP user_service_client_calls_total Calls made to the user service, including rejected ones.
+# TYPE user_service_client_calls_total counter
+user_service_client_calls_total 3
+# HELP user_service_client_failures_total Calls that failed because the user service was unhealthy.
+# TYPE user_service_client_failures_total counter
+user_service_client_failures_total 1
+# HELP user_service_client_handled_total Calls that reached the user service, by status code.
+# TYPE user_service_client_handled_total counter
+user_service_client_handled_total{grpc_code="Internal"} 1
+user_service_client_handled_total{grpc_code="OK"} 1
+# HELP user_service_client_rejected_total Calls failed fast by the open circuit breaker.
+# TYPE user_service_client_rejected_total counter
+user_service_client_rejected_total 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"user_service_client_breaker_state", "user_service_client_calls_total", "user_service_client_failures_total",
+		"user_service_client_handled_total", "user_service_client_rejected_total"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(NewCollector(c), "user_service_client_latency_seconds"); n != 1 {
+		t.Fatalf("%d latency metrics, want 1", n)
+	}
+}
@@ -0,0 +1,57 @@
+package userservice
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	clientCalls    = prometheus.NewDesc("user_service_client_calls_total", "Calls made to the user service, including rejected ones.", nil, nil)
+	clientFailures = prometheus.NewDesc("user_service_client_failures_total", "Calls that failed because the user service was unhealthy.", nil, nil)
+	clientRejected = prometheus.NewDesc("user_service_client_rejected_total", "Calls failed fast by the open circuit breaker.", nil, nil)
+	clientHandled  = prometheus.NewDesc("user_service_client_handled_total", "Calls that reached the user service, by status code.", []string{"grpc_code"}, nil)
+	clientLatency  = prometheus.NewDesc("user_service_client_latency_seconds", "Time spent in calls that reached the user service.", nil, nil)
+	breakerState   = prometheus.NewDesc("user_service_client_breaker_state", "1 for the circuit breaker's current state, 0 for the others.", []string{"state"}, nil)
+	breakerOpens   = prometheus.NewDesc("user_service_client_breaker_opens_total", "Times the circuit breaker opened.", nil, nil)
+)
+
+var breakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+type collector struct {
+	c *Client
+}
+
+// NewCollector exports the stats of c as user_service_client_* metrics.
+func NewCollector(c *Client) prometheus.Collector {
+	return collector{c: c}
+}
+
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientCalls
+	ch <- clientFailures
+	ch <- clientRejected
+	ch <- clientHandled
+	ch <- clientLatency
+	ch <- breakerState
+	ch <- breakerOpens
+}
+
+func (col collector) Collect(ch chan<- prometheus.Metric) {
+	s := col.c.Stats()
+	ch <- prometheus.MustNewConstMetric(clientCalls, prometheus.CounterValue, float64(s.Calls))
+	ch <- prometheus.MustNewConstMetric(clientFailures, prometheus.CounterValue, float64(s.Failures))
+	ch <- prometheus.MustNewConstMetric(clientRejected, prometheus.CounterValue, float64(s.Rejected))
+	var handled uint64
+	for code, n := range s.Codes {
+		ch <- prometheus.MustNewConstMetric(clientHandled, prometheus.CounterValue, float64(n), code.String())
+		handled += uint64(n)
+	}
+	ch <- prometheus.MustNewConstSummary(clientLatency, handled, s.TotalLatency.Seconds(), nil)
+	for _, state := range breakerStates {
+		v := 0.0
+		if s.Breaker == state {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(breakerState, prometheus.GaugeValue, v, string(state))
+	}
+	ch <- prometheus.MustNewConstMetric(breakerOpens, prometheus.CounterValue, float64(s.BreakerOpens))
+}
@@ -0,0 +1,67 @@
+package userservice
+
+import (
+	"maps"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Stats are the client's call metrics since it was created.
+type Stats struct {
+	// Calls is the number of calls made, including rejected ones.
+	Calls int64
+	// Failures counts calls that failed because the user service was
+	// unhealthy.
+	Failures int64
+	// Rejected counts calls failed fast by the open circuit breaker.
+	Rejected int64
+	// Codes counts the status code of each call that reached the service.
+	Codes map[codes.Code]int64
+	// TotalLatency is the time spent in calls that reached the service.
+	TotalLatency time.Duration
+	// Breaker is the circuit breaker's current state and BreakerOpens how
+	// often it has opened.
+	Breaker      BreakerState
+	BreakerOpens int64
+}
+
+// AverageLatency returns the mean duration of calls that reached the
+// service.
+func (s Stats) AverageLatency() time.Duration {
+	var n int64
+	for _, count := range s.Codes {
+		n += count
+	}
+	if n == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(n)
+}
+
+// Stats returns a snapshot of the client's metrics.
+func (c *Client) Stats() Stats {
+	c.mutex.Lock()
+	out := c.stats
+	out.Codes = maps.Clone(c.stats.Codes)
+	c.mutex.Unlock()
+
+	out.Breaker, out.BreakerOpens = c.breaker.snapshot()
+	return out
+}
+
+func (c *Client) record(code codes.Code, latency time.Duration, rejected bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stats.Calls++
+	if rejected {
+		c.stats.Rejected++
+		return
+	}
+	c.stats.Codes[code]++
+	c.stats.TotalLatency += latency
+	if isFailure(code) {
+		c.stats.Failures++
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"service2/orders"
+	pb "service2/service2/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// WatchOrder streams the status of one order until it reaches a terminal
+// state or the client goes away.
+func (s *server) WatchOrder(req *pb.WatchOrderRequest, stream pb.OrderService_WatchOrderServer) error {
+	ctx := stream.Context()
+
+	// Subscribe before reading the current state so no transition falls
+	// between the two.
+	sub := s.hub.WatchOrder(int64(req.OrderId))
+	defer sub.Close()
+
+	o, err := s.orders.Get(ctx, int64(req.OrderId))
+	if errors.Is(err, orders.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		logrus.Errorf("Failed to load order %d: %v", req.OrderId, err)
+		return status.Error(codes.Internal, "failed to load order")
+	}
+	last := orders.StatusChange{OrderID: o.ID, UserID: o.UserID, Status: o.Status, UpdatedAt: o.UpdatedAt}
+	if err := stream.Send(statusEventToProto(last, true)); err != nil {
+		return err
+	}
+
+	return followOrder(ctx, sub, last, stream.Send)
+}
+
+// followOrder sends the changes of an order after last until it reaches a
+// terminal state.
+func followOrder(ctx context.Context, sub *orders.Subscription, last orders.StatusChange, send func(*pb.OrderStatusEvent) error) error {
+	for !last.Status.Terminal() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c, ok := <-sub.C:
+			if !ok {
+				return watchError(sub.Err())
+			}
+			if stale(c, last) {
+				continue
+			}
+			if err := send(statusEventToProto(c, false)); err != nil {
+				return err
+			}
+			last = c
+		}
+	}
+	return nil
+}
+
+// WatchUserOrders streams the statuses of a user's orders until the client
+// goes away.
+func (s *server) WatchUserOrders(req *pb.WatchUserOrdersRequest, stream pb.OrderService_WatchUserOrdersServer) error {
+	ctx := stream.Context()
+
+	sub := s.hub.WatchUser(req.UserId)
+	defer sub.Close()
+
+	open, err := s.orders.OpenStatuses(ctx, req.UserId)
+	if err != nil {
+		logrus.Errorf("Failed to load orders of user %d: %v", req.UserId, err)
+		return status.Error(codes.Internal, "failed to load orders")
+	}
+	last := make(map[int64]orders.StatusChange, len(open))
+	for _, c := range open {
+		if err := stream.Send(statusEventToProto(c, true)); err != nil {
+			return err
+		}
+		last[c.OrderID] = c
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c, ok := <-sub.C:
+			if !ok {
+				return watchError(sub.Err())
+			}
+			if prev, seen := last[c.OrderID]; seen && stale(c, prev) {
+				continue
+			}
+			if err := stream.Send(statusEventToProto(c, false)); err != nil {
+				return err
+			}
+			if c.Status.Terminal() {
+				delete(last, c.OrderID)
+			} else {
+				last[c.OrderID] = c
+			}
+		}
+	}
+}
+
+// stale reports whether c was already covered by the last state sent, which
+// happens when a change commits while the current state is being read.
+func stale(c, last orders.StatusChange) bool {
+	return c.Status == last.Status || c.UpdatedAt.Before(last.UpdatedAt)
+}
+
+func watchError(err error) error {
+	switch {
+	case errors.Is(err, orders.ErrWatchLagging):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case err != nil:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Unavailable, "watch closed")
+}
+
+func statusEventToProto(c orders.StatusChange, snapshot bool) *pb.OrderStatusEvent {
+	return &pb.OrderStatusEvent{
+		OrderId:        int32(c.OrderID),
+		UserId:         c.UserID,
+		Status:         string(c.Status),
+		PreviousStatus: string(c.PreviousStatus),
+		UpdatedAt:      timestamppb.New(c.UpdatedAt),
+		Snapshot:       snapshot,
+	}
+}
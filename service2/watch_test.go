@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"service2/orders"
+	pb "service2/service2/proto"
+)
+
+func TestFollowOrderEndsWhenDelivered(t *testing.T) {
+	h := orders.NewHub()
+	sub := h.WatchOrder(1)
+	defer sub.Close()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	last := orders.StatusChange{OrderID: 1, UserID: 7, Status: orders.StatusPending, UpdatedAt: start}
+	h.Publish(orders.StatusChange{OrderID: 1, UserID: 7, Status: orders.StatusConfirmed, PreviousStatus: orders.StatusPending, UpdatedAt: start.Add(time.Second)})
+	h.Publish(orders.StatusChange{OrderID: 1, UserID: 7, Status: orders.StatusDelivered, PreviousStatus: orders.StatusConfirmed, UpdatedAt: start.Add(time.Hour)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sent []string
+	err := followOrder(ctx, sub, last, func(e *pb.OrderStatusEvent) error {
+		sent = append(sent, e.Status)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("followOrder: %v", err)
+	}
+	if len(sent) != 2 || sent[0] != "CONFIRMED" || sent[1] != "DELIVERED" {
+		t.Fatalf("sent %v, want [CONFIRMED DELIVERED]", sent)
+	}
+}
+
+func TestFollowOrderSkipsStaleChanges(t *testing.T) {
+	h := orders.NewHub()
+	sub := h.WatchOrder(1)
+	defer sub.Close()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	last := orders.StatusChange{OrderID: 1, Status: orders.StatusConfirmed, UpdatedAt: start}
+	// The confirmation was already read as the current state.
+	h.Publish(orders.StatusChange{OrderID: 1, Status: orders.StatusConfirmed, UpdatedAt: start})
+	h.Publish(orders.StatusChange{OrderID: 1, Status: orders.StatusCancelled, UpdatedAt: start.Add(time.Minute)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sent []string
+	err := followOrder(ctx, sub, last, func(e *pb.OrderStatusEvent) error {
+		sent = append(sent, e.Status)
+		return nil
+	})
+	if err != nil || len(sent) != 1 || sent[0] != "CANCELLED" {
+		t.Fatalf("sent %v, err %v, want [CANCELLED]", sent, err)
+	}
+}
@@ -0,0 +1,265 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"service3/history"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+rules:
+  - name: HighErrorRate
+    series: service/*/error_rate
+    matchers: ['service!="Monitoring Service"']
+    type: threshold
+    op: ">"
+    value: 5
+    for: 1m
+    annotations:
+      summary: '{{ .Labels.service }} has {{ .Value }} errors/s'
+notifiers:
+  - name: ops
+    type: webhook
+    url: http://example.com/hook
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.EvaluationInterval != 15*time.Second || cfg.RepeatInterval != 4*time.Hour {
+		t.Errorf("defaults: %+v", cfg)
+	}
+	r := cfg.Rules[0]
+	if r.Severity != "warning" || r.For != time.Minute || len(r.Matchers) != 1 || r.Matchers[0].String() != `service!="Monitoring Service"` {
+		t.Errorf("rule: %+v", r)
+	}
+
+	for _, bad := range []string{
+		`rules: [{name: a, series: x, type: threshold, op: "=>"}]`,
+		`rules: [{name: a, series: x, type: rate, op: ">"}]`,
+		`rules: [{name: a, series: x, type: absent, window: 1m}, {name: a, series: y, type: absent, window: 1m}]`,
+		`rules: [{name: a, series: x, type: threshold, op: ">", matchers: ['service~"x"']}]`,
+		`rules: [{name: a, series: x, type: absent, window: 1m, labels: {alertname: b}}]`,
+		`rules: [{name: a, series: x, type: absent, window: 1m, labels: {series: y}}]`,
+		`notifiers: [{name: a, type: webhook}]`,
+	} {
+		if _, err := ParseConfig([]byte(bad)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got %v", bad, err)
+		}
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	ms, err := ParseMatchers([]string{`service=~"user.*"`, `severity!="info"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for labels, want := range map[[2]string]bool{
+		{"user-service", "critical"}: true,
+		{"user-service", "info"}:     false,
+		{"order-service", "warning"}: false,
+	} {
+		if got := ms.Matches(map[string]string{"service": labels[0], "severity": labels[1]}); got != want {
+			t.Errorf("%v: got %v", labels, got)
+		}
+	}
+}
+
+type recorder struct {
+	alerts []Alert
+	// fail is how many of the next notifications fail.
+	fail int
+}
+
+func (r *recorder) Notify(_ context.Context, alerts []Alert) error {
+	if r.fail > 0 {
+		r.fail--
+		return errors.New("webhook unavailable")
+	}
+	r.alerts = append(r.alerts, alerts...)
+	return nil
+}
+
+func TestEngine(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+repeat_interval: 1h
+rules:
+  - name: HighErrorRate
+    series: service/*/error_rate
+    type: threshold
+    op: ">"
+    value: 1
+    for: 30s
+    severity: critical
+  - name: NoKafkaMessages
+    series: kafka/messages_received
+    type: absent
+    window: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := history.New()
+	e := NewEngine(cfg, store)
+	rec := &recorder{}
+	e.AddNotifier("test", nil, rec)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	// The error rate of user-service is high from the start and the Kafka
+	// series has never been seen. The absence rule has no For and fires
+	// right away.
+	store.Record("service/user-service/error_rate", at(0), 3)
+	store.Record("service/order-service/error_rate", at(0), 0)
+	e.Evaluate(ctx, at(1))
+	alerts := e.Alerts()
+	if len(alerts) != 2 || alerts[0].State != Pending || alerts[1].State != Firing {
+		t.Fatalf("at 1s: %+v", alerts)
+	}
+
+	// After 30s the error rate rule fires, and is notified once.
+	store.Record("service/user-service/error_rate", at(31), 4)
+	e.Evaluate(ctx, at(31))
+	e.Evaluate(ctx, at(45))
+	var fired []string
+	for _, a := range rec.alerts {
+		fired = append(fired, a.Rule+" "+string(a.State))
+	}
+	if len(fired) != 2 || fired[0] != "NoKafkaMessages FIRING" || fired[1] != "HighErrorRate FIRING" {
+		t.Fatalf("notified %v", fired)
+	}
+	high := findAlert(e.Alerts(), "HighErrorRate")
+	if high.State != Firing || high.Value != 4 || high.Labels["service"] != "user-service" || high.Labels["severity"] != "critical" {
+		t.Errorf("firing alert: %+v", high)
+	}
+
+	// Silenced alerts are not notified, even when they resolve.
+	e.AddSilence(Silence{Matchers: mustMatchers(t, `alertname="NoKafkaMessages"`), StartsAt: at(0), EndsAt: at(3600)})
+	store.Record("kafka/messages_received", at(50), 1)
+	store.Record("service/user-service/error_rate", at(50), 0)
+	rec.alerts = nil
+	e.Evaluate(ctx, at(50))
+	if len(rec.alerts) != 1 || rec.alerts[0].Rule != "HighErrorRate" || rec.alerts[0].State != Resolved {
+		t.Fatalf("notified %+v", rec.alerts)
+	}
+
+	// Resolved alerts are dropped after the retention.
+	later := at(50).Add(cfg.ResolvedRetention + time.Second)
+	store.Record("kafka/messages_received", later, 2)
+	e.Evaluate(ctx, later)
+	if alerts := e.Alerts(); len(alerts) != 0 {
+		t.Errorf("after retention: %+v", alerts)
+	}
+}
+
+func TestFailedNotificationsAreRetried(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+repeat_interval: 4h
+rules:
+  - name: HighErrorRate
+    series: service/user-service/error_rate
+    type: threshold
+    op: ">"
+    value: 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := history.New()
+	e := NewEngine(cfg, store)
+	rec := &recorder{fail: 1}
+	e.AddNotifier("test", nil, rec)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	notified := func() []State {
+		var states []State
+		for _, a := range rec.alerts {
+			states = append(states, a.State)
+		}
+		return states
+	}
+
+	// The first delivery of the firing alert fails; the next evaluation
+	// sends it again, and it is not repeated after that.
+	store.Record("service/user-service/error_rate", at(0), 3)
+	e.Evaluate(ctx, at(1))
+	if states := notified(); len(states) != 0 {
+		t.Fatalf("notified %v through a failing notifier", states)
+	}
+	store.Record("service/user-service/error_rate", at(10), 3)
+	e.Evaluate(ctx, at(11))
+	store.Record("service/user-service/error_rate", at(20), 3)
+	e.Evaluate(ctx, at(21))
+	if states := notified(); !slices.Equal(states, []State{Firing}) {
+		t.Fatalf("notified %v, want [FIRING]", states)
+	}
+
+	// So is the resolution.
+	rec.fail = 1
+	store.Record("service/user-service/error_rate", at(30), 0)
+	e.Evaluate(ctx, at(31))
+	e.Evaluate(ctx, at(41))
+	e.Evaluate(ctx, at(51))
+	if states := notified(); !slices.Equal(states, []State{Firing, Resolved}) {
+		t.Fatalf("notified %v, want [FIRING RESOLVED]", states)
+	}
+}
+
+func TestRateRule(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+rules:
+  - name: DatabaseGrowing
+    series: database/*/size_mb
+    type: rate
+    op: ">="
+    value: 1
+    window: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := history.New()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= 60; i += 10 {
+		store.Record("database/users/size_mb", start.Add(time.Duration(i)*time.Second), float64(100+2*i))
+		store.Record("database/orders/size_mb", start.Add(time.Duration(i)*time.Second), 100)
+	}
+	e := NewEngine(cfg, store)
+	e.Evaluate(context.Background(), start.Add(60*time.Second))
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].Labels["database"] != "users" || alerts[0].Value != 2 || alerts[0].State != Firing {
+		t.Errorf("alerts %+v", alerts)
+	}
+}
+
+func findAlert(alerts []Alert, rule string) Alert {
+	for _, a := range alerts {
+		if a.Rule == rule {
+			return a
+		}
+	}
+	return Alert{}
+}
+
+func mustMatchers(t *testing.T, ss ...string) Matchers {
+	t.Helper()
+	ms, err := ParseMatchers(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestSampleConfig(t *testing.T) {
+	if _, err := LoadConfig("../alerts.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,311 @@
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidConfig is returned for a rules file that cannot be used.
+var ErrInvalidConfig = errors.New("invalid alerting config")
+
+// Rule types.
+const (
+	// Threshold compares the latest value of a series with Value.
+	Threshold = "threshold"
+	// Rate compares the change per second of a series over Window with
+	// Value.
+	Rate = "rate"
+	// Absent fires when a series has no value for Window.
+	Absent = "absent"
+)
+
+// Config is the content of a rules file.
+type Config struct {
+	// EvaluationInterval is the time between evaluations. Defaults to 15s.
+	EvaluationInterval time.Duration `yaml:"evaluation_interval"`
+	// RepeatInterval is how often a firing alert is notified again.
+	// Defaults to 4h.
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	// ResolvedRetention is how long a resolved alert is listed. Defaults
+	// to 15m.
+	ResolvedRetention time.Duration `yaml:"resolved_retention"`
+
+	Rules     []*Rule          `yaml:"rules"`
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+	Silences  []SilenceConfig  `yaml:"silences"`
+}
+
+// Rule describes when an alert fires.
+type Rule struct {
+	Name string `yaml:"name"`
+	// Series names the series the rule watches, e.g.
+	// "service/*/error_rate". A "*" matches one path segment. Series named
+	// "service/<name>/..." carry a service label, "database/<name>/..." a
+	// database label, "kafka/groups/<group>/..." a group label and
+	// "slo/<objective>/<sli>/..." slo and sli labels.
+	Series string `yaml:"series"`
+	// Matchers select among the series by label.
+	Matchers Matchers `yaml:"matchers"`
+	Type     string   `yaml:"type"`
+	// Op and Value are the condition of threshold and rate rules, e.g.
+	// "> 5".
+	Op    string  `yaml:"op"`
+	Value float64 `yaml:"value"`
+	// Window is the period of rate and absent rules.
+	Window time.Duration `yaml:"window"`
+	// For is how long the condition has to hold before the alert fires.
+	For      time.Duration `yaml:"for"`
+	Severity string        `yaml:"severity"`
+	// Labels are added to the rule's alerts. They cannot replace the
+	// labels the engine sets, listed in reservedLabels.
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	annotations map[string]*template.Template
+}
+
+// NotifierConfig configures a notifier.
+type NotifierConfig struct {
+	Name string `yaml:"name"`
+	// Type is "log" or "webhook".
+	Type string `yaml:"type"`
+	// URL receives a POST of the alerts as JSON, for webhooks.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Matchers select the alerts the notifier receives; all when empty.
+	Matchers Matchers `yaml:"matchers"`
+}
+
+// SilenceConfig is a silence defined in the rules file.
+type SilenceConfig struct {
+	Matchers Matchers  `yaml:"matchers"`
+	StartsAt time.Time `yaml:"starts_at"`
+	EndsAt   time.Time `yaml:"ends_at"`
+	Comment  string    `yaml:"comment"`
+}
+
+// LoadConfig reads and validates a rules file.
+func LoadConfig(file string) (*Config, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(raw)
+}
+
+// ParseConfig parses and validates the content of a rules file.
+func ParseConfig(raw []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if cfg.EvaluationInterval <= 0 {
+		cfg.EvaluationInterval = 15 * time.Second
+	}
+	if cfg.RepeatInterval <= 0 {
+		cfg.RepeatInterval = 4 * time.Hour
+	}
+	if cfg.ResolvedRetention <= 0 {
+		cfg.ResolvedRetention = 15 * time.Minute
+	}
+
+	names := make(map[string]bool)
+	for i, r := range cfg.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%w: rule %d (%s): %v", ErrInvalidConfig, i+1, r.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("%w: rule %s is defined twice", ErrInvalidConfig, r.Name)
+		}
+		names[r.Name] = true
+	}
+	for i, n := range cfg.Notifiers {
+		if n.Name == "" {
+			return nil, fmt.Errorf("%w: notifier %d has no name", ErrInvalidConfig, i+1)
+		}
+		switch n.Type {
+		case "log":
+		case "webhook":
+			if n.URL == "" {
+				return nil, fmt.Errorf("%w: webhook %s has no url", ErrInvalidConfig, n.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%w: notifier %s has unknown type %q", ErrInvalidConfig, n.Name, n.Type)
+		}
+	}
+	for i, s := range cfg.Silences {
+		if len(s.Matchers) == 0 || !s.EndsAt.After(s.StartsAt) {
+			return nil, fmt.Errorf("%w: silence %d needs matchers and must end after it starts", ErrInvalidConfig, i+1)
+		}
+	}
+	return &cfg, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" || r.Series == "" {
+		return errors.New("name and series are required")
+	}
+	if _, err := path.Match(r.Series, ""); err != nil {
+		return fmt.Errorf("series: %v", err)
+	}
+	switch r.Type {
+	case Threshold, Rate:
+		if _, ok := ops[r.Op]; !ok {
+			return fmt.Errorf("unknown op %q", r.Op)
+		}
+		if r.Type == Rate && r.Window <= 0 {
+			return errors.New("rate rules need a window")
+		}
+	case Absent:
+		if r.Window <= 0 {
+			return errors.New("absent rules need a window")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	if r.For < 0 {
+		return errors.New("for is negative")
+	}
+	if r.Severity == "" {
+		r.Severity = "warning"
+	}
+	for k := range r.Labels {
+		if reservedLabels[k] {
+			return fmt.Errorf("label %s is set by the engine", k)
+		}
+	}
+
+	r.annotations = make(map[string]*template.Template)
+	for name, text := range r.Annotations {
+		t, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return fmt.Errorf("annotation %s: %v", name, err)
+		}
+		r.annotations[name] = t
+	}
+	return nil
+}
+
+// reservedLabels are the labels the engine gives every alert, which identify
+// the rule and the series it is for.
+var reservedLabels = map[string]bool{
+	"alertname": true,
+	"severity":  true,
+	"series":    true,
+	"service":   true,
+	"database":  true,
+	"group":     true,
+	"slo":       true,
+	"sli":       true,
+}
+
+var ops = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Matcher tests one label, written as name="value", name!="value",
+// name=~"regexp" or name!~"regexp".
+type Matcher struct {
+	Name   string
+	Value  string
+	Negate bool
+	re     *regexp.Regexp
+}
+
+var matcherPattern = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"(.*)"\s*$`)
+
+// ParseMatcher parses a matcher.
+func ParseMatcher(s string) (Matcher, error) {
+	m := matcherPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Matcher{}, fmt.Errorf("%w: matcher %q", ErrInvalidConfig, s)
+	}
+	out := Matcher{Name: m[1], Value: m[3], Negate: strings.HasPrefix(m[2], "!")}
+	if strings.HasSuffix(m[2], "~") {
+		re, err := regexp.Compile("^(?:" + m[3] + ")$")
+		if err != nil {
+			return Matcher{}, fmt.Errorf("%w: matcher %q: %v", ErrInvalidConfig, s, err)
+		}
+		out.re = re
+	}
+	return out, nil
+}
+
+// Matches reports whether labels satisfy m. A missing label is empty.
+func (m Matcher) Matches(labels map[string]string) bool {
+	v := labels[m.Name]
+	var ok bool
+	if m.re != nil {
+		ok = m.re.MatchString(v)
+	} else {
+		ok = v == m.Value
+	}
+	return ok != m.Negate
+}
+
+// String returns m as it is written.
+func (m Matcher) String() string {
+	op := "="
+	switch {
+	case m.re != nil && m.Negate:
+		op = "!~"
+	case m.re != nil:
+		op = "=~"
+	case m.Negate:
+		op = "!="
+	}
+	return fmt.Sprintf("%s%s%q", m.Name, op, m.Value)
+}
+
+// Matchers match when all of them do.
+type Matchers []Matcher
+
+// ParseMatchers parses each of ss.
+func ParseMatchers(ss []string) (Matchers, error) {
+	out := make(Matchers, 0, len(ss))
+	for _, s := range ss {
+		m, err := ParseMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// Matches reports whether labels satisfy every matcher.
+func (ms Matchers) Matches(labels map[string]string) bool {
+	for _, m := range ms {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalYAML reads matchers from a list of strings.
+func (ms *Matchers) UnmarshalYAML(node *yaml.Node) error {
+	var ss []string
+	if err := node.Decode(&ss); err != nil {
+		return err
+	}
+	parsed, err := ParseMatchers(ss)
+	if err != nil {
+		return err
+	}
+	*ms = parsed
+	return nil
+}
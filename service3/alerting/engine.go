@@ -0,0 +1,405 @@
+// Package alerting evaluates alert rules against the metrics history and
+// notifies about the alerts that fire and resolve.
+//
+// Each rule is evaluated per matching series every evaluation interval. An
+// alert whose condition holds is pending until it has held for the rule's
+// For duration, then firing until the condition stops holding, then
+// resolved for a while. Notifiers hear of an alert when it fires, again
+// every repeat interval while it keeps firing, and when it resolves. A
+// notification that fails is sent again at the next evaluation. Alerts
+// matched by an active silence are not notified.
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"service3/history"
+
+	"github.com/sirupsen/logrus"
+)
+
+// State is the state of an alert.
+type State string
+
+const (
+	Pending  State = "PENDING"
+	Firing   State = "FIRING"
+	Resolved State = "RESOLVED"
+)
+
+// staleness is how old the latest value of a series can be for threshold
+// rules to use it.
+const staleness = time.Minute
+
+// Source is where the rules read series from.
+type Source interface {
+	Names(prefix string) []string
+	Query(name string, from, to time.Time, step time.Duration, now time.Time) ([]history.Point, time.Duration, error)
+}
+
+// Alert is the state of a rule for one series.
+type Alert struct {
+	Rule        string
+	Labels      map[string]string
+	Annotations map[string]string
+	State       State
+	// Value is the value that last met the condition.
+	Value      float64
+	ActiveAt   time.Time
+	FiredAt    time.Time
+	ResolvedAt time.Time
+	// Silenced is set while an active silence matches the alert.
+	Silenced bool
+
+	lastNotified     time.Time
+	resolvedNotified bool
+}
+
+// Silence keeps the alerts it matches from being notified between StartsAt
+// and EndsAt.
+type Silence struct {
+	ID        string
+	Matchers  Matchers
+	StartsAt  time.Time
+	EndsAt    time.Time
+	Comment   string
+	CreatedBy string
+}
+
+// Active reports whether the silence applies at now.
+func (s Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// Notifier delivers notifications about alerts.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+type route struct {
+	name     string
+	matchers Matchers
+	notifier Notifier
+}
+
+// Engine evaluates the rules of a Config. It is safe for concurrent use.
+type Engine struct {
+	cfg    *Config
+	source Source
+	routes []route
+
+	mutex       sync.Mutex
+	alerts      map[string]*Alert
+	silences    []Silence
+	lastSilence int
+}
+
+// NewEngine creates an Engine for cfg with its notifiers and silences.
+func NewEngine(cfg *Config, source Source) *Engine {
+	e := &Engine{cfg: cfg, source: source, alerts: make(map[string]*Alert)}
+	for _, n := range cfg.Notifiers {
+		e.AddNotifier(n.Name, n.Matchers, newNotifier(n))
+	}
+	for _, s := range cfg.Silences {
+		e.AddSilence(Silence{Matchers: s.Matchers, StartsAt: s.StartsAt, EndsAt: s.EndsAt, Comment: s.Comment, CreatedBy: "config"})
+	}
+	return e
+}
+
+// AddNotifier sends the alerts matching matchers to n.
+func (e *Engine) AddNotifier(name string, matchers Matchers, n Notifier) {
+	e.routes = append(e.routes, route{name: name, matchers: matchers, notifier: n})
+}
+
+// AddSilence adds a silence and returns it with its ID.
+func (e *Engine) AddSilence(s Silence) Silence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastSilence++
+	s.ID = strconv.Itoa(e.lastSilence)
+	e.silences = append(e.silences, s)
+	return s
+}
+
+// Silences returns the silences that have not ended.
+func (e *Engine) Silences(now time.Time) []Silence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.silences = slices.DeleteFunc(e.silences, func(s Silence) bool { return !now.Before(s.EndsAt) })
+	return slices.Clone(e.silences)
+}
+
+// Alerts returns the current alerts, by rule and then labels.
+func (e *Engine) Alerts() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	out := make([]Alert, 0, len(e.alerts))
+	for _, key := range slices.Sorted(maps.Keys(e.alerts)) {
+		a := *e.alerts[key]
+		a.Labels = maps.Clone(a.Labels)
+		a.Annotations = maps.Clone(a.Annotations)
+		out = append(out, a)
+	}
+	return out
+}
+
+// Run evaluates the rules every evaluation interval until ctx is done.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.EvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Evaluate(ctx, now)
+		}
+	}
+}
+
+// result is the outcome of a rule for one series.
+type result struct {
+	labels map[string]string
+	value  float64
+}
+
+// Evaluate evaluates every rule at now, updates the alerts and sends the
+// notifications that are due.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) {
+	active := make(map[string]result)
+	evaluated := make(map[string]bool)
+	for _, r := range e.cfg.Rules {
+		results, err := e.evaluate(r, now)
+		if err != nil {
+			logrus.Errorf("Failed to evaluate alert rule %s: %v", r.Name, err)
+			continue
+		}
+		evaluated[r.Name] = true
+		for _, res := range results {
+			active[fingerprint(res.labels)] = res
+		}
+	}
+
+	due := e.update(now, active, evaluated)
+	if len(due) == 0 {
+		return
+	}
+	// An alert counts as notified once every route it matches delivered it;
+	// otherwise it is sent again at the next evaluation.
+	failed := make(map[string]bool)
+	for _, rt := range e.routes {
+		var matched []Alert
+		for _, a := range due {
+			if rt.matchers.Matches(a.Labels) {
+				matched = append(matched, a)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if err := rt.notifier.Notify(ctx, matched); err != nil {
+			logrus.Errorf("Failed to notify %s of %d alerts: %v", rt.name, len(matched), err)
+			for _, a := range matched {
+				failed[fingerprint(a.Labels)] = true
+			}
+		}
+	}
+	e.notified(now, slices.DeleteFunc(due, func(a Alert) bool { return failed[fingerprint(a.Labels)] }))
+}
+
+// update moves the alerts to their new states and returns those to notify.
+func (e *Engine) update(now time.Time, active map[string]result, evaluated map[string]bool) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rules := make(map[string]*Rule, len(e.cfg.Rules))
+	for _, r := range e.cfg.Rules {
+		rules[r.Name] = r
+	}
+
+	for key, res := range active {
+		r := rules[res.labels["alertname"]]
+		a, ok := e.alerts[key]
+		if !ok || a.State == Resolved {
+			a = &Alert{Rule: r.Name, Labels: res.labels, State: Pending, ActiveAt: now}
+			e.alerts[key] = a
+		}
+		a.Value = res.value
+		a.Annotations = r.render(a.Labels, a.Value)
+		if a.State == Pending && now.Sub(a.ActiveAt) >= r.For {
+			a.State = Firing
+			a.FiredAt = now
+		}
+	}
+	for key, a := range e.alerts {
+		if _, ok := active[key]; ok || !evaluated[a.Rule] {
+			continue
+		}
+		switch a.State {
+		case Pending:
+			delete(e.alerts, key)
+		case Firing:
+			a.State = Resolved
+			a.ResolvedAt = now
+		case Resolved:
+			if now.Sub(a.ResolvedAt) > e.cfg.ResolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+	}
+
+	var due []Alert
+	for _, a := range e.alerts {
+		a.Silenced = slices.ContainsFunc(e.silences, func(s Silence) bool {
+			return s.Active(now) && s.Matchers.Matches(a.Labels)
+		})
+		if a.Silenced {
+			continue
+		}
+		switch {
+		case a.State == Firing && (a.lastNotified.IsZero() || now.Sub(a.lastNotified) >= e.cfg.RepeatInterval):
+		case a.State == Resolved && !a.lastNotified.IsZero() && !a.resolvedNotified:
+		default:
+			continue
+		}
+		out := *a
+		out.Labels = maps.Clone(a.Labels)
+		out.Annotations = maps.Clone(a.Annotations)
+		due = append(due, out)
+	}
+	return due
+}
+
+// notified records that alerts, as returned by update, were delivered at
+// now. Alerts that changed since are left to be notified again.
+func (e *Engine) notified(now time.Time, alerts []Alert) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, n := range alerts {
+		a, ok := e.alerts[fingerprint(n.Labels)]
+		if !ok || a.State != n.State || !a.ActiveAt.Equal(n.ActiveAt) {
+			continue
+		}
+		switch a.State {
+		case Firing:
+			a.lastNotified = now
+		case Resolved:
+			a.resolvedNotified = true
+		}
+	}
+}
+
+// evaluate returns the series for which r's condition holds at now.
+func (e *Engine) evaluate(r *Rule, now time.Time) ([]result, error) {
+	var names []string
+	if !strings.Contains(r.Series, "*") {
+		names = []string{r.Series}
+	} else {
+		prefix, _, _ := strings.Cut(r.Series, "*")
+		for _, name := range e.source.Names(prefix) {
+			if ok, _ := path.Match(r.Series, name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var out []result
+	for _, name := range names {
+		labels := r.labels(name)
+		if !r.Matchers.Matches(labels) {
+			continue
+		}
+		lookback := r.Window
+		if r.Type == Threshold {
+			lookback = staleness
+		}
+		points, _, err := e.source.Query(name, now.Add(-lookback), now.Add(time.Nanosecond), 0, now)
+		if err != nil {
+			return nil, err
+		}
+
+		switch r.Type {
+		case Absent:
+			if len(points) == 0 {
+				out = append(out, result{labels: labels})
+			}
+		case Threshold:
+			if len(points) == 0 {
+				continue
+			}
+			if v := points[len(points)-1].Last; ops[r.Op](v, r.Value) {
+				out = append(out, result{labels: labels, value: v})
+			}
+		case Rate:
+			if len(points) < 2 {
+				continue
+			}
+			first, last := points[0], points[len(points)-1]
+			v := (last.Last - first.Last) / last.Time.Sub(first.Time).Seconds()
+			if ops[r.Op](v, r.Value) {
+				out = append(out, result{labels: labels, value: v})
+			}
+		}
+	}
+	return out, nil
+}
+
+// labels returns the labels of r's alert for a series.
+func (r *Rule) labels(series string) map[string]string {
+	labels := map[string]string{
+		"alertname": r.Name,
+		"severity":  r.Severity,
+		"series":    series,
+	}
+	parts := strings.Split(series, "/")
+	switch {
+	case len(parts) == 3 && (parts[0] == "service" || parts[0] == "database"):
+		labels[parts[0]] = parts[1]
+	case len(parts) == 4 && parts[0] == "slo":
+		labels["slo"], labels["sli"] = parts[1], parts[2]
+	case len(parts) == 4 && parts[0] == "kafka" && parts[1] == "groups":
+		labels["group"] = parts[2]
+	}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// render fills in the annotation templates, which see .Labels and .Value.
+func (r *Rule) render(labels map[string]string, value float64) map[string]string {
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+	out := make(map[string]string, len(r.annotations))
+	for name, t := range r.annotations {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			out[name] = r.Annotations[name]
+			continue
+		}
+		out[name] = b.String()
+	}
+	return out
+}
+
+// fingerprint identifies an alert by its labels.
+func fingerprint(labels map[string]string) string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Fprintf(&b, "%s=%q,", k, labels[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newNotifier(cfg NotifierConfig) Notifier {
+	if cfg.Type == "webhook" {
+		return NewWebhookNotifier(cfg.URL, cfg.Timeout)
+	}
+	return LogNotifier{}
+}
+
+// LogNotifier writes alerts to the log.
+type LogNotifier struct{}
+
+// Notify logs each alert.
+func (LogNotifier) Notify(_ context.Context, alerts []Alert) error {
+	for _, a := range alerts {
+		entry := logrus.WithFields(logrus.Fields{
+			"alert":    a.Rule,
+			"severity": a.Labels["severity"],
+			"series":   a.Labels["series"],
+			"value":    a.Value,
+		})
+		if a.State == Resolved {
+			entry.Info("Alert resolved")
+		} else {
+			entry.Warn("Alert firing")
+		}
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs alerts as JSON to a URL.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a WebhookNotifier. A timeout of 0 means 5s.
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type webhookAlert struct {
+	Name        string            `json:"name"`
+	State       State             `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     time.Time         `json:"fired_at"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+}
+
+// Notify sends the alerts in one request, as {"alerts": [...]}.
+func (w *WebhookNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	body := struct {
+		Alerts []webhookAlert `json:"alerts"`
+	}{}
+	for _, a := range alerts {
+		wa := webhookAlert{
+			Name:        a.Rule,
+			State:       a.State,
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			Value:       a.Value,
+			ActiveAt:    a.ActiveAt,
+			FiredAt:     a.FiredAt,
+		}
+		if a.State == Resolved {
+			wa.ResolvedAt = &a.ResolvedAt
+		}
+		body.Alerts = append(body.Alerts, wa)
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
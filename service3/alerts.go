@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"service3/alerting"
+	pb "service3/service3/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *server) ListAlerts(ctx context.Context, req *pb.ListAlertsRequest) (*pb.ListAlertsResponse, error) {
+	if s.alerts == nil {
+		return nil, status.Error(codes.FailedPrecondition, "alerting is not configured")
+	}
+	matchers, err := alerting.ParseMatchers(req.Matchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp := &pb.ListAlertsResponse{}
+	for _, a := range s.alerts.Alerts() {
+		if len(req.States) > 0 && !slices.Contains(req.States, string(a.State)) {
+			continue
+		}
+		if !matchers.Matches(a.Labels) {
+			continue
+		}
+		alert := &pb.Alert{
+			Name:        a.Rule,
+			State:       string(a.State),
+			Severity:    a.Labels["severity"],
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			Value:       a.Value,
+			ActiveAt:    timestamppb.New(a.ActiveAt),
+			Silenced:    a.Silenced,
+		}
+		if !a.FiredAt.IsZero() {
+			alert.FiredAt = timestamppb.New(a.FiredAt)
+		}
+		if !a.ResolvedAt.IsZero() {
+			alert.ResolvedAt = timestamppb.New(a.ResolvedAt)
+		}
+		resp.Alerts = append(resp.Alerts, alert)
+	}
+	for _, silence := range s.alerts.Silences(time.Now()) {
+		resp.Silences = append(resp.Silences, silenceResponse(silence))
+	}
+	return resp, nil
+}
+
+func (s *server) CreateSilence(ctx context.Context, req *pb.CreateSilenceRequest) (*pb.Silence, error) {
+	if s.alerts == nil {
+		return nil, status.Error(codes.FailedPrecondition, "alerting is not configured")
+	}
+	if len(req.Matchers) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "matchers are required")
+	}
+	matchers, err := alerting.ParseMatchers(req.Matchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	startsAt := time.Now()
+	if req.StartsAt != nil {
+		startsAt = req.StartsAt.AsTime()
+	}
+	if req.EndsAt == nil || !req.EndsAt.AsTime().After(startsAt) {
+		return nil, status.Error(codes.InvalidArgument, "ends_at must be after starts_at")
+	}
+
+	silence := s.alerts.AddSilence(alerting.Silence{
+		Matchers:  matchers,
+		StartsAt:  startsAt,
+		EndsAt:    req.EndsAt.AsTime(),
+		Comment:   req.Comment,
+		CreatedBy: req.CreatedBy,
+	})
+	return silenceResponse(silence), nil
+}
+
+func silenceResponse(silence alerting.Silence) *pb.Silence {
+	resp := &pb.Silence{
+		Id:        silence.ID,
+		StartsAt:  timestamppb.New(silence.StartsAt),
+		EndsAt:    timestamppb.New(silence.EndsAt),
+		Comment:   silence.Comment,
+		CreatedBy: silence.CreatedBy,
+	}
+	for _, m := range silence.Matchers {
+		resp.Matchers = append(resp.Matchers, m.String())
+	}
+	return resp
+}
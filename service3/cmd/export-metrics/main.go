@@ -0,0 +1,129 @@
+// Command export-metrics writes the metrics history of a service from the
+// monitoring service as the MetricsData JSON the visualization package
+// reads, and optionally renders its charts.
+//
+//	export-metrics -service user -database users -since 1h -out metrics.json
+//	export-metrics -service order -database orders -since 24h -step 1m -out metrics.json -charts charts/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+
+	pb "service3/service3/proto"
+	"service3/visualization"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:50053", "monitoring service address")
+	service := flag.String("service", "user", "service whose request metrics are exported")
+	database := flag.String("database", "", `database whose metrics are exported, e.g. "users"; none when empty`)
+	since := flag.Duration("since", time.Hour, "export the metrics of this long before now")
+	step := flag.Duration("step", 0, "resolution; the finest one kept when 0")
+	out := flag.String("out", "", "output file (required)")
+	charts := flag.String("charts", "", "also render the charts into this directory")
+	flag.Parse()
+
+	if *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		logrus.Fatalf("Failed to connect to %s: %v", *addr, err)
+	}
+	defer conn.Close()
+
+	series := []string{"service/" + *service + "/", "kafka/messages_received"}
+	if *database != "" {
+		series = append(series, "database/"+*database+"/")
+	}
+	resp, err := pb.NewMonitoringServiceClient(conn).GetMetricsHistory(ctx, &pb.GetMetricsHistoryRequest{
+		Series:      series,
+		From:        timestamppb.New(time.Now().Add(-*since)),
+		StepSeconds: int32(*step / time.Second),
+	})
+	if err != nil {
+		logrus.Fatalf("Failed to get metrics history: %v", err)
+	}
+
+	data := toMetricsData(resp.Series)
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		logrus.Fatalf("Failed to encode metrics: %v", err)
+	}
+	if err := os.WriteFile(*out, raw, 0o644); err != nil {
+		logrus.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	logrus.Infof("Exported %d points to %s", len(data), *out)
+
+	if *charts != "" {
+		if err := os.MkdirAll(*charts, 0o755); err != nil {
+			logrus.Fatalf("Failed to create %s: %v", *charts, err)
+		}
+		if err := visualization.GenerateMetricsVisuals(*out, *charts); err != nil {
+			logrus.Fatalf("Failed to render charts: %v", err)
+		}
+		logrus.Infof("Charts written to %s", *charts)
+	}
+}
+
+// toMetricsData joins the series into one MetricsData per point in time.
+// Counters take the last sample of each point and gauges the average.
+func toMetricsData(series []*pb.MetricSeries) []visualization.MetricsData {
+	byTime := make(map[time.Time]*visualization.MetricsData)
+	at := func(p *pb.MetricPoint) *visualization.MetricsData {
+		t := p.Time.AsTime()
+		d, ok := byTime[t]
+		if !ok {
+			d = &visualization.MetricsData{Timestamp: t}
+			byTime[t] = d
+		}
+		return d
+	}
+
+	for _, s := range series {
+		field := s.Name[strings.LastIndex(s.Name, "/")+1:]
+		for _, p := range s.Points {
+			d := at(p)
+			switch {
+			case strings.HasPrefix(s.Name, "service/") && field == "total_requests":
+				d.TotalRequests = uint64(p.Last)
+			case strings.HasPrefix(s.Name, "service/") && field == "successful_requests":
+				d.SuccessRequests = uint64(p.Last)
+			case strings.HasPrefix(s.Name, "service/") && field == "failed_requests":
+				d.FailedRequests = uint64(p.Last)
+			case strings.HasPrefix(s.Name, "service/") && field == "average_latency_ms":
+				d.AverageLatency = p.Avg
+			case strings.HasPrefix(s.Name, "database/") && field == "active_connections":
+				d.ActiveConns = int32(p.Avg)
+			case strings.HasPrefix(s.Name, "database/") && field == "size_mb":
+				d.DatabaseSizeMB = p.Avg
+			case s.Name == "kafka/messages_received":
+				d.MessagesReceived = int64(p.Last)
+			}
+		}
+	}
+
+	out := make([]visualization.MetricsData, 0, len(byTime))
+	for _, d := range byTime {
+		out = append(out, *d)
+	}
+	slices.SortFunc(out, func(a, b visualization.MetricsData) int { return a.Timestamp.Compare(b.Timestamp) })
+	return out
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "service3/service3/proto"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestToMetricsData(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+	point := func(at time.Time, avg, last float64) *pb.MetricPoint {
+		return &pb.MetricPoint{Time: timestamppb.New(at), Avg: avg, Last: last}
+	}
+	series := []*pb.MetricSeries{
+		// Points of different series at the same time are joined, whatever
+		// order they come in.
+		{Name: "service/user/total_requests", Points: []*pb.MetricPoint{point(t1, 15, 20), point(t0, 5, 10)}},
+		{Name: "service/user/failed_requests", Points: []*pb.MetricPoint{point(t0, 0.5, 1)}},
+		{Name: "service/user/average_latency_ms", Points: []*pb.MetricPoint{point(t0, 2.5, 3)}},
+		{Name: "database/users/active_connections", Points: []*pb.MetricPoint{point(t0, 4.6, 7)}},
+		{Name: "kafka/messages_received", Points: []*pb.MetricPoint{point(t1, 40, 50)}},
+		// Series the visualization has no field for are ignored.
+		{Name: "service/user/p99_latency_ms", Points: []*pb.MetricPoint{point(t0, 9, 9)}},
+	}
+
+	data := toMetricsData(series)
+	if len(data) != 2 {
+		t.Fatalf("%d points, want 2", len(data))
+	}
+	first, second := data[0], data[1]
+	// Counters take the last sample, gauges the average.
+	if !first.Timestamp.Equal(t0) || first.TotalRequests != 10 || first.FailedRequests != 1 ||
+		first.AverageLatency != 2.5 || first.ActiveConns != 4 || first.MessagesReceived != 0 {
+		t.Errorf("first point %+v", first)
+	}
+	if !second.Timestamp.Equal(t1) || second.TotalRequests != 20 || second.MessagesReceived != 50 || second.FailedRequests != 0 {
+		t.Errorf("second point %+v", second)
+	}
+}
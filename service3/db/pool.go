@@ -72,6 +72,11 @@ func (p *DBPool) ReleaseTx(tx *sql.Tx, err error) error {
 	return tx.Commit()
 }
 
+// DB returns the underlying connection pool.
+func (p *DBPool) DB() *sql.DB {
+	return p.db
+}
+
 func (p *DBPool) Close() error {
 	return p.db.Close()
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"service3/history"
+	pb "service3/service3/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recordHistory adds a snapshot to the history store. Database stats older
+// than a few samples are left out, so the history has a gap while a
+// database cannot be queried.
+func (s *server) recordHistory(snapshot *pb.MetricsSnapshot, interval time.Duration) {
+	now := snapshot.Time.AsTime()
+	for _, svc := range snapshot.Services {
+		prefix := "service/" + svc.Name + "/"
+		s.history.Record(prefix+"total_requests", now, float64(svc.Total.TotalRequests))
+		s.history.Record(prefix+"successful_requests", now, float64(svc.Total.SuccessfulRequests))
+		s.history.Record(prefix+"failed_requests", now, float64(svc.Total.FailedRequests))
+		s.history.Record(prefix+"average_latency_ms", now, svc.Total.AverageLatencyMs)
+		s.history.Record(prefix+"request_rate", now, svc.LastMinute.RequestRate)
+		s.history.Record(prefix+"error_rate", now, svc.LastMinute.ErrorRate)
+		s.history.Record(prefix+"p50_latency_ms", now, svc.LastMinute.P50LatencyMs)
+		s.history.Record(prefix+"p99_latency_ms", now, svc.LastMinute.P99LatencyMs)
+	}
+	for _, d := range snapshot.Databases {
+		if now.Sub(d.SampledAt.AsTime()) > 3*interval {
+			continue
+		}
+		prefix := "database/" + d.Name + "/"
+		s.history.Record(prefix+"active_connections", now, float64(d.Metrics.ActiveConnections))
+		s.history.Record(prefix+"size_mb", now, d.Metrics.DatabaseSizeMb)
+	}
+	s.history.Record("kafka/messages_received", now, float64(snapshot.Kafka.MessagesReceived))
+	s.history.Record("kafka/bytes_received", now, float64(snapshot.Kafka.BytesReceived))
+	s.history.Record("kafka/lag", now, float64(snapshot.Kafka.Lag))
+	for _, g := range snapshot.Kafka.ConsumerGroups {
+		prefix := "kafka/groups/" + g.Group + "/"
+		s.history.Record(prefix+"lag", now, float64(g.Lag))
+		s.history.Record(prefix+"consume_rate", now, g.ConsumeRate)
+		s.history.Record(prefix+"produce_rate", now, g.ProduceRate)
+	}
+}
+
+func (s *server) GetMetricsHistory(ctx context.Context, req *pb.GetMetricsHistoryRequest) (*pb.GetMetricsHistoryResponse, error) {
+	now := time.Now()
+	if req.From == nil {
+		return nil, status.Error(codes.InvalidArgument, "from is required")
+	}
+	from, to := req.From.AsTime(), now
+	if req.To != nil {
+		to = req.To.AsTime()
+	}
+
+	var names []string
+	if len(req.Series) == 0 {
+		names = s.history.Names("")
+	}
+	for _, name := range req.Series {
+		if strings.HasSuffix(name, "/") {
+			names = append(names, s.history.Names(name)...)
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	resp := &pb.GetMetricsHistoryResponse{}
+	for _, name := range names {
+		points, step, err := s.history.Query(name, from, to, time.Duration(req.StepSeconds)*time.Second, now)
+		if errors.Is(err, history.ErrInvalidRange) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err != nil {
+			logrus.Errorf("Failed to query metrics history: %v", err)
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+		series := &pb.MetricSeries{Name: name, StepSeconds: int32(step / time.Second)}
+		for _, p := range points {
+			series.Points = append(series.Points, &pb.MetricPoint{
+				Time: timestamppb.New(p.Time),
+				Min:  p.Min,
+				Max:  p.Max,
+				Avg:  p.Avg(),
+				Last: p.Last,
+			})
+		}
+		resp.Series = append(resp.Series, series)
+	}
+	return resp, nil
+}
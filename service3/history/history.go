@@ -0,0 +1,306 @@
+// Package history keeps recent values of named metrics in memory, in
+// retention tiers of decreasing resolution. Save and Load keep the coarser
+// tiers across restarts.
+//
+// Every value is added to each tier. A tier aggregates the values of one
+// step into a single point, keeping their min, max, sum, count and last
+// value, and holds the points of its retention period in a ring. Queries
+// read the finest tier that still covers the requested range.
+//
+// A point takes 64 bytes. Rings grow as their series is recorded, up to
+// the points of their retention period: with DefaultTiers a series
+// recorded every second reaches 13,680 points, about 0.9 MB, after a week.
+package history
+
+import (
+	"cmp"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidRange is returned for a query the store cannot answer.
+var ErrInvalidRange = errors.New("invalid range")
+
+// Tier is a resolution and how long it is kept.
+type Tier struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// DefaultTiers keep 1s points for an hour and 1m points for a week.
+var DefaultTiers = []Tier{
+	{Step: time.Second, Retention: time.Hour},
+	{Step: time.Minute, Retention: 7 * 24 * time.Hour},
+}
+
+// Point aggregates the values recorded in one step, starting at Time.
+type Point struct {
+	Time     time.Time
+	Min, Max float64
+	Sum      float64
+	Count    int
+	Last     float64
+}
+
+// Avg returns the mean of the values.
+func (p Point) Avg() float64 {
+	if p.Count == 0 {
+		return 0
+	}
+	return p.Sum / float64(p.Count)
+}
+
+func (p *Point) add(v float64) {
+	if p.Count == 0 || v < p.Min {
+		p.Min = v
+	}
+	if p.Count == 0 || v > p.Max {
+		p.Max = v
+	}
+	p.Sum += v
+	p.Count++
+	p.Last = v
+}
+
+// merge adds o, which follows p in time, to p.
+func (p *Point) merge(o Point) {
+	if p.Count == 0 || o.Min < p.Min {
+		p.Min = o.Min
+	}
+	if p.Count == 0 || o.Max > p.Max {
+		p.Max = o.Max
+	}
+	p.Sum += o.Sum
+	p.Count += o.Count
+	p.Last = o.Last
+}
+
+// ring holds the points of one tier. points grows until it has size
+// points, then wraps; base is the step number of points[0], so a new series
+// starts small.
+type ring struct {
+	tier   Tier
+	size   int
+	base   int64
+	points []Point
+}
+
+func (r *ring) slot(start time.Time) *Point {
+	n := start.UnixNano() / int64(r.tier.Step)
+	if len(r.points) == 0 {
+		r.base = n
+	}
+	i := int((n - r.base) % int64(r.size))
+	if i < 0 {
+		i += r.size
+	}
+	if i >= len(r.points) {
+		if i >= cap(r.points) {
+			grown := make([]Point, len(r.points), min(max(2*cap(r.points), i+1, 64), r.size))
+			copy(grown, r.points)
+			r.points = grown
+		}
+		r.points = r.points[:i+1]
+	}
+	return &r.points[i]
+}
+
+func (r *ring) add(t time.Time, v float64) {
+	start := t.Truncate(r.tier.Step)
+	p := r.slot(start)
+	if !p.Time.Equal(start) {
+		*p = Point{Time: start}
+	}
+	p.add(v)
+}
+
+// Store holds the series. It is safe for concurrent use.
+type Store struct {
+	tiers []Tier
+	// MaxPoints bounds the points a query returns per series.
+	MaxPoints int
+
+	mutex  sync.RWMutex
+	series map[string][]*ring
+}
+
+// New creates a Store with the given tiers, or DefaultTiers if there are
+// none.
+func New(tiers ...Tier) *Store {
+	if len(tiers) == 0 {
+		tiers = DefaultTiers
+	}
+	tiers = slices.Clone(tiers)
+	slices.SortFunc(tiers, func(a, b Tier) int { return cmp.Compare(a.Step, b.Step) })
+	return &Store{tiers: tiers, MaxPoints: 20000, series: make(map[string][]*ring)}
+}
+
+// Record adds the value of a series at t.
+func (s *Store) Record(name string, t time.Time, v float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, r := range s.rings(name) {
+		r.add(t, v)
+	}
+}
+
+// rings returns the rings of a series, creating them if needed. The caller
+// must hold the write lock.
+func (s *Store) rings(name string) []*ring {
+	rings, ok := s.series[name]
+	if !ok {
+		for _, tier := range s.tiers {
+			size := int((tier.Retention + tier.Step - 1) / tier.Step)
+			rings = append(rings, &ring{tier: tier, size: size})
+		}
+		s.series[name] = rings
+	}
+	return rings
+}
+
+// savedTier is the points of one tier of a series, as Save writes them.
+type savedTier struct {
+	Step   time.Duration
+	Points []Point
+}
+
+// Save writes the points of the tiers of at least minStep to w, for Load
+// to restore after a restart. Finer tiers change every second and are
+// cheap to lose, so they are left out.
+func (s *Store) Save(w io.Writer, minStep time.Duration) error {
+	s.mutex.RLock()
+	snap := make(map[string][]savedTier, len(s.series))
+	for name, rings := range s.series {
+		for _, r := range rings {
+			if r.tier.Step < minStep {
+				continue
+			}
+			saved := savedTier{Step: r.tier.Step}
+			for _, p := range r.points {
+				if p.Count > 0 {
+					saved.Points = append(saved.Points, p)
+				}
+			}
+			snap[name] = append(snap[name], saved)
+		}
+	}
+	s.mutex.RUnlock()
+	return gob.NewEncoder(w).Encode(snap)
+}
+
+// Load adds points written by Save to the store. Points of tiers the store
+// does not have are dropped, and a point recorded since the restart in the
+// same step as a saved one is merged with it.
+func (s *Store) Load(r io.Reader) error {
+	var snap map[string][]savedTier
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("decoding history: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, tiers := range snap {
+		for _, saved := range tiers {
+			i := slices.IndexFunc(s.tiers, func(t Tier) bool { return t.Step == saved.Step })
+			if i < 0 {
+				continue
+			}
+			r := s.rings(name)[i]
+			// Oldest first, so a new ring grows from the oldest point.
+			slices.SortFunc(saved.Points, func(a, b Point) int { return a.Time.Compare(b.Time) })
+			for _, p := range saved.Points {
+				slot := r.slot(p.Time)
+				switch {
+				case slot.Time.Equal(p.Time):
+					p.merge(*slot)
+					*slot = p
+				case slot.Time.Before(p.Time):
+					*slot = p
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the series starting with prefix, sorted.
+func (s *Store) Names(prefix string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var out []string
+	for name := range s.series {
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, name)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Query returns the points of a series between from and to, and their
+// step. It reads the finest tier of at least step whose retention reaches
+// back to from, and merges its points further if step is coarser than the
+// tier. A series that does not exist has no points.
+func (s *Store) Query(name string, from, to time.Time, step time.Duration, now time.Time) ([]Point, time.Duration, error) {
+	if !from.Before(to) {
+		return nil, 0, fmt.Errorf("%w: from must be before to", ErrInvalidRange)
+	}
+	if step < 0 {
+		return nil, 0, fmt.Errorf("%w: negative step", ErrInvalidRange)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rings := s.series[name]
+	if len(rings) == 0 {
+		return nil, max(step, s.tiers[0].Step), nil
+	}
+	var r *ring
+	for _, candidate := range rings {
+		if candidate.tier.Step < step {
+			continue
+		}
+		r = candidate
+		if !from.Before(now.Add(-candidate.tier.Retention)) {
+			break
+		}
+	}
+	if r == nil {
+		r = rings[len(rings)-1]
+	}
+	step = max(step, r.tier.Step)
+	if n := to.Sub(from) / step; int(n) > s.MaxPoints {
+		return nil, 0, fmt.Errorf("%w: %d points of %v; use a larger step", ErrInvalidRange, n, step)
+	}
+
+	var points []Point
+	for _, p := range r.points {
+		if p.Count > 0 && !p.Time.Before(from.Truncate(r.tier.Step)) && p.Time.Before(to) {
+			points = append(points, p)
+		}
+	}
+	slices.SortFunc(points, func(a, b Point) int { return a.Time.Compare(b.Time) })
+	if step == r.tier.Step {
+		return points, step, nil
+	}
+
+	var merged []Point
+	for _, p := range points {
+		start := p.Time.Truncate(step)
+		if len(merged) == 0 || !merged[len(merged)-1].Time.Equal(start) {
+			merged = append(merged, Point{Time: start})
+		}
+		merged[len(merged)-1].merge(p)
+	}
+	return merged, step, nil
+}
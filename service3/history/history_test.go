@@ -0,0 +1,130 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryTiers(t *testing.T) {
+	s := New(Tier{Step: time.Second, Retention: time.Minute}, Tier{Step: 10 * time.Second, Retention: time.Hour})
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// One value a second for 10 minutes: 0, 1, 2, ...
+	for i := 0; i < 600; i++ {
+		s.Record("requests", start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	now := start.Add(600 * time.Second)
+
+	// The last 30s are still in the 1s tier.
+	points, step, err := s.Query("requests", now.Add(-30*time.Second), now, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != time.Second || len(points) != 30 || points[0].Last != 570 || points[29].Last != 599 {
+		t.Errorf("30s: step %v, %d points", step, len(points))
+	}
+
+	// The last 5 minutes only in the 10s tier.
+	points, step, _ = s.Query("requests", now.Add(-5*time.Minute), now, 0, now)
+	if step != 10*time.Second || len(points) != 30 {
+		t.Fatalf("5m: step %v, %d points", step, len(points))
+	}
+	if p := points[0]; p.Min != 300 || p.Max != 309 || p.Last != 309 || p.Count != 10 || p.Avg() != 304.5 {
+		t.Errorf("5m: first point %+v", p)
+	}
+
+	// A coarser step merges the tier's points.
+	points, step, _ = s.Query("requests", now.Add(-5*time.Minute), now, time.Minute, now)
+	if step != time.Minute || len(points) != 5 || points[0].Count != 60 || points[4].Last != 599 {
+		t.Errorf("5m by 1m: step %v, %d points", step, len(points))
+	}
+
+	if points, _, _ := s.Query("unknown", now.Add(-time.Minute), now, 0, now); len(points) != 0 {
+		t.Errorf("unknown series has %d points", len(points))
+	}
+	if _, _, err := s.Query("requests", now, now, 0, now); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("empty range: err = %v", err)
+	}
+}
+
+func TestRingsGrowWithSeries(t *testing.T) {
+	s := New()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		s.Record("requests", start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	seconds, minutes := s.series["requests"][0], s.series["requests"][1]
+	if cap(seconds.points) > 64 || cap(minutes.points) > 64 {
+		t.Errorf("a new series holds %d and %d points", cap(seconds.points), cap(minutes.points))
+	}
+
+	// Past its retention a ring wraps at its size.
+	for i := 10; i < 2*3600; i++ {
+		s.Record("requests", start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	if len(seconds.points) != 3600 || cap(seconds.points) != 3600 || len(minutes.points) != 120 {
+		t.Errorf("after 2h: %d (cap %d) and %d points", len(seconds.points), cap(seconds.points), len(minutes.points))
+	}
+	now := start.Add(2 * time.Hour)
+	points, _, err := s.Query("requests", now.Add(-time.Hour), now, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3600 || points[0].Last != 3600 || points[3599].Last != 7199 {
+		t.Errorf("last hour: %d points", len(points))
+	}
+}
+
+func TestNames(t *testing.T) {
+	s := New()
+	now := time.Now()
+	s.Record("service/user/total_requests", now, 1)
+	s.Record("service/order/total_requests", now, 1)
+	s.Record("kafka/lag", now, 1)
+	names := s.Names("service/")
+	if len(names) != 2 || names[0] != "service/order/total_requests" {
+		t.Errorf("Names = %v", names)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	tiers := []Tier{{Step: time.Second, Retention: time.Minute}, {Step: time.Minute, Retention: time.Hour}}
+	before := New(tiers...)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// One value a second for 5 minutes and a half.
+	for i := 0; i < 330; i++ {
+		before.Record("requests", start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	var buf bytes.Buffer
+	if err := before.Save(&buf, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service restarts within the sixth minute and records again.
+	after := New(tiers...)
+	for i := 340; i < 345; i++ {
+		after.Record("requests", start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	if err := after.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	now := start.Add(345 * time.Second)
+
+	points, step, _ := after.Query("requests", start, now, time.Minute, now)
+	if step != time.Minute || len(points) != 6 || points[0].Count != 60 || points[0].Last != 59 {
+		t.Fatalf("restored 1m points: step %v, %+v", step, points)
+	}
+	if p := points[5]; p.Count != 35 || p.Min != 300 || p.Last != 344 {
+		t.Errorf("merged point %+v", p)
+	}
+	// The 1s tier only has what was recorded since the restart.
+	points, step, _ = after.Query("requests", now.Add(-30*time.Second), now, 0, now)
+	if step != time.Second || len(points) != 5 {
+		t.Errorf("1s points: step %v, %d points", step, len(points))
+	}
+
+	if err := after.Load(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("Load of garbage succeeded")
+	}
+}
@@ -0,0 +1,288 @@
+// Package kafkalag measures how far every consumer group is behind, from the
+// offsets the groups commit and the high watermarks of the partitions, as
+// the broker reports them.
+//
+// The broker is polled at an interval. The lag of a partition is its high
+// watermark minus the group's committed offset. Rates are the change of
+// both over the polls of the last RateWindow, and the time to drain is how
+// long the lag takes to reach 0 if they stay the same.
+package kafkalag
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Client is the part of *kafka.Client a Collector uses.
+type Client interface {
+	ListGroups(ctx context.Context, req *kafka.ListGroupsRequest) (*kafka.ListGroupsResponse, error)
+	OffsetFetch(ctx context.Context, req *kafka.OffsetFetchRequest) (*kafka.OffsetFetchResponse, error)
+	Metadata(ctx context.Context, req *kafka.MetadataRequest) (*kafka.MetadataResponse, error)
+	ListOffsets(ctx context.Context, req *kafka.ListOffsetsRequest) (*kafka.ListOffsetsResponse, error)
+}
+
+// Partition is the lag of a group on one partition.
+type Partition struct {
+	Topic     string
+	Partition int
+	// Committed is the group's committed offset, or -1 if it has not
+	// committed one; the lag then counts from the first offset.
+	Committed     int64
+	HighWatermark int64
+	Lag           int64
+	// ConsumeRate and ProduceRate are messages per second.
+	ConsumeRate float64
+	ProduceRate float64
+	// TimeToDrain is -1 while the lag is not shrinking.
+	TimeToDrain time.Duration
+}
+
+// Group is the lag of a consumer group over its partitions.
+type Group struct {
+	Group       string
+	Lag         int64
+	ConsumeRate float64
+	ProduceRate float64
+	TimeToDrain time.Duration
+	Partitions  []Partition
+}
+
+type key struct {
+	group     string
+	topic     string
+	partition int
+}
+
+type sample struct {
+	time      time.Time
+	committed int64
+	end       int64
+}
+
+// Collector polls the broker for the lag of every group. It is safe for
+// concurrent use.
+type Collector struct {
+	client Client
+	// RateWindow is the period rates are measured over.
+	RateWindow time.Duration
+
+	mutex   sync.RWMutex
+	groups  []Group
+	polled  time.Time
+	samples map[key][]sample
+}
+
+// New creates a Collector that polls through client.
+func New(client Client) *Collector {
+	return &Collector{client: client, RateWindow: time.Minute, samples: make(map[key][]sample)}
+}
+
+// Poll reads the committed offsets of every group and the offsets of their
+// partitions, and updates the lags.
+func (c *Collector) Poll(ctx context.Context, now time.Time) error {
+	listed, err := c.client.ListGroups(ctx, &kafka.ListGroupsRequest{})
+	if err != nil {
+		return fmt.Errorf("list groups: %w", err)
+	}
+	if listed.Error != nil {
+		return fmt.Errorf("list groups: %w", listed.Error)
+	}
+
+	// The committed offsets of each group, by topic and partition.
+	committed := make(map[string]map[string]map[int]int64)
+	topics := make(map[string]bool)
+	for _, g := range listed.Groups {
+		resp, err := c.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: g.GroupID})
+		if err != nil {
+			return fmt.Errorf("fetch offsets of %s: %w", g.GroupID, err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("fetch offsets of %s: %w", g.GroupID, resp.Error)
+		}
+		offsets := make(map[string]map[int]int64)
+		for topic, partitions := range resp.Topics {
+			offsets[topic] = make(map[int]int64)
+			for _, p := range partitions {
+				if p.Error == nil {
+					offsets[topic][p.Partition] = p.CommittedOffset
+				}
+			}
+			topics[topic] = true
+		}
+		committed[g.GroupID] = offsets
+	}
+	if len(topics) == 0 {
+		c.update(now, nil, nil)
+		return nil
+	}
+
+	// Every partition of those topics, with its first offset and high
+	// watermark.
+	meta, err := c.client.Metadata(ctx, &kafka.MetadataRequest{Topics: slices.Sorted(maps.Keys(topics))})
+	if err != nil {
+		return fmt.Errorf("read metadata: %w", err)
+	}
+	req := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	for _, t := range meta.Topics {
+		if t.Error != nil {
+			continue
+		}
+		for _, p := range t.Partitions {
+			req.Topics[t.Name] = append(req.Topics[t.Name], kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+		}
+	}
+	offsets, err := c.client.ListOffsets(ctx, req)
+	if err != nil {
+		return fmt.Errorf("list offsets: %w", err)
+	}
+	ends := make(map[string][]kafka.PartitionOffsets)
+	for topic, partitions := range offsets.Topics {
+		for _, p := range partitions {
+			if p.Error == nil {
+				ends[topic] = append(ends[topic], p)
+			}
+		}
+	}
+
+	c.update(now, committed, ends)
+	return nil
+}
+
+// update computes the lags of a poll. The committed offsets are by group,
+// topic and partition.
+func (c *Collector) update(now time.Time, committed map[string]map[string]map[int]int64, ends map[string][]kafka.PartitionOffsets) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	seen := make(map[key]bool)
+	var groups []Group
+	for _, group := range slices.Sorted(maps.Keys(committed)) {
+		g := Group{Group: group}
+		for _, topic := range slices.Sorted(maps.Keys(committed[group])) {
+			partitions := slices.Clone(ends[topic])
+			slices.SortFunc(partitions, func(a, b kafka.PartitionOffsets) int { return a.Partition - b.Partition })
+			for _, po := range partitions {
+				offset, ok := committed[group][topic][po.Partition]
+				if !ok {
+					offset = -1
+				}
+				p := Partition{Topic: topic, Partition: po.Partition, Committed: offset, HighWatermark: po.LastOffset}
+				if offset >= 0 {
+					p.Lag = max(po.LastOffset-offset, 0)
+				} else {
+					p.Lag = po.LastOffset - po.FirstOffset
+				}
+
+				k := key{group, topic, po.Partition}
+				seen[k] = true
+				samples := append(c.samples[k], sample{time: now, committed: max(offset, po.FirstOffset), end: po.LastOffset})
+				// Keep the newest sample at least RateWindow old, to measure
+				// the rates from.
+				for len(samples) > 1 && now.Sub(samples[1].time) >= c.RateWindow {
+					samples = samples[1:]
+				}
+				c.samples[k] = samples
+				if first := samples[0]; len(samples) > 1 {
+					elapsed := now.Sub(first.time).Seconds()
+					p.ConsumeRate = float64(max(offset, po.FirstOffset)-first.committed) / elapsed
+					p.ProduceRate = float64(po.LastOffset-first.end) / elapsed
+				}
+				p.TimeToDrain = timeToDrain(p.Lag, p.ConsumeRate, p.ProduceRate)
+
+				g.Partitions = append(g.Partitions, p)
+				g.Lag += p.Lag
+				g.ConsumeRate += p.ConsumeRate
+				g.ProduceRate += p.ProduceRate
+			}
+		}
+		g.TimeToDrain = timeToDrain(g.Lag, g.ConsumeRate, g.ProduceRate)
+		groups = append(groups, g)
+	}
+	for k := range c.samples {
+		if !seen[k] {
+			delete(c.samples, k)
+		}
+	}
+	c.groups, c.polled = groups, now
+}
+
+func timeToDrain(lag int64, consumeRate, produceRate float64) time.Duration {
+	switch {
+	case lag == 0:
+		return 0
+	case consumeRate <= produceRate:
+		return -1
+	default:
+		return time.Duration(float64(lag) / (consumeRate - produceRate) * float64(time.Second))
+	}
+}
+
+// Groups returns the lags of the last poll and when it was taken, limited
+// to the given groups and topics when there are any. Groups without
+// partitions of the topics are left out.
+func (c *Collector) Groups(groups, topics []string) ([]Group, time.Time) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var out []Group
+	for _, g := range c.groups {
+		if len(groups) > 0 && !slices.Contains(groups, g.Group) {
+			continue
+		}
+		if len(topics) > 0 {
+			g.Partitions = slices.DeleteFunc(slices.Clone(g.Partitions), func(p Partition) bool {
+				return !slices.Contains(topics, p.Topic)
+			})
+			if len(g.Partitions) == 0 {
+				continue
+			}
+			g.Lag, g.ConsumeRate, g.ProduceRate = 0, 0, 0
+			for _, p := range g.Partitions {
+				g.Lag += p.Lag
+				g.ConsumeRate += p.ConsumeRate
+				g.ProduceRate += p.ProduceRate
+			}
+			g.TimeToDrain = timeToDrain(g.Lag, g.ConsumeRate, g.ProduceRate)
+		}
+		out = append(out, g)
+	}
+	return out, c.polled
+}
+
+// Run polls every interval until ctx is done.
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			pollCtx, cancel := context.WithTimeout(ctx, interval)
+			err := c.Poll(pollCtx, now)
+			cancel()
+			if err != nil {
+				logrus.Errorf("Failed to poll Kafka consumer group offsets: %v", err)
+				continue
+			}
+			groups, _ := c.Groups(nil, nil)
+			for _, g := range groups {
+				logrus.WithFields(logrus.Fields{
+					"group":         g.Group,
+					"lag":           g.Lag,
+					"consume_rate":  fmt.Sprintf("%.2f/s", g.ConsumeRate),
+					"produce_rate":  fmt.Sprintf("%.2f/s", g.ProduceRate),
+					"time_to_drain": g.TimeToDrain,
+				}).Info("Kafka consumer group lag")
+			}
+		}
+	}
+}
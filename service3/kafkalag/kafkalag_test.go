@@ -0,0 +1,101 @@
+package kafkalag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// broker is a Client serving fixed offsets for two partitions of
+// user-events.
+type broker struct {
+	committed map[string]map[int]int64
+	first     map[int]int64
+	last      map[int]int64
+}
+
+func (b *broker) ListGroups(ctx context.Context, req *kafka.ListGroupsRequest) (*kafka.ListGroupsResponse, error) {
+	resp := &kafka.ListGroupsResponse{}
+	for group := range b.committed {
+		resp.Groups = append(resp.Groups, kafka.ListGroupsResponseGroup{GroupID: group})
+	}
+	return resp, nil
+}
+
+func (b *broker) OffsetFetch(ctx context.Context, req *kafka.OffsetFetchRequest) (*kafka.OffsetFetchResponse, error) {
+	resp := &kafka.OffsetFetchResponse{Topics: map[string][]kafka.OffsetFetchPartition{}}
+	for partition, offset := range b.committed[req.GroupID] {
+		resp.Topics["user-events"] = append(resp.Topics["user-events"], kafka.OffsetFetchPartition{Partition: partition, CommittedOffset: offset})
+	}
+	return resp, nil
+}
+
+func (b *broker) Metadata(ctx context.Context, req *kafka.MetadataRequest) (*kafka.MetadataResponse, error) {
+	return &kafka.MetadataResponse{Topics: []kafka.Topic{{
+		Name:       "user-events",
+		Partitions: []kafka.Partition{{Topic: "user-events", ID: 0}, {Topic: "user-events", ID: 1}},
+	}}}, nil
+}
+
+func (b *broker) ListOffsets(ctx context.Context, req *kafka.ListOffsetsRequest) (*kafka.ListOffsetsResponse, error) {
+	resp := &kafka.ListOffsetsResponse{Topics: map[string][]kafka.PartitionOffsets{}}
+	for _, p := range []int{0, 1} {
+		resp.Topics["user-events"] = append(resp.Topics["user-events"], kafka.PartitionOffsets{Partition: p, FirstOffset: b.first[p], LastOffset: b.last[p]})
+	}
+	return resp, nil
+}
+
+func TestCollector(t *testing.T) {
+	b := &broker{
+		committed: map[string]map[int]int64{
+			"order-service-group": {0: 100, 1: 50},
+			// Has not committed on partition 1.
+			"audit": {0: 0},
+		},
+		first: map[int]int64{0: 0, 1: 10},
+		last:  map[int]int64{0: 200, 1: 60},
+	}
+	c := New(b)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+	if err := c.Poll(ctx, start); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, polled := c.Groups(nil, nil)
+	if len(groups) != 2 || !polled.Equal(start) {
+		t.Fatalf("groups %+v", groups)
+	}
+	audit, orders := groups[0], groups[1]
+	if audit.Group != "audit" || audit.Lag != 200+50 || audit.Partitions[1].Committed != -1 || audit.TimeToDrain != -1 {
+		t.Errorf("audit: %+v", audit)
+	}
+	if orders.Lag != 100+10 || orders.ConsumeRate != 0 {
+		t.Errorf("orders: %+v", orders)
+	}
+
+	// A minute later the group consumed 120 messages of partition 0 while 60
+	// more were produced: it drains 1 message a second.
+	b.committed["order-service-group"][0] = 220
+	b.last[0] = 260
+	if err := c.Poll(ctx, start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	groups, _ = c.Groups([]string{"order-service-group"}, []string{"user-events"})
+	if len(groups) != 1 {
+		t.Fatalf("groups %+v", groups)
+	}
+	p := groups[0].Partitions[0]
+	if p.Lag != 40 || p.ConsumeRate != 2 || p.ProduceRate != 1 || p.TimeToDrain != 40*time.Second {
+		t.Errorf("partition 0: %+v", p)
+	}
+	if g := groups[0]; g.Lag != 50 || g.TimeToDrain != 50*time.Second {
+		t.Errorf("order-service-group: %+v", g)
+	}
+
+	if groups, _ := c.Groups(nil, []string{"order-events"}); len(groups) != 0 {
+		t.Errorf("other topic: %+v", groups)
+	}
+}
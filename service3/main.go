@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"sync"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -15,9 +17,18 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"pkg/histogram"
+	"pkg/metrics"
+	"service3/alerting"
 	"service3/db"
+	"service3/history"
+	"service3/kafkalag"
+	"service3/registry"
 	pb "service3/service3/proto"
+	"service3/slo"
+	"service3/window"
 )
 
 type server struct {
@@ -25,18 +36,73 @@ type server struct {
 	userPool    *db.DBPool
 	orderPool   *db.DBPool
 	kafkaReader *kafka.Reader
-	metrics     struct {
-		userService  *Metrics
-		orderService *Metrics
-		mutex        sync.RWMutex
-	}
+	// kafkaStats accumulates kafkaReader's stats, which reset on every read.
+	kafkaStats *metrics.ConsumerCollector
+	metrics    *serviceMetrics
+	// registry tracks the live service instances.
+	registry *registry.Registry
+	// databases are the pools by the name services use for them in their
+	// dependencies.
+	databases map[string]*db.DBPool
+	// history keeps the sampled metrics for GetMetricsHistory.
+	history *history.Store
+	// databaseStats and snapshot are the latest samples, shared by all
+	// StreamMetrics subscribers.
+	databaseStats databaseStats
+	snapshot      atomic.Pointer[pb.MetricsSnapshot]
+	// alerts evaluates the alert rules against history. It is nil when no
+	// rules file is configured.
+	alerts *alerting.Engine
+	// kafkaLag polls the broker for the lag of every consumer group.
+	kafkaLag *kafkalag.Collector
+	// slos tracks the objectives in SLO_FILE. It is nil when none are
+	// configured.
+	slos *slo.Tracker
 }
 
 type Metrics struct {
 	totalRequests      uint64
 	successfulRequests uint64
 	failedRequests     uint64
-	totalLatency       uint64
+	latency            *histogram.Histogram
+	// recent holds the last 15 minutes, for windowed rates.
+	recent *window.Ring
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		latency: histogram.New(),
+		recent:  window.New(15*time.Minute, 10*time.Second, time.Now()),
+	}
+}
+
+// fail counts a request that failed before reaching the database.
+func (m *Metrics) fail() {
+	m.totalRequests++
+	m.failedRequests++
+	m.recent.Fail(time.Now())
+}
+
+// observe counts a request that started at start and failed if err is set.
+func (m *Metrics) observe(start time.Time, err error) {
+	now := time.Now()
+	m.totalRequests++
+	if err != nil {
+		m.failedRequests++
+	} else {
+		m.successfulRequests++
+	}
+	m.latency.RecordDuration(now.Sub(start))
+	m.recent.Observe(now, now.Sub(start), err != nil)
+}
+
+// add counts requests reported by an instance of a service.
+func (m *Metrics) add(now time.Time, requests, failures uint64, latency *histogram.Histogram) {
+	m.totalRequests += requests
+	m.failedRequests += failures
+	m.successfulRequests += requests - failures
+	m.latency.Merge(latency)
+	m.recent.Add(now, requests, failures, latency)
 }
 
 func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
@@ -51,8 +117,7 @@ func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb
 	if err != nil {
 		s.metrics.mutex.Lock()
 		defer s.metrics.mutex.Unlock()
-		s.metrics.userService.totalRequests++
-		s.metrics.userService.failedRequests++
+		s.metrics.local.fail()
 		logrus.WithError(err).Error("Failed to begin transaction")
 		return &pb.CreateUserResponse{
 			Status: "error",
@@ -69,11 +134,9 @@ func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb
 
 	s.metrics.mutex.Lock()
 	defer s.metrics.mutex.Unlock()
-	s.metrics.userService.totalRequests++
-	s.metrics.userService.totalLatency += uint64(time.Since(start).Milliseconds())
+	s.metrics.local.observe(start, err)
 
 	if err != nil {
-		s.metrics.userService.failedRequests++
 		logrus.WithError(err).Error("Failed to create user")
 		return &pb.CreateUserResponse{
 			Status: "error",
@@ -81,7 +144,6 @@ func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb
 		}, nil
 	}
 
-	s.metrics.userService.successfulRequests++
 	logrus.WithField("user_id", userID).Info("User created successfully")
 	return &pb.CreateUserResponse{
 		UserId: userID,
@@ -97,8 +159,7 @@ func (s *server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUs
 	if err != nil {
 		s.metrics.mutex.Lock()
 		defer s.metrics.mutex.Unlock()
-		s.metrics.userService.totalRequests++
-		s.metrics.userService.failedRequests++
+		s.metrics.local.fail()
 		logrus.WithError(err).Error("Failed to begin transaction")
 		return &pb.GetUserResponse{
 			Error: err.Error(),
@@ -114,18 +175,15 @@ func (s *server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUs
 
 	s.metrics.mutex.Lock()
 	defer s.metrics.mutex.Unlock()
-	s.metrics.userService.totalRequests++
-	s.metrics.userService.totalLatency += uint64(time.Since(start).Milliseconds())
+	s.metrics.local.observe(start, err)
 
 	if err != nil {
-		s.metrics.userService.failedRequests++
 		logrus.WithError(err).Error("Failed to get user")
 		return &pb.GetUserResponse{
 			Error: err.Error(),
 		}, nil
 	}
 
-	s.metrics.userService.successfulRequests++
 	logrus.WithFields(logrus.Fields{
 		"user_id": req.UserId,
 		"name":    name,
@@ -143,33 +201,60 @@ func (s *server) GetServiceMetrics(ctx context.Context, req *pb.GetMetricsReques
 	s.metrics.mutex.RLock()
 	defer s.metrics.mutex.RUnlock()
 
-	var metrics *Metrics
-	switch req.ServiceName {
-	case "user":
-		metrics = s.metrics.userService
-	case "order":
-		metrics = s.metrics.orderService
-	default:
-		return nil, fmt.Errorf("unknown service: %s", req.ServiceName)
+	last := time.Duration(req.WindowSeconds) * time.Second
+	w, instances, err := s.metrics.merged(req.ServiceName, req.Instance, time.Now(), last)
+	if err != nil {
+		return nil, err
 	}
+	return serviceResponse(w, instances, last), nil
+}
+
+// serviceResponse describes the requests of instances, over the last
+// window or since startup when last is 0.
+func serviceResponse(w window.Window, instances []string, last time.Duration) *pb.ServiceMetricsResponse {
+	resp := serviceMetricsResponse(w.Requests, w.Failures, w.Latency)
+	resp.Instances = instances
+	if last > 0 {
+		resp.WindowSeconds = int32(last / time.Second)
+		resp.RequestRate = w.RequestRate()
+		resp.ErrorRate = w.ErrorRate()
+		resp.ErrorRatio = w.ErrorRatio()
+	}
+	return resp
+}
 
+func serviceMetricsResponse(requests, failures uint64, h *histogram.Histogram) *pb.ServiceMetricsResponse {
 	return &pb.ServiceMetricsResponse{
-		TotalRequests:      metrics.totalRequests,
-		SuccessfulRequests: metrics.successfulRequests,
-		FailedRequests:     metrics.failedRequests,
-		AverageLatencyMs:   float64(metrics.totalLatency) / float64(metrics.successfulRequests),
-	}, nil
+		TotalRequests:      requests,
+		SuccessfulRequests: requests - failures,
+		FailedRequests:     failures,
+		AverageLatencyMs:   h.Mean() / 1000,
+		P50LatencyMs:       usToMs(h.Quantile(0.5)),
+		P90LatencyMs:       usToMs(h.Quantile(0.9)),
+		P99LatencyMs:       usToMs(h.Quantile(0.99)),
+		P999LatencyMs:      usToMs(h.Quantile(0.999)),
+		MaxLatencyMs:       usToMs(h.Max()),
+		LatencyCount:       h.Count(),
+		LatencyHistogram:   histogramToProto(h),
+	}
+}
+
+func usToMs(us uint64) float64 {
+	return float64(us) / 1000
+}
+
+func histogramToProto(h *histogram.Histogram) *pb.LatencyHistogram {
+	out := &pb.LatencyHistogram{MinUs: h.Min(), MaxUs: h.Max(), SumUs: h.Sum()}
+	for _, b := range h.Buckets() {
+		out.Buckets = append(out.Buckets, &pb.LatencyBucket{LowerUs: b.Lower, Count: b.Count})
+	}
+	return out
 }
 
 func (s *server) GetDatabaseMetrics(ctx context.Context, req *pb.GetMetricsRequest) (*pb.DatabaseMetricsResponse, error) {
-	var pool *db.DBPool
-	switch req.ServiceName {
-	case "user":
-		pool = s.userPool
-	case "order":
-		pool = s.orderPool
-	default:
-		return nil, fmt.Errorf("unknown service: %s", req.ServiceName)
+	pool, err := s.database(req.ServiceName)
+	if err != nil {
+		return nil, err
 	}
 
 	tx, err := pool.BeginTx()
@@ -197,12 +282,52 @@ func (s *server) GetDatabaseMetrics(ctx context.Context, req *pb.GetMetricsReque
 }
 
 func (s *server) GetKafkaMetrics(ctx context.Context, req *pb.GetMetricsRequest) (*pb.KafkaMetricsResponse, error) {
-	stats := s.kafkaReader.Stats()
-	return &pb.KafkaMetricsResponse{
+	return s.kafkaMetrics(req.ConsumerGroups, req.Topics), nil
+}
+
+// kafkaMetrics returns the stats of the monitoring reader and the lag of
+// the given consumer groups on the given topics, or of all when empty.
+func (s *server) kafkaMetrics(groups, topics []string) *pb.KafkaMetricsResponse {
+	stats := s.kafkaStats.Totals()
+	resp := &pb.KafkaMetricsResponse{
 		MessagesReceived: stats.Messages,
 		BytesReceived:    stats.Bytes,
 		Lag:              stats.Lag,
-	}, nil
+	}
+	lags, polled := s.kafkaLag.Groups(groups, topics)
+	if !polled.IsZero() {
+		resp.PolledAt = timestamppb.New(polled)
+	}
+	for _, g := range lags {
+		group := &pb.ConsumerGroupLag{
+			Group:              g.Group,
+			Lag:                g.Lag,
+			ConsumeRate:        g.ConsumeRate,
+			ProduceRate:        g.ProduceRate,
+			TimeToDrainSeconds: drainSeconds(g.TimeToDrain),
+		}
+		for _, p := range g.Partitions {
+			group.Partitions = append(group.Partitions, &pb.PartitionLag{
+				Topic:              p.Topic,
+				Partition:          int32(p.Partition),
+				CommittedOffset:    p.Committed,
+				HighWatermark:      p.HighWatermark,
+				Lag:                p.Lag,
+				ConsumeRate:        p.ConsumeRate,
+				ProduceRate:        p.ProduceRate,
+				TimeToDrainSeconds: drainSeconds(p.TimeToDrain),
+			})
+		}
+		resp.ConsumerGroups = append(resp.ConsumerGroups, group)
+	}
+	return resp
+}
+
+func drainSeconds(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return d.Seconds()
 }
 
 func main() {
@@ -264,22 +389,78 @@ func main() {
 		userPool:    userPool,
 		orderPool:   orderPool,
 		kafkaReader: kafkaReader,
-		metrics: struct {
-			userService  *Metrics
-			orderService *Metrics
-			mutex        sync.RWMutex
-		}{
-			userService:  &Metrics{},
-			orderService: &Metrics{},
-		},
+		metrics:     newServiceMetrics(),
+		registry:    registry.New(),
+		databases:   map[string]*db.DBPool{"users": userPool, "orders": orderPool},
+		history:     history.New(),
+		kafkaLag:    kafkalag.New(&kafka.Client{Addr: kafka.TCP(kafkaAddress), Timeout: 10 * time.Second}),
+	}
+	go srv.registry.ExpireLoop(context.Background(), 5*time.Second, srv.expireInstance)
+
+	// Track the service level objectives in SLO_FILE. Their burn rates are
+	// recorded in history for the alert rules.
+	if sloFile := os.Getenv("SLO_FILE"); sloFile == "" {
+		logrus.Warn("SLO_FILE is not set, no service level objectives are tracked")
+	} else {
+		cfg, err := slo.LoadConfig(sloFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load service level objectives: %v", err)
+		}
+		srv.slos = slo.NewTracker(cfg, time.Now())
+		logrus.Infof("Tracking %d service level objectives from %s over %v", len(cfg.Objectives), sloFile, cfg.Window)
+	}
+
+	// Keep the SLO counts and the 1m history tier in MONITORING_STATE_DIR
+	// across restarts. They are saved every minute and when the service
+	// stops, so a crash loses at most the last minute.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stateDir := os.Getenv("MONITORING_STATE_DIR")
+	if stateDir == "" {
+		logrus.Warn("MONITORING_STATE_DIR is not set, SLO counts and history restart with the service")
+	} else {
+		if err := os.MkdirAll(stateDir, 0o755); err != nil {
+			logrus.Fatalf("Failed to create state directory: %v", err)
+		}
+		srv.loadState(stateDir)
+		go srv.saveStateLoop(ctx, stateDir, time.Minute)
 	}
 
+	// Evaluate the alert rules in ALERT_RULES_FILE.
+	if rulesFile := os.Getenv("ALERT_RULES_FILE"); rulesFile == "" {
+		logrus.Warn("ALERT_RULES_FILE is not set, alerting is disabled")
+	} else {
+		cfg, err := alerting.LoadConfig(rulesFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load alert rules: %v", err)
+		}
+		srv.alerts = alerting.NewEngine(cfg, srv.history)
+		go srv.alerts.Run(context.Background())
+		logrus.Infof("Evaluating %d alert rules from %s every %v", len(cfg.Rules), rulesFile, cfg.EvaluationInterval)
+	}
+
+	// Serve metrics for Prometheus on METRICS_PORT.
+	reg := metrics.New()
+	reg.RegisterDB("users", userPool.DB())
+	reg.RegisterDB("orders", orderPool.DB())
+	srv.kafkaStats = reg.RegisterKafkaReader(kafkaReader, "monitoring-service")
+	metricsAddr := ":" + os.Getenv("METRICS_PORT")
+	if metricsAddr == ":" {
+		metricsAddr = ":9090"
+	}
+	go func() {
+		logrus.Infof("Metrics served on %s/metrics", metricsAddr)
+		if err := reg.ListenAndServe(metricsAddr); err != nil {
+			logrus.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+
 	// Start metrics collection
-	go reportMetrics("User Service", srv.metrics.userService)
-	go reportMetrics("Order Service", srv.metrics.orderService)
-	go monitorDatabase("User Service", srv.userPool)
-	go monitorDatabase("Order Service", srv.orderPool)
-	go monitorKafka(kafkaAddress)
+	go srv.reportMetrics()
+	go srv.sample(time.Second)
+	go srv.monitorDatabase("User Service", "users", srv.userPool)
+	go srv.monitorDatabase("Order Service", "orders", srv.orderPool)
+	go srv.kafkaLag.Run(context.Background(), 10*time.Second)
 
 	// Start gRPC server
 	lis, err := net.Listen("tcp", ":50053")
@@ -287,32 +468,58 @@ func main() {
 		logrus.Fatalf("Failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(reg.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(reg.StreamServerInterceptor()),
+	)
 	pb.RegisterMonitoringServiceServer(grpcServer, srv)
 	reflection.Register(grpcServer)
 
+	go func() {
+		<-ctx.Done()
+		logrus.Info("Stopping the monitoring service")
+		grpcServer.Stop()
+	}()
+
 	logrus.Info("Monitoring service started on :50053")
 	if err := grpcServer.Serve(lis); err != nil {
 		logrus.Fatalf("Failed to serve: %v", err)
 	}
+	if stateDir != "" {
+		srv.saveState(stateDir)
+	}
 }
 
-func reportMetrics(serviceName string, metrics *Metrics) {
+func (s *server) reportMetrics() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		logrus.WithFields(logrus.Fields{
-			"service":            serviceName,
-			"total_requests":     metrics.totalRequests,
-			"successful":         metrics.successfulRequests,
-			"failed":             metrics.failedRequests,
-			"average_latency_ms": float64(metrics.totalLatency) / float64(metrics.successfulRequests),
-		}).Info("Service Metrics")
+		var lines []logrus.Fields
+		s.metrics.mutex.RLock()
+		for service := range s.metrics.services {
+			w, instances, _ := s.metrics.merged(service, "", time.Time{}, 0)
+			lines = append(lines, logrus.Fields{
+				"service":            service,
+				"instances":          len(instances),
+				"total_requests":     w.Requests,
+				"successful":         w.Requests - w.Failures,
+				"failed":             w.Failures,
+				"average_latency_ms": w.Latency.Mean() / 1000,
+				"p99_latency_ms":     usToMs(w.Latency.Quantile(0.99)),
+				"max_latency_ms":     usToMs(w.Latency.Max()),
+			})
+		}
+		s.metrics.mutex.RUnlock()
+		for _, fields := range lines {
+			logrus.WithFields(fields).Info("Service Metrics")
+		}
 	}
 }
 
-func monitorDatabase(serviceName string, dbPool *db.DBPool) {
+// monitorDatabase reads the stats of a database every second and keeps the
+// latest for the snapshots.
+func (s *server) monitorDatabase(serviceName, dbName string, dbPool *db.DBPool) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
@@ -351,28 +558,9 @@ func monitorDatabase(serviceName string, dbPool *db.DBPool) {
 			"active_connections": activeConnections,
 			"database_size_mb":   float64(dbSize) / (1024 * 1024),
 		}).Info("Database Metrics")
-	}
-}
-
-func monitorKafka(kafkaAddress string) {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: []string{kafkaAddress},
-		Topic:   "user-events",
-		GroupID: "monitoring-service",
-	})
-	defer reader.Close()
-
-	for range ticker.C {
-		// Get topic statistics
-		stats := reader.Stats()
-		logrus.WithFields(logrus.Fields{
-			"topic":             "user-events",
-			"messages_received": stats.Messages,
-			"bytes_received":    stats.Bytes,
-			"lag":               stats.Lag,
-		}).Info("Kafka Metrics")
+		s.databaseStats.set(dbName, time.Now(), &pb.DatabaseMetricsResponse{
+			ActiveConnections: int32(activeConnections),
+			DatabaseSizeMb:    float64(dbSize) / (1024 * 1024),
+		})
 	}
 }
@@ -0,0 +1,226 @@
+// Package registry tracks the live instances of the services that announce
+// themselves to the monitoring service.
+//
+// An instance registers with its version, endpoints and dependencies and
+// then sends heartbeats. It is live until its TTL passes without one, after
+// which Expire removes it and it has to register again.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotRegistered is returned for a heartbeat of an instance that is
+	// not registered, or whose registration expired.
+	ErrNotRegistered = errors.New("instance not registered")
+	// ErrInvalid is returned for an incomplete registration.
+	ErrInvalid = errors.New("invalid registration")
+)
+
+// Dependency kinds.
+const (
+	// KindService is another registered service, named by its service name.
+	KindService = "service"
+	// KindPostgres is a database, named as the monitoring service knows it,
+	// e.g. "users".
+	KindPostgres = "postgres"
+	// KindKafka is a Kafka topic.
+	KindKafka = "kafka"
+)
+
+// Dependency is something an instance needs to work.
+type Dependency struct {
+	Kind string
+	Name string
+}
+
+// Instance is a registered instance of a service.
+type Instance struct {
+	Service      string
+	ID           string
+	Version      string
+	Endpoints    []string
+	Dependencies []Dependency
+
+	RegisteredAt  time.Time
+	LastHeartbeat time.Time
+	TTL           time.Duration
+}
+
+// ExpiresAt returns when the instance expires without another heartbeat.
+func (i Instance) ExpiresAt() time.Time {
+	return i.LastHeartbeat.Add(i.TTL)
+}
+
+// Service is a service with at least one live instance.
+type Service struct {
+	Name      string
+	Instances []Instance
+}
+
+// Dependencies returns the dependencies of all instances of the service,
+// without duplicates.
+func (s Service) Dependencies() []Dependency {
+	var out []Dependency
+	for _, i := range s.Instances {
+		for _, d := range i.Dependencies {
+			if !slices.Contains(out, d) {
+				out = append(out, d)
+			}
+		}
+	}
+	return out
+}
+
+// Registry holds the registered instances. It is safe for concurrent use.
+type Registry struct {
+	// MinTTL and MaxTTL bound the TTL an instance asks for; DefaultTTL is
+	// used when it asks for none.
+	MinTTL, MaxTTL, DefaultTTL time.Duration
+
+	mutex    sync.RWMutex
+	services map[string]map[string]*Instance
+}
+
+// New creates an empty Registry.
+func New() *Registry {
+	return &Registry{
+		MinTTL:     5 * time.Second,
+		MaxTTL:     5 * time.Minute,
+		DefaultTTL: 30 * time.Second,
+		services:   make(map[string]map[string]*Instance),
+	}
+}
+
+// Register adds an instance, or replaces its registration, and returns it
+// with its TTL. A registration counts as a heartbeat.
+func (r *Registry) Register(now time.Time, in Instance) (Instance, error) {
+	if in.Service == "" || in.ID == "" {
+		return Instance{}, fmt.Errorf("%w: service and instance ID are required", ErrInvalid)
+	}
+	for _, d := range in.Dependencies {
+		if d.Name == "" || (d.Kind != KindService && d.Kind != KindPostgres && d.Kind != KindKafka) {
+			return Instance{}, fmt.Errorf("%w: dependency %s %q", ErrInvalid, d.Kind, d.Name)
+		}
+	}
+	switch {
+	case in.TTL == 0:
+		in.TTL = r.DefaultTTL
+	case in.TTL < r.MinTTL:
+		in.TTL = r.MinTTL
+	case in.TTL > r.MaxTTL:
+		in.TTL = r.MaxTTL
+	}
+	in.RegisteredAt, in.LastHeartbeat = now, now
+	in.Endpoints = slices.Clone(in.Endpoints)
+	in.Dependencies = slices.Clone(in.Dependencies)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	instances, ok := r.services[in.Service]
+	if !ok {
+		instances = make(map[string]*Instance)
+		r.services[in.Service] = instances
+	}
+	instances[in.ID] = &in
+	return in, nil
+}
+
+// Heartbeat extends the registration of an instance.
+func (r *Registry) Heartbeat(now time.Time, service, id string) (Instance, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	in, ok := r.services[service][id]
+	if !ok || now.After(in.ExpiresAt()) {
+		return Instance{}, fmt.Errorf("%w: %s/%s", ErrNotRegistered, service, id)
+	}
+	in.LastHeartbeat = now
+	return *in, nil
+}
+
+// Expire removes the instances whose TTL has passed and returns them.
+func (r *Registry) Expire(now time.Time) []Instance {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var expired []Instance
+	for service, instances := range r.services {
+		for id, in := range instances {
+			if now.After(in.ExpiresAt()) {
+				expired = append(expired, *in)
+				delete(instances, id)
+			}
+		}
+		if len(instances) == 0 {
+			delete(r.services, service)
+		}
+	}
+	return expired
+}
+
+// ExpireLoop expires instances every interval until ctx is done, passing
+// each expired instance to onExpire.
+func (r *Registry) ExpireLoop(ctx context.Context, interval time.Duration, onExpire func(Instance)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, in := range r.Expire(now) {
+				logrus.WithFields(logrus.Fields{
+					"service":        in.Service,
+					"instance":       in.ID,
+					"last_heartbeat": in.LastHeartbeat,
+				}).Warn("Service instance expired")
+				onExpire(in)
+			}
+		}
+	}
+}
+
+// Services returns the services with live instances, by name, with their
+// instances by ID.
+func (r *Registry) Services(now time.Time) []Service {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var out []Service
+	for name := range r.services {
+		if s, ok := r.service(now, name); ok {
+			out = append(out, s)
+		}
+	}
+	slices.SortFunc(out, func(a, b Service) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Service returns a service if it has live instances.
+func (r *Registry) Service(now time.Time, name string) (Service, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.service(now, name)
+}
+
+func (r *Registry) service(now time.Time, name string) (Service, bool) {
+	s := Service{Name: name}
+	for _, in := range r.services[name] {
+		if !now.After(in.ExpiresAt()) {
+			s.Instances = append(s.Instances, *in)
+		}
+	}
+	slices.SortFunc(s.Instances, func(a, b Instance) int { return strings.Compare(a.ID, b.ID) })
+	return s, len(s.Instances) > 0
+}
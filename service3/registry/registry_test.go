@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterHeartbeatExpire(t *testing.T) {
+	r := New()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	in, err := r.Register(start, Instance{
+		Service:      "order",
+		ID:           "a",
+		Dependencies: []Dependency{{Kind: KindPostgres, Name: "orders"}, {Kind: KindService, Name: "user"}},
+		TTL:          time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.TTL != r.MinTTL {
+		t.Errorf("TTL = %v, want it raised to %v", in.TTL, r.MinTTL)
+	}
+	if _, err := r.Register(start, Instance{Service: "order", ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a keeps sending heartbeats, b does not.
+	if _, err := r.Heartbeat(start.Add(4*time.Second), "order", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if expired := r.Expire(start.Add(8 * time.Second)); len(expired) != 0 {
+		t.Errorf("expired %v before the TTL", expired)
+	}
+	s, ok := r.Service(start.Add(10*time.Second), "order")
+	if !ok || len(s.Instances) != 1 || s.Instances[0].ID != "b" {
+		t.Errorf("live instances at 10s = %v", s.Instances)
+	}
+	if len(s.Dependencies()) != 0 {
+		t.Errorf("dependencies of b = %v", s.Dependencies())
+	}
+
+	expired := r.Expire(start.Add(10 * time.Second))
+	if len(expired) != 1 || expired[0].ID != "a" {
+		t.Errorf("expired at 10s = %v, want a", expired)
+	}
+	if _, err := r.Heartbeat(start.Add(10*time.Second), "order", "a"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("heartbeat after expiry: err = %v", err)
+	}
+	expired = r.Expire(start.Add(31 * time.Second))
+	if len(expired) != 1 || expired[0].ID != "b" {
+		t.Errorf("expired at 31s = %v, want b", expired)
+	}
+	if services := r.Services(start.Add(31 * time.Second)); len(services) != 0 {
+		t.Errorf("services = %v", services)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	r := New()
+	for _, in := range []Instance{
+		{ID: "a"},
+		{Service: "order"},
+		{Service: "order", ID: "a", Dependencies: []Dependency{{Kind: "redis", Name: "cache"}}},
+	} {
+		if _, err := r.Register(time.Now(), in); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Register(%+v): err = %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"pkg/histogram"
+	pb "service3/service3/proto"
+	"service3/window"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// localInstance names this process among the instances of the user
+// service, for the CreateUser and GetUser calls it serves itself.
+const localInstance = "service3"
+
+// serviceMetrics holds the stats of every instance of every service. A
+// service is known once it registers or reports; registered services report
+// zeros before their first report.
+type serviceMetrics struct {
+	mutex sync.RWMutex
+	// services maps a service name to the stats of each of its instances.
+	services map[string]map[string]*Metrics
+	// local is the instance for the calls served by this process.
+	local *Metrics
+}
+
+func newServiceMetrics() *serviceMetrics {
+	local := newMetrics()
+	return &serviceMetrics{
+		services: map[string]map[string]*Metrics{
+			"user": {localInstance: local},
+		},
+		local: local,
+	}
+}
+
+// addService makes service known. The caller must hold the write lock.
+func (m *serviceMetrics) addService(service string) {
+	if _, ok := m.services[service]; !ok {
+		m.services[service] = make(map[string]*Metrics)
+	}
+}
+
+// dropInstance forgets the stats of an instance, and of its service if it
+// was the last one. The caller must hold the write lock.
+func (m *serviceMetrics) dropInstance(service, instance string) {
+	instances, ok := m.services[service]
+	if !ok || instances[instance] == m.local {
+		return
+	}
+	delete(instances, instance)
+	if len(instances) == 0 {
+		delete(m.services, service)
+	}
+}
+
+// instance returns the stats of an instance, creating them on its first
+// report. The caller must hold the write lock.
+func (m *serviceMetrics) instance(service, instance string) *Metrics {
+	m.addService(service)
+	instances := m.services[service]
+	metrics, ok := instances[instance]
+	if !ok {
+		metrics = newMetrics()
+		instances[instance] = metrics
+		logrus.WithFields(logrus.Fields{"service": service, "instance": instance}).Info("First metrics report")
+	}
+	return metrics
+}
+
+// merged returns the requests of the instances of service, or only of
+// instance when it is set, and the names of the instances included. The
+// requests are those of the last window ending at now, or the totals since
+// startup when last is 0. The caller must hold the read lock.
+func (m *serviceMetrics) merged(service, instance string, now time.Time, last time.Duration) (window.Window, []string, error) {
+	instances, ok := m.services[service]
+	if !ok {
+		return window.Window{}, nil, status.Errorf(codes.NotFound, "unknown service: %s", service)
+	}
+	if instance != "" {
+		metrics, ok := instances[instance]
+		if !ok {
+			return window.Window{}, nil, status.Errorf(codes.NotFound, "no reports from instance %s of %s", instance, service)
+		}
+		instances = map[string]*Metrics{instance: metrics}
+	}
+
+	out := window.Window{Latency: histogram.New()}
+	var names []string
+	for name, metrics := range instances {
+		names = append(names, name)
+		if last == 0 {
+			out.Requests += metrics.totalRequests
+			out.Failures += metrics.failedRequests
+			out.Latency.Merge(metrics.latency)
+			continue
+		}
+		w, err := metrics.recent.Last(now, last)
+		if err != nil {
+			return window.Window{}, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		out.Merge(w)
+	}
+	slices.Sort(names)
+	return out, names, nil
+}
+
+// ReportMetrics adds the reports of a service instance to its stats until
+// the instance closes the stream.
+func (s *server) ReportMetrics(stream pb.MonitoringService_ReportMetricsServer) error {
+	var reports uint64
+	for {
+		report, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.ReportMetricsResponse{Reports: reports})
+		}
+		if err != nil {
+			return err
+		}
+		if report.Service == "" || report.Instance == "" {
+			return status.Error(codes.InvalidArgument, "service and instance are required")
+		}
+		for _, m := range report.Methods {
+			if m.Failures > m.Requests {
+				return status.Errorf(codes.InvalidArgument, "%s: more failures than requests", m.Method)
+			}
+		}
+
+		now := time.Now()
+		s.metrics.mutex.Lock()
+		metrics := s.metrics.instance(report.Service, report.Instance)
+		for _, m := range report.Methods {
+			latency := histogramFromProto(m.Latency)
+			metrics.add(now, m.Requests, m.Failures, latency)
+			if s.slos != nil {
+				s.slos.Observe(now, report.Service, m.Method, m.Requests, m.Failures, latency)
+			}
+		}
+		s.metrics.mutex.Unlock()
+		reports++
+	}
+}
+
+func histogramFromProto(h *pb.LatencyHistogram) *histogram.Histogram {
+	if h == nil {
+		return histogram.New()
+	}
+	buckets := make([]histogram.Bucket, 0, len(h.Buckets))
+	for _, b := range h.Buckets {
+		buckets = append(buckets, histogram.Bucket{Lower: b.LowerUs, Count: b.Count})
+	}
+	return histogram.FromBuckets(buckets, h.MinUs, h.MaxUs, h.SumUs)
+}
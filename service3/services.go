@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"service3/db"
+	"service3/registry"
+	pb "service3/service3/proto"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	in := registry.Instance{
+		Service:   req.Service,
+		ID:        req.InstanceId,
+		Version:   req.Version,
+		Endpoints: req.Endpoints,
+		TTL:       time.Duration(req.TtlSeconds) * time.Second,
+	}
+	for _, d := range req.Dependencies {
+		in.Dependencies = append(in.Dependencies, registry.Dependency{Kind: d.Kind, Name: d.Name})
+	}
+	in, err := s.registry.Register(time.Now(), in)
+	if err != nil {
+		return nil, registryError("register instance", err)
+	}
+
+	s.metrics.mutex.Lock()
+	s.metrics.addService(in.Service)
+	s.metrics.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"service":  in.Service,
+		"instance": in.ID,
+		"version":  in.Version,
+		"ttl":      in.TTL,
+	}).Info("Service instance registered")
+	return &pb.RegisterResponse{
+		TtlSeconds:               int32(in.TTL / time.Second),
+		HeartbeatIntervalSeconds: int32(max(in.TTL/3, time.Second) / time.Second),
+	}, nil
+}
+
+func (s *server) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	in, err := s.registry.Heartbeat(time.Now(), req.Service, req.InstanceId)
+	if err != nil {
+		return nil, registryError("record heartbeat", err)
+	}
+	return &pb.HeartbeatResponse{ExpiresAt: timestamppb.New(in.ExpiresAt())}, nil
+}
+
+func (s *server) ListServices(ctx context.Context, req *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	resp := &pb.ListServicesResponse{}
+	for _, svc := range s.registry.Services(time.Now()) {
+		info := &pb.ServiceInfo{Name: svc.Name, Dependencies: dependenciesToProto(svc.Dependencies())}
+		for _, in := range svc.Instances {
+			info.Instances = append(info.Instances, &pb.InstanceInfo{
+				InstanceId:    in.ID,
+				Version:       in.Version,
+				Endpoints:     in.Endpoints,
+				Dependencies:  dependenciesToProto(in.Dependencies),
+				RegisteredAt:  timestamppb.New(in.RegisteredAt),
+				LastHeartbeat: timestamppb.New(in.LastHeartbeat),
+				ExpiresAt:     timestamppb.New(in.ExpiresAt()),
+			})
+		}
+		resp.Services = append(resp.Services, info)
+	}
+	return resp, nil
+}
+
+// expireInstance drops the stats of an instance whose registration expired.
+func (s *server) expireInstance(in registry.Instance) {
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	s.metrics.dropInstance(in.Service, in.ID)
+}
+
+// database returns the pool of the database a registered service depends
+// on.
+func (s *server) database(service string) (*db.DBPool, error) {
+	svc, ok := s.registry.Service(time.Now(), service)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "service %s has no live instances", service)
+	}
+	for _, d := range svc.Dependencies() {
+		if d.Kind != registry.KindPostgres {
+			continue
+		}
+		if pool, ok := s.databases[d.Name]; ok {
+			return pool, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "service %s depends on no database known to the monitoring service", service)
+}
+
+func dependenciesToProto(deps []registry.Dependency) []*pb.Dependency {
+	out := make([]*pb.Dependency, 0, len(deps))
+	for _, d := range deps {
+		out = append(out, &pb.Dependency{Kind: d.Kind, Name: d.Name})
+	}
+	return out
+}
+
+func registryError(op string, err error) error {
+	switch {
+	case errors.Is(err, registry.ErrNotRegistered):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, registry.ErrInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		logrus.Errorf("Failed to %s: %v", op, err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
@@ -0,0 +1,390 @@
+// Package slo tracks service level objectives over a rolling compliance
+// window, from the request stats the services report.
+//
+// An objective sets an availability target, a latency target or both for a
+// service or one of its methods. Each target is an SLI: the fraction of
+// good requests, which are those that did not fail through the server's
+// fault for availability and those at or below the latency threshold for
+// latency. A request the caller got wrong, such as an order for a deleted
+// user, is good: it is the caller's error and spends no budget. The error
+// budget is the fraction of requests the target allows to be bad. Burn
+// rates say how fast the budget is spent, as the bad fraction of a window
+// over the allowed one; a burn rate of 1 spends exactly the budget over the
+// compliance window.
+package slo
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"pkg/histogram"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidConfig is returned for an objectives file that cannot be used.
+var ErrInvalidConfig = errors.New("invalid SLO config")
+
+// SLI kinds.
+const (
+	Availability = "availability"
+	Latency      = "latency"
+)
+
+// slotWidth is the resolution of the counts.
+const slotWidth = time.Minute
+
+// BurnRateAlert is a multi-window burn-rate condition: it holds while the
+// burn rates over both Long and Short exceed Factor. The long window makes
+// the alert significant and the short one lets it resolve soon after the
+// burn stops.
+type BurnRateAlert struct {
+	Long, Short time.Duration
+	Factor      float64
+	Severity    string
+}
+
+// Name identifies the alert in history series, e.g. "1h_5m".
+func (a BurnRateAlert) Name() string {
+	return formatWindow(a.Long) + "_" + formatWindow(a.Short)
+}
+
+// BurnRateAlerts are the conditions of the SRE workbook for a 28-day
+// window: the first two spend 2% and 5% of the budget before they fire, the
+// last two 10%.
+var BurnRateAlerts = []BurnRateAlert{
+	{Long: time.Hour, Short: 5 * time.Minute, Factor: 14.4, Severity: "critical"},
+	{Long: 6 * time.Hour, Short: 30 * time.Minute, Factor: 6, Severity: "critical"},
+	{Long: 24 * time.Hour, Short: 2 * time.Hour, Factor: 3, Severity: "warning"},
+	{Long: 72 * time.Hour, Short: 6 * time.Hour, Factor: 1, Severity: "warning"},
+}
+
+func formatWindow(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0 && d >= 72*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+// Config is the content of an objectives file.
+type Config struct {
+	// Window is the compliance window. Defaults to 28 days.
+	Window     time.Duration `yaml:"window"`
+	Objectives []*Objective  `yaml:"objectives"`
+}
+
+// Objective is the targets of a service, or of one of its methods.
+type Objective struct {
+	Name    string `yaml:"name"`
+	Service string `yaml:"service"`
+	// Method is the full gRPC method, e.g. "/user.UserService/CreateUser".
+	// The objective covers every method of the service when it is empty.
+	Method string `yaml:"method"`
+	// Availability is the fraction of requests that must succeed, e.g.
+	// 0.999. No availability SLI is tracked when it is 0.
+	Availability float64 `yaml:"availability"`
+	// LatencyTarget is the fraction of requests that must take at most
+	// LatencyThreshold, e.g. 0.99 for "p99 < 200ms". No latency SLI is
+	// tracked when it is 0.
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+	LatencyTarget    float64       `yaml:"latency_target"`
+}
+
+// LoadConfig reads and validates an objectives file.
+func LoadConfig(file string) (*Config, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(raw)
+}
+
+// ParseConfig parses and validates the content of an objectives file.
+func ParseConfig(raw []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 28 * 24 * time.Hour
+	}
+	if cfg.Window < slotWidth {
+		return nil, fmt.Errorf("%w: window is shorter than %v", ErrInvalidConfig, slotWidth)
+	}
+
+	names := make(map[string]bool)
+	for i, o := range cfg.Objectives {
+		switch {
+		case o.Name == "" || o.Service == "":
+			return nil, fmt.Errorf("%w: objective %d: name and service are required", ErrInvalidConfig, i+1)
+		case names[o.Name]:
+			return nil, fmt.Errorf("%w: objective %s is defined twice", ErrInvalidConfig, o.Name)
+		case o.Availability == 0 && o.LatencyTarget == 0:
+			return nil, fmt.Errorf("%w: objective %s has no target", ErrInvalidConfig, o.Name)
+		case o.Availability < 0 || o.Availability >= 1 || o.LatencyTarget < 0 || o.LatencyTarget >= 1:
+			return nil, fmt.Errorf("%w: objective %s: targets must be between 0 and 1", ErrInvalidConfig, o.Name)
+		case o.LatencyTarget > 0 && o.LatencyThreshold <= 0:
+			return nil, fmt.Errorf("%w: objective %s has a latency target without a threshold", ErrInvalidConfig, o.Name)
+		}
+		names[o.Name] = true
+	}
+	return &cfg, nil
+}
+
+// slot counts the requests of one slotWidth.
+type slot struct {
+	start time.Time
+	total uint64
+	bad   uint64
+}
+
+// sli is the counts of one SLI over the compliance window.
+type sli struct {
+	objective *Objective
+	kind      string
+	target    float64
+	slots     []slot
+}
+
+func (s *sli) add(now time.Time, total, bad uint64) {
+	start := now.Truncate(slotWidth)
+	sl := &s.slots[int(start.UnixNano()/int64(slotWidth))%len(s.slots)]
+	if !sl.start.Equal(start) {
+		*sl = slot{start: start}
+	}
+	sl.total += total
+	sl.bad += bad
+}
+
+// Tracker counts the requests of the objectives of a Config. It is safe for
+// concurrent use.
+type Tracker struct {
+	cfg     *Config
+	started time.Time
+
+	mutex sync.RWMutex
+	slis  []*sli
+}
+
+// NewTracker creates a Tracker for the objectives of cfg.
+func NewTracker(cfg *Config, now time.Time) *Tracker {
+	t := &Tracker{cfg: cfg, started: now}
+	n := int((cfg.Window + slotWidth - 1) / slotWidth)
+	for _, o := range cfg.Objectives {
+		if o.Availability > 0 {
+			t.slis = append(t.slis, &sli{objective: o, kind: Availability, target: o.Availability, slots: make([]slot, n)})
+		}
+		if o.LatencyTarget > 0 {
+			t.slis = append(t.slis, &sli{objective: o, kind: Latency, target: o.LatencyTarget, slots: make([]slot, n)})
+		}
+	}
+	return t
+}
+
+// Observe counts requests of a method of a service, with the latencies of
+// those that were timed, if any. failures are the requests that failed
+// through the server's fault, as metrics.ServerFault tells them apart; the
+// services' reporters count no others.
+func (t *Tracker) Observe(now time.Time, service, method string, requests, failures uint64, latency *histogram.Histogram) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, s := range t.slis {
+		o := s.objective
+		if o.Service != service || (o.Method != "" && o.Method != method) {
+			continue
+		}
+		switch s.kind {
+		case Availability:
+			s.add(now, requests, failures)
+		case Latency:
+			if latency == nil {
+				continue
+			}
+			timed := latency.Count()
+			fast := latency.CountAtMost(uint64(o.LatencyThreshold / time.Microsecond))
+			s.add(now, timed, timed-fast)
+		}
+	}
+}
+
+// snapshot is the state Save writes: when the tracker started and the
+// recorded slots of each SLI, by name.
+type snapshot struct {
+	Started time.Time
+	Slots   map[string][]savedSlot
+}
+
+type savedSlot struct {
+	Start      time.Time
+	Total, Bad uint64
+}
+
+func (s *sli) name() string {
+	return s.objective.Name + "/" + s.kind
+}
+
+// Save writes the counts of every SLI to w, for Load to restore after a
+// restart.
+func (t *Tracker) Save(w io.Writer) error {
+	t.mutex.RLock()
+	snap := snapshot{Started: t.started, Slots: make(map[string][]savedSlot, len(t.slis))}
+	for _, s := range t.slis {
+		var slots []savedSlot
+		for _, sl := range s.slots {
+			if !sl.start.IsZero() {
+				slots = append(slots, savedSlot{Start: sl.start, Total: sl.total, Bad: sl.bad})
+			}
+		}
+		snap.Slots[s.name()] = slots
+	}
+	t.mutex.RUnlock()
+	return gob.NewEncoder(w).Encode(snap)
+}
+
+// Load adds counts written by Save to the tracker. Counts of SLIs that are
+// no longer configured are dropped, and the tracker's start moves back to
+// the saved one so Elapsed covers the restored counts.
+func (t *Tracker) Load(r io.Reader) error {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("decoding SLO counts: %w", err)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !snap.Started.IsZero() && snap.Started.Before(t.started) {
+		t.started = snap.Started
+	}
+	for _, s := range t.slis {
+		for _, saved := range snap.Slots[s.name()] {
+			sl := &s.slots[int(saved.Start.UnixNano()/int64(slotWidth))%len(s.slots)]
+			switch {
+			case sl.start.Equal(saved.Start):
+				sl.total += saved.Total
+				sl.bad += saved.Bad
+			case sl.start.Before(saved.Start):
+				*sl = slot{start: saved.Start, total: saved.Total, bad: saved.Bad}
+			}
+		}
+	}
+	return nil
+}
+
+// BurnRate is the state of a BurnRateAlert for an SLI.
+type BurnRate struct {
+	Alert     BurnRateAlert
+	LongRate  float64
+	ShortRate float64
+}
+
+// Firing reports whether both burn rates exceed the alert's factor.
+func (b BurnRate) Firing() bool {
+	return b.LongRate > b.Alert.Factor && b.ShortRate > b.Alert.Factor
+}
+
+// Status is the state of an SLI over the compliance window.
+type Status struct {
+	Objective *Objective
+	// Kind is Availability or Latency, and Target its target.
+	Kind   string
+	Target float64
+	// Window is the compliance window and Elapsed the part of it the
+	// tracker has seen, shorter until it has run for a whole window. Counts
+	// restored by Load extend Elapsed back to when they started, though
+	// requests reported while the monitoring service was down are missing.
+	Window  time.Duration
+	Elapsed time.Duration
+	Total   uint64
+	Bad     uint64
+	// BudgetRemaining is the fraction of the error budget not spent yet. It
+	// is negative once the budget is exhausted.
+	BudgetRemaining float64
+	BurnRates       []BurnRate
+}
+
+// Name identifies the SLI, e.g. "create-user/availability".
+func (s Status) Name() string {
+	return s.Objective.Name + "/" + s.Kind
+}
+
+// Value returns the fraction of good requests, or 1 when there were none.
+func (s Status) Value() float64 {
+	return 1 - ratio(s.Bad, s.Total)
+}
+
+// Met reports whether the SLI meets its target.
+func (s Status) Met() bool {
+	return s.Value() >= s.Target
+}
+
+// Statuses returns the state of every SLI at now, by objective.
+func (t *Tracker) Statuses(now time.Time) []Status {
+	// Sum each window in one pass over the slots.
+	windows := []time.Duration{t.cfg.Window}
+	for _, a := range BurnRateAlerts {
+		windows = append(windows, a.Long, a.Short)
+	}
+	starts := make([]time.Time, len(windows))
+	for i, w := range windows {
+		starts[i] = now.Truncate(slotWidth).Add(-w + slotWidth)
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	out := make([]Status, 0, len(t.slis))
+	for _, s := range t.slis {
+		total := make([]uint64, len(windows))
+		bad := make([]uint64, len(windows))
+		for _, sl := range s.slots {
+			if sl.start.IsZero() || sl.start.After(now) {
+				continue
+			}
+			for i, start := range starts {
+				if !sl.start.Before(start) {
+					total[i] += sl.total
+					bad[i] += sl.bad
+				}
+			}
+		}
+
+		budget := 1 - s.target
+		st := Status{
+			Objective:       s.objective,
+			Kind:            s.kind,
+			Target:          s.target,
+			Window:          t.cfg.Window,
+			Elapsed:         min(now.Sub(t.started), t.cfg.Window),
+			Total:           total[0],
+			Bad:             bad[0],
+			BudgetRemaining: 1 - ratio(bad[0], total[0])/budget,
+		}
+		for i, a := range BurnRateAlerts {
+			st.BurnRates = append(st.BurnRates, BurnRate{
+				Alert:     a,
+				LongRate:  ratio(bad[1+2*i], total[1+2*i]) / budget,
+				ShortRate: ratio(bad[2+2*i], total[2+2*i]) / budget,
+			})
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+func ratio(n, d uint64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
@@ -0,0 +1,199 @@
+package slo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"pkg/histogram"
+	"pkg/metrics"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+objectives:
+  - name: create-user
+    service: user
+    method: /user.UserService/CreateUser
+    availability: 0.999
+    latency_threshold: 200ms
+    latency_target: 0.99
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Window != 28*24*time.Hour || cfg.Objectives[0].LatencyThreshold != 200*time.Millisecond {
+		t.Errorf("config %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		`objectives: [{name: a, service: user}]`,
+		`objectives: [{name: a, service: user, availability: 99.9}]`,
+		`objectives: [{name: a, service: user, latency_target: 0.99}]`,
+		`objectives: [{name: a, service: user, availability: 0.9}, {name: a, service: order, availability: 0.9}]`,
+	} {
+		if _, err := ParseConfig([]byte(bad)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got %v", bad, err)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+objectives:
+  - name: create-user
+    service: user
+    method: /user.UserService/CreateUser
+    availability: 0.99
+    latency_threshold: 200ms
+    latency_target: 0.9
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := NewTracker(cfg, start)
+
+	latency := func(fast, slow uint64) *histogram.Histogram {
+		h := histogram.New()
+		h.RecordN(50_000, fast)
+		h.RecordN(500_000, slow)
+		return h
+	}
+	// Two hours of 100 requests a minute, 1 failed and 5 slow.
+	for i := 0; i < 120; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		tr.Observe(now, "user", "/user.UserService/CreateUser", 100, 1, latency(95, 5))
+		// Other methods and services do not count.
+		tr.Observe(now, "user", "/user.UserService/GetUser", 100, 100, latency(0, 100))
+		tr.Observe(now, "order", "/user.UserService/CreateUser", 100, 100, latency(0, 100))
+	}
+	// Then 10 minutes of an outage.
+	for i := 120; i < 130; i++ {
+		tr.Observe(start.Add(time.Duration(i)*time.Minute), "user", "/user.UserService/CreateUser", 100, 100, nil)
+	}
+	now := start.Add(129*time.Minute + 30*time.Second)
+
+	statuses := tr.Statuses(now)
+	if len(statuses) != 2 {
+		t.Fatalf("%d statuses", len(statuses))
+	}
+	avail, lat := statuses[0], statuses[1]
+	if avail.Name() != "create-user/availability" || avail.Total != 13000 || avail.Bad != 1120 {
+		t.Errorf("availability: %+v", avail)
+	}
+	// 1120 bad of an allowed 130.
+	if !near(avail.BudgetRemaining, 1-1120/130.0) || avail.Met() {
+		t.Errorf("availability budget %v", avail.BudgetRemaining)
+	}
+	// The last hour has 50 minutes of 1% and 10 of 100% failures.
+	fast := avail.BurnRates[0]
+	if !near(fast.LongRate, (50+1000)/6000.0/0.01) || !near(fast.ShortRate, 100) || !fast.Firing() {
+		t.Errorf("1h/5m burn rate %+v", fast)
+	}
+
+	// The outage was not timed, so latency only counts the first two hours.
+	if lat.Name() != "create-user/latency" || lat.Total != 12000 || lat.Bad != 600 || !near(lat.BudgetRemaining, 0.5) || !lat.Met() {
+		t.Errorf("latency: %+v", lat)
+	}
+	if lat.BurnRates[0].Firing() {
+		t.Errorf("latency 1h/5m burn rate %+v", lat.BurnRates[0])
+	}
+}
+
+func TestClientErrorsDoNotBurnBudget(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+objectives:
+  - name: create-order
+    service: order
+    method: /order.OrderService/CreateOrder
+    availability: 0.999
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr := NewTracker(cfg, start)
+
+	// An hour of CreateOrder calls, most of them for deleted users, bad
+	// quantities or unknown products, counted the way the reporter does.
+	errs := []error{
+		nil,
+		status.Error(codes.FailedPrecondition, "user 7 is deleted"),
+		status.Error(codes.InvalidArgument, "quantity must be positive"),
+		status.Error(codes.NotFound, "no product 3"),
+		context.Canceled,
+	}
+	var failures uint64
+	for _, err := range errs {
+		if metrics.ServerFault(err) {
+			failures++
+		}
+	}
+	for i := 0; i < 60; i++ {
+		tr.Observe(start.Add(time.Duration(i)*time.Minute), "order", "/order.OrderService/CreateOrder", uint64(len(errs)), failures, nil)
+	}
+
+	st := tr.Statuses(start.Add(time.Hour))[0]
+	if st.Total != 300 || st.Bad != 0 || st.BudgetRemaining != 1 || !st.Met() {
+		t.Errorf("availability: %+v", st)
+	}
+	for _, b := range st.BurnRates {
+		if b.Firing() {
+			t.Errorf("burn rate %+v", b)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+objectives:
+  - name: create-user
+    service: user
+    availability: 0.99
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	before := NewTracker(cfg, start)
+	for i := 0; i < 60; i++ {
+		before.Observe(start.Add(time.Duration(i)*time.Minute), "user", "/user.UserService/GetUser", 100, 1, nil)
+	}
+	var buf bytes.Buffer
+	if err := before.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service restarts in the same minute it saved, and counts again.
+	restart := start.Add(59*time.Minute + 30*time.Second)
+	after := NewTracker(cfg, restart)
+	after.Observe(restart, "user", "/user.UserService/GetUser", 100, 1, nil)
+	if err := after.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	st := after.Statuses(start.Add(61 * time.Minute))[0]
+	if st.Total != 6100 || st.Bad != 61 || st.Elapsed != 61*time.Minute {
+		t.Errorf("restored status %+v", st)
+	}
+
+	if err := after.Load(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("Load of garbage succeeded")
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSampleConfig(t *testing.T) {
+	if _, err := LoadConfig("../slos.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pb "service3/service3/proto"
+	"service3/slo"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordSLOs adds the error budget and burn rates of every SLI to the
+// history store, as slo/<objective>/<sli>/..., so alert rules can watch
+// them. A burn-rate alert is recorded as the lower of its two burn rates,
+// which exceeds the alert's factor exactly when the alert's condition holds.
+func (s *server) recordSLOs(now time.Time) {
+	if s.slos == nil {
+		return
+	}
+	for _, st := range s.slos.Statuses(now) {
+		prefix := "slo/" + st.Name() + "/"
+		s.history.Record(prefix+"error_budget_remaining", now, st.BudgetRemaining)
+		for _, b := range st.BurnRates {
+			s.history.Record(prefix+"burn_rate_"+b.Alert.Name(), now, min(b.LongRate, b.ShortRate))
+		}
+	}
+}
+
+func (s *server) GetSLOStatus(ctx context.Context, req *pb.GetSLOStatusRequest) (*pb.GetSLOStatusResponse, error) {
+	if s.slos == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no service level objectives are configured")
+	}
+
+	resp := &pb.GetSLOStatusResponse{}
+	for _, st := range s.slos.Statuses(time.Now()) {
+		o := st.Objective
+		if (req.ServiceName != "" && o.Service != req.ServiceName) || (req.Objective != "" && o.Name != req.Objective) {
+			continue
+		}
+		out := &pb.SLOStatus{
+			Objective:            o.Name,
+			Service:              o.Service,
+			Method:               o.Method,
+			Sli:                  st.Kind,
+			Target:               st.Target,
+			WindowSeconds:        int64(st.Window / time.Second),
+			ElapsedSeconds:       int64(st.Elapsed / time.Second),
+			TotalRequests:        st.Total,
+			BadRequests:          st.Bad,
+			Value:                st.Value(),
+			Met:                  st.Met(),
+			ErrorBudgetRemaining: st.BudgetRemaining,
+		}
+		if st.Kind == slo.Latency {
+			out.LatencyThresholdMs = float64(o.LatencyThreshold) / float64(time.Millisecond)
+		}
+		for _, b := range st.BurnRates {
+			out.BurnRates = append(out.BurnRates, &pb.BurnRate{
+				LongWindowSeconds:  int64(b.Alert.Long / time.Second),
+				ShortWindowSeconds: int64(b.Alert.Short / time.Second),
+				LongBurnRate:       b.LongRate,
+				ShortBurnRate:      b.ShortRate,
+				Threshold:          b.Alert.Factor,
+				Severity:           b.Alert.Severity,
+				Firing:             b.Firing(),
+			})
+		}
+		resp.Slos = append(resp.Slos, out)
+	}
+	if len(resp.Slos) == 0 && (req.ServiceName != "" || req.Objective != "") {
+		return nil, status.Error(codes.NotFound, "no matching service level objectives")
+	}
+	return resp, nil
+}
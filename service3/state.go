@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateFile is a part of the in-memory state kept across restarts, in a
+// file of MONITORING_STATE_DIR.
+type stateFile struct {
+	name string
+	save func(io.Writer) error
+	load func(io.Reader) error
+}
+
+// stateFiles returns the state the server keeps across restarts.
+func (s *server) stateFiles() []stateFile {
+	var files []stateFile
+	if s.history != nil {
+		// The 1s tier only covers the last hour and is not kept. The 1m
+		// tier is written whole on every save: about 600 KB for a series
+		// with a week of points.
+		files = append(files, stateFile{
+			name: "history.gob",
+			save: func(w io.Writer) error { return s.history.Save(w, time.Minute) },
+			load: s.history.Load,
+		})
+	}
+	if s.slos != nil {
+		files = append(files, stateFile{name: "slos.gob", save: s.slos.Save, load: s.slos.Load})
+	}
+	return files
+}
+
+// loadState restores the state saved in dir. Missing files are skipped,
+// and a file that cannot be read is logged and ignored.
+func (s *server) loadState(dir string) {
+	for _, f := range s.stateFiles() {
+		file, err := os.Open(filepath.Join(dir, f.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = f.load(file)
+			file.Close()
+		}
+		if err != nil {
+			logrus.WithField("file", f.name).WithError(err).Error("Failed to restore state")
+			continue
+		}
+		logrus.WithField("file", f.name).Info("Restored state")
+	}
+}
+
+// saveState writes the state to dir. Each file is written to a temporary
+// file first and renamed, so a crash leaves the previous one in place.
+func (s *server) saveState(dir string) {
+	for _, f := range s.stateFiles() {
+		if err := writeFileAtomic(filepath.Join(dir, f.name), f.save); err != nil {
+			logrus.WithField("file", f.name).WithError(err).Error("Failed to save state")
+		}
+	}
+}
+
+func writeFileAtomic(path string, save func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveStateLoop saves the state to dir every interval until ctx is done.
+func (s *server) saveStateLoop(ctx context.Context, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.saveState(dir)
+		}
+	}
+}
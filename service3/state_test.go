@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"service3/history"
+	"service3/slo"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	cfg, err := slo.ParseConfig([]byte(`
+objectives:
+  - name: create-user
+    service: user
+    availability: 0.99
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	now := time.Now()
+
+	before := &server{history: history.New(), slos: slo.NewTracker(cfg, now.Add(-time.Hour))}
+	before.slos.Observe(now, "user", "/user.UserService/CreateUser", 10, 1, nil)
+	before.history.Record("user/requests", now, 10)
+	before.saveState(dir)
+
+	after := &server{history: history.New(), slos: slo.NewTracker(cfg, now)}
+	after.loadState(dir)
+	st := after.slos.Statuses(now)[0]
+	if st.Total != 10 || st.Bad != 1 || st.Elapsed < time.Hour {
+		t.Errorf("restored status %+v", st)
+	}
+	points, _, _ := after.history.Query("user/requests", now.Add(-time.Hour), now.Add(time.Minute), time.Minute, now)
+	if len(points) != 1 || points[0].Last != 10 {
+		t.Errorf("restored history %+v", points)
+	}
+
+	// Only the state files are left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("state dir %v, %v", entries, err)
+	}
+
+	// A corrupt file is ignored.
+	if err := os.WriteFile(filepath.Join(dir, "slos.gob"), []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fresh := &server{history: history.New(), slos: slo.NewTracker(cfg, now)}
+	fresh.loadState(dir)
+	if st := fresh.slos.Statuses(now)[0]; st.Total != 0 {
+		t.Errorf("status after a corrupt file %+v", st)
+	}
+}
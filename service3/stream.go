@@ -0,0 +1,145 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	pb "service3/service3/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// databaseStats holds the latest stats monitorDatabase read of each
+// database, so snapshots do not query the databases themselves.
+type databaseStats struct {
+	mutex  sync.Mutex
+	latest map[string]*pb.DatabaseSnapshot
+}
+
+func (d *databaseStats) set(name string, at time.Time, m *pb.DatabaseMetricsResponse) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.latest == nil {
+		d.latest = make(map[string]*pb.DatabaseSnapshot)
+	}
+	d.latest[name] = &pb.DatabaseSnapshot{Name: name, Metrics: m, SampledAt: timestamppb.New(at)}
+}
+
+// all returns the latest stats of every database, by name.
+func (d *databaseStats) all() []*pb.DatabaseSnapshot {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	out := make([]*pb.DatabaseSnapshot, 0, len(d.latest))
+	for _, name := range slices.Sorted(maps.Keys(d.latest)) {
+		out = append(out, d.latest[name])
+	}
+	return out
+}
+
+// sample takes a snapshot every interval, for the StreamMetrics subscribers
+// to share, and records it in the history.
+func (s *server) sample(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		snapshot := s.takeSnapshot(now)
+		s.snapshot.Store(snapshot)
+		s.recordHistory(snapshot, interval)
+		s.recordSLOs(now)
+	}
+}
+
+func (s *server) takeSnapshot(now time.Time) *pb.MetricsSnapshot {
+	snapshot := &pb.MetricsSnapshot{
+		Time:      timestamppb.New(now),
+		Databases: s.databaseStats.all(),
+		Kafka:     s.kafkaMetrics(nil, nil),
+	}
+
+	s.metrics.mutex.RLock()
+	defer s.metrics.mutex.RUnlock()
+	for _, name := range slices.Sorted(maps.Keys(s.metrics.services)) {
+		total, instances, err := s.metrics.merged(name, "", now, 0)
+		if err != nil {
+			continue
+		}
+		recent, _, err := s.metrics.merged(name, "", now, time.Minute)
+		if err != nil {
+			continue
+		}
+		svc := &pb.ServiceSnapshot{
+			Name:       name,
+			Total:      serviceResponse(total, instances, 0),
+			LastMinute: serviceResponse(recent, instances, time.Minute),
+		}
+		svc.Total.LatencyHistogram = nil
+		svc.LastMinute.LatencyHistogram = nil
+		snapshot.Services = append(snapshot.Services, svc)
+	}
+	return snapshot
+}
+
+var snapshotSections = []string{"services", "databases", "kafka"}
+
+func (s *server) StreamMetrics(req *pb.StreamMetricsRequest, stream pb.MonitoringService_StreamMetricsServer) error {
+	interval := 5 * time.Second
+	if req.IntervalSeconds != 0 {
+		if req.IntervalSeconds < 1 || req.IntervalSeconds > 60 {
+			return status.Error(codes.InvalidArgument, "interval_seconds must be between 1 and 60")
+		}
+		interval = time.Duration(req.IntervalSeconds) * time.Second
+	}
+	sections := req.Sections
+	if len(sections) == 0 {
+		sections = snapshotSections
+	}
+	for _, section := range sections {
+		if !slices.Contains(snapshotSections, section) {
+			return status.Errorf(codes.InvalidArgument, "unknown section %q", section)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if snapshot := s.snapshot.Load(); snapshot != nil {
+			if err := stream.Send(filterSnapshot(snapshot, req, sections)); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// filterSnapshot returns the parts of a shared snapshot a subscriber asked
+// for. The snapshot itself is not modified.
+func filterSnapshot(snapshot *pb.MetricsSnapshot, req *pb.StreamMetricsRequest, sections []string) *pb.MetricsSnapshot {
+	out := &pb.MetricsSnapshot{Time: snapshot.Time}
+	if slices.Contains(sections, "services") {
+		for _, svc := range snapshot.Services {
+			if len(req.Services) == 0 || slices.Contains(req.Services, svc.Name) {
+				out.Services = append(out.Services, svc)
+			}
+		}
+	}
+	if slices.Contains(sections, "databases") {
+		for _, d := range snapshot.Databases {
+			if len(req.Databases) == 0 || slices.Contains(req.Databases, d.Name) {
+				out.Databases = append(out.Databases, d)
+			}
+		}
+	}
+	if slices.Contains(sections, "kafka") {
+		out.Kafka = snapshot.Kafka
+	}
+	return out
+}
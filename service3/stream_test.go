@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "service3/service3/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testSnapshot(at time.Time) *pb.MetricsSnapshot {
+	return &pb.MetricsSnapshot{
+		Time: timestamppb.New(at),
+		Services: []*pb.ServiceSnapshot{
+			{Name: "order", Total: &pb.ServiceMetricsResponse{TotalRequests: 10}},
+			{Name: "user", Total: &pb.ServiceMetricsResponse{TotalRequests: 20}},
+		},
+		Databases: []*pb.DatabaseSnapshot{{Name: "orders"}, {Name: "users"}},
+		Kafka:     &pb.KafkaMetricsResponse{},
+	}
+}
+
+func TestFilterSnapshot(t *testing.T) {
+	snapshot := testSnapshot(time.Now())
+
+	all := filterSnapshot(snapshot, &pb.StreamMetricsRequest{}, snapshotSections)
+	if len(all.Services) != 2 || len(all.Databases) != 2 || all.Kafka == nil || all.Time != snapshot.Time {
+		t.Errorf("unfiltered snapshot %v", all)
+	}
+
+	// Services and databases are filtered by name.
+	req := &pb.StreamMetricsRequest{Services: []string{"user"}, Databases: []string{"orders", "unknown"}}
+	out := filterSnapshot(snapshot, req, snapshotSections)
+	if len(out.Services) != 1 || out.Services[0].Name != "user" || len(out.Databases) != 1 || out.Databases[0].Name != "orders" {
+		t.Errorf("snapshot of user and orders %v", out)
+	}
+
+	// Sections not asked for are left out.
+	out = filterSnapshot(snapshot, &pb.StreamMetricsRequest{}, []string{"kafka"})
+	if len(out.Services) != 0 || len(out.Databases) != 0 || out.Kafka == nil {
+		t.Errorf("kafka snapshot %v", out)
+	}
+
+	// The shared snapshot is not modified.
+	if len(snapshot.Services) != 2 || len(snapshot.Databases) != 2 {
+		t.Errorf("shared snapshot modified: %v", snapshot)
+	}
+}
+
+// fakeMetricsStream passes the snapshots StreamMetrics sends to a channel.
+type fakeMetricsStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan *pb.MetricsSnapshot
+}
+
+func (f *fakeMetricsStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeMetricsStream) Send(s *pb.MetricsSnapshot) error {
+	f.sent <- s
+	return nil
+}
+
+func TestStreamMetricsSubscribers(t *testing.T) {
+	s := &server{}
+	start := time.Now()
+	s.snapshot.Store(testSnapshot(start))
+
+	type subscriber struct {
+		stream *fakeMetricsStream
+		cancel context.CancelFunc
+		done   chan error
+	}
+	subscribe := func(req *pb.StreamMetricsRequest) subscriber {
+		ctx, cancel := context.WithCancel(context.Background())
+		sub := subscriber{
+			stream: &fakeMetricsStream{ctx: ctx, sent: make(chan *pb.MetricsSnapshot, 10)},
+			cancel: cancel,
+			done:   make(chan error, 1),
+		}
+		go func() { sub.done <- s.StreamMetrics(req, sub.stream) }()
+		return sub
+	}
+	next := func(sub subscriber) *pb.MetricsSnapshot {
+		t.Helper()
+		select {
+		case snapshot := <-sub.stream.sent:
+			return snapshot
+		case <-time.After(5 * time.Second):
+			t.Fatal("no snapshot sent")
+			return nil
+		}
+	}
+
+	users := subscribe(&pb.StreamMetricsRequest{IntervalSeconds: 1, Services: []string{"user"}})
+	orders := subscribe(&pb.StreamMetricsRequest{IntervalSeconds: 1, Services: []string{"order"}, Sections: []string{"services"}})
+
+	// Both subscribers get their part of the same sampled snapshot.
+	u, o := next(users), next(orders)
+	if len(u.Services) != 1 || u.Services[0].Name != "user" || len(u.Databases) != 2 {
+		t.Errorf("user subscriber got %v", u)
+	}
+	if len(o.Services) != 1 || o.Services[0].Name != "order" || len(o.Databases) != 0 || o.Kafka != nil {
+		t.Errorf("order subscriber got %v", o)
+	}
+	if u.Time != o.Time {
+		t.Error("subscribers got different snapshots")
+	}
+
+	// A new sample reaches every subscriber on its next tick.
+	s.snapshot.Store(testSnapshot(start.Add(time.Second)))
+	u, o = next(users), next(orders)
+	if !u.Time.AsTime().Equal(start.Add(time.Second)) || u.Time != o.Time {
+		t.Errorf("after a new sample: %v and %v", u.Time.AsTime(), o.Time.AsTime())
+	}
+
+	// The stream ends when its client cancels, and the other one goes on.
+	users.cancel()
+	select {
+	case err := <-users.done:
+		if err != nil {
+			t.Errorf("StreamMetrics after cancel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamMetrics did not return after the client cancelled")
+	}
+	next(orders)
+	orders.cancel()
+	<-orders.done
+}
+
+func TestStreamMetricsInvalidRequest(t *testing.T) {
+	s := &server{}
+	stream := &fakeMetricsStream{ctx: context.Background(), sent: make(chan *pb.MetricsSnapshot, 1)}
+	for _, req := range []*pb.StreamMetricsRequest{
+		{IntervalSeconds: 61},
+		{Sections: []string{"alerts"}},
+	} {
+		if err := s.StreamMetrics(req, stream); err == nil {
+			t.Errorf("%v: no error", req)
+		}
+	}
+}
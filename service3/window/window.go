@@ -0,0 +1,157 @@
+// Package window counts requests in a ring of fixed-width time slots, so
+// rates and latency percentiles can be read over the last minutes instead
+// of the whole lifetime of the process.
+package window
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"pkg/histogram"
+)
+
+// ErrInvalidWindow is returned for a window the ring cannot answer.
+var ErrInvalidWindow = errors.New("invalid window")
+
+type slot struct {
+	start    time.Time
+	requests uint64
+	failures uint64
+	latency  *histogram.Histogram
+}
+
+// Ring holds the requests of the last Span, in slots of a fixed width. It is
+// not safe for concurrent use.
+type Ring struct {
+	width   time.Duration
+	slots   []slot
+	started time.Time
+}
+
+// New creates a Ring covering span in slots of width. span is rounded up to
+// a whole number of slots.
+func New(span, width time.Duration, now time.Time) *Ring {
+	n := int((span + width - 1) / width)
+	r := &Ring{width: width, slots: make([]slot, n), started: now}
+	for i := range r.slots {
+		r.slots[i].latency = histogram.New()
+	}
+	return r
+}
+
+// Span returns the longest window the ring answers.
+func (r *Ring) Span() time.Duration {
+	return time.Duration(len(r.slots)) * r.width
+}
+
+// slotAt returns the slot for now, clearing it if it last held an older
+// period.
+func (r *Ring) slotAt(now time.Time) *slot {
+	start := now.Truncate(r.width)
+	s := &r.slots[int(start.UnixNano()/int64(r.width))%len(r.slots)]
+	if !s.start.Equal(start) {
+		s.start = start
+		s.requests, s.failures = 0, 0
+		s.latency = histogram.New()
+	}
+	return s
+}
+
+// Fail counts a request that failed before its latency could be measured.
+func (r *Ring) Fail(now time.Time) {
+	s := r.slotAt(now)
+	s.requests++
+	s.failures++
+}
+
+// Observe counts a request that took latency and failed if failed is set.
+func (r *Ring) Observe(now time.Time, latency time.Duration, failed bool) {
+	s := r.slotAt(now)
+	s.requests++
+	if failed {
+		s.failures++
+	}
+	s.latency.RecordDuration(latency)
+}
+
+// Add counts requests served by another process, such as those of a
+// report, with their latencies.
+func (r *Ring) Add(now time.Time, requests, failures uint64, latency *histogram.Histogram) {
+	s := r.slotAt(now)
+	s.requests += requests
+	s.failures += failures
+	s.latency.Merge(latency)
+}
+
+// Window is what a Ring holds for a recent period.
+type Window struct {
+	// Elapsed is the time covered, shorter than the window asked for while
+	// the slot in progress fills up or when the ring is younger than it.
+	Elapsed  time.Duration
+	Requests uint64
+	Failures uint64
+	Latency  *histogram.Histogram
+}
+
+// Merge adds the requests of o, such as those of another instance, to w.
+func (w *Window) Merge(o Window) {
+	w.Elapsed = max(w.Elapsed, o.Elapsed)
+	w.Requests += o.Requests
+	w.Failures += o.Failures
+	if w.Latency == nil {
+		w.Latency = histogram.New()
+	}
+	w.Latency.Merge(o.Latency)
+}
+
+// RequestRate returns requests per second.
+func (w Window) RequestRate() float64 {
+	return perSecond(w.Requests, w.Elapsed)
+}
+
+// ErrorRate returns failed requests per second.
+func (w Window) ErrorRate() float64 {
+	return perSecond(w.Failures, w.Elapsed)
+}
+
+// ErrorRatio returns the fraction of requests that failed, or 0 when there
+// were none.
+func (w Window) ErrorRatio() float64 {
+	if w.Requests == 0 {
+		return 0
+	}
+	return float64(w.Failures) / float64(w.Requests)
+}
+
+func perSecond(n uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// Last returns the requests of the window ending at now. d is rounded up to
+// whole slots and must not exceed Span.
+func (r *Ring) Last(now time.Time, d time.Duration) (Window, error) {
+	if d <= 0 || d > r.Span() {
+		return Window{}, fmt.Errorf("%w: %v is not between 0 and %v", ErrInvalidWindow, d, r.Span())
+	}
+	n := int((d + r.width - 1) / r.width)
+	from := now.Truncate(r.width).Add(-time.Duration(n-1) * r.width)
+	if r.started.After(from) {
+		from = r.started
+	}
+
+	w := Window{Elapsed: now.Sub(from), Latency: histogram.New()}
+	for i := range r.slots {
+		s := &r.slots[i]
+		if s.start.IsZero() || !s.start.Add(r.width).After(from) || s.start.After(now) {
+			continue
+		}
+		w.Requests += s.requests
+		w.Failures += s.failures
+		w.Latency.Merge(s.latency)
+	}
+	return w, nil
+}
@@ -0,0 +1,59 @@
+package window
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLast(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := New(15*time.Minute, 10*time.Second, start)
+
+	// One request a second for 20 minutes; the last 2 minutes all fail.
+	for i := 0; i < 1200; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		r.Observe(now, time.Duration(i)*time.Millisecond, i >= 1080)
+	}
+	now := start.Add(1199*time.Second + 500*time.Millisecond)
+
+	w, err := r.Last(now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Requests != 60 || w.Failures != 60 || w.ErrorRatio() != 1 {
+		t.Errorf("1m: %d requests, %d failures", w.Requests, w.Failures)
+	}
+	if rate := w.RequestRate(); rate < 0.99 || rate > 1.01 {
+		t.Errorf("1m: rate %v", rate)
+	}
+	if w.Latency.Min() != 1140000 {
+		t.Errorf("1m: min latency %d", w.Latency.Min())
+	}
+
+	w, _ = r.Last(now, 5*time.Minute)
+	if w.Requests != 300 || w.Failures != 120 {
+		t.Errorf("5m: %d requests, %d failures", w.Requests, w.Failures)
+	}
+
+	w, _ = r.Last(now, 15*time.Minute)
+	if w.Requests != 900 {
+		t.Errorf("15m: %d requests", w.Requests)
+	}
+
+	if _, err := r.Last(now, 16*time.Minute); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("16m: err = %v", err)
+	}
+}
+
+func TestLastYoungerThanWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 5, 0, time.UTC)
+	r := New(15*time.Minute, 10*time.Second, start)
+	r.Fail(start)
+	r.Fail(start.Add(time.Second))
+
+	w, _ := r.Last(start.Add(2*time.Second), 5*time.Minute)
+	if w.Requests != 2 || w.Elapsed != 2*time.Second || w.ErrorRate() != 1 {
+		t.Errorf("%d requests over %v", w.Requests, w.Elapsed)
+	}
+}